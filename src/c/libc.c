@@ -23,6 +23,7 @@
 #include <sys/stat.h>
 #include <sys/statfs.h>
 #include <sys/statvfs.h>   
+#include <sys/mman.h>
 #include "libc.h"
 
 static int (*ptr_open)(const char *pathname, int flags, ...) = NULL;
@@ -35,6 +36,10 @@ static int (*ptr_creat64)(const char *pathname, mode_t mode) = NULL;
 static int (*ptr_fdatasync)(int fd) = NULL;
 static int (*ptr_fsync)(int fd) = NULL;
 static int (*ptr_ftruncate64)(int fd, off64_t length) = NULL;
+static int (*ptr_fallocate)(int fd, int mode, off_t offset, off_t len) = NULL;
+static int (*ptr_fallocate64)(int fd, int mode, off64_t offset, off64_t len) = NULL;
+static int (*ptr_posix_fallocate)(int fd, off_t offset, off_t len) = NULL;
+static int (*ptr_posix_fallocate64)(int fd, off64_t offset, off64_t len) = NULL;
 static int (*ptr_ftruncate)(int fd, off_t length) = NULL;
 static int (*ptr_truncate64)(const char *path, off64_t length) = NULL;
 static int (*ptr_truncate)(const char *path, off_t length) = NULL;
@@ -90,14 +95,26 @@ static off64_t (*ptr_ftello64)(FILE *stream) = NULL;
 static size_t (*ptr_fread)(void *ptr, size_t size, size_t nmemb, FILE *stream) = NULL;
 static size_t (*ptr_fwrite)(const void *ptr, size_t size, size_t nmemb, FILE *stream) = NULL;
 static void (*ptr_rewind)(FILE *stream) = NULL;
+static int (*ptr_dup)(int oldfd) = NULL;
 static int (*ptr_dup2)(int oldfd, int newfd) = NULL;
+static int (*ptr_dup3)(int oldfd, int newfd, int flags) = NULL;
 static int (*ptr_unlinkat)(int dirfd, const char *pathname, int flags) = NULL;
 static int (*ptr_openat)(int dirfd, const char *pathname, int flags, ...) = NULL; 
 static int (*ptr_faccessat)(int dirfd, const char *pathname, int mode, int flags) = NULL;
 static int (*ptr___fxstatat)(int vers, int dirfd, const char *pathname, struct stat *buf, int flags) = NULL;
 static int (*ptr___fxstatat64)(int vers, int dirfd, const char *pathname, struct stat64 *buf, int flags) = NULL;
+static int (*ptr_fstatat)(int dirfd, const char *pathname, struct stat *buf, int flags) = NULL;
+static int (*ptr_fstatat64)(int dirfd, const char *pathname, struct stat64 *buf, int flags) = NULL;
+static int (*ptr_statx)(int dirfd, const char *pathname, int flags, unsigned int mask, struct statx *statxbuf) = NULL;
 static int (*ptr_mkdir)(const char *pathname, mode_t mode) = NULL;
 static int (*ptr_mkdirat)(int dirfd, const char *pathname, mode_t mode) = NULL; 
+static int (*ptr_symlink)(const char *target, const char *linkpath) = NULL;
+static int (*ptr_symlinkat)(const char *target, int newdirfd, const char *linkpath) = NULL;
+static ssize_t (*ptr_readlink)(const char *pathname, char *buf, size_t bufsiz) = NULL;
+static ssize_t (*ptr_readlinkat)(int dirfd, const char *pathname, char *buf, size_t bufsiz) = NULL;
+static int (*ptr_chdir)(const char *path) = NULL;
+static int (*ptr_fchdir)(int fd) = NULL;
+static char *(*ptr_getcwd)(char *buf, size_t size) = NULL;
 static int (*ptr_rmdir)(const char *pathname) = NULL;
 static int (*ptr_rename)(const char *oldpath, const char *newpath) = NULL;
 static int (*ptr_renameat)(int olddirfd, const char *oldpath, int newdirfd, const char *newpath) = NULL;
@@ -115,6 +132,20 @@ static int (*ptr_feof)(FILE *stream) = NULL;
 static int (*ptr_ferror)(FILE *stream) = NULL;
 static void (*ptr_clearerr)(FILE *stream) = NULL;
 static ssize_t (*ptr_getxattr)(const char *path, const char *name, void *value,  size_t size) = NULL;
+static ssize_t (*ptr_fgetxattr)(int fd, const char *name, void *value, size_t size) = NULL;
+static int (*ptr_setxattr)(const char *path, const char *name, const void *value, size_t size, int flags) = NULL;
+static int (*ptr_fsetxattr)(int fd, const char *name, const void *value, size_t size, int flags) = NULL;
+static ssize_t (*ptr_listxattr)(const char *path, char *list, size_t size) = NULL;
+static ssize_t (*ptr_flistxattr)(int fd, char *list, size_t size) = NULL;
+static int (*ptr_removexattr)(const char *path, const char *name) = NULL;
+static int (*ptr_fremovexattr)(int fd, const char *name) = NULL;
+static void* (*ptr_mmap)(void *addr, size_t length, int prot, int flags, int fd, off_t offset) = NULL;
+static int (*ptr_munmap)(void *addr, size_t length) = NULL;
+static int (*ptr_msync)(void *addr, size_t length, int flags) = NULL;
+static int (*ptr_fcntl)(int fd, int cmd, ...) = NULL;
+static int (*ptr_flock)(int fd, int operation) = NULL;
+static int (*ptr_lockf)(int fd, int cmd, off_t len) = NULL;
+static int (*ptr_lockf64)(int fd, int cmd, off64_t len) = NULL;
 
 
 static int g_do_trace = -1;
@@ -195,6 +226,22 @@ int libc_ftruncate64(int fd, off64_t length) {
     CALL_NEXT(ftruncate64, fd, length)
 }
 
+int libc_fallocate(int fd, int mode, off_t offset, off_t len) {
+    CALL_NEXT(fallocate, fd, mode, offset, len)
+}
+
+int libc_fallocate64(int fd, int mode, off64_t offset, off64_t len) {
+    CALL_NEXT(fallocate64, fd, mode, offset, len)
+}
+
+int libc_posix_fallocate(int fd, off_t offset, off_t len) {
+    CALL_NEXT(posix_fallocate, fd, offset, len)
+}
+
+int libc_posix_fallocate64(int fd, off64_t offset, off64_t len) {
+    CALL_NEXT(posix_fallocate64, fd, offset, len)
+}
+
 int libc_ftruncate(int fd, off_t length) {
     CALL_NEXT(ftruncate, fd, length)
 }
@@ -415,10 +462,18 @@ void libc_rewind(FILE *stream) {
     CALL_NEXT(rewind, stream)
 }
 
+int libc_dup(int oldfd) {
+    CALL_NEXT(dup, oldfd)
+}
+
 int libc_dup2(int oldfd, int newfd) {
     CALL_NEXT(dup2, oldfd, newfd)
 }
 
+int libc_dup3(int oldfd, int newfd, int flags) {
+    CALL_NEXT(dup3, oldfd, newfd, flags)
+}
+
 int libc_unlinkat(int dirfd, const char *pathname, int flags) {
     CALL_NEXT(unlinkat, dirfd, pathname, flags)
 }
@@ -437,6 +492,18 @@ int libc__fxstatat64(int vers, int dirfd, const char *pathname, struct stat64 *b
     CALL_NEXT(__fxstatat64, vers, dirfd, pathname, buf, flags)
 }
 
+int libc_fstatat(int dirfd, const char *pathname, struct stat *buf, int flags) {
+    CALL_NEXT(fstatat, dirfd, pathname, buf, flags)
+}
+
+int libc_fstatat64(int dirfd, const char *pathname, struct stat64 *buf, int flags) {
+    CALL_NEXT(fstatat64, dirfd, pathname, buf, flags)
+}
+
+int libc_statx(int dirfd, const char *pathname, int flags, unsigned int mask, struct statx *statxbuf) {
+    CALL_NEXT(statx, dirfd, pathname, flags, mask, statxbuf)
+}
+
 int libc_openat(int dirfd, const char *pathname, int flags, int mode) {
     CALL_NEXT(openat, dirfd, pathname, flags, mode)
 }
@@ -449,6 +516,34 @@ int libc_mkdirat(int dirfd, const char *pathname, mode_t mode) {
     CALL_NEXT(mkdirat, dirfd, pathname, mode)
 }
 
+int libc_symlink(const char *target, const char *linkpath) {
+    CALL_NEXT(symlink, target, linkpath)
+}
+
+int libc_symlinkat(const char *target, int newdirfd, const char *linkpath) {
+    CALL_NEXT(symlinkat, target, newdirfd, linkpath)
+}
+
+ssize_t libc_readlink(const char *pathname, char *buf, size_t bufsiz) {
+    CALL_NEXT(readlink, pathname, buf, bufsiz)
+}
+
+ssize_t libc_readlinkat(int dirfd, const char *pathname, char *buf, size_t bufsiz) {
+    CALL_NEXT(readlinkat, dirfd, pathname, buf, bufsiz)
+}
+
+int libc_chdir(const char *path) {
+    CALL_NEXT(chdir, path)
+}
+
+int libc_fchdir(int fd) {
+    CALL_NEXT(fchdir, fd)
+}
+
+char *libc_getcwd(char *buf, size_t size) {
+    CALL_NEXT(getcwd, buf, size)
+}
+
 int libc_rmdir(const char *pathname) {
     CALL_NEXT(rmdir, pathname)
 }
@@ -515,4 +610,60 @@ void libc_clearerr(FILE *stream) {
 
 ssize_t libc_getxattr(const char *path, const char *name, void *value,  size_t size) {
     CALL_NEXT(getxattr, path, name, value, size)
-}
\ No newline at end of file
+}
+
+ssize_t libc_fgetxattr(int fd, const char *name, void *value, size_t size) {
+    CALL_NEXT(fgetxattr, fd, name, value, size)
+}
+
+int libc_setxattr(const char *path, const char *name, const void *value, size_t size, int flags) {
+    CALL_NEXT(setxattr, path, name, value, size, flags)
+}
+
+int libc_fsetxattr(int fd, const char *name, const void *value, size_t size, int flags) {
+    CALL_NEXT(fsetxattr, fd, name, value, size, flags)
+}
+
+ssize_t libc_listxattr(const char *path, char *list, size_t size) {
+    CALL_NEXT(listxattr, path, list, size)
+}
+
+ssize_t libc_flistxattr(int fd, char *list, size_t size) {
+    CALL_NEXT(flistxattr, fd, list, size)
+}
+
+int libc_removexattr(const char *path, const char *name) {
+    CALL_NEXT(removexattr, path, name)
+}
+
+int libc_fremovexattr(int fd, const char *name) {
+    CALL_NEXT(fremovexattr, fd, name)
+}
+
+int libc_fcntl(int fd, int cmd, void *arg) {
+    CALL_NEXT(fcntl, fd, cmd, arg)
+}
+
+int libc_flock(int fd, int operation) {
+    CALL_NEXT(flock, fd, operation)
+}
+
+int libc_lockf(int fd, int cmd, off_t len) {
+    CALL_NEXT(lockf, fd, cmd, len)
+}
+
+int libc_lockf64(int fd, int cmd, off64_t len) {
+    CALL_NEXT(lockf64, fd, cmd, len)
+}
+
+void* libc_mmap(void *addr, size_t length, int prot, int flags, int fd, off_t offset) {
+    CALL_NEXT(mmap, addr, length, prot, flags, fd, offset)
+}
+
+int libc_munmap(void *addr, size_t length) {
+    CALL_NEXT(munmap, addr, length)
+}
+
+int libc_msync(void *addr, size_t length, int flags) {
+    CALL_NEXT(msync, addr, length, flags)
+}
@@ -31,6 +31,10 @@ int libc_creat64(const char *pathname, mode_t mode);
 int libc_fdatasync(int fd);
 int libc_fsync(int fd);
 int libc_ftruncate64(int fd, off64_t length);
+int libc_fallocate(int fd, int mode, off_t offset, off_t len);
+int libc_fallocate64(int fd, int mode, off64_t offset, off64_t len);
+int libc_posix_fallocate(int fd, off_t offset, off_t len);
+int libc_posix_fallocate64(int fd, off64_t offset, off64_t len);
 int libc_ftruncate(int fd, off_t length);
 int libc_truncate64(const char *path, off64_t length);
 int libc_truncate(const char *path, off_t length);
@@ -86,14 +90,26 @@ off64_t libc_ftello64(FILE *stream);
 size_t libc_fread(void *ptr, size_t size, size_t nmemb, FILE *stream);
 size_t libc_fwrite(const void *ptr, size_t size, size_t nmemb, FILE *stream);
 void libc_rewind(FILE *stream);
+int libc_dup(int oldfd);
 int libc_dup2(int oldfd, int newfd);
+int libc_dup3(int oldfd, int newfd, int flags);
 int libc_unlinkat(int dirfd, const char *pathname, int flags);
 int libc_faccessat(int dirfd, const char *pathname, int mode, int flags);
 int libc__fxstatat(int vers, int dirfd, const char *pathname, struct stat *buf, int flags);
 int libc__fxstatat64(int vers, int dirfd, const char *pathname, struct stat64 *buf, int flags);
+int libc_fstatat(int dirfd, const char *pathname, struct stat *buf, int flags);
+int libc_fstatat64(int dirfd, const char *pathname, struct stat64 *buf, int flags);
+int libc_statx(int dirfd, const char *pathname, int flags, unsigned int mask, struct statx *statxbuf);
 int libc_openat(int dirfd, const char *pathname, int flags, int mode);
 int libc_mkdir(const char *pathname, mode_t mode);
 int libc_mkdirat(int dirfd, const char *pathname, mode_t mode);
+int libc_symlink(const char *target, const char *linkpath);
+int libc_symlinkat(const char *target, int newdirfd, const char *linkpath);
+ssize_t libc_readlink(const char *pathname, char *buf, size_t bufsiz);
+ssize_t libc_readlinkat(int dirfd, const char *pathname, char *buf, size_t bufsiz);
+int libc_chdir(const char *path);
+int libc_fchdir(int fd);
+char *libc_getcwd(char *buf, size_t size);
 int libc_rmdir(const char *pathname);
 int libc_rename(const char *oldpath, const char *newpath);
 int libc_renameat(int olddirfd, const char *oldpath, int newdirfd, const char *newpath);
@@ -111,6 +127,20 @@ int libc_feof(FILE *stream);
 int libc_ferror(FILE *stream);
 void libc_clearerr(FILE *stream);
 ssize_t libc_getxattr(const char *path, const char *name, void *value,  size_t size);
+ssize_t libc_fgetxattr(int fd, const char *name, void *value, size_t size);
+int libc_setxattr(const char *path, const char *name, const void *value, size_t size, int flags);
+int libc_fsetxattr(int fd, const char *name, const void *value, size_t size, int flags);
+ssize_t libc_listxattr(const char *path, char *list, size_t size);
+ssize_t libc_flistxattr(int fd, char *list, size_t size);
+int libc_removexattr(const char *path, const char *name);
+int libc_fremovexattr(int fd, const char *name);
+int libc_fcntl(int fd, int cmd, void *arg);
+int libc_flock(int fd, int operation);
+int libc_lockf(int fd, int cmd, off_t len);
+int libc_lockf64(int fd, int cmd, off64_t len);
+void* libc_mmap(void *addr, size_t length, int prot, int flags, int fd, off_t offset);
+int libc_munmap(void *addr, size_t length);
+int libc_msync(void *addr, size_t length, int flags);
 
 
 #endif
\ No newline at end of file
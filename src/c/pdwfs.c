@@ -27,6 +27,8 @@
 #include <sys/statvfs.h>   
 #include <errno.h>
 #include <fcntl.h>
+#include <sys/file.h>
+#include <sys/mman.h>
 
 #include <glib.h>
 #include <glib/gprintf.h>
@@ -69,11 +71,14 @@ static int pdwfs_fprintf(FILE* stream, const char* color, const char *cat, const
     exit(EXIT_FAILURE);\
 }
 
-#define IS_STD_FD(fd) (fd == STDIN_FILENO || fd == STDOUT_FILENO || fd == STDERR_FILENO)
-
-#define PATH_NOT_MANAGED(path) (!pdwfs_initialized || !contains_path(mount_register, path))
-#define FD_NOT_MANAGED(fd) (!pdwfs_initialized || IS_STD_FD(fd) || !contains_fd(fd_register, fd))
+// 'path' is an lvalue, replaced by the path to pass through to the libc if not managed (see contains_path)
+#define PATH_NOT_MANAGED(path) (!pdwfs_initialized || !contains_path(mount_register, &path))
+// standard fds are managed only once redirected to a managed file (dup2)
+#define FD_NOT_MANAGED(fd) (!pdwfs_initialized || !contains_fd(fd_register, fd))
+// a path relative to a directory fd is managed if the directory is (AT_FDCWD stands for the current directory)
+#define AT_PATH_NOT_MANAGED(dirfd, path) ((path[0] == '/' || dirfd == AT_FDCWD) ? PATH_NOT_MANAGED(path) : FD_NOT_MANAGED(dirfd))
 #define STREAM_NOT_MANAGED(stream) FD_NOT_MANAGED(fileno(stream))
+#define MAPPING_NOT_MANAGED(addr, length) (!pdwfs_initialized || !contains_mapping(mapping_register, addr, length))
 
 
 //-----------------------------------------------------------------------------------------
@@ -108,19 +113,39 @@ void register_mounts(GHashTable *self, gchar **mounts) {
     }
 }
 
-// lookup function used in g_hash_table_find
+// lookup function used in g_hash_table_find,
+// path elements are compared so that /scratch/out2 does not belong to the mount point /scratch/out
 gboolean finder(gpointer mount, gpointer unused, gpointer abspath) {
-    return g_str_has_prefix(abspath, mount);
+    if (!g_str_has_prefix(abspath, mount)) {
+        return FALSE;
+    }
+    size_t len = strlen(mount);
+    char next = ((char *)abspath)[len];
+    return next == '\0' || next == '/' || (len > 0 && ((char *)mount)[len - 1] == '/');
 }
 
-// returns 1 if the path in argument belongs to one of the mount points registered
-int contains_path(GHashTable *self, const char *path) {
+// a chdir into a mount point only changes the current directory of pdwfs (see chdir), the current directory
+// of the process stays where it was, so relative paths passed through to the libc are made absolute
+static int cwd_managed = 0;
+
+// per-thread buffers of the absolute paths passed through to the libc, used in turn by the (at most two)
+// path arguments of a call
+static __thread char libc_paths[2][PATH_MAX];
+static __thread int next_libc_path = 0;
+
+// returns 1 if the path in argument belongs to one of the mount points registered,
+// otherwise a relative path is replaced by its absolute path when the current directory is in a mount point
+int contains_path(GHashTable *self, const char **path) {
     
-    char *apath = abspath(path);
+    char *apath = abspath(*path);
     if (!apath) {
         return 0;
     }
     gpointer item_ptr = g_hash_table_find(self, (GHRFunc)finder, apath);
+    if (!item_ptr && cwd_managed && (*path)[0] != '/' && strlen(apath) < PATH_MAX) {
+        next_libc_path ^= 1;
+        *path = strcpy(libc_paths[next_libc_path], apath);
+    }
     free(apath);
     return (item_ptr) ? 1 : 0;    
 }
@@ -168,10 +193,91 @@ int contains_fd(GHashTable *self, int fd) {
     return g_hash_table_contains(self, GINT_TO_POINTER(fd));    
 }
 
+// registers a file descriptor duplicated from a managed one
+void register_fd(GHashTable *self, int fd) {
+    if (!contains_fd(self, fd)) {
+        g_hash_table_insert(self, GINT_TO_POINTER(fd), GINT_TO_POINTER(0));
+    }
+}
+
+// unregisters a file descriptor without closing it
+void steal_fd(GHashTable *self, int fd) {
+    g_hash_table_steal(self, GINT_TO_POINTER(fd));
+}
+
 // end of fd_register
 //-----------------------------------------------------------------------------------------
 
 
+//-----------------------------------------------------------------------------------------
+// mapping_register
+//
+// managed files are mapped in anonymous memory, the mapping_register records the memory ranges
+// of their shared mappings so that msync and munmap calls on other ranges go straight to the system
+
+GHashTable *new_mapping_register() {
+    return g_hash_table_new(g_direct_hash, g_direct_equal);
+}
+
+void free_mapping_register(GHashTable *self) {
+    g_hash_table_destroy(self);
+}
+
+void register_mapping(GHashTable *self, void *addr, size_t length) {
+    g_hash_table_insert(self, addr, GSIZE_TO_POINTER(length));
+}
+
+struct mem_range {
+    char *start;
+    char *end;
+};
+
+// lookup function used in g_hash_table_find, true if the mapping overlaps the memory range
+gboolean overlaps(gpointer addr, gpointer length, gpointer range) {
+    struct mem_range *r = range;
+    return (char *)addr < r->end && r->start < (char *)addr + GPOINTER_TO_SIZE(length);
+}
+
+// returns 1 if the memory range overlaps one of the mappings registered
+int contains_mapping(GHashTable *self, void *addr, size_t length) {
+    struct mem_range r = {addr, (char *)addr + length};
+    return (g_hash_table_find(self, (GHRFunc)overlaps, &r)) ? 1 : 0;
+}
+
+// unregisters a memory range, the parts of the mappings outside of the range remain registered
+void remove_mapping_range(GHashTable *self, void *addr, size_t length) {
+    struct mem_range r = {addr, (char *)addr + length};
+    GArray *kept = g_array_new(FALSE, FALSE, sizeof(struct mem_range));
+    GHashTableIter iter;
+    gpointer key, value;
+
+    g_hash_table_iter_init(&iter, self);
+    while (g_hash_table_iter_next(&iter, &key, &value)) {
+        if (!overlaps(key, value, &r)) {
+            continue;
+        }
+        struct mem_range m = {key, (char *)key + GPOINTER_TO_SIZE(value)};
+        if (m.start < r.start) {
+            struct mem_range before = {m.start, r.start};
+            g_array_append_val(kept, before);
+        }
+        if (r.end < m.end) {
+            struct mem_range after = {r.end, m.end};
+            g_array_append_val(kept, after);
+        }
+        g_hash_table_iter_remove(&iter);
+    }
+    for (guint i = 0; i < kept->len; i++) {
+        struct mem_range m = g_array_index(kept, struct mem_range, i);
+        register_mapping(self, m.start, m.end - m.start);
+    }
+    g_array_free(kept, TRUE);
+}
+
+// end of mapping_register
+//-----------------------------------------------------------------------------------------
+
+
 static int pdwfs_initialized = 0;
 // there are cases where pdwfs is not yet initialized and a another library constructor
 // (called before pdwfs.so constructor) does some IO (e.g libselinux, libnuma)
@@ -181,6 +287,7 @@ static int pdwfs_initialized = 0;
 
 static GHashTable *fd_register = NULL;
 static GHashTable *mount_register = NULL;
+static GHashTable *mapping_register = NULL;
 
 static __attribute__((constructor)) void init_pdwfs(void) {
     char buf[1024];
@@ -193,6 +300,7 @@ static __attribute__((constructor)) void init_pdwfs(void) {
     register_mounts(mount_register, mounts);
     g_strfreev(mounts);
     fd_register = new_fd_register();
+    mapping_register = new_mapping_register();
     pdwfs_initialized = 1;
 }
 
@@ -200,6 +308,7 @@ static __attribute__((destructor)) void finalize_pdwfs(void) {
     FinalizePdwfs();
     free_fd_register(fd_register);
     free_mount_register(mount_register);
+    free_mapping_register(mapping_register);
 }
 
 int open(const char *pathname, int flags, ...) {
@@ -251,7 +360,11 @@ ssize_t write(int fd, const void *buf, size_t count) {
         return libc_write(fd, buf, count);
     }
     GoSlice buffer = {(void*)buf, count, count};
-    return Write(fd, buffer);
+    ssize_t ret = Write(fd, buffer);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
 }
 
 ssize_t read(int fd, void *buf, size_t count) {
@@ -261,7 +374,11 @@ ssize_t read(int fd, void *buf, size_t count) {
         return libc_read(fd, buf, count);
     }
     GoSlice buffer = {buf, count, count};
-    return Read(fd, buffer);
+    ssize_t ret = Read(fd, buffer);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
 }
 
 int creat(const char *pathname, mode_t mode) {
@@ -299,7 +416,11 @@ int ftruncate64(int fd, off64_t length) {
     if FD_NOT_MANAGED(fd) {
         return libc_ftruncate64(fd, length);
     }
-    return Ftruncate(fd, length);
+    int ret = Ftruncate(fd, length);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
 }
 
 int ftruncate(int fd, off_t length) {
@@ -308,7 +429,11 @@ int ftruncate(int fd, off_t length) {
     if FD_NOT_MANAGED(fd) {
         return libc_ftruncate(fd, length);
     }
-    return Ftruncate(fd, length);
+    int ret = Ftruncate(fd, length);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
 }
 
 int truncate64(const char *path, off64_t length) {
@@ -317,7 +442,12 @@ int truncate64(const char *path, off64_t length) {
     if PATH_NOT_MANAGED(path) {
         return libc_truncate64(path, length);
     }
-    NOT_IMPLEMENTED("truncate64")
+    GoString gopath = {strdup(path), strlen(path)};
+    int ret = Truncate(gopath, length);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
 }
 
 int truncate(const char *path, off_t length) {
@@ -326,7 +456,63 @@ int truncate(const char *path, off_t length) {
     if PATH_NOT_MANAGED(path) {
         return libc_truncate(path, length);
     }
-    NOT_IMPLEMENTED("truncate")
+    GoString gopath = {strdup(path), strlen(path)};
+    int ret = Truncate(gopath, length);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
+}
+
+int fallocate(int fd, int mode, off_t offset, off_t len) {
+    TRACE("intercepting fallocate(fd=%d, mode=%d, offset=%ld, len=%ld)\n", fd, mode, offset, len)
+
+    if FD_NOT_MANAGED(fd) {
+        return libc_fallocate(fd, mode, offset, len);
+    }
+    int ret = Fallocate(fd, mode, offset, len);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
+}
+
+int fallocate64(int fd, int mode, off64_t offset, off64_t len) {
+    TRACE("intercepting fallocate64(fd=%d, mode=%d, offset=%ld, len=%ld)\n", fd, mode, offset, len)
+
+    if FD_NOT_MANAGED(fd) {
+        return libc_fallocate64(fd, mode, offset, len);
+    }
+    int ret = Fallocate(fd, mode, offset, len);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
+}
+
+// posix_fallocate returns the error number instead of setting errno
+int posix_fallocate(int fd, off_t offset, off_t len) {
+    TRACE("intercepting posix_fallocate(fd=%d, offset=%ld, len=%ld)\n", fd, offset, len)
+
+    if FD_NOT_MANAGED(fd) {
+        return libc_posix_fallocate(fd, offset, len);
+    }
+    if (Fallocate(fd, 0, offset, len) < 0) {
+        return GetErrno();
+    }
+    return 0;
+}
+
+int posix_fallocate64(int fd, off64_t offset, off64_t len) {
+    TRACE("intercepting posix_fallocate64(fd=%d, offset=%ld, len=%ld)\n", fd, offset, len)
+
+    if FD_NOT_MANAGED(fd) {
+        return libc_posix_fallocate64(fd, offset, len);
+    }
+    if (Fallocate(fd, 0, offset, len) < 0) {
+        return GetErrno();
+    }
+    return 0;
 }
 
 off64_t lseek64(int fd, off64_t offset, int whence) {
@@ -410,7 +596,11 @@ ssize_t pwrite(int fd, const void *buf, size_t count, off_t offset) {
         return libc_pwrite(fd, buf, count, offset);
     }
     GoSlice buffer = {(void*)buf, count, count};
-    return Pwrite(fd, buffer, offset);
+    ssize_t ret = Pwrite(fd, buffer, offset);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
 }
 
 ssize_t pwrite64(int fd, const void *buf, size_t count, off64_t offset) {
@@ -420,7 +610,11 @@ ssize_t pwrite64(int fd, const void *buf, size_t count, off64_t offset) {
         return libc_pwrite64(fd, buf, count, offset);
     }
     GoSlice buffer = {(void*)buf, count, count};
-    return Pwrite(fd, buffer, offset);
+    ssize_t ret = Pwrite(fd, buffer, offset);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
 }
 
 ssize_t pwritev(int fd, const struct iovec *iov, int iovcnt, off_t offset) {
@@ -438,7 +632,11 @@ ssize_t pwritev(int fd, const struct iovec *iov, int iovcnt, off_t offset) {
     }
     GoSlice iovSlice = {&vec, iovcnt, iovcnt};
 
-    return Pwritev(fd, iovSlice, offset);
+    ssize_t ret = Pwritev(fd, iovSlice, offset);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
 }
 
 ssize_t pwritev64(int fd, const struct iovec *iov, int iovcnt, off64_t offset) {
@@ -456,7 +654,11 @@ ssize_t pwritev64(int fd, const struct iovec *iov, int iovcnt, off64_t offset) {
     }
     GoSlice iovSlice = {&vec, iovcnt, iovcnt};
 
-    return Pwritev(fd, iovSlice, offset);
+    ssize_t ret = Pwritev(fd, iovSlice, offset);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
 }
 
 ssize_t readv(int fd, const struct iovec *iov, int iovcnt) {
@@ -492,7 +694,11 @@ ssize_t writev(int fd, const struct iovec *iov, int iovcnt) {
     }
     GoSlice iovSlice = {&vec, iovcnt, iovcnt};
 
-    return Writev(fd, iovSlice);
+    ssize_t ret = Writev(fd, iovSlice);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
 }
 
 int ioctl(int fd, unsigned long request, void *argp) {
@@ -555,7 +761,11 @@ int __lxstat(int vers, const char *pathname, struct stat *buf) {
         return libc__lxstat(vers, pathname, buf);
     }
     GoString filename = {strdup(pathname), strlen(pathname)};
-    return Lstat(filename, buf);
+    int ret = Lstat(filename, buf);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
 }
 
 int __lxstat64(int vers, const char *pathname, struct stat64 *buf) {
@@ -565,7 +775,11 @@ int __lxstat64(int vers, const char *pathname, struct stat64 *buf) {
         return libc__lxstat64(vers, pathname, buf);
     }
     GoString filename = {strdup(pathname), strlen(pathname)};
-    return Lstat64(filename, buf);
+    int ret = Lstat64(filename, buf);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
 }
 
 int __fxstat(int vers, int fd, struct stat *buf) {
@@ -593,7 +807,11 @@ int statfs(const char *path, struct statfs *buf) {
         return libc_statfs(path,  buf);
     }
     GoString filename = {strdup(path), strlen(path)};
-    return Statfs(filename, buf);
+    int ret = Statfs(filename, buf);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
 }
 
 int statfs64(const char *path, struct statfs64 *buf) {
@@ -603,7 +821,11 @@ int statfs64(const char *path, struct statfs64 *buf) {
         return libc_statfs64(path,  buf);
     }
     GoString filename = {strdup(path), strlen(path)};
-    return Statfs64(filename, buf);
+    int ret = Statfs64(filename, buf);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
 }
 
 int fstatfs(int fd, struct statfs *buf) {
@@ -645,6 +867,7 @@ FILE* fopen(const char *path, const char *mode) {
     GoString gomode = {strdup(mode), strlen(mode)};
     int ret = Fopen(gopath, gomode, fileno(stream));
     if (ret < 0) {
+        errno = GetErrno();
         remove_fd(fd_register, fileno(stream));
         return (FILE*)(NULL);
     }
@@ -993,35 +1216,234 @@ void rewind(FILE *stream) {
     NOT_IMPLEMENTED("rewind")
 }
 
+// registers newfd, a system duplicate of the managed oldfd, as sharing its open file description
+static int dup_managed(int oldfd, int newfd) {
+    if (newfd < 0) {
+        return newfd;
+    }
+    register_fd(fd_register, newfd);
+    int ret = Dup(oldfd, newfd);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
+}
+
+int dup(int oldfd) {
+    TRACE("intercepting dup(oldfd=%d)\n", oldfd)
+
+    if FD_NOT_MANAGED(oldfd) {
+        return libc_dup(oldfd);
+    }
+    // duplicates the system file descriptor twin of oldfd to get a valid fd
+    return dup_managed(oldfd, libc_dup(oldfd));
+}
+
+// dup3 is dup2 with flags (O_CLOEXEC), both share the same implementation
+static int dup_to(int oldfd, int newfd, int flags, int is_dup3) {
+    if (FD_NOT_MANAGED(oldfd) && FD_NOT_MANAGED(newfd)) {
+        return (is_dup3) ? libc_dup3(oldfd, newfd, flags) : libc_dup2(oldfd, newfd);
+    }
+    if FD_NOT_MANAGED(oldfd) {
+        // newfd no longer references a managed file, the system fd is replaced atomically by dup2
+        Close(newfd);
+        steal_fd(fd_register, newfd);
+        return (is_dup3) ? libc_dup3(oldfd, newfd, flags) : libc_dup2(oldfd, newfd);
+    }
+    if (oldfd == newfd) {
+        if (is_dup3) {
+            errno = EINVAL;
+            return -1;
+        }
+        return newfd;
+    }
+    int ret = (is_dup3) ? libc_dup3(oldfd, newfd, flags) : libc_dup2(oldfd, newfd);
+    if (ret < 0) {
+        return ret;
+    }
+    register_fd(fd_register, newfd);
+    ret = Dup2(oldfd, newfd);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
+}
+
 int dup2(int oldfd, int newfd) {
     TRACE("intercepting dup2(oldfd=%d, newfd=%d)\n", oldfd, newfd)
+    return dup_to(oldfd, newfd, 0, 0);
+}
 
-    if (FD_NOT_MANAGED(oldfd) && FD_NOT_MANAGED(newfd)) {
-        return libc_dup2(oldfd, newfd);
+int dup3(int oldfd, int newfd, int flags) {
+    TRACE("intercepting dup3(oldfd=%d, newfd=%d, flags=%d)\n", oldfd, newfd, flags)
+    return dup_to(oldfd, newfd, flags, 1);
+}
+
+int fcntl(int fd, int cmd, ...) {
+    va_list ap;
+    va_start(ap, cmd);
+    void *arg = va_arg(ap, void*);
+    va_end(ap);
+
+    TRACE("intercepting fcntl(fd=%d, cmd=%d, arg=%p)\n", fd, cmd, arg)
+
+    if FD_NOT_MANAGED(fd) {
+        return libc_fcntl(fd, cmd, arg);
+    }
+    if (cmd == F_DUPFD || cmd == F_DUPFD_CLOEXEC) {
+        return dup_managed(fd, libc_fcntl(fd, cmd, arg));
+    }
+    // commands other than locking apply to the system file descriptor twin of the managed fd
+    if (cmd != F_GETLK && cmd != F_SETLK && cmd != F_SETLKW) {
+        return libc_fcntl(fd, cmd, arg);
+    }
+    int ret = Fcntl(fd, cmd, (struct flock*)arg);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
+}
+
+int fcntl64(int fd, int cmd, ...) __attribute__((alias("fcntl")));
+
+int flock(int fd, int operation) {
+    TRACE("intercepting flock(fd=%d, operation=%d)\n", fd, operation)
+
+    if FD_NOT_MANAGED(fd) {
+        return libc_flock(fd, operation);
     }
-    NOT_IMPLEMENTED("dup2")
+    int ret = Flock(fd, operation);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
+}
+
+int lockf64(int fd, int cmd, off64_t len) {
+    TRACE("intercepting lockf64(fd=%d, cmd=%d, len=%ld)\n", fd, cmd, len)
+
+    if FD_NOT_MANAGED(fd) {
+        return libc_lockf64(fd, cmd, len);
+    }
+    int ret = Lockf(fd, cmd, len);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
+}
+
+int lockf(int fd, int cmd, off_t len) {
+    TRACE("intercepting lockf(fd=%d, cmd=%d, len=%ld)\n", fd, cmd, len)
+
+    if FD_NOT_MANAGED(fd) {
+        return libc_lockf(fd, cmd, len);
+    }
+    int ret = Lockf(fd, cmd, len);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
 }
 
 int unlinkat(int dirfd, const char *pathname, int flags) {
-    TRACE("intercepting unlinkat(dirfd=%d, pathname=%s, flags=%d) (PASS THOUGH)\n", dirfd, pathname, flags)
-    return libc_unlinkat(dirfd, pathname, flags);
+    TRACE("intercepting unlinkat(dirfd=%d, pathname=%s, flags=%d)\n", dirfd, pathname, flags)
+
+    if AT_PATH_NOT_MANAGED(dirfd, pathname) {
+        return libc_unlinkat(dirfd, pathname, flags);
     }
+    GoString gopath = {strdup(pathname), strlen(pathname)};
+    int ret = Unlinkat(dirfd, gopath, flags);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
+}
 
 int faccessat(int dirfd, const char *pathname, int mode, int flags) {
-    TRACE("intercepting faccessat(dirfd=%d, pathname=%s, mode=%d, flags=%d) (PASS THOUGH)\n", dirfd, pathname, mode, flags)
-    return libc_faccessat(dirfd, pathname, mode, flags);
+    TRACE("intercepting faccessat(dirfd=%d, pathname=%s, mode=%d, flags=%d)\n", dirfd, pathname, mode, flags)
+
+    if AT_PATH_NOT_MANAGED(dirfd, pathname) {
+        return libc_faccessat(dirfd, pathname, mode, flags);
     }
+    GoString gopath = {strdup(pathname), strlen(pathname)};
+    int ret = Faccessat(dirfd, gopath, mode, flags);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
+}
 
 // __fxstatat is the glibc function corresponding to fstatat syscall
 int __fxstatat(int vers, int dirfd, const char *pathname, struct stat *buf, int flags) {
-    TRACE("intercepting __fxstatat(vers=%d, dirfd=%d, pathname=%s, buf=%p, flags=%d) (PASS THOUGH)\n", vers, dirfd, pathname, buf, flags)
-    return libc__fxstatat(vers, dirfd, pathname, buf, flags);
+    TRACE("intercepting __fxstatat(vers=%d, dirfd=%d, pathname=%s, buf=%p, flags=%d)\n", vers, dirfd, pathname, buf, flags)
+
+    if AT_PATH_NOT_MANAGED(dirfd, pathname) {
+        return libc__fxstatat(vers, dirfd, pathname, buf, flags);
+    }
+    GoString gopath = {strdup(pathname), strlen(pathname)};
+    int ret = Fstatat(dirfd, gopath, buf, flags);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
 }
 
 // __fxstatat64 is the LARGEFILE64 version of glibc function corresponding to fstatat syscall
 int __fxstatat64(int vers, int dirfd, const char *pathname, struct stat64 *buf, int flags) {
-    TRACE("intercepting __fxstatat64(vers=%d, dirfd=%d, pathname=%s, buf=%p, flags=%d) (PASS THOUGH)\n", dirfd, pathname, buf, flags)
-    return libc__fxstatat64(vers, dirfd, pathname, buf, flags);
+    TRACE("intercepting __fxstatat64(vers=%d, dirfd=%d, pathname=%s, buf=%p, flags=%d)\n", vers, dirfd, pathname, buf, flags)
+
+    if AT_PATH_NOT_MANAGED(dirfd, pathname) {
+        return libc__fxstatat64(vers, dirfd, pathname, buf, flags);
+    }
+    GoString gopath = {strdup(pathname), strlen(pathname)};
+    int ret = Fstatat64(dirfd, gopath, buf, flags);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
+}
+
+// fstatat is exported as a function by glibc >= 2.33 (instead of __fxstatat)
+int fstatat(int dirfd, const char *pathname, struct stat *buf, int flags) {
+    TRACE("intercepting fstatat(dirfd=%d, pathname=%s, buf=%p, flags=%d)\n", dirfd, pathname, buf, flags)
+
+    if AT_PATH_NOT_MANAGED(dirfd, pathname) {
+        return libc_fstatat(dirfd, pathname, buf, flags);
+    }
+    GoString gopath = {strdup(pathname), strlen(pathname)};
+    int ret = Fstatat(dirfd, gopath, buf, flags);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
+}
+
+int fstatat64(int dirfd, const char *pathname, struct stat64 *buf, int flags) {
+    TRACE("intercepting fstatat64(dirfd=%d, pathname=%s, buf=%p, flags=%d)\n", dirfd, pathname, buf, flags)
+
+    if AT_PATH_NOT_MANAGED(dirfd, pathname) {
+        return libc_fstatat64(dirfd, pathname, buf, flags);
+    }
+    GoString gopath = {strdup(pathname), strlen(pathname)};
+    int ret = Fstatat64(dirfd, gopath, buf, flags);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
+}
+
+int statx(int dirfd, const char *pathname, int flags, unsigned int mask, struct statx *statxbuf) {
+    TRACE("intercepting statx(dirfd=%d, pathname=%s, flags=%d, mask=%u, statxbuf=%p)\n", dirfd, pathname, flags, mask, statxbuf)
+
+    if AT_PATH_NOT_MANAGED(dirfd, pathname) {
+        return libc_statx(dirfd, pathname, flags, mask, statxbuf);
+    }
+    GoString gopath = {strdup(pathname), strlen(pathname)};
+    int ret = Statx(dirfd, gopath, flags, mask, statxbuf);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
 }
 
 int openat(int dirfd, const char *pathname, int flags, ...) {
@@ -1035,10 +1457,25 @@ int openat(int dirfd, const char *pathname, int flags, ...) {
         va_end(arg);
         }
 
-    TRACE("intercepting openat(dirfd=%d, pathname=%s, flags=%d, mode=%d) (PASS THOUGH)\n", dirfd, pathname, flags, mode)
-    return libc_openat(dirfd, pathname, flags, mode);
+    TRACE("intercepting openat(dirfd=%d, pathname=%s, flags=%d, mode=%d)\n", dirfd, pathname, flags, mode)
+
+    if AT_PATH_NOT_MANAGED(dirfd, pathname) {
+        return libc_openat(dirfd, pathname, flags, mode);
+    }
+    GoString filename = {strdup(pathname), strlen(pathname)};
+
+    int fd = get_new_fd(fd_register);
+
+    int ret = Openat(dirfd, filename, flags, mode, fd);
+    if (ret < 0) {
+        errno = GetErrno();
+        remove_fd(fd_register, fd);
+    }
+    return ret;
 }
 
+int openat64(int dirfd, const char *pathname, int flags, ...) __attribute__((alias("openat")));
+
 int mkdir(const char *pathname, mode_t mode) {
     TRACE("intercepting mkdir(pathname=%s, mode=%d)\n", pathname, mode)
     
@@ -1046,12 +1483,165 @@ int mkdir(const char *pathname, mode_t mode) {
         return libc_mkdir(pathname, mode);
     }
     GoString gopath = {strdup(pathname), strlen(pathname)};
-    return Mkdir(gopath, mode);
+    int ret = Mkdir(gopath, mode);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
 }
 
 int mkdirat(int dirfd, const char *pathname, mode_t mode) {
-    TRACE("intercepting mkdirat(dirfd=%d, pathname=%s, mode=%d) (PASS THROUGH)\n", dirfd, pathname, mode)
-    return libc_mkdirat(dirfd, pathname, mode);
+    TRACE("intercepting mkdirat(dirfd=%d, pathname=%s, mode=%d)\n", dirfd, pathname, mode)
+
+    if AT_PATH_NOT_MANAGED(dirfd, pathname) {
+        return libc_mkdirat(dirfd, pathname, mode);
+    }
+    GoString gopath = {strdup(pathname), strlen(pathname)};
+    int ret = Mkdirat(dirfd, gopath, mode);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
+}
+
+int symlink(const char *target, const char *linkpath) {
+    TRACE("intercepting symlink(target=%s, linkpath=%s)\n", target, linkpath)
+
+    if PATH_NOT_MANAGED(linkpath) {
+        return libc_symlink(target, linkpath);
+    }
+    GoString gotarget = {strdup(target), strlen(target)};
+    GoString gopath = {strdup(linkpath), strlen(linkpath)};
+    int ret = Symlink(gotarget, gopath);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
+}
+
+int symlinkat(const char *target, int newdirfd, const char *linkpath) {
+    TRACE("intercepting symlinkat(target=%s, newdirfd=%d, linkpath=%s)\n", target, newdirfd, linkpath)
+
+    if AT_PATH_NOT_MANAGED(newdirfd, linkpath) {
+        return libc_symlinkat(target, newdirfd, linkpath);
+    }
+    GoString gotarget = {strdup(target), strlen(target)};
+    GoString gopath = {strdup(linkpath), strlen(linkpath)};
+    int ret = Symlinkat(gotarget, newdirfd, gopath);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
+}
+
+ssize_t readlink(const char *pathname, char *buf, size_t bufsiz) {
+    TRACE("intercepting readlink(pathname=%s, buf=%p, bufsiz=%d)\n", pathname, buf, bufsiz)
+
+    if PATH_NOT_MANAGED(pathname) {
+        return libc_readlink(pathname, buf, bufsiz);
+    }
+    GoString gopath = {strdup(pathname), strlen(pathname)};
+    GoSlice buffer = {buf, bufsiz, bufsiz};
+    ssize_t ret = Readlink(gopath, buffer);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
+}
+
+ssize_t readlinkat(int dirfd, const char *pathname, char *buf, size_t bufsiz) {
+    TRACE("intercepting readlinkat(dirfd=%d, pathname=%s, buf=%p, bufsiz=%d)\n", dirfd, pathname, buf, bufsiz)
+
+    if AT_PATH_NOT_MANAGED(dirfd, pathname) {
+        return libc_readlinkat(dirfd, pathname, buf, bufsiz);
+    }
+    GoString gopath = {strdup(pathname), strlen(pathname)};
+    GoSlice buffer = {buf, bufsiz, bufsiz};
+    ssize_t ret = Readlinkat(dirfd, gopath, buffer);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
+}
+
+int chdir(const char *path) {
+    TRACE("intercepting chdir(path=%s)\n", path)
+
+    if (!pdwfs_initialized) {
+        return libc_chdir(path);
+    }
+    if PATH_NOT_MANAGED(path) {
+        int ret = libc_chdir(path);
+        if (ret == 0) {
+            ExitWorkDir();
+            cwd_managed = 0;
+        }
+        return ret;
+    }
+    GoString gopath = {strdup(path), strlen(path)};
+    int ret = Chdir(gopath);
+    if (ret < 0) {
+        errno = GetErrno();
+    } else {
+        cwd_managed = 1;
+    }
+    return ret;
+}
+
+int fchdir(int fd) {
+    TRACE("intercepting fchdir(fd=%d)\n", fd)
+
+    if FD_NOT_MANAGED(fd) {
+        int ret = libc_fchdir(fd);
+        if (ret == 0 && pdwfs_initialized) {
+            ExitWorkDir();
+            cwd_managed = 0;
+        }
+        return ret;
+    }
+    int ret = Fchdir(fd);
+    if (ret < 0) {
+        errno = GetErrno();
+    } else {
+        cwd_managed = 1;
+    }
+    return ret;
+}
+
+char *getcwd(char *buf, size_t size) {
+    TRACE("intercepting getcwd(buf=%p, size=%d)\n", buf, size)
+
+    if (!pdwfs_initialized) {
+        return libc_getcwd(buf, size);
+    }
+    char cwd[PATH_MAX];
+    GoSlice buffer = {cwd, PATH_MAX, PATH_MAX};
+    int len = Getcwd(buffer);
+    if (len == 0) {
+        // the current directory is not in a mount point
+        return libc_getcwd(buf, size);
+    }
+    if (len < 0) {
+        errno = GetErrno();
+        return NULL;
+    }
+    if (buf == NULL && size == 0) {
+        // glibc extension: the buffer is allocated as large as needed
+        return strdup(cwd);
+    }
+    if (size < (size_t)len + 1) {
+        errno = ERANGE;
+        return NULL;
+    }
+    if (buf == NULL) {
+        buf = malloc(size);
+        if (buf == NULL) {
+            errno = ENOMEM;
+            return NULL;
+        }
+    }
+    memcpy(buf, cwd, len + 1);
+    return buf;
 }
 
 int rmdir(const char *pathname) {
@@ -1108,7 +1698,11 @@ int statvfs(const char *pathname, struct statvfs *buf) {
         return libc_statvfs(pathname, buf);
     }
     GoString gopath = {strdup(pathname), strlen(pathname)};
-    return Statvfs(gopath, buf);
+    int ret = Statvfs(gopath, buf);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
 }
 
 int statvfs64(const char *pathname, struct statvfs64 *buf) {
@@ -1118,7 +1712,11 @@ int statvfs64(const char *pathname, struct statvfs64 *buf) {
         return libc_statvfs64(pathname, buf);
     }
     GoString gopath = {strdup(pathname), strlen(pathname)};
-    return Statvfs64(gopath, buf);
+    int ret = Statvfs64(gopath, buf);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
 }
 
 int fstatvfs(int fd, struct statvfs *buf) {
@@ -1224,8 +1822,212 @@ ssize_t getxattr(const char *path, const char *name, void *value,  size_t size)
     if PATH_NOT_MANAGED(path) {
         return libc_getxattr(path, name, value, size);
     }
-    // hack for CEA computing facility relying on some extended attributes
-    // TODO: intercept setxattr to record attributes instead ?
-    errno = EOPNOTSUPP;
-    return -1;
+    GoString gopath = {strdup(path), strlen(path)};
+    GoString goname = {strdup(name), strlen(name)};
+    GoSlice buffer = {value, size, size};
+    ssize_t ret = Getxattr(gopath, goname, buffer);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
+}
+
+ssize_t fgetxattr(int fd, const char *name, void *value, size_t size) {
+    TRACE("intercepting fgetxattr(fd=%d, name=%s, value=%p, size=%d)\n", fd, name, value, size)
+
+    if FD_NOT_MANAGED(fd) {
+        return libc_fgetxattr(fd, name, value, size);
+    }
+    GoString goname = {strdup(name), strlen(name)};
+    GoSlice buffer = {value, size, size};
+    ssize_t ret = Fgetxattr(fd, goname, buffer);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
+}
+
+int setxattr(const char *path, const char *name, const void *value, size_t size, int flags) {
+    TRACE("intercepting setxattr(path=%s, name=%s, value=%p, size=%d, flags=%d)\n", path, name, value, size, flags)
+
+    if PATH_NOT_MANAGED(path) {
+        return libc_setxattr(path, name, value, size, flags);
+    }
+    GoString gopath = {strdup(path), strlen(path)};
+    GoString goname = {strdup(name), strlen(name)};
+    GoSlice buffer = {(void*)value, size, size};
+    int ret = Setxattr(gopath, goname, buffer, flags);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
+}
+
+int fsetxattr(int fd, const char *name, const void *value, size_t size, int flags) {
+    TRACE("intercepting fsetxattr(fd=%d, name=%s, value=%p, size=%d, flags=%d)\n", fd, name, value, size, flags)
+
+    if FD_NOT_MANAGED(fd) {
+        return libc_fsetxattr(fd, name, value, size, flags);
+    }
+    GoString goname = {strdup(name), strlen(name)};
+    GoSlice buffer = {(void*)value, size, size};
+    int ret = Fsetxattr(fd, goname, buffer, flags);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
+}
+
+ssize_t listxattr(const char *path, char *list, size_t size) {
+    TRACE("intercepting listxattr(path=%s, list=%p, size=%d)\n", path, list, size)
+
+    if PATH_NOT_MANAGED(path) {
+        return libc_listxattr(path, list, size);
+    }
+    GoString gopath = {strdup(path), strlen(path)};
+    GoSlice buffer = {list, size, size};
+    ssize_t ret = Listxattr(gopath, buffer);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
+}
+
+ssize_t flistxattr(int fd, char *list, size_t size) {
+    TRACE("intercepting flistxattr(fd=%d, list=%p, size=%d)\n", fd, list, size)
+
+    if FD_NOT_MANAGED(fd) {
+        return libc_flistxattr(fd, list, size);
+    }
+    GoSlice buffer = {list, size, size};
+    ssize_t ret = Flistxattr(fd, buffer);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
+}
+
+int removexattr(const char *path, const char *name) {
+    TRACE("intercepting removexattr(path=%s, name=%s)\n", path, name)
+
+    if PATH_NOT_MANAGED(path) {
+        return libc_removexattr(path, name);
+    }
+    GoString gopath = {strdup(path), strlen(path)};
+    GoString goname = {strdup(name), strlen(name)};
+    int ret = Removexattr(gopath, goname);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
+}
+
+int fremovexattr(int fd, const char *name) {
+    TRACE("intercepting fremovexattr(fd=%d, name=%s)\n", fd, name)
+
+    if FD_NOT_MANAGED(fd) {
+        return libc_fremovexattr(fd, name);
+    }
+    GoString goname = {strdup(name), strlen(name)};
+    int ret = Fremovexattr(fd, goname);
+    if (ret < 0) {
+        errno = GetErrno();
+    }
+    return ret;
+}
+
+// rounds a length up to a multiple of the page size
+static size_t page_align(size_t length) {
+    size_t pagesize = sysconf(_SC_PAGESIZE);
+    return (length + pagesize - 1) / pagesize * pagesize;
+}
+
+// writes back and unregisters the shared mappings of managed files in the memory range
+static int unmap_managed(void *addr, size_t length) {
+    if ((size_t)addr % sysconf(_SC_PAGESIZE) != 0) {
+        errno = EINVAL;
+        return -1;
+    }
+    GoSlice buffer = {addr, length, length};
+    if (Munmap(buffer) < 0) {
+        errno = GetErrno();
+        return -1;
+    }
+    remove_mapping_range(mapping_register, addr, length);
+    return 0;
+}
+
+// maps anonymous memory in place of a managed file, the content of the file is loaded by the Go layer
+static void* mmap_managed(void *addr, size_t length, int prot, int flags, int fd, off_t offset) {
+    if (length == 0) {
+        errno = EINVAL;
+        return MAP_FAILED;
+    }
+    size_t len = page_align(length);
+    int anon_flags = (flags & ~MAP_SHARED_VALIDATE) | MAP_PRIVATE | MAP_ANONYMOUS;
+    void *ptr = libc_mmap(addr, len, PROT_READ | PROT_WRITE, anon_flags, -1, 0);
+    if (ptr == MAP_FAILED) {
+        return ptr;
+    }
+    GoSlice buffer = {ptr, len, len};
+    if (Mmap(fd, buffer, offset, prot, flags) < 0) {
+        int err = GetErrno();
+        libc_munmap(ptr, len);
+        errno = err;
+        return MAP_FAILED;
+    }
+    if (mprotect(ptr, len, prot) < 0) {
+        int err = errno;
+        Munmap(buffer);
+        libc_munmap(ptr, len);
+        errno = err;
+        return MAP_FAILED;
+    }
+    if (flags & MAP_SHARED) {
+        register_mapping(mapping_register, ptr, len);
+    }
+    return ptr;
+}
+
+void* mmap(void *addr, size_t length, int prot, int flags, int fd, off_t offset) {
+    TRACE("intercepting mmap(addr=%p, length=%lu, prot=%d, flags=%d, fd=%d, offset=%ld)\n", addr, length, prot, flags, fd, offset)
+
+    // a fixed mapping replaces the mappings of the memory range
+    if ((flags & MAP_FIXED) && !MAPPING_NOT_MANAGED(addr, page_align(length))) {
+        if (unmap_managed(addr, page_align(length)) < 0) {
+            return MAP_FAILED;
+        }
+    }
+    if ((flags & MAP_ANONYMOUS) || FD_NOT_MANAGED(fd)) {
+        return libc_mmap(addr, length, prot, flags, fd, offset);
+    }
+    return mmap_managed(addr, length, prot, flags, fd, offset);
+}
+
+void* mmap64(void *addr, size_t length, int prot, int flags, int fd, off64_t offset) __attribute__((alias("mmap")));
+
+int munmap(void *addr, size_t length) {
+    TRACE("intercepting munmap(addr=%p, length=%lu)\n", addr, length)
+
+    if MAPPING_NOT_MANAGED(addr, page_align(length)) {
+        return libc_munmap(addr, length);
+    }
+    if (unmap_managed(addr, page_align(length)) < 0) {
+        return -1;
+    }
+    return libc_munmap(addr, length);
+}
+
+int msync(void *addr, size_t length, int flags) {
+    TRACE("intercepting msync(addr=%p, length=%lu, flags=%d)\n", addr, length, flags)
+
+    if MAPPING_NOT_MANAGED(addr, page_align(length)) {
+        return libc_msync(addr, length, flags);
+    }
+    GoSlice buffer = {addr, page_align(length), page_align(length)};
+    if (Msync(buffer) < 0) {
+        errno = GetErrno();
+        return -1;
+    }
+    return libc_msync(addr, length, flags);
 }
\ No newline at end of file
@@ -0,0 +1,100 @@
+// Copyright 2019 CEA
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// pdwfs-admin administers the Redis instances shared by pdwfs processes on a running deployment.
+// The Redis instances are found from the pdwfs configuration (PDWFS_CONF, PDWFS_REDIS, ...).
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cea-hpc/pdwfs/config"
+	"github.com/cea-hpc/pdwfs/redisfs"
+)
+
+const usage = `Usage: pdwfs-admin command [arguments]
+
+commands:
+    ring list           list the Redis instances of the ring
+    ring add addr       add the Redis instance at addr to the ring, data now placed on it is moved to it
+    ring drain addr     move all the data of the Redis instance at addr to the others and remove it from the ring
+                        (the instance must also be removed from the configuration of the jobs)
+    namespace list      list the namespaces having files in the Redis instances
+    namespace drop ns   remove all the files of the namespace ns (no job should be using it)
+
+no job should be using the Redis instances while nodes are added or drained,
+running jobs do not reload the ring membership
+`
+
+var errUsage = errors.New("invalid command")
+
+// command is an administration command taking a fixed number of arguments
+type command struct {
+	nargs int
+	run   func(ring *redisfs.RedisRing, args []string, out io.Writer) error
+}
+
+var commands = map[string]command{
+	"ring list": {0, func(ring *redisfs.RedisRing, args []string, out io.Writer) error {
+		for _, addr := range ring.Nodes() {
+			fmt.Fprintln(out, addr)
+		}
+		return nil
+	}},
+	"ring add": {1, func(ring *redisfs.RedisRing, args []string, out io.Writer) error {
+		return ring.AddNode(args[0])
+	}},
+	"ring drain": {1, func(ring *redisfs.RedisRing, args []string, out io.Writer) error {
+		return ring.DrainNode(args[0])
+	}},
+	"namespace list": {0, func(ring *redisfs.RedisRing, args []string, out io.Writer) error {
+		namespaces, err := ring.Namespaces()
+		for _, ns := range namespaces {
+			fmt.Fprintln(out, ns)
+		}
+		return err
+	}},
+	"namespace drop": {1, func(ring *redisfs.RedisRing, args []string, out io.Writer) error {
+		return ring.DropNamespace(args[0])
+	}},
+}
+
+// runs the command line 'args' on the ring of the Redis instances configured, writes its output to 'out'
+func run(conf *config.Redis, args []string, out io.Writer) error {
+	if len(args) < 2 {
+		return errUsage
+	}
+	cmd, ok := commands[args[0]+" "+args[1]]
+	if !ok || len(args)-2 != cmd.nargs {
+		return errUsage
+	}
+	ring := redisfs.NewRedisRing(conf)
+	defer ring.Close()
+	return cmd.run(ring, args[2:], out)
+}
+
+func main() {
+	conf := config.New()
+	if err := run(conf.Redis, os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "pdwfs-admin:", err)
+		if err == errUsage {
+			fmt.Fprint(os.Stderr, usage)
+		}
+		os.Exit(1)
+	}
+}
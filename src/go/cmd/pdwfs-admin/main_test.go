@@ -0,0 +1,74 @@
+// Copyright 2019 CEA
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/cea-hpc/pdwfs/redisfs"
+	"github.com/cea-hpc/pdwfs/util"
+)
+
+func TestRingCommands(t *testing.T) {
+	server1, conf := util.InitRedisTestServer()
+	defer server1.Stop()
+	server2, conf2 := util.InitRedisTestServer()
+	defer server2.Stop()
+	addr1, addr2 := conf.Addrs[0], conf2.Addrs[0]
+
+	out := &bytes.Buffer{}
+	util.Ok(t, run(conf, []string{"ring", "list"}, out))
+	util.Equals(t, addr1+"\n", out.String(), "wrong ring members")
+
+	util.Ok(t, run(conf, []string{"ring", "add", addr2}, out))
+	out.Reset()
+	util.Ok(t, run(conf, []string{"ring", "list"}, out))
+	util.Equals(t, 2, len(bytes.Fields(out.Bytes())), "node should have been added")
+
+	// the membership is found from any member
+	util.Ok(t, run(conf2, []string{"ring", "drain", addr1}, out))
+	out.Reset()
+	util.Ok(t, run(conf2, []string{"ring", "list"}, out))
+	util.Equals(t, addr2+"\n", out.String(), "node should have been drained")
+
+	util.Equals(t, errUsage, run(conf, []string{"ring"}, out), "missing subcommand")
+	util.Equals(t, errUsage, run(conf, []string{"ring", "add"}, out), "missing argument")
+	util.Equals(t, errUsage, run(conf, []string{"ring", "move", addr1}, out), "unknown subcommand")
+}
+
+func TestNamespaceCommands(t *testing.T) {
+	server, conf := util.InitRedisTestServer()
+	defer server.Stop()
+
+	ring := redisfs.NewRedisRing(conf)
+	defer ring.Close()
+	for _, ns := range []string{"job1", "job2"} {
+		store := redisfs.NewDataStore(ring, 10)
+		store.SetNamespace(ns)
+		util.Ok(t, store.WriteAt("/path/to/file", 0, []byte("some data")))
+	}
+
+	out := &bytes.Buffer{}
+	util.Ok(t, run(conf, []string{"namespace", "list"}, out))
+	util.Equals(t, "job1\njob2\n", out.String(), "wrong namespaces")
+
+	util.Ok(t, run(conf, []string{"namespace", "drop", "job1"}, out))
+	out.Reset()
+	util.Ok(t, run(conf, []string{"namespace", "list"}, out))
+	util.Equals(t, "job2\n", out.String(), "namespace should have been dropped")
+
+	util.Equals(t, redisfs.ErrInvalidNamespace, run(conf, []string{"namespace", "drop", "job*"}, out), "invalid namespace")
+}
@@ -41,13 +41,153 @@ var check = try
 type Mount struct {
 	Path       string
 	StripeSize int
+	Pins       []Pin // stripes placement rules, the first matching rule applies
+	// percentage of the Redis instances memory above which writes are refused (0 to disable)
+	HighWatermark float64
+	Quota         Quota
+	// prefix of all the Redis keys of the mount point, allows several jobs to share the same Redis instances
+	// (defaults to PDWFS_NAMESPACE or to the job ID, see JobID)
+	Namespace string
+	// time to live in seconds of files and directories since their last access (0 for no expiry),
+	// expired files are not released from the quota usage
+	TTL      int64
+	TTLRules []TTLRule // time to live by path pattern, the first matching rule applies
+	Staging  Staging
+	// overlay mode on the real directory of the mount point: "" (disabled), "ro" or "copyup"
+	Overlay      string
+	WriteThrough WriteThrough
+	SealWait     SealWait
+	Events       Events
+	// retention policies bounding the memory used by files only useful for a while, the first matching rule applies
+	Retention []RetentionRule
+	// duration in seconds after which the advisory locks of a process not refreshing them expire (default 30)
+	LockLease float64
+	// size in bytes up to which writes spanning several stripes are seen whole or not at all by concurrent readers,
+	// at the cost of extra round trips to Redis for these writes and for reads spanning several stripes (0 to disable)
+	AtomicWriteSize int64
+	// duration in seconds the attributes of files (existence, type, mode, size) are cached before being fetched
+	// again from Redis, opening a file always fetches them (default 1, negative to fetch them on every access)
+	AttrTimeout float64
 }
 
+// RetentionRule removes the files matching a pattern once they have been read enough
+// or once they are too old in their series
+type RetentionRule struct {
+	Pattern  string // shell pattern (see filepath.Match) matched against the file path or one of its parent directories
+	MaxReads int64  // the file is removed once closed by this number of readers since last written (0 to disable)
+	KeepLast int64  // only the last files created matching the pattern are kept, older ones are removed (0 to disable)
+}
+
+// Events publishes file events (see Event* constants) to Redis so that workflow engines can react to them.
+// Events are published on the channel and/or appended to the stream named "pdwfs:events:{<mount path>}"
+// (prefixed by the namespace if any), placed on the Redis instances like any other key.
+type Events struct {
+	Channel      bool     // publish events as JSON messages on the Redis channel
+	Stream       bool     // append events to a capped Redis Stream
+	StreamMaxLen int64    // approximate maximum number of events kept in the stream (default 10000)
+	Ops          []string // types of the events published, all if empty
+	Patterns     []string // shell patterns (see filepath.Match) of the paths publishing events, all if empty
+}
+
+// Event types
+const (
+	EventCreate   = "create"   // a file is created
+	EventClose    = "close"    // a file opened for writing is closed
+	EventTruncate = "truncate" // a file is truncated
+	EventUnlink   = "unlink"   // a file is removed
+)
+
+// EventOps lists all the event types
+var EventOps = []string{EventCreate, EventClose, EventTruncate, EventUnlink}
+
+// SealWait makes readers opening files matching one of the patterns wait until the files exist
+// and are sealed (closed by their last writer), so that consumers do not need to poll for complete files
+type SealWait struct {
+	Patterns []string // shell patterns (see filepath.Match) matched against the file path or one of its parent directories
+	Timeout  float64  // maximum time to wait in seconds, opening fails with ETIMEDOUT afterwards (0 waits forever)
+}
+
+// WriteThrough copies the files to the real directory of the mount point in the background once closed
+type WriteThrough struct {
+	Enabled   bool
+	Workers   int  // number of concurrent stripe copies (default 4)
+	QueueSize int  // number of files waiting to be copied, closing a file blocks when the queue is full (default 1024)
+	Retries   int  // number of retries of a failed copy
+	NoWait    bool // FinalizePdwfs does not wait for the queue to drain, files still queued are not copied
+}
+
+// Overlay modes: files of the real directory of the mount point are visible through pdwfs,
+// they are either read-only or copied into pdwfs when opened for writing
+const (
+	OverlayReadOnly = "ro"
+	OverlayCopyUp   = "copyup"
+)
+
+// Staging configures the copies between the mount point and persistent directories
+type Staging struct {
+	In       string   // directory tree imported into the mount point at initialization (empty to disable)
+	Out      string   // directory the files are drained to (empty to disable)
+	Patterns []string // shell patterns of the files drained at finalization (all files if empty)
+	OnClose  []string // shell patterns of the files drained asynchronously as soon as they are closed after writing
+	Workers  int      // number of concurrent stripe copies (default 4)
+	// maximum time in seconds to wait for the stage-in by another process, StageIn fails afterwards (0 waits forever)
+	InTimeout float64
+}
+
+// TTLRule sets the time to live of the files matching a pattern
+type TTLRule struct {
+	Pattern string // shell pattern (see filepath.Match) matched against the file path or one of its parent directories
+	TTL     int64  // time to live in seconds, 0 or negative for no expiry
+}
+
+// Quota limits the resources used in a mount point, writes and file creations above the limits fail with EDQUOT
+type Quota struct {
+	Bytes  int64 // maximum number of bytes stored (0 for no limit)
+	Inodes int64 // maximum number of files and directories (0 for no limit)
+	PerJob bool  // limits apply to each job separately (see JobID) instead of the whole mount point
+}
+
+// ValidNamespace returns true if the namespace is made of letters, digits, '.', '_' and '-' only
+func ValidNamespace(namespace string) bool {
+	if namespace == "" {
+		return false
+	}
+	for _, c := range namespace {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// JobID returns the identifier of the batch job the process runs in, or an empty string outside of a job
+func JobID() string {
+	for _, env := range []string{"PDWFS_JOBID", "SLURM_JOB_ID", "PBS_JOBID", "LSB_JOBID"} {
+		if id := os.Getenv(env); id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+// Pin places all stripes of the files matching a pattern on a single Redis instance
+type Pin struct {
+	Pattern string // shell pattern (see filepath.Match) matched against the file path or one of its parent directories
+	Node    string // address of the Redis instance, or "local" for an instance running on the writer's host
+}
+
+// LocalNode is the Pin node value designating a Redis instance local to the writer's host
+const LocalNode = "local"
+
 //Redis connection configuration
 type Redis struct {
 	Addrs        []string
 	Cluster      bool
 	ClusterAddrs []string
+	// stripes placement strategy: consistent (default), jump, rendezvous or raid0,
+	// the strategy of a ring and the weights of its nodes are fixed when the ring is created or a node is added
+	Placement string
+	Weights   map[string]int // relative weight of Redis instances by address (default 1)
 }
 
 // NewRedisConf generates a default configuration
@@ -56,6 +196,7 @@ func NewRedisConf() *Redis {
 		Addrs:        []string{":6379"},
 		Cluster:      false,
 		ClusterAddrs: []string{":7001", ":7002", ":7003", ":7004", ":7005", ":7006"},
+		Placement:    "consistent",
 	}
 
 }
@@ -108,6 +249,22 @@ func New() *Pdwfs {
 		conf.Redis.Addrs = a
 	}
 
+	if placement := os.Getenv("PDWFS_PLACEMENT"); placement != "" {
+		conf.Redis.Placement = placement
+	}
+
+	if weights := os.Getenv("PDWFS_WEIGHTS"); weights != "" {
+		conf.Redis.Weights = map[string]int{}
+		for _, w := range strings.Split(weights, ",") {
+			i := strings.LastIndex(w, "=")
+			weight, err := strconv.Atoi(w[i+1:])
+			if i < 1 || err != nil {
+				log.Fatalln("PDWFS_WEIGHTS must be a comma-separated list of 'address=weight'")
+			}
+			conf.Redis.Weights[w[:i]] = weight
+		}
+	}
+
 	if path := os.Getenv("PDWFS_MOUNTPATH"); path != "" {
 		conf.Mounts[path] = &Mount{
 			Path:       path,
@@ -115,6 +272,141 @@ func New() *Pdwfs {
 		}
 	}
 
+	if watermark := os.Getenv("PDWFS_HIGHWATERMARK"); watermark != "" {
+		for _, mount := range conf.Mounts {
+			wm, err := strconv.ParseFloat(watermark, 64)
+			if err != nil {
+				log.Fatalln("Can't convert high watermark in PDWFS_HIGHWATERMARK to float")
+			}
+			mount.HighWatermark = wm
+		}
+	}
+
+	if quota := os.Getenv("PDWFS_QUOTA_BYTES"); quota != "" {
+		for _, mount := range conf.Mounts {
+			bytes, err := strconv.ParseInt(quota, 10, 64)
+			if err != nil {
+				log.Fatalln("Can't convert quota in PDWFS_QUOTA_BYTES to int")
+			}
+			mount.Quota.Bytes = bytes
+		}
+	}
+
+	if quota := os.Getenv("PDWFS_QUOTA_INODES"); quota != "" {
+		for _, mount := range conf.Mounts {
+			inodes, err := strconv.ParseInt(quota, 10, 64)
+			if err != nil {
+				log.Fatalln("Can't convert quota in PDWFS_QUOTA_INODES to int")
+			}
+			mount.Quota.Inodes = inodes
+		}
+	}
+
+	namespace := os.Getenv("PDWFS_NAMESPACE")
+	if namespace == "" {
+		namespace = JobID()
+	}
+	for _, mount := range conf.Mounts {
+		if mount.Namespace == "" {
+			mount.Namespace = namespace
+		}
+	}
+
+	if ttl := os.Getenv("PDWFS_TTL"); ttl != "" {
+		for _, mount := range conf.Mounts {
+			seconds, err := strconv.ParseInt(ttl, 10, 64)
+			if err != nil {
+				log.Fatalln("Can't convert time to live in PDWFS_TTL to int")
+			}
+			mount.TTL = seconds
+		}
+	}
+
+	if dir := os.Getenv("PDWFS_STAGEIN"); dir != "" {
+		for _, mount := range conf.Mounts {
+			mount.Staging.In = dir
+		}
+	}
+
+	if dir := os.Getenv("PDWFS_STAGEOUT"); dir != "" {
+		for _, mount := range conf.Mounts {
+			mount.Staging.Out = dir
+		}
+	}
+
+	if overlay := os.Getenv("PDWFS_OVERLAY"); overlay != "" {
+		for _, mount := range conf.Mounts {
+			mount.Overlay = overlay
+		}
+	}
+
+	if wt := os.Getenv("PDWFS_WRITETHROUGH"); wt != "" {
+		if wt != "wait" && wt != "nowait" {
+			log.Fatalln("PDWFS_WRITETHROUGH must be 'wait' or 'nowait'")
+		}
+		for _, mount := range conf.Mounts {
+			mount.WriteThrough.Enabled = true
+			mount.WriteThrough.NoWait = wt == "nowait"
+		}
+	}
+
+	if patterns := os.Getenv("PDWFS_SEALWAIT"); patterns != "" {
+		for _, mount := range conf.Mounts {
+			mount.SealWait.Patterns = strings.Split(patterns, ",")
+		}
+	}
+
+	if timeout := os.Getenv("PDWFS_SEALTIMEOUT"); timeout != "" {
+		for _, mount := range conf.Mounts {
+			t, err := strconv.ParseFloat(timeout, 64)
+			if err != nil {
+				log.Fatalln("Can't convert timeout in PDWFS_SEALTIMEOUT to float")
+			}
+			mount.SealWait.Timeout = t
+		}
+	}
+
+	if events := os.Getenv("PDWFS_EVENTS"); events != "" {
+		for _, mount := range conf.Mounts {
+			for _, sink := range strings.Split(events, ",") {
+				switch sink {
+				case "channel":
+					mount.Events.Channel = true
+				case "stream":
+					mount.Events.Stream = true
+				default:
+					log.Fatalln("PDWFS_EVENTS must be a comma-separated list of 'channel' and 'stream'")
+				}
+			}
+		}
+	}
+
+	if ops := os.Getenv("PDWFS_EVENTS_OPS"); ops != "" {
+		for _, mount := range conf.Mounts {
+			mount.Events.Ops = strings.Split(ops, ",")
+		}
+	}
+
+	if size := os.Getenv("PDWFS_ATOMICWRITESIZE"); size != "" {
+		for _, mount := range conf.Mounts {
+			bytes, err := strconv.ParseInt(size, 10, 64)
+			if err != nil {
+				log.Fatalln("Can't convert atomic write size in PDWFS_ATOMICWRITESIZE to int")
+			}
+			mount.AtomicWriteSize = bytes
+		}
+	}
+
+	if timeout := os.Getenv("PDWFS_ATTRTIMEOUT"); timeout != "" {
+		for _, mount := range conf.Mounts {
+			t, err := strconv.ParseFloat(timeout, 64)
+			if err != nil {
+				log.Fatalln("Can't convert attribute timeout in PDWFS_ATTRTIMEOUT to float")
+			}
+			mount.AttrTimeout = t
+		}
+	}
+
 	if stripeSize := os.Getenv("PDWFS_STRIPESIZE"); stripeSize != "" {
 		for _, mount := range conf.Mounts {
 			size, err := strconv.Atoi(stripeSize)
@@ -141,6 +433,25 @@ func New() *Pdwfs {
 			err := fmt.Sprintf("Mount point '%s' block size (%dMB) is above what Redis can sustain, set block size <= 512MB", path, conf.StripeSize/(1024*1024))
 			panic(err)
 		}
+		if out := conf.Staging.Out; out != "" {
+			out, err := filepath.Abs(out)
+			check(err)
+			if out == conf.Path || strings.HasPrefix(out, conf.Path+"/") {
+				panic(fmt.Sprintf("Mount point '%s' stage-out directory '%s' must be outside of the mount point", path, out))
+			}
+			conf.Staging.Out = out
+		}
+		if conf.Overlay != "" && conf.Overlay != OverlayReadOnly && conf.Overlay != OverlayCopyUp {
+			panic(fmt.Sprintf("Mount point '%s' overlay mode '%s' is unknown, use '%s' or '%s'", path, conf.Overlay, OverlayReadOnly, OverlayCopyUp))
+		}
+		if conf.Namespace != "" && !ValidNamespace(conf.Namespace) {
+			panic(fmt.Sprintf("Mount point '%s' namespace '%s' is invalid, only letters, digits, '.', '_' and '-' are allowed", path, conf.Namespace))
+		}
+		for _, op := range conf.Events.Ops {
+			if !contains(EventOps, op) {
+				panic(fmt.Sprintf("Mount point '%s' event type '%s' is unknown, use one of %s", path, op, strings.Join(EventOps, ", ")))
+			}
+		}
 		normalized[conf.Path] = conf
 	}
 	conf.Mounts = normalized
@@ -148,6 +459,15 @@ func New() *Pdwfs {
 	return &conf
 }
 
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
 // Dump writes the configuration in a JSON file
 func (c *Pdwfs) Dump() {
 	content, err := json.MarshalIndent(c, "", "    ")
@@ -0,0 +1,28 @@
+/*
+* Copyright 2019 CEA
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* 	http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*/
+
+// Error number set by the Go functions for the C layer. Like errno, it is per thread: a call from C into Go
+// runs on the calling thread, so concurrent calls from several threads do not overwrite each other's error.
+
+static __thread int pdwfs_errno;
+
+void pdwfs_set_errno(int err) {
+    pdwfs_errno = err;
+}
+
+int pdwfs_get_errno(void) {
+    return pdwfs_errno;
+}
@@ -18,14 +18,22 @@
 package main
 
 /*
-#cgo CFLAGS: -D_LARGEFILE64_SOURCE
+#cgo CFLAGS: -D_LARGEFILE64_SOURCE -D_GNU_SOURCE
 #include <stdlib.h>
 #include <stdio.h>
 #include <unistd.h>
+#include <fcntl.h>
+#include <sys/file.h>
 #include <sys/stat.h>
 #include <sys/statfs.h>
 #include <sys/statvfs.h>
 #include <errno.h>
+#include <sys/xattr.h>
+#include <sys/mman.h>
+
+// see errno.c
+void pdwfs_set_errno(int err);
+int pdwfs_get_errno(void);
 */
 import "C"
 
@@ -36,9 +44,8 @@ import (
 	"io"
 	"os"
 	"path/filepath"
-	"strings"
 	"sync"
-	"syscall"
+	"unsafe"
 
 	"github.com/cea-hpc/pdwfs/config"
 	"github.com/cea-hpc/pdwfs/redisfs"
@@ -65,12 +72,27 @@ var check = try
 // PdwFS manages multiple redisfs mount points and keeps a map of opened fd <-> opened redisfs.File.
 // This map is used to translate I/O calls coming from the C layer and addressed by a system file descriptor
 // to pdwfs implementation of Files (redisfs.File).
+// Several fds reference the same open file description when duplicated (dup, dup2, ...).
 type PdwFS struct {
 	mounts    map[string]*redisfs.RedisFS
+	paths     []string // mount paths
 	conf      *config.Pdwfs
 	prefix    string
-	fdFileMap map[int]*redisfs.File
-	lock      sync.RWMutex
+	fdFileMap map[int]*openFile
+	mappings  map[uintptr]*mapping // shared memory mappings by start address
+	// files the process holds fcntl or lockf locks on, released when any fd of the file is closed
+	recordLocked map[string]bool
+	lock         sync.RWMutex
+}
+
+// openFile is an open file description, shared by the fds duplicated from the fd returned by open
+// (the offset and the flags of the redisfs.File are shared as well)
+type openFile struct {
+	file   redisfs.File
+	fd     int  // fd returned by open, identifies the description as owner of advisory locks
+	flags  int  // open flags
+	refs   int  // number of fds and shared memory mappings referencing the description
+	locked bool // the description holds flock locks, released when the last fd is closed
 }
 
 //NewPdwFS returns a new PdwFS instance with newly created redisfs mount points based on configuration info
@@ -79,42 +101,59 @@ func NewPdwFS(conf *config.Pdwfs) *PdwFS {
 		panic("No mount path specified...")
 	}
 	mounts := map[string]*redisfs.RedisFS{}
+	paths := []string{}
 	for path, mountConf := range conf.Mounts {
 		mounts[path] = redisfs.NewRedisFS(conf.Redis, mountConf)
+		paths = append(paths, path)
 	}
 	return &PdwFS{
-		mounts:    mounts,
-		conf:      conf,
-		fdFileMap: make(map[int]*redisfs.File),
-		lock:      sync.RWMutex{},
+		mounts:       mounts,
+		paths:        paths,
+		conf:         conf,
+		fdFileMap:    make(map[int]*openFile),
+		mappings:     make(map[uintptr]*mapping),
+		recordLocked: make(map[string]bool),
+		lock:         sync.RWMutex{},
 	}
 }
 
-// parse a filename to return the correponding mount point if found
+// parse a filename to return the correponding mount point if found (the deepest one for nested mount points)
 func (fs *PdwFS) getMount(filename string) (*redisfs.RedisFS, error) {
 	if filename == "" {
-		//short-circuit filepath.Abs as Abs behaviour is to return working directory on empty string
+		//short-circuit redisfs.AbsPath as Abs behaviour is to return working directory on empty string
 		// this is not the behaviour we want
 		return nil, nil
 	}
-	p, err := filepath.Abs(filename)
+	p, err := redisfs.AbsPath(filename)
 	if err != nil {
 		return nil, err
 	}
-	for path, mount := range fs.mounts {
-		if strings.HasPrefix(p, path) {
-			return mount, nil
-		}
+	if path, ok := redisfs.LongestMount(p, fs.paths); ok {
+		return fs.mounts[path], nil
 	}
 	return nil, nil
 }
 
 // register a new redisfs.File and its associated system file descriptor
-func (fs *PdwFS) registerFile(fd int, redisFile *redisfs.File) error {
+func (fs *PdwFS) registerFile(fd, flags int, redisFile *redisfs.File) error {
 	if _, ok := fs.fdFileMap[fd]; ok {
 		return errFdInUse
 	}
-	fs.fdFileMap[fd] = redisFile
+	fs.fdFileMap[fd] = &openFile{file: *redisFile, fd: fd, flags: flags, refs: 1}
+	return nil
+}
+
+// register newfd as a reference to the open file description of oldfd
+func (fs *PdwFS) dupFd(oldfd, newfd int) error {
+	f, ok := fs.fdFileMap[oldfd]
+	if !ok {
+		return errInvalidFd
+	}
+	if _, ok := fs.fdFileMap[newfd]; ok {
+		return errFdInUse
+	}
+	f.refs++
+	fs.fdFileMap[newfd] = f
 	return nil
 }
 
@@ -129,12 +168,90 @@ func (fs *PdwFS) removeFd(fd int) error {
 
 func (fs *PdwFS) getFileFromFd(fd int) (*redisfs.File, error) {
 	if f, ok := fs.fdFileMap[fd]; ok {
-		return f, nil
+		return &f.file, nil
 	}
 	return nil, errInvalidFd
 }
 
+// returns the redisfs.File of an fd for an I/O, the global lock is only held for the lookup:
+// the File serializes the I/Os using its offset and the I/Os on overlapping ranges of the file by itself
+func (fs *PdwFS) lookupFd(fd int) (*redisfs.File, error) {
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+	return fs.getFileFromFd(fd)
+}
+
+// drop a reference to an open file description, the description is closed with its last reference
+func (fs *PdwFS) release(f *openFile) error {
+	if f.refs--; f.refs > 0 {
+		return nil
+	}
+	if f.locked {
+		mount, err := fs.getMount(f.file.Name())
+		check(err)
+		try(mount.Unlock(f.file.Name(), redisfs.NewLockOwner(f.fd)))
+	}
+	return f.file.Close()
+}
+
+// close a file descriptor, the open file description is closed with its last fd (or shared memory mapping)
+func (fs *PdwFS) closeFd(fd int) error {
+	f, ok := fs.fdFileMap[fd]
+	if !ok {
+		return errInvalidFd
+	}
+	// as POSIX record locks, the fcntl and lockf locks of the process on the file are released with any of its fds
+	if name := f.file.Name(); fs.recordLocked[name] {
+		mount, err := fs.getMount(name)
+		check(err)
+		try(mount.Unlock(name, redisfs.NewProcessLockOwner()))
+		delete(fs.recordLocked, name)
+	}
+	if err := fs.release(f); err != nil {
+		return err
+	}
+	return fs.removeFd(fd)
+}
+
+// mapping is a shared memory mapping of a managed file, it references the open file description of the mapped fd
+type mapping struct {
+	*redisfs.Mapping
+	file *openFile
+}
+
+func addressOf(buf []byte) uintptr {
+	return uintptr(unsafe.Pointer(&buf[0]))
+}
+
+// returns the start addresses of the mappings overlapping the memory range [start, end[
+func (fs *PdwFS) overlappingMappings(start, end uintptr) []uintptr {
+	addrs := []uintptr{}
+	for addr, m := range fs.mappings {
+		if addr < end && start < addr+uintptr(m.Len()) {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// returns the byte range of a mapping overlapping the memory range [start, end[
+func overlap(addr uintptr, m *mapping, start, end uintptr) (int, int) {
+	if start < addr {
+		start = addr
+	}
+	if limit := addr + uintptr(m.Len()); end > limit {
+		end = limit
+	}
+	return int(start - addr), int(end - start)
+}
+
 func (fs *PdwFS) finalize() {
+	// as the system does for mappings never unmapped, modified pages are written back at exit
+	for _, m := range fs.mappings {
+		if err := m.Sync(0, m.Len()); err != nil {
+			fmt.Fprintf(os.Stderr, "pdwfs: cannot write back the memory mapping of '%s': %s\n", m.file.file.Name(), err)
+		}
+	}
 	for _, mount := range fs.mounts {
 		mount.Finalize()
 	}
@@ -172,52 +289,155 @@ func FinalizePdwfs() {
 	pdwfs.finalize()
 }
 
-var errno C.int
-
-//GetErrno is used by C functions to retrieve the error number set by Go function
+//GetErrno is used by C functions to retrieve the error number set by Go function in the calling thread
 //export GetErrno
 func GetErrno() C.int {
-	return errno
+	return C.pdwfs_get_errno()
 }
 
 // setErrno is used by Go functions to set errno
 func setErrno(err C.int) {
-	errno = err
+	C.pdwfs_set_errno(err)
+}
+
+// returns the errno of the errors of path resolution (possibly wrapped in several *os.PathError)
+func resolveErrno(err error) (C.int, bool) {
+	for {
+		e, ok := err.(*os.PathError)
+		if !ok {
+			break
+		}
+		err = e.Err
+	}
+	switch err {
+	case redisfs.ErrNotDirectory:
+		return C.ENOTDIR, true
+	case redisfs.ErrTooManyLinks:
+		return C.ELOOP, true
+	case redisfs.ErrLinkOutsideMount:
+		return C.EXDEV, true
+	}
+	return 0, false
+}
+
+// sets errno for the errors of opening a file, 'call' names the intercepted call
+func setOpenErrno(call string, err error) {
+	if os.IsNotExist(err) {
+		setErrno(C.ENOENT)
+	} else if os.IsExist(err) {
+		setErrno(C.EEXIST)
+	} else if e, ok := err.(*os.PathError); ok && e.Err == redisfs.ErrIsDirectory {
+		setErrno(C.EISDIR)
+	} else if e, ok := err.(*os.PathError); ok && e.Err == redisfs.ErrQuotaExceeded {
+		setErrno(C.EDQUOT)
+	} else if e, ok := err.(*os.PathError); ok && e.Err == redisfs.ErrReadOnlyFS {
+		setErrno(C.EROFS)
+	} else if e, ok := err.(*os.PathError); ok && e.Err == redisfs.ErrTimeout {
+		setErrno(C.ETIMEDOUT)
+	} else if e, ok := err.(*os.PathError); ok && e.Err == redisfs.ErrNotDirectory {
+		setErrno(C.ENOTDIR)
+	} else if errno, ok := resolveErrno(err); ok {
+		setErrno(errno)
+	} else {
+		panic(fmt.Sprintf("unhandled %T in %s: %s", err, call, err))
+	}
+}
+
+// waits until a file opened with 'flags' is sealed if its mount point requires it (see config.SealWait),
+// the global lock is not held while waiting so that a writer of the process can close the file meanwhile
+func waitSealed(filename string, flags int) error {
+	pdwfs.lock.Lock()
+	mount, err := pdwfs.getMount(filename)
+	check(err)
+	wait, err := mount.SealWaiter(filename, flags)
+	pdwfs.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return wait()
+}
+
+// opens a file once waited for its seal (see waitSealed), the global lock must be held
+func open(filename string, flags, mode, fd int) int {
+	mount, err := pdwfs.getMount(filename)
+	check(err)
+
+	file, err := mount.OpenFileNoWait(filename, flags, os.FileMode(mode))
+	if err != nil {
+		setOpenErrno("Open", err)
+		return -1
+	}
+	try(pdwfs.registerFile(fd, flags, &file))
+	return fd
 }
 
 //Open implements open libc call
 //export Open
 func Open(filename string, flags, mode, fd int) int {
+	if err := waitSealed(filename, flags); err != nil {
+		setOpenErrno("Open", err)
+		return -1
+	}
 	pdwfs.lock.Lock()
 	defer pdwfs.lock.Unlock()
-	mount, err := pdwfs.getMount(filename)
-	check(err)
+	return open(filename, flags, mode, fd)
+}
 
-	file, err := mount.OpenFile(filename, flags, os.FileMode(mode))
-	if err != nil {
-		if os.IsNotExist(err) {
+// resolves a path relative to the directory opened as dirfd (or to the current directory for AT_FDCWD),
+// sets errno and returns false if the path cannot be resolved
+func resolveAt(dirfd int, filename string, flags int) (string, bool) {
+	if filepath.IsAbs(filename) {
+		return filename, true
+	}
+	if dirfd == C.AT_FDCWD {
+		if filename == "" {
 			setErrno(C.ENOENT)
-		} else if os.IsExist(err) {
-			setErrno(C.EEXIST)
-		} else if e, ok := err.(*os.PathError); ok && e.Err == redisfs.ErrIsDirectory {
-			setErrno(C.EISDIR)
-		} else {
-			panic(fmt.Sprintf("unhandled %T in Open: %s", err, err))
+			return "", false
+		}
+		path, err := redisfs.AbsPath(filename)
+		check(err)
+		return path, true
+	}
+	file, err := pdwfs.getFileFromFd(dirfd)
+	if err != nil {
+		setErrno(C.EBADF)
+		return "", false
+	}
+	if filename == "" {
+		if flags&C.AT_EMPTY_PATH != 0 {
+			return (*file).Name(), true
 		}
+		setErrno(C.ENOENT)
+		return "", false
+	}
+	if !redisfs.IsDir(*file) {
+		setErrno(C.ENOTDIR)
+		return "", false
+	}
+	return filepath.Join((*file).Name(), filename), true
+}
+
+//Openat implements openat libc call, dirfd is AT_FDCWD or a directory opened in a mount point
+//export Openat
+func Openat(dirfd int, filename string, flags, mode, fd int) int {
+	pdwfs.lock.Lock()
+	path, ok := resolveAt(dirfd, filename, 0)
+	pdwfs.lock.Unlock()
+	if !ok {
 		return -1
 	}
-	try(pdwfs.registerFile(fd, &file))
-	return fd
+	if err := waitSealed(path, flags); err != nil {
+		setOpenErrno("Openat", err)
+		return -1
+	}
+	pdwfs.lock.Lock()
+	defer pdwfs.lock.Unlock()
+	return open(path, flags, mode, fd)
 }
 
 //Fopen implements fopen libc call
 //export Fopen
 func Fopen(filename string, mode string, fd int) int {
-	pdwfs.lock.Lock()
-	defer pdwfs.lock.Unlock()
-	mount, err := pdwfs.getMount(filename)
-	check(err)
-
 	var flags int
 	switch mode {
 	case "r":
@@ -227,20 +447,21 @@ func Fopen(filename string, mode string, fd int) int {
 	default:
 		panic(fmt.Sprintf("fopen mode '%s' unknown or not implemented yet", mode))
 	}
-	file, err := mount.OpenFile(filename, flags, os.FileMode(0600))
+	if err := waitSealed(filename, flags); err != nil {
+		setOpenErrno("Fopen", err)
+		return -1
+	}
+	pdwfs.lock.Lock()
+	defer pdwfs.lock.Unlock()
+	mount, err := pdwfs.getMount(filename)
+	check(err)
+
+	file, err := mount.OpenFileNoWait(filename, flags, os.FileMode(0600))
 	if err != nil {
-		if os.IsNotExist(err) {
-			setErrno(C.ENOENT)
-		} else if os.IsExist(err) {
-			setErrno(C.EEXIST)
-		} else if e, ok := err.(*os.PathError); ok && e.Err == redisfs.ErrIsDirectory {
-			setErrno(C.EISDIR)
-		} else {
-			panic(fmt.Sprintf("unhandled %T in Fopen: %s", err, err))
-		}
+		setOpenErrno("Fopen", err)
 		return -1
 	}
-	try(pdwfs.registerFile(fd, &file))
+	try(pdwfs.registerFile(fd, flags, &file))
 	return fd
 }
 
@@ -249,20 +470,45 @@ func Fopen(filename string, mode string, fd int) int {
 func Close(fd int) int {
 	pdwfs.lock.Lock()
 	defer pdwfs.lock.Unlock()
-	file, err := pdwfs.getFileFromFd(fd)
-	check(err)
-
-	try((*file).Close()) // no known conversion to errno, just panic if err != nil
-	try(pdwfs.removeFd(fd))
+	try(pdwfs.closeFd(fd)) // no known conversion to errno, just panic if err != nil
 	return 0
 }
 
+//Dup registers newfd, obtained by the C layer from dup or fcntl(F_DUPFD), as a duplicate of oldfd
+//export Dup
+func Dup(oldfd, newfd int) int {
+	pdwfs.lock.Lock()
+	defer pdwfs.lock.Unlock()
+	if err := pdwfs.dupFd(oldfd, newfd); err != nil {
+		setErrno(C.EBADF)
+		return -1
+	}
+	return newfd
+}
+
+//Dup2 implements dup2 libc call (and dup3), newfd is closed first if it references a managed file
+//export Dup2
+func Dup2(oldfd, newfd int) int {
+	pdwfs.lock.Lock()
+	defer pdwfs.lock.Unlock()
+	if _, ok := pdwfs.fdFileMap[oldfd]; !ok {
+		setErrno(C.EBADF)
+		return -1
+	}
+	if oldfd == newfd {
+		return newfd
+	}
+	if _, ok := pdwfs.fdFileMap[newfd]; ok {
+		try(pdwfs.closeFd(newfd))
+	}
+	try(pdwfs.dupFd(oldfd, newfd))
+	return newfd
+}
+
 //Write implements write libc call
 //export Write
 func Write(fd int, buf []byte) int {
-	pdwfs.lock.Lock()
-	defer pdwfs.lock.Unlock()
-	file, err := pdwfs.getFileFromFd(fd)
+	file, err := pdwfs.lookupFd(fd)
 	check(err)
 
 	n, err := (*file).Write(buf)
@@ -270,6 +516,10 @@ func Write(fd int, buf []byte) int {
 	if err != nil {
 		if err == redisfs.ErrReadOnly {
 			setErrno(C.EBADF)
+		} else if err == redisfs.ErrNoSpace {
+			setErrno(C.ENOSPC)
+		} else if err == redisfs.ErrQuotaExceeded {
+			setErrno(C.EDQUOT)
 		} else {
 			check(err) // no known conversion to errno, just panic if err != nil
 		}
@@ -282,9 +532,7 @@ func Write(fd int, buf []byte) int {
 //Pwrite implements pwrite libc call
 //export Pwrite
 func Pwrite(fd int, buf []byte, off int64) int {
-	pdwfs.lock.Lock()
-	defer pdwfs.lock.Unlock()
-	file, err := pdwfs.getFileFromFd(fd)
+	file, err := pdwfs.lookupFd(fd)
 	check(err)
 
 	n, err := (*file).WriteAt(buf, off)
@@ -292,6 +540,10 @@ func Pwrite(fd int, buf []byte, off int64) int {
 		if e, ok := err.(*os.PathError); ok && e.Err == redisfs.ErrNegativeOffset {
 			setErrno(C.EINVAL)
 			C.perror(C.CString(e.Err.Error()))
+		} else if err == redisfs.ErrNoSpace {
+			setErrno(C.ENOSPC)
+		} else if err == redisfs.ErrQuotaExceeded {
+			setErrno(C.EDQUOT)
 		} else {
 			panic(fmt.Sprintf("unhandled %T in Pwrite: %s", err, err))
 		}
@@ -303,22 +555,27 @@ func Pwrite(fd int, buf []byte, off int64) int {
 //Writev implements writev libc call
 //export Writev
 func Writev(fd int, iov [][]byte) int {
-	pdwfs.lock.Lock()
-	defer pdwfs.lock.Unlock()
-	file, err := pdwfs.getFileFromFd(fd)
+	file, err := pdwfs.lookupFd(fd)
 	check(err)
 
 	n, err := (*file).WriteVec(iov)
-	check(err) // no known conversion to errno, just panic if err != nil
+	if err != nil {
+		if err == redisfs.ErrNoSpace {
+			setErrno(C.ENOSPC)
+		} else if err == redisfs.ErrQuotaExceeded {
+			setErrno(C.EDQUOT)
+		} else {
+			check(err) // no known conversion to errno, just panic if err != nil
+		}
+		return -1
+	}
 	return n
 }
 
 //Pwritev implements pwritev libc call
 //export Pwritev
 func Pwritev(fd int, iov [][]byte, off int64) int {
-	pdwfs.lock.Lock()
-	defer pdwfs.lock.Unlock()
-	file, err := pdwfs.getFileFromFd(fd)
+	file, err := pdwfs.lookupFd(fd)
 	check(err)
 
 	n, err := (*file).WriteVecAt(iov, off)
@@ -326,6 +583,10 @@ func Pwritev(fd int, iov [][]byte, off int64) int {
 		if e, ok := err.(*os.PathError); ok && e.Err == redisfs.ErrNegativeOffset {
 			setErrno(C.EINVAL)
 			C.perror(C.CString(err.Error()))
+		} else if err == redisfs.ErrNoSpace {
+			setErrno(C.ENOSPC)
+		} else if err == redisfs.ErrQuotaExceeded {
+			setErrno(C.EDQUOT)
 		} else {
 			panic(fmt.Sprintf("unhandled %T in Pwritev: %s", err, err))
 		}
@@ -337,15 +598,15 @@ func Pwritev(fd int, iov [][]byte, off int64) int {
 //Read implements read libc call
 //export Read
 func Read(fd int, buf []byte) int {
-	pdwfs.lock.Lock()
-	defer pdwfs.lock.Unlock()
-	file, err := pdwfs.getFileFromFd(fd)
+	file, err := pdwfs.lookupFd(fd)
 	check(err)
 
 	n, err := (*file).Read(buf)
-	if err != nil && err != io.EOF{
+	if err != nil && err != io.EOF {
 		if err == redisfs.ErrWriteOnly {
 			setErrno(C.EBADF)
+		} else if err == redisfs.ErrIsDirectory {
+			setErrno(C.EISDIR)
 		} else {
 			check(err) // no known conversion to errno, just panic if err != nil
 		}
@@ -357,9 +618,7 @@ func Read(fd int, buf []byte) int {
 //Pread implements pread libc call
 //export Pread
 func Pread(fd int, buf []byte, off int64) int {
-	pdwfs.lock.Lock()
-	defer pdwfs.lock.Unlock()
-	file, err := pdwfs.getFileFromFd(fd)
+	file, err := pdwfs.lookupFd(fd)
 	check(err)
 
 	n, err := (*file).ReadAt(buf, off)
@@ -378,9 +637,7 @@ func Pread(fd int, buf []byte, off int64) int {
 //Readv implements readv libc call
 //export Readv
 func Readv(fd int, iov [][]byte) int {
-	pdwfs.lock.Lock()
-	defer pdwfs.lock.Unlock()
-	file, err := pdwfs.getFileFromFd(fd)
+	file, err := pdwfs.lookupFd(fd)
 	check(err)
 
 	n, err := (*file).ReadVec(iov)
@@ -393,9 +650,7 @@ func Readv(fd int, iov [][]byte) int {
 //Preadv implements preadv libc call
 //export Preadv
 func Preadv(fd int, iov [][]byte, off int64) int {
-	pdwfs.lock.Lock()
-	defer pdwfs.lock.Unlock()
-	file, err := pdwfs.getFileFromFd(fd)
+	file, err := pdwfs.lookupFd(fd)
 	check(err)
 
 	n, err := (*file).ReadVecAt(iov, off)
@@ -414,9 +669,7 @@ func Preadv(fd int, iov [][]byte, off int64) int {
 //Lseek implements lseek libc call
 //export Lseek
 func Lseek(fd int, offset int64, whence int) int64 {
-	pdwfs.lock.Lock()
-	defer pdwfs.lock.Unlock()
-	file, err := pdwfs.getFileFromFd(fd)
+	file, err := pdwfs.lookupFd(fd)
 	check(err)
 
 	n, err := (*file).Seek(offset, whence)
@@ -436,11 +689,7 @@ func Lseek(fd int, offset int64, whence int) int64 {
 	return n
 }
 
-//Unlink implements unlink libc call
-//export Unlink
-func Unlink(filename string) int {
-	pdwfs.lock.Lock()
-	defer pdwfs.lock.Unlock()
+func unlink(filename string) int {
 	mount, err := pdwfs.getMount(filename)
 	check(err)
 
@@ -448,6 +697,10 @@ func Unlink(filename string) int {
 	if err != nil {
 		if os.IsNotExist(err) {
 			setErrno(C.ENOENT)
+		} else if e, ok := err.(*os.PathError); ok && e.Err == redisfs.ErrReadOnlyFS {
+			setErrno(C.EROFS)
+		} else if errno, ok := resolveErrno(err); ok {
+			setErrno(errno)
 		} else {
 			panic(fmt.Sprintf("unhandled %T in Unlink: %s", err, err))
 		}
@@ -456,11 +709,15 @@ func Unlink(filename string) int {
 	return 0
 }
 
-//Mkdir implements mkdir libc call
-//export Mkdir
-func Mkdir(dirname string, mode int) int {
+//Unlink implements unlink libc call
+//export Unlink
+func Unlink(filename string) int {
 	pdwfs.lock.Lock()
 	defer pdwfs.lock.Unlock()
+	return unlink(filename)
+}
+
+func mkdir(dirname string, mode int) int {
 	mount, err := pdwfs.getMount(dirname)
 	check(err)
 
@@ -470,6 +727,10 @@ func Mkdir(dirname string, mode int) int {
 			setErrno(C.ENOENT)
 		} else if os.IsExist(err) {
 			setErrno(C.EEXIST)
+		} else if e, ok := err.(*os.PathError); ok && e.Err == redisfs.ErrQuotaExceeded {
+			setErrno(C.EDQUOT)
+		} else if errno, ok := resolveErrno(err); ok {
+			setErrno(errno)
 		} else {
 			panic(fmt.Sprintf("unhandled %T in Mkdir: %s", err, err))
 		}
@@ -478,11 +739,27 @@ func Mkdir(dirname string, mode int) int {
 	return 0
 }
 
-//Rmdir implements rmdir libc call
-//export Rmdir
-func Rmdir(dirname string) int {
+//Mkdir implements mkdir libc call
+//export Mkdir
+func Mkdir(dirname string, mode int) int {
 	pdwfs.lock.Lock()
 	defer pdwfs.lock.Unlock()
+	return mkdir(dirname, mode)
+}
+
+//Mkdirat implements mkdirat libc call, dirfd is AT_FDCWD or a directory opened in a mount point
+//export Mkdirat
+func Mkdirat(dirfd int, dirname string, mode int) int {
+	pdwfs.lock.Lock()
+	defer pdwfs.lock.Unlock()
+	path, ok := resolveAt(dirfd, dirname, 0)
+	if !ok {
+		return -1
+	}
+	return mkdir(path, mode)
+}
+
+func rmdir(dirname string) int {
 	mount, err := pdwfs.getMount(dirname)
 	check(err)
 
@@ -492,6 +769,8 @@ func Rmdir(dirname string) int {
 			setErrno(C.ENOENT)
 		} else if e, ok := err.(*os.PathError); ok && e.Err == redisfs.ErrDirNotEmpty {
 			setErrno(C.ENOTEMPTY)
+		} else if errno, ok := resolveErrno(err); ok {
+			setErrno(errno)
 		} else {
 			panic(fmt.Sprintf("unhandled %T in Rmdir: %s", err, err))
 		}
@@ -500,11 +779,30 @@ func Rmdir(dirname string) int {
 	return 0
 }
 
-//Access implements access libc call
-//export Access
-func Access(filename string, mode int) int {
+//Rmdir implements rmdir libc call
+//export Rmdir
+func Rmdir(dirname string) int {
+	pdwfs.lock.Lock()
+	defer pdwfs.lock.Unlock()
+	return rmdir(dirname)
+}
+
+//Unlinkat implements unlinkat libc call, removing a directory if flags contains AT_REMOVEDIR
+//export Unlinkat
+func Unlinkat(dirfd int, filename string, flags int) int {
 	pdwfs.lock.Lock()
 	defer pdwfs.lock.Unlock()
+	path, ok := resolveAt(dirfd, filename, 0)
+	if !ok {
+		return -1
+	}
+	if flags&C.AT_REMOVEDIR != 0 {
+		return rmdir(path)
+	}
+	return unlink(path)
+}
+
+func access(filename string, mode int) int {
 	mount, err := pdwfs.getMount(filename)
 	check(err)
 
@@ -517,6 +815,10 @@ func Access(filename string, mode int) int {
 	if err != nil {
 		if os.IsNotExist(err) {
 			setErrno(C.ENOENT)
+		} else if e, ok := err.(*os.PathError); ok && e.Err == redisfs.ErrParentDirNotExist {
+			setErrno(C.ENOENT)
+		} else if errno, ok := resolveErrno(err); ok {
+			setErrno(errno)
 		} else {
 			panic(fmt.Sprintf("unhandled %T in Access: %s", err, err))
 		}
@@ -525,93 +827,538 @@ func Access(filename string, mode int) int {
 	return 0
 }
 
-// Ftruncate implements ftruncate libc call
-//export Ftruncate
-func Ftruncate(fd int, length int64) int {
+//Access implements access libc call
+//export Access
+func Access(filename string, mode int) int {
 	pdwfs.lock.Lock()
 	defer pdwfs.lock.Unlock()
-	file, err := pdwfs.getFileFromFd(fd)
-	check(err)
+	return access(filename, mode)
+}
 
-	err = (*file).Truncate(length)
-	check(err) // no known conversion to errno, just panic if err != nil
-	return 0
+//Faccessat implements faccessat libc call
+//export Faccessat
+func Faccessat(dirfd int, filename string, mode, flags int) int {
+	pdwfs.lock.Lock()
+	defer pdwfs.lock.Unlock()
+	path, ok := resolveAt(dirfd, filename, flags)
+	if !ok {
+		return -1
+	}
+	return access(path, mode)
 }
 
-func stat(filename string, stats *C.struct_stat) int {
-	mount, err := pdwfs.getMount(filename)
+func symlink(target, linkpath string) int {
+	mount, err := pdwfs.getMount(linkpath)
 	check(err)
 
-	inode, err := mount.Stat(filename)
+	err = mount.Symlink(target, linkpath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			setErrno(C.ENOENT)
+		} else if os.IsExist(err) {
+			setErrno(C.EEXIST)
 		} else if e, ok := err.(*os.PathError); ok && e.Err == redisfs.ErrParentDirNotExist {
 			setErrno(C.ENOENT)
+		} else if e, ok := err.(*os.PathError); ok && e.Err == redisfs.ErrQuotaExceeded {
+			setErrno(C.EDQUOT)
+		} else if errno, ok := resolveErrno(err); ok {
+			setErrno(errno)
 		} else {
-			panic(fmt.Sprintf("unhandled %T in stat: %s", err, err))
+			panic(fmt.Sprintf("unhandled %T in Symlink: %s", err, err))
 		}
 		return -1
 	}
-	// Only implements value required by test applications
-	if inode.IsDir() {
-		stats.st_mode = C.__S_IFDIR
-	} else {
-		stats.st_mode = C.__S_IFREG
-	}
-	stats.st_size = C.long(inode.Size()) // total file size in bytes
 	return 0
 }
 
-//Stat implements part of __xstat libc call
-//export Stat
-func Stat(filename string, stats *C.struct_stat) int {
+//Symlink implements symlink libc call
+//export Symlink
+func Symlink(target, linkpath string) int {
+	pdwfs.lock.Lock()
+	defer pdwfs.lock.Unlock()
+	return symlink(target, linkpath)
+}
+
+//Symlinkat implements symlinkat libc call
+//export Symlinkat
+func Symlinkat(target string, newdirfd int, linkpath string) int {
 	pdwfs.lock.Lock()
 	defer pdwfs.lock.Unlock()
-	return stat(filename, stats)
+	path, ok := resolveAt(newdirfd, linkpath, 0)
+	if !ok {
+		return -1
+	}
+	return symlink(target, path)
 }
 
-func stat64(filename string, stats *C.struct_stat64) int {
+// copies the target of the link in buf (truncated and not null-terminated, as readlink does)
+func readlink(filename string, buf []byte) int {
 	mount, err := pdwfs.getMount(filename)
 	check(err)
 
-	inode, err := mount.Stat(filename)
+	target, err := mount.Readlink(filename)
 	if err != nil {
 		if os.IsNotExist(err) {
 			setErrno(C.ENOENT)
 		} else if e, ok := err.(*os.PathError); ok && e.Err == redisfs.ErrParentDirNotExist {
 			setErrno(C.ENOENT)
+		} else if e, ok := err.(*os.PathError); ok && e.Err == redisfs.ErrNotSymlink {
+			setErrno(C.EINVAL)
+		} else if errno, ok := resolveErrno(err); ok {
+			setErrno(errno)
 		} else {
-			panic(fmt.Sprintf("unhandled %T in stat: %s", err, err))
+			panic(fmt.Sprintf("unhandled %T in Readlink: %s", err, err))
 		}
 		return -1
 	}
-	// Only implements value required by test applications
-	if inode.IsDir() {
-		stats.st_mode = C.__S_IFDIR
-	} else {
-		stats.st_mode = C.__S_IFREG
-	}
-	stats.st_size = C.long(inode.Size()) // total file size in bytes
-	return 0
+	return copy(buf, target)
 }
 
-//Stat64 implements part of __stat64 libc call
-//export Stat64
-func Stat64(filename string, stats *C.struct_stat64) int {
+//Readlink implements readlink libc call
+//export Readlink
+func Readlink(filename string, buf []byte) int {
 	pdwfs.lock.Lock()
 	defer pdwfs.lock.Unlock()
-	return stat64(filename, stats)
+	return readlink(filename, buf)
 }
 
-//Fstat implements part of __fxstat libc call, cf. Stat
-//export Fstat
-func Fstat(fd int, stats *C.struct_stat) int {
+//Readlinkat implements readlinkat libc call
+//export Readlinkat
+func Readlinkat(dirfd int, filename string, buf []byte) int {
 	pdwfs.lock.Lock()
 	defer pdwfs.lock.Unlock()
-	file, err := pdwfs.getFileFromFd(fd)
-	check(err)
-	return stat((*file).Name(), stats)
+	path, ok := resolveAt(dirfd, filename, C.AT_EMPTY_PATH)
+	if !ok {
+		return -1
+	}
+	return readlink(path, buf)
+}
+
+//Chdir implements chdir libc call for the directories of the mount points,
+//the current directory is tracked by pdwfs as these directories do not exist on disk
+//export Chdir
+func Chdir(dirname string) int {
+	pdwfs.lock.Lock()
+	defer pdwfs.lock.Unlock()
+	path, err := redisfs.AbsPath(dirname)
+	check(err)
+	return chdir(path)
+}
+
+//Fchdir implements fchdir libc call for the directories of the mount points, cf. Chdir
+//export Fchdir
+func Fchdir(fd int) int {
+	pdwfs.lock.Lock()
+	defer pdwfs.lock.Unlock()
+	file, err := pdwfs.getFileFromFd(fd)
+	if err != nil {
+		setErrno(C.EBADF)
+		return -1
+	}
+	return chdir((*file).Name())
+}
+
+func chdir(path string) int {
+	mount, err := pdwfs.getMount(path)
+	check(err)
+
+	fi, err := mount.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			setErrno(C.ENOENT)
+		} else if e, ok := err.(*os.PathError); ok && e.Err == redisfs.ErrParentDirNotExist {
+			setErrno(C.ENOENT)
+		} else if errno, ok := resolveErrno(err); ok {
+			setErrno(errno)
+		} else {
+			panic(fmt.Sprintf("unhandled %T in Chdir: %s", err, err))
+		}
+		return -1
+	}
+	if !fi.IsDir() {
+		setErrno(C.ENOTDIR)
+		return -1
+	}
+	redisfs.SetWorkDir(path)
+	return 0
+}
+
+//ExitWorkDir is called once the process changed directory outside of the mount points with the libc
+//export ExitWorkDir
+func ExitWorkDir() {
+	redisfs.SetWorkDir("")
+}
+
+//Getcwd copies in buf the null-terminated current directory if inside a mount point and returns its length,
+//it returns 0 if the current directory is not in a mount point (the libc call applies)
+//export Getcwd
+func Getcwd(buf []byte) int {
+	dir := redisfs.WorkDir()
+	if dir == "" {
+		return 0
+	}
+	if len(dir)+1 > len(buf) {
+		setErrno(C.ERANGE)
+		return -1
+	}
+	return copy(buf, dir+"\000") - 1
+}
+
+// Ftruncate implements ftruncate libc call
+//export Ftruncate
+func Ftruncate(fd int, length int64) int {
+	file, err := pdwfs.lookupFd(fd)
+	check(err)
+
+	err = (*file).Truncate(length)
+	if err != nil {
+		if err == redisfs.ErrNoSpace {
+			setErrno(C.ENOSPC)
+		} else if err == redisfs.ErrQuotaExceeded {
+			setErrno(C.EDQUOT)
+		} else if err == redisfs.ErrNegativeTruncateSize || err == redisfs.ErrReadOnly || err == redisfs.ErrIsDirectory {
+			setErrno(C.EINVAL)
+		} else {
+			check(err) // no known conversion to errno, just panic if err != nil
+		}
+		return -1
+	}
+	return 0
+}
+
+//Truncate implements truncate libc call
+//export Truncate
+func Truncate(filename string, length int64) int {
+	pdwfs.lock.Lock()
+	defer pdwfs.lock.Unlock()
+	mount, err := pdwfs.getMount(filename)
+	check(err)
+
+	err = mount.Truncate(filename, length)
+	if err != nil {
+		if os.IsNotExist(err) {
+			setErrno(C.ENOENT)
+		} else if e, ok := err.(*os.PathError); ok && e.Err == redisfs.ErrParentDirNotExist {
+			setErrno(C.ENOENT)
+		} else if e, ok := err.(*os.PathError); ok && e.Err == redisfs.ErrIsDirectory {
+			setErrno(C.EISDIR)
+		} else if e, ok := err.(*os.PathError); ok && e.Err == redisfs.ErrNegativeTruncateSize {
+			setErrno(C.EINVAL)
+		} else if e, ok := err.(*os.PathError); ok && e.Err == redisfs.ErrNoSpace {
+			setErrno(C.ENOSPC)
+		} else if e, ok := err.(*os.PathError); ok && e.Err == redisfs.ErrQuotaExceeded {
+			setErrno(C.EDQUOT)
+		} else if e, ok := err.(*os.PathError); ok && e.Err == redisfs.ErrReadOnlyFS {
+			setErrno(C.EROFS)
+		} else if e, ok := err.(*os.PathError); ok && e.Err == redisfs.ErrTimeout {
+			setErrno(C.ETIMEDOUT)
+		} else if errno, ok := resolveErrno(err); ok {
+			setErrno(errno)
+		} else {
+			panic(fmt.Sprintf("unhandled %T in Truncate: %s", err, err))
+		}
+		return -1
+	}
+	return 0
+}
+
+//Fallocate implements fallocate and posix_fallocate libc calls (mode 0),
+//the FALLOC_FL_KEEP_SIZE and FALLOC_FL_PUNCH_HOLE modes are supported
+//export Fallocate
+func Fallocate(fd, mode int, offset, length int64) int {
+	file, err := pdwfs.lookupFd(fd)
+	check(err)
+
+	err = (*file).Fallocate(mode, offset, length)
+	if err != nil {
+		if err == redisfs.ErrNoSpace {
+			setErrno(C.ENOSPC)
+		} else if err == redisfs.ErrQuotaExceeded {
+			setErrno(C.EDQUOT)
+		} else if err == redisfs.ErrInvalidRange {
+			setErrno(C.EINVAL)
+		} else if err == redisfs.ErrAllocateMode {
+			setErrno(C.EOPNOTSUPP)
+		} else if err == redisfs.ErrReadOnly {
+			setErrno(C.EBADF)
+		} else if err == redisfs.ErrIsDirectory {
+			setErrno(C.EISDIR)
+		} else {
+			check(err)
+		}
+		return -1
+	}
+	return 0
+}
+
+// resolves a lock request on fd into an absolute byte range, 'start' being relative to 'whence'
+// and a negative length locking the bytes before 'start'
+func lockRange(fd, whence int, start, length int64) (string, *redisfs.RedisFS, redisfs.FileLock) {
+	pdwfs.lock.Lock()
+	defer pdwfs.lock.Unlock()
+	f, ok := pdwfs.fdFileMap[fd]
+	if !ok {
+		panic(errInvalidFd)
+	}
+	file := &f.file
+	name := (*file).Name()
+	mount, err := pdwfs.getMount(name)
+	check(err)
+
+	switch whence {
+	case io.SeekCurrent:
+		pos, err := (*file).Seek(0, io.SeekCurrent)
+		check(err)
+		start += pos
+	case io.SeekEnd:
+		fi, err := mount.Stat(name)
+		check(err)
+		start += fi.Size()
+	}
+	if length < 0 {
+		start += length
+		length = -length
+	}
+	return name, mount, redisfs.FileLock{Start: start, Len: length, Owner: redisfs.NewLockOwner(f.fd)}
+}
+
+// sets an advisory lock, the global lock is not held while waiting for conflicting locks to be released
+func setLock(fd int, mount *redisfs.RedisFS, name string, lock redisfs.FileLock, wait bool) int {
+	err := mount.Lock(name, lock, wait)
+	if err != nil {
+		if err == redisfs.ErrLocked {
+			setErrno(C.EAGAIN)
+		} else {
+			panic(fmt.Sprintf("unhandled %T in setLock: %s", err, err))
+		}
+		return -1
+	}
+	if lock.Type != redisfs.LockNone {
+		pdwfs.lock.Lock()
+		if lock.Owner.Fd == redisfs.ProcessLockFd {
+			pdwfs.recordLocked[name] = true
+		} else if f, ok := pdwfs.fdFileMap[fd]; ok {
+			f.locked = true
+		}
+		pdwfs.lock.Unlock()
+	}
+	return 0
+}
+
+//Flock implements flock libc call, flock locks are whole-file locks shared with fcntl locks
+//export Flock
+func Flock(fd, operation int) int {
+	name, mount, lock := lockRange(fd, io.SeekStart, 0, 0)
+	switch operation &^ C.LOCK_NB {
+	case C.LOCK_SH:
+		lock.Type = redisfs.LockShared
+	case C.LOCK_EX:
+		lock.Type = redisfs.LockExclusive
+	case C.LOCK_UN:
+		lock.Type = redisfs.LockNone
+	default:
+		setErrno(C.EINVAL)
+		return -1
+	}
+	return setLock(fd, mount, name, lock, operation&C.LOCK_NB == 0)
+}
+
+//Fcntl implements the F_GETLK, F_SETLK and F_SETLKW commands of fcntl libc call,
+//fcntl locks are owned by the process whatever the fd they are taken through
+//export Fcntl
+func Fcntl(fd, cmd int, flock *C.struct_flock) int {
+	name, mount, lock := lockRange(fd, int(flock.l_whence), int64(flock.l_start), int64(flock.l_len))
+	lock.Owner = redisfs.NewProcessLockOwner()
+	if lock.Start < 0 {
+		setErrno(C.EINVAL)
+		return -1
+	}
+	switch flock.l_type {
+	case C.F_RDLCK:
+		lock.Type = redisfs.LockShared
+	case C.F_WRLCK:
+		lock.Type = redisfs.LockExclusive
+	case C.F_UNLCK:
+		lock.Type = redisfs.LockNone
+	default:
+		setErrno(C.EINVAL)
+		return -1
+	}
+
+	switch cmd {
+	case C.F_GETLK:
+		conflict, err := mount.TestLock(name, lock)
+		check(err)
+		if conflict == nil {
+			flock.l_type = C.F_UNLCK
+			return 0
+		}
+		flock.l_type = C.F_RDLCK
+		if conflict.Type == redisfs.LockExclusive {
+			flock.l_type = C.F_WRLCK
+		}
+		flock.l_whence = C.SEEK_SET
+		flock.l_start = C.__off_t(conflict.Start)
+		flock.l_len = C.__off_t(conflict.Len)
+		flock.l_pid = C.__pid_t(conflict.Owner.Pid)
+		return 0
+	case C.F_SETLK, C.F_SETLKW:
+		return setLock(fd, mount, name, lock, cmd == C.F_SETLKW)
+	default:
+		panic(fmt.Sprintf("fcntl command %d not implemented", cmd))
+	}
+}
+
+//Lockf implements lockf libc call, locking 'length' bytes from the current position (0 up to the end of file)
+//export Lockf
+func Lockf(fd, cmd int, length int64) int {
+	name, mount, lock := lockRange(fd, io.SeekCurrent, 0, length)
+	lock.Owner = redisfs.NewProcessLockOwner()
+	if lock.Start < 0 {
+		setErrno(C.EINVAL)
+		return -1
+	}
+	lock.Type = redisfs.LockExclusive
+	switch cmd {
+	case C.F_LOCK, C.F_TLOCK:
+		return setLock(fd, mount, name, lock, cmd == C.F_LOCK)
+	case C.F_ULOCK:
+		lock.Type = redisfs.LockNone
+		return setLock(fd, mount, name, lock, false)
+	case C.F_TEST:
+		conflict, err := mount.TestLock(name, lock)
+		check(err)
+		if conflict != nil {
+			setErrno(C.EACCES)
+			return -1
+		}
+		return 0
+	default:
+		setErrno(C.EINVAL)
+		return -1
+	}
+}
+
+// preferred I/O block size reported by stat
+const statBlockSize = 4096
+
+// returns the description of a file of a mount point, sets errno and returns nil if it cannot be described
+func lookupStat(filename string, follow bool) os.FileInfo {
+	mount, err := pdwfs.getMount(filename)
+	check(err)
+
+	var inode os.FileInfo
+	if follow {
+		inode, err = mount.Stat(filename)
+	} else {
+		inode, err = mount.Lstat(filename)
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			setErrno(C.ENOENT)
+		} else if e, ok := err.(*os.PathError); ok && e.Err == redisfs.ErrParentDirNotExist {
+			setErrno(C.ENOENT)
+		} else if errno, ok := resolveErrno(err); ok {
+			setErrno(errno)
+		} else {
+			panic(fmt.Sprintf("unhandled %T in stat: %s", err, err))
+		}
+		return nil
+	}
+	return inode
+}
+
+// returns the st_mode of a file: its type and permissions
+func statMode(inode os.FileInfo) uint32 {
+	mode := uint32(inode.Mode().Perm())
+	if inode.IsDir() {
+		return mode | C.__S_IFDIR
+	} else if inode.Mode()&os.ModeSymlink != 0 {
+		return mode | C.__S_IFLNK
+	}
+	return mode | C.__S_IFREG
+}
+
+// returns the st_nlink of a file, files have no hard links and subdirectories are not counted
+func statNlink(inode os.FileInfo) uint64 {
+	if inode.IsDir() {
+		return 2
+	}
+	return 1
+}
+
+// returns the number of 512-byte blocks allocated to a file
+func statBlocks(inode os.FileInfo) int64 {
+	return (inode.Size() + 511) / 512
+}
+
+func stat(filename string, stats *C.struct_stat, follow bool) int {
+	inode := lookupStat(filename, follow)
+	if inode == nil {
+		return -1
+	}
+	// files are owned by the user of the process, times are not tracked and reported as the current time
+	mtime := inode.ModTime()
+	*stats = C.struct_stat{}
+	stats.st_mode = C.__mode_t(statMode(inode))
+	stats.st_nlink = C.__nlink_t(statNlink(inode))
+	stats.st_uid = C.__uid_t(os.Getuid())
+	stats.st_gid = C.__gid_t(os.Getgid())
+	stats.st_size = C.long(inode.Size()) // total file size in bytes
+	stats.st_blksize = C.__blksize_t(statBlockSize)
+	stats.st_blocks = C.__blkcnt_t(statBlocks(inode))
+	stats.st_atim.tv_sec = C.__time_t(mtime.Unix())
+	stats.st_atim.tv_nsec = C.__syscall_slong_t(mtime.Nanosecond())
+	stats.st_mtim = stats.st_atim
+	stats.st_ctim = stats.st_atim
+	return 0
+}
+
+//Stat implements part of __xstat libc call
+//export Stat
+func Stat(filename string, stats *C.struct_stat) int {
+	pdwfs.lock.Lock()
+	defer pdwfs.lock.Unlock()
+	return stat(filename, stats, true)
+}
+
+func stat64(filename string, stats *C.struct_stat64, follow bool) int {
+	inode := lookupStat(filename, follow)
+	if inode == nil {
+		return -1
+	}
+	mtime := inode.ModTime()
+	*stats = C.struct_stat64{}
+	stats.st_mode = C.__mode_t(statMode(inode))
+	stats.st_nlink = C.__nlink_t(statNlink(inode))
+	stats.st_uid = C.__uid_t(os.Getuid())
+	stats.st_gid = C.__gid_t(os.Getgid())
+	stats.st_size = C.long(inode.Size()) // total file size in bytes
+	stats.st_blksize = C.__blksize_t(statBlockSize)
+	stats.st_blocks = C.__blkcnt64_t(statBlocks(inode))
+	stats.st_atim.tv_sec = C.__time_t(mtime.Unix())
+	stats.st_atim.tv_nsec = C.__syscall_slong_t(mtime.Nanosecond())
+	stats.st_mtim = stats.st_atim
+	stats.st_ctim = stats.st_atim
+	return 0
+}
+
+//Stat64 implements part of __stat64 libc call
+//export Stat64
+func Stat64(filename string, stats *C.struct_stat64) int {
+	pdwfs.lock.Lock()
+	defer pdwfs.lock.Unlock()
+	return stat64(filename, stats, true)
+}
+
+//Fstat implements part of __fxstat libc call, cf. Stat
+//export Fstat
+func Fstat(fd int, stats *C.struct_stat) int {
+	pdwfs.lock.Lock()
+	defer pdwfs.lock.Unlock()
+	file, err := pdwfs.getFileFromFd(fd)
+	check(err)
+	return stat((*file).Name(), stats, true)
 }
 
 //Fstat64 implements part of __fxstat64 libc call, cf. Stat
@@ -621,80 +1368,437 @@ func Fstat64(fd int, stats *C.struct_stat64) int {
 	defer pdwfs.lock.Unlock()
 	file, err := pdwfs.getFileFromFd(fd)
 	check(err)
-	return stat64((*file).Name(), stats)
+	return stat64((*file).Name(), stats, true)
 }
 
-//Lstat implements part of __lxstat libc call (symlink are not supported so it's an alias to Stat)
+//Lstat implements part of __lxstat libc call, cf. Stat (symbolic links are not followed)
 //export Lstat
 func Lstat(filename string, stats *C.struct_stat) int {
-	return Stat(filename, stats)
+	pdwfs.lock.Lock()
+	defer pdwfs.lock.Unlock()
+	return stat(filename, stats, false)
 }
 
-//Lstat64 implements part of __lxstat64 libc call (symlink are not supported so it's an alias to Stat)
+//Lstat64 implements part of __lxstat64 libc call, cf. Lstat
 //export Lstat64
 func Lstat64(filename string, stats *C.struct_stat64) int {
-	return Stat64(filename, stats)
+	pdwfs.lock.Lock()
+	defer pdwfs.lock.Unlock()
+	return stat64(filename, stats, false)
+}
+
+//Fstatat implements part of __fxstatat and fstatat libc calls
+//export Fstatat
+func Fstatat(dirfd int, filename string, stats *C.struct_stat, flags int) int {
+	pdwfs.lock.Lock()
+	defer pdwfs.lock.Unlock()
+	path, ok := resolveAt(dirfd, filename, flags)
+	if !ok {
+		return -1
+	}
+	return stat(path, stats, flags&C.AT_SYMLINK_NOFOLLOW == 0)
+}
+
+//Fstatat64 implements part of __fxstatat64 and fstatat64 libc calls, cf. Fstatat
+//export Fstatat64
+func Fstatat64(dirfd int, filename string, stats *C.struct_stat64, flags int) int {
+	pdwfs.lock.Lock()
+	defer pdwfs.lock.Unlock()
+	path, ok := resolveAt(dirfd, filename, flags)
+	if !ok {
+		return -1
+	}
+	return stat64(path, stats, flags&C.AT_SYMLINK_NOFOLLOW == 0)
 }
 
-func statfs() syscall.Statfs_t {
-	return syscall.Statfs_t{
-		Type:   0xEF53, // ext2 filesystem
-		Bsize:  1,      // block size
-		Blocks: 1,      // number of blocks
-		Bfree:  1,      // total free blocks
-		Bavail: 1,      // free blocks available to user (unpriviledged)
-		Files:  1,      // total file nodes in fs
-		Ffree:  1,      // free file nodes in fs
+//Statx implements statx libc call, all the basic fields but the inode number are returned
+//export Statx
+func Statx(dirfd int, filename string, flags, mask int, statxbuf *C.struct_statx) int {
+	pdwfs.lock.Lock()
+	defer pdwfs.lock.Unlock()
+	path, ok := resolveAt(dirfd, filename, flags)
+	if !ok {
+		return -1
+	}
+	inode := lookupStat(path, flags&C.AT_SYMLINK_NOFOLLOW == 0)
+	if inode == nil {
+		return -1
 	}
+	mtime := inode.ModTime()
+	*statxbuf = C.struct_statx{}
+	statxbuf.stx_mask = C.STATX_TYPE | C.STATX_MODE | C.STATX_NLINK | C.STATX_UID | C.STATX_GID |
+		C.STATX_ATIME | C.STATX_MTIME | C.STATX_CTIME | C.STATX_SIZE | C.STATX_BLOCKS
+	statxbuf.stx_blksize = C.__u32(statBlockSize)
+	statxbuf.stx_nlink = C.__u32(statNlink(inode))
+	statxbuf.stx_uid = C.__u32(os.Getuid())
+	statxbuf.stx_gid = C.__u32(os.Getgid())
+	statxbuf.stx_mode = C.__u16(statMode(inode))
+	statxbuf.stx_size = C.__u64(inode.Size())
+	statxbuf.stx_blocks = C.__u64(statBlocks(inode))
+	statxbuf.stx_mtime.tv_sec = C.__s64(mtime.Unix())
+	statxbuf.stx_mtime.tv_nsec = C.__u32(mtime.Nanosecond())
+	statxbuf.stx_atime = statxbuf.stx_mtime
+	statxbuf.stx_ctime = statxbuf.stx_mtime
+	return 0
+}
+
+// returns the storage capacity of the mount point managing 'filename'
+func statfs(filename string) (redisfs.FsStats, error) {
+	mount, err := pdwfs.getMount(filename)
+	check(err)
+	return mount.Statfs()
 }
 
 //Statfs implements part of statfs libc call
 //export Statfs
 func Statfs(filename string, fsstats *C.struct_statfs) int {
-	//FIXME: this information should be returned by the redisfs instance managing 'filename'
-	s := statfs()
-	fsstats.f_type = C.long(s.Type)      // fs type
-	fsstats.f_bsize = C.long(s.Bsize)    // block size
-	fsstats.f_blocks = C.ulong(s.Blocks) // number of blocks
-	fsstats.f_bfree = C.ulong(s.Bfree)   // total free blocks
-	fsstats.f_bavail = C.ulong(s.Bavail) // free blocks available to user (unpriviledged)
-	fsstats.f_files = C.ulong(s.Files)   // total file nodes in fs
-	fsstats.f_ffree = C.ulong(s.Ffree)   // free file nodes in fs
+	pdwfs.lock.Lock()
+	defer pdwfs.lock.Unlock()
+	s, err := statfs(filename)
+	if err != nil {
+		setErrno(C.EIO)
+		return -1
+	}
+	fsstats.f_type = C.long(0xEF53)           // fs type (ext2 filesystem)
+	fsstats.f_bsize = C.long(s.BlockSize)     // block size
+	fsstats.f_blocks = C.ulong(s.Blocks)      // number of blocks
+	fsstats.f_bfree = C.ulong(s.BlocksFree)   // total free blocks
+	fsstats.f_bavail = C.ulong(s.BlocksAvail) // free blocks available to user (unpriviledged)
+	fsstats.f_files = C.ulong(s.Files)        // total file nodes in fs
+	fsstats.f_ffree = C.ulong(s.FilesFree)    // free file nodes in fs
 	return 0
 }
 
 //Statfs64 implements part of statfs64 libc call
 //export Statfs64
 func Statfs64(filename string, fsstats *C.struct_statfs64) int {
-	//FIXME: this information should be returned by the redisfs instance managing 'filename'
-	s := statfs()
-	fsstats.f_type = C.long(s.Type)      // fs type
-	fsstats.f_bsize = C.long(s.Bsize)    // block size
-	fsstats.f_blocks = C.ulong(s.Blocks) // number of blocks
-	fsstats.f_bfree = C.ulong(s.Bfree)   // total free blocks
-	fsstats.f_bavail = C.ulong(s.Bavail) // free blocks available to user (unpriviledged)
-	fsstats.f_files = C.ulong(s.Files)   // total file nodes in fs
-	fsstats.f_ffree = C.ulong(s.Ffree)   // free file nodes in fs
+	pdwfs.lock.Lock()
+	defer pdwfs.lock.Unlock()
+	s, err := statfs(filename)
+	if err != nil {
+		setErrno(C.EIO)
+		return -1
+	}
+	fsstats.f_type = C.long(0xEF53)           // fs type (ext2 filesystem)
+	fsstats.f_bsize = C.long(s.BlockSize)     // block size
+	fsstats.f_blocks = C.ulong(s.Blocks)      // number of blocks
+	fsstats.f_bfree = C.ulong(s.BlocksFree)   // total free blocks
+	fsstats.f_bavail = C.ulong(s.BlocksAvail) // free blocks available to user (unpriviledged)
+	fsstats.f_files = C.ulong(s.Files)        // total file nodes in fs
+	fsstats.f_ffree = C.ulong(s.FilesFree)    // free file nodes in fs
 	return 0
 }
 
 //Statvfs implements part of statvfs libc call
 //export Statvfs
 func Statvfs(filename string, vfsstats *C.struct_statvfs) int {
-	//FIXME: this information should be returned by the redisfs instance managing 'filename'
-	s := statfs()
-	vfsstats.f_bsize = C.ulong(s.Bsize) // block size
+	pdwfs.lock.Lock()
+	defer pdwfs.lock.Unlock()
+	s, err := statfs(filename)
+	if err != nil {
+		setErrno(C.EIO)
+		return -1
+	}
 	//NOTE: statvfs is used by openmpi to get the fs page size (bsize) in mpool_hugepage_component.c
+	vfsstats.f_bsize = C.ulong(s.BlockSize)    // block size
+	vfsstats.f_frsize = C.ulong(s.BlockSize)   // fragment size
+	vfsstats.f_blocks = C.ulong(s.Blocks)      // number of blocks (in f_frsize units)
+	vfsstats.f_bfree = C.ulong(s.BlocksFree)   // total free blocks
+	vfsstats.f_bavail = C.ulong(s.BlocksAvail) // free blocks available to user (unpriviledged)
+	vfsstats.f_files = C.ulong(s.Files)        // total file nodes in fs
+	vfsstats.f_ffree = C.ulong(s.FilesFree)    // free file nodes in fs
+	vfsstats.f_favail = C.ulong(s.FilesFree)   // free file nodes available to user (unpriviledged)
 	return 0
 }
 
 //Statvfs64 implements part of statvfs libc call
 //export Statvfs64
 func Statvfs64(filename string, vfsstats *C.struct_statvfs64) int {
-	//FIXME: this information should be returned by the redisfs instance managing 'filename'
-	s := statfs()
-	vfsstats.f_bsize = C.ulong(s.Bsize) // block size
+	pdwfs.lock.Lock()
+	defer pdwfs.lock.Unlock()
+	s, err := statfs(filename)
+	if err != nil {
+		setErrno(C.EIO)
+		return -1
+	}
 	//NOTE: statvfs is used by openmpi to get the fs page size (bsize) in mpool_hugepage_component.c
+	vfsstats.f_bsize = C.ulong(s.BlockSize)    // block size
+	vfsstats.f_frsize = C.ulong(s.BlockSize)   // fragment size
+	vfsstats.f_blocks = C.ulong(s.Blocks)      // number of blocks (in f_frsize units)
+	vfsstats.f_bfree = C.ulong(s.BlocksFree)   // total free blocks
+	vfsstats.f_bavail = C.ulong(s.BlocksAvail) // free blocks available to user (unpriviledged)
+	vfsstats.f_files = C.ulong(s.Files)        // total file nodes in fs
+	vfsstats.f_ffree = C.ulong(s.FilesFree)    // free file nodes in fs
+	vfsstats.f_favail = C.ulong(s.FilesFree)   // free file nodes available to user (unpriviledged)
+	return 0
+}
+
+// sets errno from the error of an extended attribute operation
+func setXattrErrno(op string, err error) {
+	if os.IsNotExist(err) {
+		setErrno(C.ENOENT)
+	} else if e, ok := err.(*os.PathError); ok && e.Err == redisfs.ErrParentDirNotExist {
+		setErrno(C.ENOENT)
+	} else if e, ok := err.(*os.PathError); ok && e.Err == redisfs.ErrNoAttr {
+		setErrno(C.ENODATA)
+	} else if e, ok := err.(*os.PathError); ok && e.Err == redisfs.ErrAttrExists {
+		setErrno(C.EEXIST)
+	} else if e, ok := err.(*os.PathError); ok && e.Err == redisfs.ErrAttrNotSupported {
+		setErrno(C.EOPNOTSUPP)
+	} else if e, ok := err.(*os.PathError); ok && e.Err == redisfs.ErrAttrNameTooLong {
+		setErrno(C.ERANGE)
+	} else if e, ok := err.(*os.PathError); ok && e.Err == redisfs.ErrAttrTooBig {
+		setErrno(C.E2BIG)
+	} else if e, ok := err.(*os.PathError); ok && e.Err == redisfs.ErrReadOnlyFS {
+		setErrno(C.EROFS)
+	} else if e, ok := err.(*os.PathError); ok && e.Err == redisfs.ErrNoSpace {
+		setErrno(C.ENOSPC)
+	} else if errno, ok := resolveErrno(err); ok {
+		setErrno(errno)
+	} else {
+		panic(fmt.Sprintf("unhandled %T in %s: %s", err, op, err))
+	}
+}
+
+// copies the value of the attribute in 'value' and returns its size, an empty 'value' only returns the size
+func getxattr(filename, attr string, value []byte) int {
+	mount, err := pdwfs.getMount(filename)
+	check(err)
+
+	v, err := mount.Getxattr(filename, attr)
+	if err != nil {
+		setXattrErrno("Getxattr", err)
+		return -1
+	}
+	if len(value) == 0 {
+		return len(v)
+	}
+	if len(v) > len(value) {
+		setErrno(C.ERANGE)
+		return -1
+	}
+	return copy(value, v)
+}
+
+//Getxattr implements getxattr libc call
+//export Getxattr
+func Getxattr(filename, attr string, value []byte) int {
+	pdwfs.lock.Lock()
+	defer pdwfs.lock.Unlock()
+	return getxattr(filename, attr, value)
+}
+
+//Fgetxattr implements fgetxattr libc call
+//export Fgetxattr
+func Fgetxattr(fd int, attr string, value []byte) int {
+	pdwfs.lock.Lock()
+	defer pdwfs.lock.Unlock()
+	file, err := pdwfs.getFileFromFd(fd)
+	check(err)
+	return getxattr((*file).Name(), attr, value)
+}
+
+func setxattr(filename, attr string, value []byte, flags int) int {
+	mount, err := pdwfs.getMount(filename)
+	check(err)
+
+	if flags&^(C.XATTR_CREATE|C.XATTR_REPLACE) != 0 || flags == C.XATTR_CREATE|C.XATTR_REPLACE {
+		setErrno(C.EINVAL)
+		return -1
+	}
+	if err = mount.Setxattr(filename, attr, value, flags); err != nil {
+		setXattrErrno("Setxattr", err)
+		return -1
+	}
+	return 0
+}
+
+//Setxattr implements setxattr libc call
+//export Setxattr
+func Setxattr(filename, attr string, value []byte, flags int) int {
+	pdwfs.lock.Lock()
+	defer pdwfs.lock.Unlock()
+	return setxattr(filename, attr, value, flags)
+}
+
+//Fsetxattr implements fsetxattr libc call
+//export Fsetxattr
+func Fsetxattr(fd int, attr string, value []byte, flags int) int {
+	pdwfs.lock.Lock()
+	defer pdwfs.lock.Unlock()
+	file, err := pdwfs.getFileFromFd(fd)
+	check(err)
+	return setxattr((*file).Name(), attr, value, flags)
+}
+
+// copies in 'list' the null-terminated names of the attributes and returns the size of the list,
+// an empty 'list' only returns the size
+func listxattr(filename string, list []byte) int {
+	mount, err := pdwfs.getMount(filename)
+	check(err)
+
+	attrs, err := mount.Listxattr(filename)
+	if err != nil {
+		setXattrErrno("Listxattr", err)
+		return -1
+	}
+	names := ""
+	for _, attr := range attrs {
+		names += attr + "\000"
+	}
+	if len(list) == 0 {
+		return len(names)
+	}
+	if len(names) > len(list) {
+		setErrno(C.ERANGE)
+		return -1
+	}
+	return copy(list, names)
+}
+
+//Listxattr implements listxattr libc call
+//export Listxattr
+func Listxattr(filename string, list []byte) int {
+	pdwfs.lock.Lock()
+	defer pdwfs.lock.Unlock()
+	return listxattr(filename, list)
+}
+
+//Flistxattr implements flistxattr libc call
+//export Flistxattr
+func Flistxattr(fd int, list []byte) int {
+	pdwfs.lock.Lock()
+	defer pdwfs.lock.Unlock()
+	file, err := pdwfs.getFileFromFd(fd)
+	check(err)
+	return listxattr((*file).Name(), list)
+}
+
+func removexattr(filename, attr string) int {
+	mount, err := pdwfs.getMount(filename)
+	check(err)
+
+	if err = mount.Removexattr(filename, attr); err != nil {
+		setXattrErrno("Removexattr", err)
+		return -1
+	}
+	return 0
+}
+
+//Removexattr implements removexattr libc call
+//export Removexattr
+func Removexattr(filename, attr string) int {
+	pdwfs.lock.Lock()
+	defer pdwfs.lock.Unlock()
+	return removexattr(filename, attr)
+}
+
+//Fremovexattr implements fremovexattr libc call
+//export Fremovexattr
+func Fremovexattr(fd int, attr string) int {
+	pdwfs.lock.Lock()
+	defer pdwfs.lock.Unlock()
+	file, err := pdwfs.getFileFromFd(fd)
+	check(err)
+	return removexattr((*file).Name(), attr)
+}
+
+// sets errno from the error of the write back of a memory mapping
+func setSyncErrno(op string, err error) {
+	if err == redisfs.ErrNoSpace {
+		setErrno(C.ENOSPC)
+	} else if err == redisfs.ErrQuotaExceeded {
+		setErrno(C.EDQUOT)
+	} else {
+		panic(fmt.Sprintf("unhandled %T in %s: %s", err, op, err))
+	}
+}
+
+//Mmap loads a managed file in buf, the anonymous memory mapped by the C layer in place of the file,
+//shared mappings of files opened for reading and writing are written back on msync and munmap
+//export Mmap
+func Mmap(fd int, buf []byte, off int64, prot, flags int) int {
+	pdwfs.lock.Lock()
+	defer pdwfs.lock.Unlock()
+	f, ok := pdwfs.fdFileMap[fd]
+	if !ok {
+		setErrno(C.EBADF)
+		return -1
+	}
+	shared := flags&C.MAP_SHARED != 0
+	access := f.flags & C.O_ACCMODE
+	if access == C.O_WRONLY || shared && prot&C.PROT_WRITE != 0 && access != C.O_RDWR {
+		setErrno(C.EACCES)
+		return -1
+	}
+	mount, err := pdwfs.getMount(f.file.Name())
+	check(err)
+
+	m, err := mount.Map(f.file, buf, off, os.Getpagesize())
+	if err != nil {
+		if e, ok := err.(*os.PathError); ok && e.Err == redisfs.ErrIsDirectory {
+			setErrno(C.ENODEV)
+		} else if e, ok := err.(*os.PathError); ok && e.Err == redisfs.ErrInvalidRange {
+			setErrno(C.EINVAL)
+		} else {
+			panic(fmt.Sprintf("unhandled %T in Mmap: %s", err, err))
+		}
+		return -1
+	}
+	// private mappings and shared mappings of read-only files are never written back
+	if shared && access == C.O_RDWR {
+		f.refs++ // the file stays open until unmapped
+		pdwfs.mappings[addressOf(buf)] = &mapping{m, f}
+	}
+	return 0
+}
+
+//Msync writes back the modified pages of the shared mappings overlapping the memory range of buf
+//export Msync
+func Msync(buf []byte) int {
+	pdwfs.lock.Lock()
+	defer pdwfs.lock.Unlock()
+	start := addressOf(buf)
+	end := start + uintptr(len(buf))
+	for _, addr := range pdwfs.overlappingMappings(start, end) {
+		m := pdwfs.mappings[addr]
+		if err := m.Sync(overlap(addr, m, start, end)); err != nil {
+			setSyncErrno("Msync", err)
+			return -1
+		}
+	}
+	return 0
+}
+
+//Munmap writes back the modified pages of the shared mappings overlapping the memory range of buf
+//and forgets about them, the pages outside of the range remain mapped
+//export Munmap
+func Munmap(buf []byte) int {
+	pdwfs.lock.Lock()
+	defer pdwfs.lock.Unlock()
+	start := addressOf(buf)
+	end := start + uintptr(len(buf))
+	addrs := pdwfs.overlappingMappings(start, end)
+	for _, addr := range addrs {
+		m := pdwfs.mappings[addr]
+		if err := m.Sync(overlap(addr, m, start, end)); err != nil {
+			setSyncErrno("Munmap", err)
+			return -1
+		}
+	}
+	for _, addr := range addrs {
+		m := pdwfs.mappings[addr]
+		delete(pdwfs.mappings, addr)
+		if addr < start {
+			m.file.refs++
+			pdwfs.mappings[addr] = &mapping{m.Sub(0, int(start-addr)), m.file}
+		}
+		if limit := addr + uintptr(m.Len()); end < limit {
+			m.file.refs++
+			pdwfs.mappings[end] = &mapping{m.Sub(int(end-addr), m.Len()), m.file}
+		}
+		try(pdwfs.release(m.file))
+	}
 	return 0
 }
 
@@ -15,11 +15,16 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"sync"
+	"syscall"
 	"testing"
 
 	"github.com/cea-hpc/pdwfs/config"
+	"github.com/cea-hpc/pdwfs/redisfs"
 	"github.com/cea-hpc/pdwfs/util"
 )
 
@@ -80,3 +85,246 @@ func TestMultiMount(t *testing.T) {
 	util.Equals(t, "The Force is strong with this one.\n", string(data), "Bad quote !")
 
 }
+
+func TestDupFd(t *testing.T) {
+	redis, redisConf := util.InitRedisTestServer()
+	defer redis.Stop()
+
+	conf := config.New()
+	conf.Redis = redisConf
+	conf.Mounts["/rebels/leia"] = &config.Mount{
+		Path:       "/rebels/leia",
+		StripeSize: 1024,
+	}
+	pdwfs := NewPdwFS(conf)
+	defer pdwfs.finalize()
+
+	mount, err := pdwfs.getMount("/rebels/leia/message")
+	util.Ok(t, err)
+	f, err := mount.OpenFile("/rebels/leia/message", os.O_WRONLY|os.O_CREATE, 0600)
+	util.Ok(t, err)
+	util.Ok(t, pdwfs.registerFile(3, os.O_WRONLY, &f))
+	util.Ok(t, pdwfs.dupFd(3, 4))
+	util.Equals(t, errFdInUse, pdwfs.dupFd(3, 4), "fd already used")
+
+	// both fds share the same offset
+	file, err := pdwfs.getFileFromFd(3)
+	util.Ok(t, err)
+	_, err = (*file).Write([]byte("Help me, "))
+	util.Ok(t, err)
+	util.Ok(t, pdwfs.closeFd(3))
+	file, err = pdwfs.getFileFromFd(4)
+	util.Ok(t, err)
+	_, err = (*file).Write([]byte("Obi-Wan Kenobi.\n"))
+	util.Ok(t, err)
+	util.Ok(t, pdwfs.closeFd(4))
+
+	data, err := readFile(pdwfs, "/rebels/leia/message")
+	util.Ok(t, err)
+	util.Equals(t, "Help me, Obi-Wan Kenobi.\n", string(data), "Bad message !")
+}
+
+// sets the pdwfs instance used by the exported functions with a mount point at 'path'
+func initPdwfs(redisConf *config.Redis, path string) {
+	conf := config.New()
+	conf.Redis = redisConf
+	conf.Mounts[path] = &config.Mount{
+		Path:       path,
+		StripeSize: 16,
+	}
+	pdwfs = NewPdwFS(conf)
+}
+
+func TestConcurrentIO(t *testing.T) {
+	redis, redisConf := util.InitRedisTestServer()
+	defer redis.Stop()
+	initPdwfs(redisConf, "/rebels/han")
+	defer pdwfs.finalize()
+
+	// threads write disjoint ranges of a file and read them back through the same fd
+	const fd, n, size = 3, 8, 40
+	util.Equals(t, fd, Open("/rebels/han/falcon", os.O_RDWR|os.O_CREATE, 0600, fd), "open failed")
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data := bytes.Repeat([]byte{byte('a' + i)}, size)
+			if Pwrite(fd, data, int64(i*size)) != size {
+				t.Errorf("pwrite %d failed", i)
+			}
+			if Pwritev(fd, [][]byte{data[:size/2], data[size/2:]}, int64((n+i)*size)) != size {
+				t.Errorf("pwritev %d failed", i)
+			}
+			buf := make([]byte, size)
+			if Pread(fd, buf, int64(i*size)) != size || !bytes.Equal(data, buf) {
+				t.Errorf("pread %d failed: %q", i, buf)
+			}
+			buf = make([]byte, size)
+			if Preadv(fd, [][]byte{buf[:size/2], buf[size/2:]}, int64((n+i)*size)) != size || !bytes.Equal(data, buf) {
+				t.Errorf("preadv %d failed: %q", i, buf)
+			}
+		}(i)
+	}
+	wg.Wait()
+	util.Equals(t, 0, Ftruncate(fd, n*size), "ftruncate failed")
+	util.Equals(t, 0, Close(fd), "close failed")
+
+	data, err := readFile(pdwfs, "/rebels/han/falcon")
+	util.Ok(t, err)
+	util.Equals(t, n*size, len(data), "wrong file size")
+	for i := 0; i < n; i++ {
+		util.Equals(t, string(bytes.Repeat([]byte{byte('a' + i)}, size)), string(data[i*size:(i+1)*size]),
+			fmt.Sprintf("wrong range %d", i))
+	}
+}
+
+func TestConcurrentSharedOffset(t *testing.T) {
+	redis, redisConf := util.InitRedisTestServer()
+	defer redis.Stop()
+	initPdwfs(redisConf, "/rebels/chewie")
+	defer pdwfs.finalize()
+
+	// threads sharing an fd write and read whole records, each I/O moves the offset past its own record
+	const fd, n, size = 3, 8, 40
+	util.Equals(t, fd, Open("/rebels/chewie/log", os.O_RDWR|os.O_CREATE, 0600, fd), "open failed")
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if Write(fd, bytes.Repeat([]byte{byte('a' + i)}, size)) != size {
+				t.Errorf("write %d failed", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+	util.Equals(t, int64(n*size), Lseek(fd, 0, os.SEEK_CUR), "wrong offset after writes")
+	util.Equals(t, int64(0), Lseek(fd, 0, os.SEEK_SET), "lseek failed")
+
+	records := make(chan string, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, size)
+			if Read(fd, buf) != size {
+				t.Error("read failed")
+			}
+			records <- string(buf)
+		}()
+	}
+	wg.Wait()
+	close(records)
+	util.Equals(t, int64(n*size), Lseek(fd, 0, os.SEEK_CUR), "wrong offset after reads")
+	util.Equals(t, 0, Close(fd), "close failed")
+
+	// every record is read once, none is torn
+	seen := map[string]bool{}
+	for record := range records {
+		seen[record] = true
+	}
+	for i := 0; i < n; i++ {
+		record := string(bytes.Repeat([]byte{byte('a' + i)}, size))
+		util.Assert(t, seen[record], "record %d not read", i)
+	}
+}
+
+func TestRecordLocks(t *testing.T) {
+	redis, redisConf := util.InitRedisTestServer()
+	defer redis.Stop()
+	initPdwfs(redisConf, "/rebels/lando")
+	defer pdwfs.finalize()
+
+	const tlock = 2 // F_TLOCK of lockf
+	name := "/rebels/lando/cloud-city"
+	util.Equals(t, 3, Open(name, os.O_RDWR|os.O_CREATE, 0600, 3), "open failed")
+	util.Equals(t, 4, Open(name, os.O_RDWR, 0, 4), "open failed")
+
+	// lockf locks are owned by the process, not by the open file description
+	util.Equals(t, 0, Lockf(3, tlock, 0), "lockf failed")
+	util.Equals(t, 0, Lockf(4, tlock, 0), "lockf through another fd of the process failed")
+	mount, err := pdwfs.getMount(name)
+	util.Ok(t, err)
+	other := redisfs.FileLock{Type: redisfs.LockExclusive, Owner: redisfs.LockOwner{Host: "bespin", Pid: 1, Fd: 3}}
+	conflict, err := mount.TestLock(name, other)
+	util.Ok(t, err)
+	util.Assert(t, conflict != nil, "another process should conflict with the lock")
+
+	// closing any fd of the file releases the locks of the process
+	util.Equals(t, 0, Close(4), "close failed")
+	conflict, err = mount.TestLock(name, other)
+	util.Ok(t, err)
+	util.Assert(t, conflict == nil, "locks should be released with the fd")
+	util.Equals(t, 0, Close(3), "close failed")
+}
+
+func TestAtCalls(t *testing.T) {
+	redis, redisConf := util.InitRedisTestServer()
+	defer redis.Stop()
+	initPdwfs(redisConf, "/rebels/chewie")
+	defer pdwfs.finalize()
+
+	// flags of <fcntl.h> and <sys/stat.h> (C is not available in tests)
+	const (
+		atFdcwd           = -100
+		atSymlinkNofollow = 0x100
+		atRemoveDir       = 0x200
+		atEmptyPath       = 0x1000
+		statxSize         = 0x200
+	)
+	dir := "/rebels/chewie/dir"
+	util.Equals(t, 0, Mkdirat(atFdcwd, dir, 0755), "mkdirat failed")
+	util.Equals(t, 3, Open(dir, os.O_RDONLY, 0, 3), "open of the directory failed")
+	util.Equals(t, 4, Openat(3, "file", os.O_WRONLY|os.O_CREATE, 0640, 4), "openat failed")
+	util.Equals(t, 4, Write(4, []byte("roar")), "write failed")
+	util.Equals(t, 0, Close(4), "close failed")
+	util.Equals(t, 0, Symlinkat("file", 3, "link"), "symlinkat failed")
+
+	// paths relative to a directory fd or to the current directory
+	path, ok := resolveAt(3, "file", 0)
+	util.Assert(t, ok && path == dir+"/file", "wrong path relative to dirfd: %s", path)
+	path, ok = resolveAt(3, "", atEmptyPath)
+	util.Assert(t, ok && path == dir, "wrong empty path: %s", path)
+	path, ok = resolveAt(3, "/abs/path", 0)
+	util.Assert(t, ok && path == "/abs/path", "absolute path should be kept: %s", path)
+	cwd, err := os.Getwd()
+	util.Ok(t, err)
+	path, ok = resolveAt(atFdcwd, "file", 0)
+	util.Assert(t, ok && path == cwd+"/file", "wrong path relative to the current directory: %s", path)
+	_, ok = resolveAt(3, "", 0)
+	util.Assert(t, !ok && int(GetErrno()) == int(syscall.ENOENT), "empty path should fail with ENOENT")
+	_, ok = resolveAt(99, "file", 0)
+	util.Assert(t, !ok && int(GetErrno()) == int(syscall.EBADF), "unknown dirfd should fail with EBADF")
+
+	var st _Ctype_struct_stat
+	util.Equals(t, 0, Fstatat(3, "file", &st, 0), "fstatat failed")
+	util.Equals(t, uint32(syscall.S_IFREG|0640), uint32(st.st_mode), "wrong mode")
+	util.Equals(t, int64(4), int64(st.st_size), "wrong size")
+	util.Equals(t, uint64(1), uint64(st.st_nlink), "wrong number of links")
+	util.Equals(t, os.Getuid(), int(st.st_uid), "wrong owner")
+	util.Equals(t, 0, Fstatat(atFdcwd, dir+"/link", &st, 0), "fstatat failed")
+	util.Equals(t, uint32(syscall.S_IFREG), uint32(st.st_mode)&syscall.S_IFMT, "link should be followed")
+	util.Equals(t, 0, Fstatat(3, "link", &st, atSymlinkNofollow), "fstatat failed")
+	util.Equals(t, uint32(syscall.S_IFLNK), uint32(st.st_mode)&syscall.S_IFMT, "link should not be followed")
+
+	var stx _Ctype_struct_statx
+	util.Equals(t, 0, Statx(3, "file", 0, 0, &stx), "statx failed")
+	util.Assert(t, uint32(stx.stx_mask)&statxSize != 0, "size should be in the mask")
+	util.Equals(t, uint16(syscall.S_IFREG|0640), uint16(stx.stx_mode), "wrong mode")
+	util.Equals(t, uint64(4), uint64(stx.stx_size), "wrong size")
+	util.Equals(t, uint64(1), uint64(stx.stx_blocks), "wrong number of blocks")
+	util.Equals(t, uint32(os.Getgid()), uint32(stx.stx_gid), "wrong group")
+	util.Equals(t, 0, Statx(3, "link", atSymlinkNofollow, 0, &stx), "statx failed")
+	util.Equals(t, uint16(syscall.S_IFLNK), uint16(stx.stx_mode)&syscall.S_IFMT, "link should not be followed")
+
+	util.Equals(t, 0, Unlinkat(3, "file", 0), "unlinkat failed")
+	util.Equals(t, -1, Fstatat(3, "file", &st, 0), "unlinked file should not exist")
+	util.Equals(t, int(syscall.ENOENT), int(GetErrno()), "wrong errno")
+	util.Equals(t, -1, Unlinkat(atFdcwd, dir, atRemoveDir), "non empty directory should not be removed")
+	util.Equals(t, int(syscall.ENOTEMPTY), int(GetErrno()), "wrong errno")
+	util.Equals(t, 0, Unlinkat(3, "link", 0), "unlinkat failed")
+	util.Equals(t, 0, Close(3), "close failed")
+	util.Equals(t, 0, Unlinkat(atFdcwd, dir, atRemoveDir), "unlinkat of the directory failed")
+	util.Equals(t, -1, Fstatat(atFdcwd, dir, &st, 0), "removed directory should not exist")
+}
@@ -0,0 +1,170 @@
+// Copyright 2019 CEA
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Atomic writes across stripes. A write spanning several stripes updates Redis instances independently
+// and a concurrent reader may see it partially applied. When enabled, writes spanning several stripes and
+// below a size limit are versioned in the hash "<content name>:writes", placed on the ring like the stripes:
+// the "gen" field counts the writes started on the content and each write in progress is recorded in the field
+// named after its generation with its byte range and the deadline of its lease, past which the writer is deemed dead
+// and the entry is dropped (see atomicWriteLease). Readers spanning several stripes read the hash before and after
+// reading the stripes and read again if an overlapping write was in progress or if any write started meanwhile,
+// so that they see a versioned write either whole or not at all.
+
+package redisfs
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/cea-hpc/pdwfs/redigo/redis"
+)
+
+const (
+	// a reader gives up waiting for a consistent read after this delay (e.g. the writer died in the middle of a write)
+	atomicReadTimeout = 10 * time.Second
+	atomicReadRetry   = time.Millisecond
+)
+
+// duration after which a write still recorded in progress is deemed abandoned by a dead writer,
+// readers drop it instead of waiting for it (much longer than any write up to the atomic write size)
+var atomicWriteLease = 2 * time.Second
+
+// returns the key of the hash versioning the writes of a content
+func writesKey(name string) string {
+	return name + ":writes"
+}
+
+// SetAtomicWriteSize sets the size in bytes up to which the writes spanning several stripes are seen
+// whole or not at all by readers (0 disables versioning)
+func (s *DataStore) SetAtomicWriteSize(size int64) {
+	s.atomicWriteSize = size
+}
+
+// returns true if the byte range [off, off+length[ spans several stripes
+func (s DataStore) spansStripes(off int64, length int) bool {
+	return length > 0 && off/s.stripeSize != (off+int64(length)-1)/s.stripeSize
+}
+
+// starts a new generation of writes and records the byte range ARGV[1] as written until the lease
+// of ARGV[3] milliseconds expires (in time of the Redis instance), returns the generation
+var beginWriteScript = redis.NewScript(1, `
+		redis.replicate_commands()
+		local now = redis.call("TIME")
+		local deadline = now[1] * 1000 + math.floor(now[2] / 1000) + tonumber(ARGV[3])
+		local gen = redis.call("HINCRBY", KEYS[1], "gen", 1)
+		redis.call("HSET", KEYS[1], gen, ARGV[1] .. ":" .. string.format("%d", deadline))
+		if tonumber(ARGV[2]) > 0 then
+			redis.call("EXPIRE", KEYS[1], ARGV[2])
+		end
+		return gen
+	`)
+
+// records a write of the byte range [off, end[ in progress, returns its generation
+func (s DataStore) beginWrite(name string, off, end int64) (int64, error) {
+	conn := s.redisRing.GetClient(writesKey(name)).pool.Get()
+	defer conn.Close()
+	lease := atomicWriteLease.Nanoseconds() / int64(time.Millisecond)
+	return redis.Int64(beginWriteScript.Do(conn, writesKey(name), fmt.Sprintf("%d:%d", off, end), s.ttl(name), lease))
+}
+
+// records the end of a write
+func (s DataStore) endWrite(name string, gen int64) {
+	conn := s.redisRing.GetClient(writesKey(name)).pool.Get()
+	defer conn.Close()
+	Try(err(conn.Do("HDEL", writesKey(name), gen)))
+}
+
+// writeVersions is the state of the versioned writes of a content
+type writeVersions struct {
+	gen     int64      // generation of the last write started
+	writing [][2]int64 // byte ranges of the writes in progress
+}
+
+// returns the fields of the versions hash, the writes whose lease has expired are dropped
+var writeVersionsScript = redis.NewScript(1, `
+		redis.replicate_commands()
+		local now = redis.call("TIME")
+		now = now[1] * 1000 + math.floor(now[2] / 1000)
+		local fields = redis.call("HGETALL", KEYS[1])
+		local res = {}
+		for i = 1, #fields, 2 do
+			local deadline = string.match(fields[i + 1], ":(%d+)$")
+			if fields[i] ~= "gen" and tonumber(deadline) < now then
+				redis.call("HDEL", KEYS[1], fields[i])
+			else
+				table.insert(res, fields[i])
+				table.insert(res, fields[i + 1])
+			end
+		end
+		return res
+	`)
+
+func (s DataStore) writeVersions(name string) writeVersions {
+	conn := s.redisRing.GetClient(writesKey(name)).pool.Get()
+	defer conn.Close()
+	fields, err := redis.StringMap(writeVersionsScript.Do(conn, writesKey(name)))
+	Check(err)
+	v := writeVersions{}
+	for field, value := range fields {
+		if field == "gen" {
+			v.gen, err = strconv.ParseInt(value, 10, 64)
+			Check(err)
+			continue
+		}
+		var r [2]int64
+		var deadline int64
+		_, err := fmt.Sscanf(value, "%d:%d:%d", &r[0], &r[1], &deadline)
+		Check(err)
+		v.writing = append(v.writing, r)
+	}
+	return v
+}
+
+// returns true if a write in progress overlaps the byte range [off, end[
+func (v writeVersions) overlaps(off, end int64) bool {
+	for _, r := range v.writing {
+		if r[0] < end && off < r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// reads the byte range [off, off+length[ of a content with read, read again as long as a versioned write
+// of the range is seen partially applied
+func (s DataStore) consistentRead(name string, off int64, length int, read func()) {
+	if s.atomicWriteSize <= 0 || !s.spansStripes(off, length) {
+		read()
+		return
+	}
+	end := off + int64(length)
+	deadline := time.Now().Add(atomicReadTimeout)
+	for {
+		before := s.writeVersions(name)
+		if !before.overlaps(off, end) {
+			read()
+			if s.writeVersions(name).gen == before.gen {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			log.Printf("WARNING read of '%s' at offset %d may not be consistent, writes still in progress after %s", name, off, atomicReadTimeout)
+			read()
+			return
+		}
+		time.Sleep(atomicReadRetry)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2019 CEA
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redisfs
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cea-hpc/pdwfs/util"
+)
+
+func TestWriteVersions(t *testing.T) {
+	redis, conf := util.InitRedisTestServer()
+	defer redis.Stop()
+	store := NewDataStore(NewRedisRing(conf), 4)
+	defer store.Close()
+
+	util.Assert(t, !store.spansStripes(0, 4), "write should fit in a stripe")
+	util.Assert(t, store.spansStripes(2, 4), "write should span two stripes")
+
+	gen, err := store.beginWrite("file", 2, 6)
+	util.Ok(t, err)
+	v := store.writeVersions("file")
+	util.Equals(t, gen, v.gen, "wrong generation")
+	util.Assert(t, v.overlaps(0, 4), "write in progress should overlap")
+	util.Assert(t, !v.overlaps(6, 8), "write in progress should not overlap")
+	store.endWrite("file", gen)
+	v = store.writeVersions("file")
+	util.Equals(t, gen, v.gen, "generation should be kept")
+	util.Assert(t, !v.overlaps(0, 8), "no write should be in progress")
+}
+
+func TestAbandonedWrite(t *testing.T) {
+	redis, conf := util.InitRedisTestServer()
+	defer redis.Stop()
+	store := NewDataStore(NewRedisRing(conf), 4)
+	store.SetAtomicWriteSize(16)
+	defer store.Close()
+
+	defer func(lease time.Duration) { atomicWriteLease = lease }(atomicWriteLease)
+	atomicWriteLease = 100 * time.Millisecond
+
+	util.Ok(t, store.WriteAt("file", 0, []byte("01234567")))
+	// the writer dies in the middle of a write
+	_, err := store.beginWrite("file", 2, 6)
+	util.Ok(t, err)
+
+	start := time.Now()
+	dst := make([]byte, 8)
+	util.Equals(t, int64(8), store.ReadAt("file", 0, dst), "wrong read length")
+	util.Assert(t, time.Since(start) < atomicReadTimeout/2, "read should not wait for the abandoned write")
+	util.Equals(t, "01234567", string(dst), "wrong data")
+	util.Assert(t, !store.writeVersions("file").overlaps(0, 8), "abandoned write should have been dropped")
+}
+
+func TestAtomicWrites(t *testing.T) {
+	redis, conf := util.InitRedisTestServer()
+	defer redis.Stop()
+	store := NewDataStore(NewRedisRing(conf), 4)
+	store.SetAtomicWriteSize(16)
+	defer store.Close()
+
+	// unaligned writes of a single letter spanning 5 stripes, readers must never see two letters
+	const size = 16
+	util.Ok(t, store.WriteAt("file", 2, bytes.Repeat([]byte("a"), size)))
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			letter := []byte{byte('a' + i%26)}
+			if err := store.WriteAt("file", 2, bytes.Repeat(letter, size)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	dst := make([]byte, size)
+	for reading := true; reading; {
+		select {
+		case <-done:
+			reading = false
+		default:
+		}
+		store.ReadAt("file", 2, dst)
+		util.Equals(t, string(bytes.Repeat(dst[:1], size)), string(dst), "torn read")
+	}
+	wg.Wait()
+}
@@ -0,0 +1,101 @@
+// Copyright 2019 CEA
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Client-side cache of the inode attributes with close-to-open consistency (as NFS). The existence, type, mode,
+// link target and size of an inode fetched from Redis are trusted for a short time (see config.Mount.AttrTimeout),
+// then the inode is revalidated: it is dropped if it no longer exists, otherwise its attributes are fetched again.
+// Opening a file always revalidates it, so that a process opening a file after another process closed it sees
+// the file as the other process left it. Changes made through the RedisFS itself update the cache at once.
+// Redis client-side tracking would invalidate the cache on change but needs RESP3, not spoken by the Redis client.
+
+package redisfs
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultAttrTimeout is the default duration the attributes of an inode are trusted before being revalidated
+const DefaultAttrTimeout = time.Second
+
+// attrCache holds the attributes of an inode fetched from Redis, nil attributes are fetched when next needed
+type attrCache struct {
+	mtx       sync.Mutex
+	validated time.Time // last time the inode was checked against Redis, the attributes are not older
+	isDir     *bool
+	mode      *os.FileMode
+	target    *string
+	size      *int64
+	sizeGen   int64 // counts the size invalidations, a size fetched meanwhile is not cached
+}
+
+func newAttrCache() *attrCache {
+	return &attrCache{validated: time.Now()}
+}
+
+// returns true if the inode has been checked against Redis for less than 'timeout'
+func (c *attrCache) fresh(timeout time.Duration) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return time.Since(c.validated) < timeout
+}
+
+// marks the inode for revalidation on its next lookup
+func (c *attrCache) expire() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.validated = time.Time{}
+}
+
+// drops all the attributes once the inode has been checked against Redis
+func (c *attrCache) invalidate() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.validated = time.Now()
+	c.isDir, c.mode, c.target, c.size = nil, nil, nil, nil
+	c.sizeGen++
+}
+
+// drops the size after a modification of the content (c is nil for files opened without an inode)
+func (c *attrCache) invalidateSize() {
+	if c == nil {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.size = nil
+	c.sizeGen++
+}
+
+// returns the cached size or the size returned by fetch, Redis is not queried with the cache locked
+// so that writers are not delayed by the lookup
+func (c *attrCache) getSize(fetch func() int64) int64 {
+	c.mtx.Lock()
+	if c.size != nil {
+		defer c.mtx.Unlock()
+		return *c.size
+	}
+	gen := c.sizeGen
+	c.mtx.Unlock()
+
+	size := fetch()
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.sizeGen == gen {
+		c.size = &size
+	}
+	return size
+}
@@ -0,0 +1,143 @@
+// Copyright 2019 CEA
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// File events (creation, close after write, truncation, removal) published to Redis,
+// as JSON messages on a Pub/Sub channel and/or as entries of a capped stream,
+// so that workflow engines can react to the files produced in a mount point.
+
+package redisfs
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	"github.com/cea-hpc/pdwfs/config"
+)
+
+// DefaultEventsStreamMaxLen is the default approximate maximum number of events kept in the stream
+const DefaultEventsStreamMaxLen = 10000
+
+// Event describes an operation on a file
+type Event struct {
+	Path string    `json:"path"`
+	Op   string    `json:"op"`   // event type, see config.EventCreate...
+	Size int64     `json:"size"` // size of the file after the operation
+	Host string    `json:"host"` // host of the process performing the operation
+	Pid  int       `json:"pid"`  // pid of the process performing the operation
+	Time time.Time `json:"timestamp"`
+}
+
+// Events publishes the file events of a mount point.
+// A nil *Events is valid and does not publish anything.
+type Events struct {
+	conf      config.Events
+	redisRing *RedisRing
+	mountPath string
+	key       string // name of the channel and of the stream
+	host      string
+	pid       int
+}
+
+// NewEvents returns an Events publisher for the mount point, key is the channel and stream name
+func NewEvents(conf config.Events, ring *RedisRing, mountPath, key string) *Events {
+	if conf.StreamMaxLen <= 0 {
+		conf.StreamMaxLen = DefaultEventsStreamMaxLen
+	}
+	host, err := os.Hostname()
+	Check(err)
+	return &Events{
+		conf:      conf,
+		redisRing: ring,
+		mountPath: mountPath,
+		key:       key,
+		host:      host,
+		pid:       os.Getpid(),
+	}
+}
+
+// Key returns the name of the channel and of the stream the events are published to
+func (e *Events) Key() string {
+	return e.key
+}
+
+// returns true if events of type 'op' on path are published
+func (e *Events) enabled(op, path string) bool {
+	if e == nil {
+		return false
+	}
+	if len(e.conf.Ops) > 0 && !contains(e.conf.Ops, op) {
+		return false
+	}
+	if len(e.conf.Patterns) == 0 {
+		return true
+	}
+	for _, pattern := range e.conf.Patterns {
+		if matchPathOrParent(pattern, path, e.mountPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// publishes an event, failures are logged and do not fail the operation on the file
+func (e *Events) emit(op, path string, size int64) {
+	if !e.enabled(op, path) {
+		return
+	}
+	ev := Event{Path: path, Op: op, Size: size, Host: e.host, Pid: e.pid, Time: time.Now()}
+	conn := e.redisRing.GetClient(e.key).pool.Get()
+	defer conn.Close()
+	if e.conf.Channel {
+		msg, err := json.Marshal(ev)
+		Check(err)
+		if _, err := conn.Do("PUBLISH", e.key, msg); err != nil {
+			log.Printf("WARNING cannot publish %s event of '%s': %s", op, path, err)
+		}
+	}
+	if e.conf.Stream {
+		_, err := conn.Do("XADD", e.key, "MAXLEN", "~", e.conf.StreamMaxLen, "*",
+			"path", ev.Path, "op", ev.Op, "size", ev.Size, "host", ev.Host, "pid", ev.Pid,
+			"timestamp", ev.Time.Format(time.RFC3339Nano))
+		if err != nil {
+			log.Printf("WARNING cannot add %s event of '%s' to stream: %s", op, path, err)
+		}
+	}
+}
+
+// eventsFile wraps a file opened for writing to publish its truncations and close
+type eventsFile struct {
+	File
+	events *Events
+	inode  *Inode
+}
+
+// Truncate changes the size of the file and publishes a truncate event
+func (f *eventsFile) Truncate(size int64) error {
+	if err := f.File.Truncate(size); err != nil {
+		return err
+	}
+	f.events.emit(config.EventTruncate, f.inode.Path(), size)
+	return nil
+}
+
+// Close closes the file and publishes a close event
+func (f *eventsFile) Close() error {
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+	f.events.emit(config.EventClose, f.inode.Path(), f.inode.Size())
+	return nil
+}
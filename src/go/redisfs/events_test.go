@@ -0,0 +1,95 @@
+// Copyright 2019 CEA
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redisfs
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cea-hpc/pdwfs/config"
+	"github.com/cea-hpc/pdwfs/redigo/redis"
+	"github.com/cea-hpc/pdwfs/util"
+)
+
+func TestEventsChannel(t *testing.T) {
+	server, redisConf := util.InitRedisTestServer()
+	defer server.Stop()
+
+	mountConf := util.GetMountPathConf()
+	mountConf.Events = config.Events{Channel: true, Patterns: []string{"*.out"}}
+	fs := NewRedisFS(redisConf, mountConf)
+	defer fs.Finalize()
+
+	psc := redis.PubSubConn{Conn: fs.redisRing.GetClient(fs.events.Key()).pool.Get()}
+	defer psc.Close()
+	util.Ok(t, psc.Subscribe(fs.events.Key()))
+	_, ok := psc.Receive().(redis.Subscription)
+	util.Assert(t, ok, "subscription should be confirmed")
+
+	// events of files not matching the patterns are filtered out
+	f, err := fs.OpenFile(filepath.Join(mountConf.Path, "ignored"), os.O_CREATE|os.O_WRONLY, 0600)
+	util.Ok(t, err)
+	f.Close()
+
+	name := filepath.Join(mountConf.Path, "result.out")
+	f, err = fs.OpenFile(name, os.O_CREATE|os.O_WRONLY, 0600)
+	util.Ok(t, err)
+	_, err = f.Write([]byte("some data"))
+	util.Ok(t, err)
+	util.Ok(t, f.Truncate(4))
+	f.Close()
+	util.Ok(t, fs.Remove(name))
+
+	expected := []Event{
+		{Path: name, Op: config.EventCreate, Size: 0},
+		{Path: name, Op: config.EventTruncate, Size: 4},
+		{Path: name, Op: config.EventClose, Size: 4},
+		{Path: name, Op: config.EventUnlink, Size: 0},
+	}
+	for _, exp := range expected {
+		msg, ok := psc.Receive().(redis.Message)
+		util.Assert(t, ok, "event message expected")
+		var ev Event
+		util.Ok(t, json.Unmarshal(msg.Data, &ev))
+		util.Equals(t, exp.Path, ev.Path, "wrong event path")
+		util.Equals(t, exp.Op, ev.Op, "wrong event type")
+		util.Equals(t, exp.Size, ev.Size, "wrong event size")
+		util.Equals(t, os.Getpid(), ev.Pid, "wrong event pid")
+	}
+}
+
+func TestEventsStream(t *testing.T) {
+	server, redisConf := util.InitRedisTestServer()
+	defer server.Stop()
+
+	mountConf := util.GetMountPathConf()
+	mountConf.Events = config.Events{Stream: true, Ops: []string{config.EventClose}}
+	fs := NewRedisFS(redisConf, mountConf)
+	defer fs.Finalize()
+
+	for _, name := range []string{"a", "b"} {
+		f, err := fs.OpenFile(filepath.Join(mountConf.Path, name), os.O_CREATE|os.O_WRONLY, 0600)
+		util.Ok(t, err)
+		f.Close()
+	}
+
+	conn := fs.redisRing.GetClient(fs.events.Key()).pool.Get()
+	defer conn.Close()
+	entries, err := redis.Values(conn.Do("XRANGE", fs.events.Key(), "-", "+"))
+	util.Ok(t, err)
+	util.Equals(t, 2, len(entries), "only close events should be in the stream")
+}
@@ -30,58 +30,99 @@ var (
 	ErrInvalidSeekWhence = errors.New("Seek whence is not a proper value")
 	// ErrNegativeSeekLocation is returned if the seek location is negative.
 	ErrNegativeSeekLocation = errors.New("Seek location (from offset and whence) is negative")
+	// ErrInvalidRange is returned if the byte range of an allocation is invalid.
+	ErrInvalidRange = errors.New("Invalid byte range")
+	// ErrAllocateMode is returned if the mode of an allocation is not supported.
+	ErrAllocateMode = errors.New("Allocation mode not supported")
 )
 
-// MemFile represents a file backed by a Store which is secured from concurrent access.
+// Fallocate modes, same values as the FALLOC_FL_* flags of Linux
+const (
+	FallocKeepSize  = 0x01 // allocated bytes beyond the end of the file do not change its size
+	FallocPunchHole = 0x02 // deallocates the range, must be combined with FallocKeepSize
+)
+
+// fileOffset is the offset of an open file, its lock serializes the calls using the offset
+// (Read, Write, Seek, ...) as Linux does for regular files
+type fileOffset struct {
+	sync.Mutex
+	pos int64
+}
+
+// MemFile represents an open file backed by a Store which is secured from concurrent access.
+// The byte-range lock is shared by the open files of an inode while each open file has its own offset.
 type MemFile struct {
 	store  *DataStore
 	path   string
-	offset int64
-	mtx    *sync.RWMutex
+	offset fileOffset
+	ranges *RangeMutex // byte-range lock of the inode
+	attrs  *attrCache  // cached attributes of the inode, the size is dropped on modification (nil if none)
 }
 
-// NewMemFile creates a file which byte slice is safe from concurrent access,
-// the file itself is not thread-safe.
-func NewMemFile(store *DataStore, path string, mtx *sync.RWMutex) *MemFile {
+// NewMemFile creates a file which byte slice is safe from concurrent access, ranges being the byte-range lock
+// of the inode, the file itself is safe for concurrent use as well.
+func NewMemFile(store *DataStore, path string, ranges *RangeMutex) *MemFile {
 	return &MemFile{
-		store: store,
-		path:  path,
-		mtx:   mtx,
+		store:  store,
+		path:   path,
+		ranges: ranges,
 	}
 }
 
 // Name of the file
-func (f MemFile) Name() string {
+func (f *MemFile) Name() string {
 	return f.path
 }
 
 // Size of file
-func (f MemFile) Size() int64 {
+func (f *MemFile) Size() int64 {
 	return f.store.GetSize(f.path)
 }
 
 // Sync has no effect
-func (f MemFile) Sync() error {
+func (f *MemFile) Sync() error {
 	return nil
 }
 
 // Truncate changes the size of the file
-func (f MemFile) Truncate(size int64) error {
+func (f *MemFile) Truncate(size int64) error {
 	if size < 0 {
 		return ErrNegativeTruncateSize
 	}
-	f.mtx.Lock()
-	defer f.mtx.Unlock()
-	f.store.Resize(f.path, size)
-	return nil
+	defer f.ranges.Unlock(f.ranges.Lock(0, ToEOF))
+	defer f.attrs.invalidateSize()
+	return f.store.Resize(f.path, size)
+}
+
+// Fallocate allocates the byte range [off, off+length[ of the file, extending the file unless the mode
+// has FallocKeepSize, or deallocates the range (FallocPunchHole) which then reads as null bytes
+func (f *MemFile) Fallocate(mode int, off, length int64) error {
+	if off < 0 || length <= 0 {
+		return ErrInvalidRange
+	}
+	if mode&^(FallocKeepSize|FallocPunchHole) != 0 || mode&FallocPunchHole != 0 && mode&FallocKeepSize == 0 {
+		return ErrAllocateMode
+	}
+	if mode&FallocPunchHole != 0 {
+		defer f.ranges.Unlock(f.ranges.Lock(off, off+length))
+		return f.store.Deallocate(f.path, off, length)
+	}
+	// the size of the file may change
+	defer f.ranges.Unlock(f.ranges.Lock(off, ToEOF))
+	// the content is allocated on write, only the size of the file changes
+	if mode&FallocKeepSize != 0 || off+length <= f.store.GetSize(f.path) {
+		return nil
+	}
+	defer f.attrs.invalidateSize()
+	return f.store.Resize(f.path, off+length)
 }
 
 // Close the file (no op)
-func (f MemFile) Close() error {
+func (f *MemFile) Close() error {
 	return nil
 }
 
-func (f MemFile) readAt(dst []byte, off int64) (int, error) {
+func (f *MemFile) readAt(dst []byte, off int64) (int, error) {
 	if off < 0 {
 		panic(ErrNegativeOffset)
 	}
@@ -98,21 +139,29 @@ func (f MemFile) readAt(dst []byte, off int64) (int, error) {
 
 // Read reads len(dst) byte starting at the current offset.
 func (f *MemFile) Read(dst []byte) (int, error) {
-	f.mtx.RLock() // should this be a Lock instead of RLock to safeguard offset update?
-	defer f.mtx.RUnlock()
-	read, err := f.readAt(dst, f.offset)
-	f.offset += int64(read)
+	f.offset.Lock()
+	defer f.offset.Unlock()
+	read, err := f.ReadAt(dst, f.offset.pos)
+	f.offset.pos += int64(read)
 	return read, err
 }
 
 // ReadAt reads len(dst) bytes starting at offset off.
-func (f MemFile) ReadAt(dst []byte, off int64) (int, error) {
-	f.mtx.RLock()
-	defer f.mtx.RUnlock()
+func (f *MemFile) ReadAt(dst []byte, off int64) (int, error) {
+	defer f.ranges.Unlock(f.ranges.RLock(off, off+int64(len(dst))))
 	return f.readAt(dst, off)
 }
 
-func (f MemFile) readVecAt(dstv [][]byte, off int64) (int, error) {
+// returns the total length of a vector of byte slices
+func vecLen(v [][]byte) int64 {
+	var n int64
+	for _, b := range v {
+		n += int64(len(b))
+	}
+	return n
+}
+
+func (f *MemFile) readVecAt(dstv [][]byte, off int64) (int, error) {
 	var n int
 	for _, dst := range dstv {
 		read, err := f.readAt(dst, off)
@@ -130,94 +179,101 @@ func (f MemFile) readVecAt(dstv [][]byte, off int64) (int, error) {
 
 // ReadVec reads a vector of byte slices starting at the current offset.
 func (f *MemFile) ReadVec(dstv [][]byte) (int, error) {
-	f.mtx.RLock() // should this be a Lock instead of RLock to safeguard offset update?
-	defer f.mtx.RUnlock()
-	read, err := f.readVecAt(dstv, f.offset)
-	f.offset += int64(read)
+	f.offset.Lock()
+	defer f.offset.Unlock()
+	read, err := f.ReadVecAt(dstv, f.offset.pos)
+	f.offset.pos += int64(read)
 	return read, err
 }
 
 // ReadVecAt reads a vector of byte slices starting at offset off.
-func (f MemFile) ReadVecAt(dstv [][]byte, off int64) (int, error) {
-	f.mtx.RLock()
-	defer f.mtx.RUnlock()
+func (f *MemFile) ReadVecAt(dstv [][]byte, off int64) (int, error) {
+	defer f.ranges.Unlock(f.ranges.RLock(off, off+vecLen(dstv)))
 	return f.readVecAt(dstv, off)
 }
 
-func (f MemFile) writeAt(data []byte, off int64) (int, error) {
+func (f *MemFile) writeAt(data []byte, off int64) (int, error) {
 	if off < 0 {
 		panic(ErrNegativeOffset)
 	}
-	f.store.WriteAt(f.path, off, data)
+	defer f.attrs.invalidateSize()
+	if err := f.store.WriteAt(f.path, off, data); err != nil {
+		return 0, err
+	}
 	return len(data), nil
 }
 
 // Write writes len(data) byte starting at the current offset
 func (f *MemFile) Write(data []byte) (int, error) {
-	f.mtx.Lock()
-	defer f.mtx.Unlock()
-	wrote, err := f.writeAt(data, f.offset)
-	f.offset += int64(wrote)
+	f.offset.Lock()
+	defer f.offset.Unlock()
+	wrote, err := f.WriteAt(data, f.offset.pos)
+	f.offset.pos += int64(wrote)
 	return wrote, err
 }
 
 // WriteAt writes len(data) byte starting at the offset off
-func (f MemFile) WriteAt(data []byte, off int64) (int, error) {
-	f.mtx.Lock()
-	defer f.mtx.Unlock()
+func (f *MemFile) WriteAt(data []byte, off int64) (int, error) {
+	defer f.ranges.Unlock(f.ranges.Lock(off, off+int64(len(data))))
 	return f.writeAt(data, off)
 }
 
-func (f MemFile) writeVecAt(datav [][]byte, off int64) (int, error) {
+func (f *MemFile) writeVecAt(datav [][]byte, off int64) (int, error) {
 	var n int
 	for _, data := range datav {
-		wrote, _ := f.writeAt(data, off)
+		wrote, err := f.writeAt(data, off)
 		off += int64(wrote)
 		n += wrote
+		if err != nil {
+			return n, err
+		}
 	}
 	return n, nil
 }
 
 // WriteVec writes a vector of byte slices starting at the current offset
 func (f *MemFile) WriteVec(datav [][]byte) (int, error) {
-	f.mtx.Lock()
-	defer f.mtx.Unlock()
-	wrote, err := f.writeVecAt(datav, f.offset)
-	f.offset += int64(wrote)
+	f.offset.Lock()
+	defer f.offset.Unlock()
+	wrote, err := f.WriteVecAt(datav, f.offset.pos)
+	f.offset.pos += int64(wrote)
 	return wrote, err
 }
 
 // WriteVecAt writes a vector of byte slices at offset off
-func (f MemFile) WriteVecAt(datav [][]byte, off int64) (int, error) {
-	f.mtx.Lock()
-	defer f.mtx.Unlock()
+func (f *MemFile) WriteVecAt(datav [][]byte, off int64) (int, error) {
+	defer f.ranges.Unlock(f.ranges.Lock(off, off+vecLen(datav)))
 	return f.writeVecAt(datav, off)
 }
 
 // Seek sets the offset for the next Read or Write to offset off,
 // interpreted according to whence:
+//
 // 	0 (os.SEEK_SET) means relative to the origin of the file
 // 	1 (os.SEEK_CUR) means relative to the current offset
 // 	2 (os.SEEK_END) means relative to the end of the file
+//
 // It returns the new offset and an error, if any.
 func (f *MemFile) Seek(off int64, whence int) (int64, error) {
-	f.mtx.Lock()
-	defer f.mtx.Unlock()
+	f.offset.Lock()
+	defer f.offset.Unlock()
 
 	var abs int64
 	switch whence {
 	case os.SEEK_SET: // Relative to the origin of the file
 		abs = off
 	case os.SEEK_CUR: // Relative to the current offset
-		abs = int64(f.offset) + off
-	case os.SEEK_END: // Relative to the end
+		abs = f.offset.pos + off
+	case os.SEEK_END: // Relative to the end, not in the middle of a write
+		r := f.ranges.RLock(0, ToEOF)
 		abs = f.Size() + off
+		f.ranges.Unlock(r)
 	default:
 		return 0, ErrInvalidSeekWhence
 	}
 	if abs < 0 {
 		return 0, ErrNegativeSeekLocation
 	}
-	f.offset = abs
+	f.offset.pos = abs
 	return abs, nil
 }
@@ -38,7 +38,7 @@ var (
 func setupMemFile(t *testing.T) (*MemFile, *util.RedisTestServer, *DataStore) {
 	redis, conf := util.InitRedisTestServer()
 	store := NewDataStore(NewRedisRing(conf), config.DefaultStripeSize)
-	f := NewMemFile(store, "/path/to/file", &sync.RWMutex{})
+	f := NewMemFile(store, "/path/to/file", NewRangeMutex())
 	return f, redis, store
 }
 
@@ -240,3 +240,98 @@ func TestSize(t *testing.T) {
 		t.Fatalf("Unexpected file size: %d (expected %d)", s, int64(len(dots)))
 	}
 }
+
+func TestFallocate(t *testing.T) {
+	f, redis, client := setupMemFile(t)
+	defer redis.Stop()
+	defer client.Close()
+
+	_, err := f.Write([]byte(dots))
+	util.Ok(t, err)
+
+	util.Equals(t, ErrInvalidRange, f.Fallocate(0, 0, 0), "empty range is invalid")
+	util.Equals(t, ErrAllocateMode, f.Fallocate(FallocPunchHole, 0, 4), "punch hole requires keep size")
+
+	util.Ok(t, f.Fallocate(FallocKeepSize, 0, 100))
+	util.Equals(t, int64(len(dots)), f.Size(), "size should be kept")
+	util.Ok(t, f.Fallocate(0, 0, 8))
+	util.Equals(t, int64(len(dots)), f.Size(), "allocating inside the file should not change its size")
+	util.Ok(t, f.Fallocate(0, 10, 20))
+	util.Equals(t, int64(30), f.Size(), "file should be extended")
+
+	util.Ok(t, f.Fallocate(FallocPunchHole|FallocKeepSize, 1, 4))
+	buf := make([]byte, len(dots))
+	_, err = f.ReadAt(buf, 0)
+	util.Ok(t, err)
+	util.Equals(t, "1\x00\x00\x00\x002....3....4", string(buf), "hole should read as null bytes")
+	util.Equals(t, int64(30), f.Size(), "punching a hole should not change the size")
+}
+
+func TestConcurrentOffset(t *testing.T) {
+	f, redis, client := setupMemFile(t)
+	defer redis.Stop()
+	defer client.Close()
+
+	const writers, records = 4, 50
+	// each writer appends records filled with its own letter, records must not overlap
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(letter byte) {
+			defer wg.Done()
+			record := []byte(strings.Repeat(string(letter), len(dots)))
+			for r := 0; r < records; r++ {
+				if _, err := f.Write(record); err != nil {
+					t.Error(err)
+					return
+				}
+				if r%10 == 0 {
+					f.Seek(0, os.SEEK_CUR)
+				}
+			}
+		}(byte('a' + w))
+	}
+	wg.Wait()
+	util.Equals(t, int64(writers*records*len(dots)), f.Size(), "records should not overlap")
+
+	count := map[byte]int{}
+	content := make([]byte, f.Size())
+	_, err := f.ReadAt(content, 0)
+	util.Ok(t, err)
+	for i := 0; i < len(content); i += len(dots) {
+		record := string(content[i : i+len(dots)])
+		util.Equals(t, strings.Repeat(record[:1], len(dots)), record, "torn record")
+		count[record[0]]++
+	}
+	for w := 0; w < writers; w++ {
+		util.Equals(t, records, count[byte('a'+w)], "wrong number of records")
+	}
+
+	// concurrent readers share the offset, each byte is read once
+	_, err = f.Seek(0, os.SEEK_SET)
+	util.Ok(t, err)
+	var mtx sync.Mutex
+	read := 0
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, len(dots))
+			for {
+				n, err := f.Read(buf)
+				mtx.Lock()
+				read += n
+				mtx.Unlock()
+				if err == io.EOF || n == 0 {
+					return
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	util.Equals(t, len(content), read, "each byte should be read once")
+}
@@ -16,11 +16,16 @@ package redisfs
 
 import (
 	"errors"
+	"hash/crc32"
 	"io"
+	"log"
+	"math"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/cea-hpc/pdwfs/config"
 )
@@ -40,16 +45,28 @@ var (
 	ErrDirNotEmpty = errors.New("Directory is not empty")
 	// ErrParentDirNotExist is returned if the parent directory does not exist
 	ErrParentDirNotExist = errors.New("Parent directory does not exist")
+	// ErrTimeout is returned if a file is not sealed by its writers before the configured timeout
+	ErrTimeout = errors.New("Timed out waiting for the file to be sealed")
+	// ErrNotSymlink is returned if a file is not a symbolic link (readlink)
+	ErrNotSymlink = errors.New("Is not a symbolic link")
+	// ErrTooManyLinks is returned if too many symbolic links are followed to resolve a path (likely a loop)
+	ErrTooManyLinks = errors.New("Too many levels of symbolic links")
+	// ErrLinkOutsideMount is returned if a symbolic link points outside of the mount point,
+	// such links cannot be created as they could not be followed
+	ErrLinkOutsideMount = errors.New("Symbolic link points outside of the mount point")
 )
 
 // File represents a File with common operations.
 // It differs from os.File so e.g. Stat() needs to be called from the Filesystem instead.
-//   osfile.Stat() -> filesystem.Stat(file.Name())
+//
+//	osfile.Stat() -> filesystem.Stat(file.Name())
 type File interface {
 	Name() string
 	Sync() error
 	// Truncate shrinks or extends the size of the File to the specified size.
 	Truncate(int64) error
+	// Fallocate allocates or deallocates a byte range of the File, see MemFile.Fallocate.
+	Fallocate(mode int, off, length int64) error
 	io.Reader
 	io.ReaderAt
 	io.Writer
@@ -72,67 +89,278 @@ type RedisFS struct {
 	redisRing *RedisRing
 	inodes    map[string]*Inode
 	root      *Inode
+	quota     *Quota
+	stager    *Stager // nil if no stage-out directory is configured
+	flusher   *Stager // copies closed files to the real directory in write-through mode, nil otherwise
+	events    *Events // nil if events are not published
+	locker    *Locker
+	// duration the cached inodes are trusted before being revalidated against Redis (see attrcache.go)
+	attrTimeout time.Duration
 }
 
 // NewRedisFS a new RedisFS filesystem which entirely resides in memory
 func NewRedisFS(redisConf *config.Redis, mountConf *config.Mount) *RedisFS {
 	redisRing := NewRedisRing(redisConf)
 	dataStore := NewDataStore(redisRing, int64(mountConf.StripeSize))
+	dataStore.SetHighWatermark(mountConf.HighWatermark)
+	dataStore.SetNamespace(mountConf.Namespace)
+	dataStore.SetAtomicWriteSize(mountConf.AtomicWriteSize)
+
+	var quota *Quota
+	if q := mountConf.Quota; q.Bytes > 0 || q.Inodes > 0 {
+		scope := mountConf.Path
+		if q.PerJob {
+			scope += "@" + config.JobID()
+		}
+		quota = NewQuota(redisRing, scope, q.Bytes, q.Inodes)
+		quota.SetNamespace(mountConf.Namespace)
+		dataStore.SetQuota(quota)
+	}
 
 	// create root inode
 	//FIXME: mount path (root) should only be created it it exists on the FS at startup
 	root := NewInode(dataStore, redisRing, mountConf.Path)
 	root.initMeta(true, 0600)
 
-	return &RedisFS{
+	fs := &RedisFS{
 		mountConf: mountConf,
 		redisRing: redisRing,
 		dataStore: dataStore,
 		inodes:    map[string]*Inode{root.Path(): root},
 		root:      root,
+		quota:     quota,
+		locker:    NewLocker(redisRing, time.Duration(mountConf.LockLease*float64(time.Second))),
+	}
+	switch {
+	case mountConf.AttrTimeout == 0:
+		fs.attrTimeout = DefaultAttrTimeout
+	case mountConf.AttrTimeout > 0:
+		fs.attrTimeout = time.Duration(mountConf.AttrTimeout * float64(time.Second))
+	}
+
+	if staging := mountConf.Staging; staging.In != "" || staging.Out != "" {
+		fs.stager = NewStager(stagingName, dataStore, redisRing, mountConf.Path, staging.Out, StagerOptions{Workers: staging.Workers})
+		if staging.In != "" {
+			Check(fs.StageIn(staging.In))
+		}
 	}
+	if ev := mountConf.Events; ev.Channel || ev.Stream {
+		fs.events = NewEvents(ev, redisRing, mountConf.Path, dataStore.namespaced("pdwfs:events:{"+mountConf.Path+"}"))
+	}
+	if wt := mountConf.WriteThrough; wt.Enabled {
+		fs.flusher = NewStager(flushName, dataStore, redisRing, mountConf.Path, mountConf.Path, StagerOptions{
+			Workers:   wt.Workers,
+			QueueSize: wt.QueueSize,
+			Retries:   wt.Retries,
+		})
+	}
+	return fs
 }
 
-// Finalize performs close up actions on the virtual file system
+// Finalize performs close up actions on the virtual file system,
+// files not drained yet are copied to the stage-out directory if any
+// and files queued in write-through mode are flushed unless configured otherwise
 func (fs *RedisFS) Finalize() {
+	if fs.stager != nil {
+		if fs.mountConf.Staging.Out != "" {
+			fs.StageOut()
+		}
+		fs.stager.Close()
+	}
+	if fs.flusher != nil {
+		if fs.mountConf.WriteThrough.NoWait {
+			// the flusher keeps using the Redis connections until the process exits,
+			// the files it has not flushed by then are lost
+			if n := fs.flusher.Pending(); n > 0 {
+				log.Printf("WARNING %d files queued for write-through on %s are not flushed yet", n, fs.mountConf.Path)
+			}
+			fs.locker.Close()
+			return
+		}
+		fs.flusher.Close()
+	}
+	fs.locker.Close()
 	fs.redisRing.Close()
 	fs.dataStore.Close()
 }
 
+// FsStats describes the storage capacity of the filesystem (see statfs)
+type FsStats struct {
+	BlockSize   int64  // block size in bytes
+	Blocks      uint64 // total number of blocks
+	BlocksFree  uint64 // number of free blocks
+	BlocksAvail uint64 // number of free blocks available to writers (below the high watermark)
+	Files       uint64 // total number of inodes
+	FilesFree   uint64 // number of free inodes
+}
+
+// block size reported by Statfs
+const statfsBlockSize = 4096
+
+// Statfs returns the storage capacity of the filesystem, based on the memory used in the Redis instances
+// and the mount point quota if any
+func (fs *RedisFS) Statfs() (FsStats, error) {
+	used, max, err := fs.redisRing.MemoryUsage()
+	if err != nil {
+		return FsStats{}, err
+	}
+	free := max - used
+	if free < 0 {
+		free = 0
+	}
+	avail := free
+	if wm := fs.mountConf.HighWatermark; wm > 0 {
+		avail = int64(wm*float64(max)/100) - used
+		if avail < 0 {
+			avail = 0
+		}
+	}
+	stats := FsStats{
+		BlockSize:   statfsBlockSize,
+		Blocks:      uint64(max / statfsBlockSize),
+		BlocksFree:  uint64(free / statfsBlockSize),
+		BlocksAvail: uint64(avail / statfsBlockSize),
+		Files:       math.MaxUint32, // number of inodes is not limited
+		FilesFree:   math.MaxUint32,
+	}
+	if fs.quota == nil {
+		return stats, nil
+	}
+	usedBytes, usedInodes, err := fs.quota.Usage()
+	if err != nil {
+		return FsStats{}, err
+	}
+	maxBytes, maxInodes := fs.quota.Limits()
+	if maxBytes > 0 {
+		left := maxBytes - usedBytes
+		if left < 0 {
+			left = 0
+		}
+		stats.Blocks = minUint64(stats.Blocks, uint64(maxBytes/statfsBlockSize))
+		stats.BlocksFree = minUint64(stats.BlocksFree, uint64(left/statfsBlockSize))
+		stats.BlocksAvail = minUint64(stats.BlocksAvail, uint64(left/statfsBlockSize))
+	}
+	if maxInodes > 0 {
+		left := maxInodes - usedInodes
+		if left < 0 {
+			left = 0
+		}
+		stats.Files = uint64(maxInodes)
+		stats.FilesFree = uint64(left)
+	}
+	return stats, nil
+}
+
+func minUint64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
 // ValidatePath ensures path belongs to a filesystem tree catched by pdwfs
 func (fs *RedisFS) ValidatePath(path string) error {
-	p, err := filepath.Abs(path)
+	p, err := AbsPath(path)
 	if err != nil {
 		return err
 	}
-	if !strings.HasPrefix(p, fs.mountConf.Path) {
+	if !InMount(p, fs.mountConf.Path) {
 		return ErrFileNotManaged
 	}
 	return nil
 }
 
-func (fs *RedisFS) createInode(path string, dir bool, mode os.FileMode, parent *Inode) *Inode {
+func (fs *RedisFS) createInode(path string, dir bool, mode os.FileMode, parent *Inode) (*Inode, error) {
+	ttl := fs.ttl(path)
+	if err := fs.quota.reserveInodes(path, 1, ttl); err != nil {
+		return nil, err
+	}
 	i := NewInode(fs.dataStore, fs.redisRing, path)
+	i.ttl = ttl
 	i.initMeta(dir, mode)
+	i.setTTL(i.ttl)
 	parent.setChild(i)
+	fs.removeWhiteout(parent, path)
 	fs.inodes[i.Path()] = i
-	return i
+	return i, nil
 }
 
 func (fs *RedisFS) getInode(path string) (*Inode, bool) {
 	if i, ok := fs.inodes[path]; ok {
-		return i, true
+		if i.attrs.fresh(fs.attrTimeout) || i.revalidate() {
+			return i, true
+		}
+		delete(fs.inodes, path) // removed by another process or expired
 	}
 	i := NewInode(fs.dataStore, fs.redisRing, path)
 	if ok := i.exists(); !ok {
 		return nil, false
 	}
+	i.loadPin()
+	i.loadTTL(fs.ttl(path))
 	fs.inodes[i.Path()] = i
 	return i, true
 }
 
+// returns the Redis instance on which the stripes of a new file should be placed,
+// or an empty string if the file follows the ring placement
+func (fs *RedisFS) pinnedNode(path string) string {
+	for _, pin := range fs.mountConf.Pins {
+		if !matchPathOrParent(pin.Pattern, path, fs.mountConf.Path) {
+			continue
+		}
+		if pin.Node != config.LocalNode {
+			return pin.Node
+		}
+		local := fs.redisRing.LocalNodes()
+		if len(local) == 0 {
+			return ""
+		}
+		// spread the files among the local instances
+		return local[crc32.ChecksumIEEE([]byte(path))%uint32(len(local))]
+	}
+	return ""
+}
+
+// returns the time to live in seconds of a file or directory, 0 if it does not expire
+func (fs *RedisFS) ttl(path string) int64 {
+	ttl := fs.mountConf.TTL
+	for _, rule := range fs.mountConf.TTLRules {
+		if matchPathOrParent(rule.Pattern, path, fs.mountConf.Path) {
+			ttl = rule.TTL
+			break
+		}
+	}
+	if ttl < 0 {
+		return 0
+	}
+	return ttl
+}
+
+// returns true if the pattern matches the path or one of its parent directories within the mount point
+func matchPathOrParent(pattern, path, root string) bool {
+	for ; len(path) >= len(root); path = filepath.Dir(path) {
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return true
+		}
+		if path == "/" {
+			break
+		}
+	}
+	return false
+}
+
+// marks the cached inode of a path, if any, for revalidation on its next lookup
+func (fs *RedisFS) expireAttrs(path string) {
+	if i, ok := fs.inodes[path]; ok {
+		i.attrs.expire()
+	}
+}
+
 func (fs *RedisFS) removeInode(i *Inode) {
-	i.remove()
+	for _, path := range i.remove() {
+		fs.quota.releaseInodes(path, 1)
+	}
 	delete(fs.inodes, i.Path())
 }
 
@@ -142,20 +370,79 @@ func (fs *RedisFS) fileInfo(abspath string) (parent, node *Inode, err error) {
 	}
 	parentPath := filepath.Dir(abspath)
 	fiParent, _ := fs.getInode(parentPath)
-	if fiParent == nil || !fiParent.IsDir() {
+	if fiParent == nil {
+		fiParent = fs.lowerDir(parentPath)
+	}
+	if fiParent == nil {
 		return nil, nil, ErrParentDirNotExist
 	}
+	if !fiParent.IsDir() {
+		return nil, nil, ErrNotDirectory
+	}
 	fiNode, _ := fs.getInode(abspath)
 	return fiParent, fiNode, nil
 }
 
+// maximum number of symbolic links followed to resolve a path (as MAXSYMLINKS on Linux)
+const maxSymlinks = 40
+
+// resolves the symbolic links in the directories of an absolute path, and the last element of the path
+// if 'followLast' is true, links are only followed inside the mount point
+func (fs *RedisFS) resolve(path string, followLast bool) (string, error) {
+	root := fs.root.Path()
+	for links := 0; ; {
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			return "", ErrLinkOutsideMount
+		}
+		if rel == "." {
+			return path, nil
+		}
+		parts := strings.Split(rel, "/")
+		next := ""
+		cur := root
+		for n, part := range parts {
+			cur = filepath.Join(cur, part)
+			if n == len(parts)-1 && !followLast {
+				break
+			}
+			i, ok := fs.getInode(cur)
+			if !ok {
+				break // nothing to follow in a path that does not exist (yet)
+			}
+			if !i.IsSymlink() {
+				if n < len(parts)-1 && !i.IsDir() {
+					return "", ErrNotDirectory // a file used as a directory
+				}
+				continue
+			}
+			if links++; links > maxSymlinks {
+				return "", ErrTooManyLinks
+			}
+			target := i.Target()
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(cur), target)
+			}
+			next = filepath.Join(append([]string{target}, parts[n+1:]...)...)
+			break
+		}
+		if next == "" {
+			return path, nil
+		}
+		path = next
+	}
+}
+
 // Mkdir creates a new directory with given permissions
 func (fs *RedisFS) Mkdir(name string, perm os.FileMode) error {
 	if err := fs.ValidatePath(name); err != nil {
 		return &os.PathError{Op: "mkdir", Path: name, Err: err}
 	}
-	path, err := filepath.Abs(name)
+	path, err := AbsPath(name)
 	Check(err)
+	if path, err = fs.resolve(path, false); err != nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: err}
+	}
 	fiParent, fiNode, err := fs.fileInfo(path)
 	if err != nil {
 		return &os.PathError{Op: "mkdir", Path: name, Err: err}
@@ -169,7 +456,12 @@ func (fs *RedisFS) Mkdir(name string, perm os.FileMode) error {
 	if fiNode != nil {
 		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
 	}
-	fs.createInode(path, true, perm, fiParent)
+	if _, ok := fs.lowerStat(path); ok {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	if _, err := fs.createInode(path, true, perm, fiParent); err != nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: err}
+	}
 	return nil
 }
 
@@ -190,15 +482,27 @@ func (fs *RedisFS) ReadDir(path string) ([]os.FileInfo, error) {
 	if err := fs.ValidatePath(path); err != nil {
 		return nil, &os.PathError{Op: "readdir", Path: path, Err: err}
 	}
-	path, err := filepath.Abs(path)
+	path, err := AbsPath(path)
 	Check(err)
+	if path, err = fs.resolve(path, true); err != nil {
+		return nil, &os.PathError{Op: "readdir", Path: path, Err: err}
+	}
 	_, fi, err := fs.fileInfo(path)
 	if err != nil {
 		return nil, &os.PathError{Op: "readdir", Path: path, Err: err}
 	}
+	if fi == nil {
+		fi = fs.lowerDir(path)
+	}
+	if fi == nil {
+		if _, ok := fs.lowerStat(path); !ok {
+			return nil, &os.PathError{Op: "readdir", Path: path, Err: os.ErrNotExist}
+		}
+	}
 	if fi == nil || !fi.IsDir() {
 		return nil, &os.PathError{Op: "readdir", Path: path, Err: ErrNotDirectory}
 	}
+	fi.touchMeta()
 
 	fis, err := fi.getChildren()
 	if err != nil {
@@ -208,16 +512,21 @@ func (fs *RedisFS) ReadDir(path string) ([]os.FileInfo, error) {
 	for i := 0; i < len(fis); i++ {
 		f[i] = fis[i]
 	}
+	f = fs.mergeLower(path, f)
 	sort.Sort(byName(f))
 	return f, nil
 }
 
-//RmDir remove a directory if it has no entry
+// RmDir remove a directory if it has no entry
 func (fs *RedisFS) RmDir(path string) error {
 	if err := fs.ValidatePath(path); err != nil {
 		return &os.PathError{Op: "rmdir", Path: path, Err: err}
 	}
-	path = filepath.Clean(path)
+	path, err := AbsPath(path)
+	Check(err)
+	if fi, err := fs.Lstat(path); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		return &os.PathError{Op: "rmdir", Path: path, Err: ErrNotDirectory}
+	}
 	entries, err := fs.ReadDir(path)
 	if err != nil {
 		return &os.PathError{Op: "rmdir", Path: path, Err: err}
@@ -235,31 +544,146 @@ func hasFlag(flag int, flags int) bool {
 // OpenFile opens a file handle with a specified flag (os.O_RDONLY etc.) and perm (e.g. 0666).
 // If success the returned File can be used for I/O. Otherwise an error is returned, which
 // is a *os.PathError and can be extracted for further information.
+// Readers of files matching the seal wait patterns block until the files are sealed (see SealWaiter).
 func (fs *RedisFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	wait, err := fs.SealWaiter(name, flag)
+	if err == nil {
+		err = wait()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return fs.OpenFileNoWait(name, flag, perm)
+}
+
+// SealWaiter returns a function blocking until the named file is sealed by its last writer if readers
+// opening it with 'flag' wait for it (see config.SealWait), or a function returning at once otherwise.
+// The function does not use the RedisFS so that callers may release their own locks while waiting.
+func (fs *RedisFS) SealWaiter(name string, flag int) (func() error, error) {
+	noWait := func() error { return nil }
+	wait := fs.mountConf.SealWait
+	if isWriteFlag(flag) || len(wait.Patterns) == 0 {
+		return noWait, nil
+	}
 	if err := fs.ValidatePath(name); err != nil {
 		return nil, &os.PathError{Op: "open", Path: name, Err: err}
 	}
-	path, err := filepath.Abs(name)
+	path, err := AbsPath(name)
 	Check(err)
+	fs.expireAttrs(path)
+	if path, err = fs.resolve(path, !hasFlag(syscall.O_NOFOLLOW, flag)); err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	if !fs.matchAny(wait.Patterns, path) {
+		return noWait, nil
+	}
+	timeout := time.Duration(wait.Timeout * float64(time.Second))
+	inode := NewInode(fs.dataStore, fs.redisRing, path)
+	return func() error {
+		if err := inode.waitSealed(timeout); err != nil {
+			return &os.PathError{Op: "open", Path: name, Err: err}
+		}
+		return nil
+	}, nil
+}
+
+// OpenFileNoWait opens a file as OpenFile does, without waiting for the file to be sealed
+func (fs *RedisFS) OpenFileNoWait(name string, flag int, perm os.FileMode) (File, error) {
+	if err := fs.ValidatePath(name); err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	path, err := AbsPath(name)
+	Check(err)
+	// close-to-open consistency: the file, or the link to it, is revalidated against Redis
+	fs.expireAttrs(path)
+	if path, err = fs.resolve(path, !hasFlag(syscall.O_NOFOLLOW, flag)); err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	fs.expireAttrs(path)
 	fiParent, fiNode, err := fs.fileInfo(path)
 	if err != nil {
 		return nil, &os.PathError{Op: "open", Path: name, Err: err}
 	}
 
+	if fiNode == nil {
+		if fi, ok := fs.lowerStat(path); ok {
+			f, i, err := fs.openLower(path, fi, flag, fiParent)
+			if err != nil {
+				return nil, &os.PathError{Op: "open", Path: name, Err: err}
+			}
+			if f != nil {
+				return f, nil
+			}
+			fiNode = i // copied up
+		}
+	}
 	if fiNode == nil {
 		if !hasFlag(os.O_CREATE, flag) {
 			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
 		}
-		fiNode = fs.createInode(path, false, perm, fiParent)
+		if fiNode, err = fs.createInode(path, false, perm, fiParent); err != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+		fs.events.emit(config.EventCreate, path, 0)
+		fs.addToSeries(path)
+		if node := fs.pinnedNode(path); node != "" {
+			if err := fiNode.pin(node); err != nil {
+				log.Printf("WARNING cannot pin '%s' on node %s, using ring placement: %s", path, node, err)
+			}
+		}
 	} else { // file exists
 		if hasFlag(os.O_CREATE|os.O_EXCL, flag) {
 			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
 		}
+		if fiNode.IsSymlink() { // O_NOFOLLOW
+			return nil, &os.PathError{Op: "open", Path: name, Err: ErrTooManyLinks}
+		}
 		if fiNode.IsDir() {
-			return nil, &os.PathError{Op: "open", Path: name, Err: ErrIsDirectory}
+			if isWriteFlag(flag) {
+				return nil, &os.PathError{Op: "open", Path: name, Err: ErrIsDirectory}
+			}
+			fiNode.touchMeta()
+			return &dirFile{path}, nil
 		}
+		if hasFlag(syscall.O_DIRECTORY, flag) {
+			return nil, &os.PathError{Op: "open", Path: name, Err: ErrNotDirectory}
+		}
+		fiNode.touch()
+	}
+	f, err := fiNode.getFile(flag)
+	if err != nil {
+		return nil, err
 	}
-	return fiNode.getFile(flag)
+	if !isWriteFlag(flag) {
+		if rule := fs.retention(path); rule != nil && rule.MaxReads > 0 {
+			f = &consumeOnCloseFile{f, fs, fiNode}
+		}
+		return f, nil
+	}
+	if hasFlag(os.O_TRUNC, flag) {
+		fs.events.emit(config.EventTruncate, path, 0)
+	}
+	f = &sealOnCloseFile{f, fiNode.openWriter()}
+	if fs.events != nil {
+		f = &eventsFile{f, fs.events, fiNode}
+	}
+	// the file is modified, it must be drained again
+	if fs.mountConf.Staging.Out != "" {
+		fs.stager.Reset(path)
+		if fs.matchAny(fs.mountConf.Staging.OnClose, path) {
+			f = &stageOnCloseFile{f, fs.stager}
+		}
+	}
+	if fs.flusher != nil {
+		fs.flusher.Reset(path)
+		f = &stageOnCloseFile{f, fs.flusher}
+	}
+	return f, nil
+}
+
+// returns true if the open flags allow writing
+func isWriteFlag(flag int) bool {
+	return hasFlag(os.O_WRONLY, flag) || hasFlag(os.O_RDWR, flag) || hasFlag(os.O_TRUNC, flag)
 }
 
 // roFile wraps the given file and disables Write(..) operation.
@@ -272,6 +696,16 @@ func (f *roFile) Write(p []byte) (n int, err error) {
 	return 0, ErrReadOnly
 }
 
+// Truncate is disabled and returns ErrorReadOnly
+func (f *roFile) Truncate(size int64) error {
+	return ErrReadOnly
+}
+
+// Fallocate is disabled and returns ErrorReadOnly
+func (f *roFile) Fallocate(mode int, off, length int64) error {
+	return ErrReadOnly
+}
+
 // woFile wraps the given file and disables Read(..) operation.
 type woFile struct {
 	File
@@ -282,47 +716,267 @@ func (f *woFile) Read(p []byte) (n int, err error) {
 	return 0, ErrWriteOnly
 }
 
+// sealOnCloseFile wraps a file opened for writing, the file is sealed once closed by its last writer
+type sealOnCloseFile struct {
+	File
+	writer *writer
+}
+
+// Close closes the file and unregisters the writer
+func (f *sealOnCloseFile) Close() error {
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+	f.writer.close()
+	return nil
+}
+
+// dirFile is a handle on an opened directory, used as base directory by the *at calls (openat, ...)
+type dirFile struct {
+	path string
+}
+
+// IsDir returns true if the file is a handle on a directory
+func IsDir(f File) bool {
+	_, ok := f.(*dirFile)
+	return ok
+}
+
+// Name returns the path of the directory
+func (d *dirFile) Name() string {
+	return d.path
+}
+
+// Sync does nothing
+func (d *dirFile) Sync() error {
+	return nil
+}
+
+// Close does nothing
+func (d *dirFile) Close() error {
+	return nil
+}
+
+// Seek does nothing, directory entries are listed with RedisFS.ReadDir
+func (d *dirFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, nil
+}
+
+// Truncate is disabled and returns ErrIsDirectory
+func (d *dirFile) Truncate(size int64) error {
+	return ErrIsDirectory
+}
+
+// Fallocate is disabled and returns ErrIsDirectory
+func (d *dirFile) Fallocate(mode int, off, length int64) error {
+	return ErrIsDirectory
+}
+
+// Read is disabled and returns ErrIsDirectory
+func (d *dirFile) Read(p []byte) (int, error) {
+	return 0, ErrIsDirectory
+}
+
+// ReadAt is disabled and returns ErrIsDirectory
+func (d *dirFile) ReadAt(p []byte, off int64) (int, error) {
+	return 0, ErrIsDirectory
+}
+
+// Write is disabled and returns ErrIsDirectory
+func (d *dirFile) Write(p []byte) (int, error) {
+	return 0, ErrIsDirectory
+}
+
+// WriteAt is disabled and returns ErrIsDirectory
+func (d *dirFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, ErrIsDirectory
+}
+
+// ReadVec is disabled and returns ErrIsDirectory
+func (d *dirFile) ReadVec(datav [][]byte) (int, error) {
+	return 0, ErrIsDirectory
+}
+
+// ReadVecAt is disabled and returns ErrIsDirectory
+func (d *dirFile) ReadVecAt(datav [][]byte, off int64) (int, error) {
+	return 0, ErrIsDirectory
+}
+
+// WriteVec is disabled and returns ErrIsDirectory
+func (d *dirFile) WriteVec(datav [][]byte) (int, error) {
+	return 0, ErrIsDirectory
+}
+
+// WriteVecAt is disabled and returns ErrIsDirectory
+func (d *dirFile) WriteVecAt(datav [][]byte, off int64) (int, error) {
+	return 0, ErrIsDirectory
+}
+
 // Remove removes the named file or directory.
 // If there is an error, it will be of type *PathError.
 func (fs *RedisFS) Remove(name string) error {
 	if err := fs.ValidatePath(name); err != nil {
 		return &os.PathError{Op: "remove", Path: name, Err: err}
 	}
-	path, err := filepath.Abs(name)
+	path, err := AbsPath(name)
 	Check(err)
+	if path, err = fs.resolve(path, false); err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	}
 	fiParent, fiNode, err := fs.fileInfo(path)
 	if err != nil {
 		return &os.PathError{Op: "remove", Path: name, Err: err}
 	}
 	if fiNode == nil {
+		if _, ok := fs.lowerStat(path); ok {
+			return &os.PathError{Op: "remove", Path: name, Err: ErrReadOnlyFS}
+		}
 		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
 	}
+	unlink := fs.events.enabled(config.EventUnlink, path) && !fiNode.IsDir()
 	fiParent.removeChild(fiNode)
 	fs.removeInode(fiNode)
+	if _, ok := fs.lowerStat(path); ok {
+		// the file was copied up, hide the file of the real directory
+		fs.addWhiteout(fiParent, path)
+	}
+	if unlink {
+		fs.events.emit(config.EventUnlink, path, 0)
+	}
+	return nil
+}
+
+// Truncate changes the size of the named file, the file is opened for writing
+// so that the truncation is seen as any other modification (events, staging, ...)
+func (fs *RedisFS) Truncate(name string, size int64) error {
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: name, Err: ErrNegativeTruncateSize}
+	}
+	f, err := fs.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return &os.PathError{Op: "truncate", Path: name, Err: err}
+	}
+	return f.Close()
+}
+
+// Persist removes the expiry of the named file or directory so that it is kept until removed.
+// The parent directories are persisted as well to keep the file reachable.
+func (fs *RedisFS) Persist(name string) error {
+	if err := fs.ValidatePath(name); err != nil {
+		return &os.PathError{Op: "persist", Path: name, Err: err}
+	}
+	path, err := AbsPath(name)
+	Check(err)
+	if path, err = fs.resolve(path, true); err != nil {
+		return &os.PathError{Op: "persist", Path: name, Err: err}
+	}
+	_, fiNode, err := fs.fileInfo(path)
+	if err != nil {
+		return &os.PathError{Op: "persist", Path: name, Err: err}
+	}
+	if fiNode == nil {
+		return &os.PathError{Op: "persist", Path: name, Err: os.ErrNotExist}
+	}
+	for p := path; p != fs.root.Path(); p = filepath.Dir(p) {
+		i, ok := fs.getInode(p)
+		if !ok {
+			return &os.PathError{Op: "persist", Path: name, Err: os.ErrNotExist}
+		}
+		i.persist()
+	}
 	return nil
 }
 
 // Stat returns the Inode structure describing the named file.
 // If there is an error, it will be of type *PathError.
 func (fs *RedisFS) Stat(name string) (os.FileInfo, error) {
+	return fs.stat(name, "stat", true)
+}
+
+// returns the Inode describing the named file, the file itself being a link is followed if 'follow' is true
+func (fs *RedisFS) stat(name, op string, follow bool) (os.FileInfo, error) {
 	if err := fs.ValidatePath(name); err != nil {
-		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+		return nil, &os.PathError{Op: op, Path: name, Err: err}
 	}
-	path, err := filepath.Abs(name)
+	path, err := AbsPath(name)
 	Check(err)
+	if path, err = fs.resolve(path, follow); err != nil {
+		return nil, &os.PathError{Op: op, Path: name, Err: err}
+	}
 	_, fi, err := fs.fileInfo(path)
 	if err != nil {
-		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+		return nil, &os.PathError{Op: op, Path: name, Err: err}
 	}
 	if fi == nil {
-		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+		if lower, ok := fs.lowerStat(path); ok {
+			return lower, nil
+		}
+		return nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
 	}
 	return fi, nil
 }
 
-// Lstat returns a Inode describing the named file.
-// RedisFS does not support symbolic links.
-// Alias for fs.Stat(name)
+// Lstat returns a Inode describing the named file, if the file is a symbolic link
+// the Inode describes the link itself (the link is not followed).
 func (fs *RedisFS) Lstat(name string) (os.FileInfo, error) {
-	return fs.Stat(name)
+	return fs.stat(name, "lstat", false)
+}
+
+// Symlink creates 'name' as a symbolic link to 'target', the target may not exist but must be in the mount point
+func (fs *RedisFS) Symlink(target, name string) error {
+	if err := fs.ValidatePath(name); err != nil {
+		return &os.PathError{Op: "symlink", Path: name, Err: err}
+	}
+	if target == "" {
+		return &os.PathError{Op: "symlink", Path: name, Err: os.ErrNotExist}
+	}
+	path, err := AbsPath(name)
+	Check(err)
+	if path, err = fs.resolve(path, false); err != nil {
+		return &os.PathError{Op: "symlink", Path: name, Err: err}
+	}
+	fiParent, fiNode, err := fs.fileInfo(path)
+	if err != nil {
+		return &os.PathError{Op: "symlink", Path: name, Err: err}
+	}
+	if fiNode != nil {
+		return &os.PathError{Op: "symlink", Path: name, Err: os.ErrExist}
+	}
+	if _, ok := fs.lowerStat(path); ok {
+		return &os.PathError{Op: "symlink", Path: name, Err: os.ErrExist}
+	}
+	abstarget := filepath.Clean(target)
+	if !filepath.IsAbs(abstarget) {
+		abstarget = filepath.Join(filepath.Dir(path), abstarget)
+	}
+	if !InMount(abstarget, fs.mountConf.Path) {
+		return &os.PathError{Op: "symlink", Path: name, Err: ErrLinkOutsideMount}
+	}
+	// the target is recorded first so that the link is never seen without it
+	link := NewInode(fs.dataStore, fs.redisRing, path)
+	if err := link.setTarget(target); err != nil {
+		return &os.PathError{Op: "symlink", Path: name, Err: err}
+	}
+	if _, err := fs.createInode(path, false, os.ModeSymlink|0777, fiParent); err != nil {
+		link.delMeta()
+		return &os.PathError{Op: "symlink", Path: name, Err: err}
+	}
+	return nil
+}
+
+// Readlink returns the target of the symbolic link 'name'
+func (fs *RedisFS) Readlink(name string) (string, error) {
+	fi, err := fs.stat(name, "readlink", false)
+	if err != nil {
+		return "", err
+	}
+	i, ok := fi.(*Inode)
+	if !ok || !i.IsSymlink() {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: ErrNotSymlink}
+	}
+	return i.Target(), nil
 }
@@ -20,10 +20,13 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 	"reflect"
 
+	"github.com/cea-hpc/pdwfs/config"
 	"github.com/cea-hpc/pdwfs/util"
 )
 
@@ -711,3 +714,452 @@ func TestBenchOpenWriteClose(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestPinnedPlacement(t *testing.T) {
+	server1, redisConf := util.InitRedisTestServer()
+	defer server1.Stop()
+	server2, redisConf2 := util.InitRedisTestServer()
+	defer server2.Stop()
+	redisConf.Addrs = append(redisConf.Addrs, redisConf2.Addrs...)
+
+	mountConf := util.GetMountPathConf()
+	mountConf.Path = "/"
+	mountConf.StripeSize = 10
+	mountConf.Pins = []config.Pin{{Pattern: "/pinned", Node: redisConf2.Addrs[0]}}
+
+	fs := NewRedisFS(redisConf, mountConf)
+	defer fs.Finalize()
+
+	util.Ok(t, fs.Mkdir("/pinned", 0777))
+	f, err := fs.OpenFile("/pinned/file", os.O_RDWR|os.O_CREATE, 0666)
+	util.Ok(t, err)
+	data := bytes.Repeat([]byte("0123456789"), 10)
+	_, err = f.Write(data)
+	util.Ok(t, err)
+
+	// all stripes are on the pinned node
+	stripes, err := NewRedisClient(redisConf2.Addrs[0]).SMembers("/pinned/file:stripes")
+	util.Ok(t, err)
+	util.Equals(t, 10, len(stripes), "all stripes should be on the pinned node")
+
+	// another client finds the stripes from the metadata
+	fs2 := NewRedisFS(redisConf, mountConf)
+	defer fs2.Finalize()
+	f2, err := fs2.OpenFile("/pinned/file", os.O_RDONLY, 0)
+	util.Ok(t, err)
+	readData, err := ioutil.ReadAll(f2)
+	util.Ok(t, err)
+	util.Equals(t, data, readData, "read data does not match written data")
+
+	// a pin on a node which left the ring falls back to the ring placement
+	prefix := metaKeyPrefix(fs.dataStore, "/pinned/file")
+	client := fs.redisRing.GetClient(prefix)
+	util.Ok(t, client.Set(prefix+":node", []byte("unknown:6379")))
+	fs3 := NewRedisFS(redisConf, mountConf)
+	defer fs3.Finalize()
+	_, err = fs3.Stat("/pinned/file")
+	util.Ok(t, err)
+	util.Ok(t, client.Set(prefix+":node", []byte(redisConf2.Addrs[0])))
+
+	util.Ok(t, fs2.Remove("/pinned/file"))
+	pinned, err := NewRedisClient(redisConf2.Addrs[0]).SMembers(pinnedKey)
+	util.Ok(t, err)
+	util.Equals(t, 0, len(pinned), "file should have been unpinned")
+}
+
+func TestMatchPathOrParent(t *testing.T) {
+	util.Assert(t, matchPathOrParent("/mnt/out/*.h5", "/mnt/out/a.h5", "/mnt"), "file should match")
+	util.Assert(t, matchPathOrParent("/mnt/analysis", "/mnt/analysis/step/a.h5", "/mnt"), "parent directory should match")
+	util.Assert(t, !matchPathOrParent("/mnt/analysis", "/mnt/other/a.h5", "/mnt"), "path should not match")
+	util.Assert(t, !matchPathOrParent("/", "/mnt/a.h5", "/mnt"), "directories above the mount point should not match")
+}
+
+func TestStatfs(t *testing.T) {
+	redis, redisConf := util.InitRedisTestServer()
+	defer redis.Stop()
+
+	client := NewRedisClient(redisConf.Addrs[0])
+	defer client.Close()
+	conn := client.pool.Get()
+	_, err := conn.Do("CONFIG", "SET", "maxmemory", 100*1024*1024)
+	util.Ok(t, err)
+	conn.Close()
+
+	mountConf := util.GetMountPathConf()
+	mountConf.HighWatermark = 50
+	fs := NewRedisFS(redisConf, mountConf)
+	defer fs.Finalize()
+
+	stats, err := fs.Statfs()
+	util.Ok(t, err)
+	util.Equals(t, uint64(100*1024*1024/statfsBlockSize), stats.Blocks, "total blocks should match maxmemory")
+	util.Assert(t, stats.BlocksFree < stats.Blocks, "some memory is used")
+	util.Assert(t, stats.BlocksAvail < stats.Blocks/2, "available blocks should be below high watermark")
+}
+
+func TestQuotaInodes(t *testing.T) {
+	redis, redisConf := util.InitRedisTestServer()
+	defer redis.Stop()
+
+	mountConf := util.GetMountPathConf()
+	mountConf.Quota = config.Quota{Inodes: 2}
+	fs := NewRedisFS(redisConf, mountConf)
+	defer fs.Finalize()
+
+	dir := filepath.Join(mountConf.Path, "dir")
+	util.Ok(t, fs.Mkdir(dir, 0755))
+	f, err := fs.OpenFile(filepath.Join(dir, "file1"), os.O_CREATE|os.O_RDWR, 0600)
+	util.Ok(t, err)
+	f.Close()
+
+	_, err = fs.OpenFile(filepath.Join(dir, "file2"), os.O_CREATE|os.O_RDWR, 0600)
+	e, ok := err.(*os.PathError)
+	util.Assert(t, ok && e.Err == ErrQuotaExceeded, "file creation above inode quota should fail")
+
+	stats, err := fs.Statfs()
+	util.Ok(t, err)
+	util.Equals(t, uint64(2), stats.Files, "wrong number of inodes")
+	util.Equals(t, uint64(0), stats.FilesFree, "wrong number of free inodes")
+
+	util.Ok(t, fs.Remove(dir))
+	stats, err = fs.Statfs()
+	util.Ok(t, err)
+	util.Equals(t, uint64(2), stats.FilesFree, "inodes should be released")
+}
+
+func TestTTL(t *testing.T) {
+	redis, redisConf := util.InitRedisTestServer()
+	defer redis.Stop()
+
+	mountConf := util.GetMountPathConf()
+	mountConf.TTL = 1
+	fs := NewRedisFS(redisConf, mountConf)
+	defer fs.Finalize()
+
+	dir := filepath.Join(mountConf.Path, "dir")
+	util.Ok(t, fs.Mkdir(dir, 0755))
+	for _, name := range []string{"expired", "persisted"} {
+		f, err := fs.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_RDWR, 0600)
+		util.Ok(t, err)
+		_, err = f.Write([]byte("some data"))
+		util.Ok(t, err)
+		f.Close()
+	}
+	util.Ok(t, fs.Persist(filepath.Join(dir, "persisted")))
+
+	time.Sleep(2 * time.Second)
+
+	_, err := fs.Stat(filepath.Join(dir, "expired"))
+	util.Assert(t, os.IsNotExist(err), "file should have expired")
+
+	entries, err := fs.ReadDir(dir)
+	util.Ok(t, err)
+	util.Equals(t, 1, len(entries), "expired entry should be pruned")
+
+	fi, err := fs.Stat(filepath.Join(dir, "persisted"))
+	util.Ok(t, err)
+	util.Equals(t, int64(9), fi.Size(), "persisted file content should be kept")
+}
+
+func TestSealWait(t *testing.T) {
+	redis, redisConf := util.InitRedisTestServer()
+	defer redis.Stop()
+
+	mountConf := util.GetMountPathConf()
+	mountConf.SealWait.Patterns = []string{"*.out"}
+	mountConf.SealWait.Timeout = 5
+	fs := NewRedisFS(redisConf, mountConf)
+	defer fs.Finalize()
+
+	name := filepath.Join(mountConf.Path, "result.out")
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		f, err := fs.OpenFile(name, os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return
+		}
+		f.Write([]byte("some data"))
+		time.Sleep(500 * time.Millisecond)
+		f.Close()
+	}()
+
+	// the reader blocks until the file is created and closed by the writer
+	f, err := fs.OpenFile(name, os.O_RDONLY, 0)
+	util.Ok(t, err)
+	buf := make([]byte, 9)
+	_, err = f.Read(buf)
+	util.Ok(t, err)
+	util.Equals(t, "some data", string(buf), "reader should see the whole sealed file")
+	f.Close()
+
+	// the file stays sealed for later readers
+	f, err = fs.OpenFile(name, os.O_RDONLY, 0)
+	util.Ok(t, err)
+	f.Close()
+
+	// reopening for writing unseals the file
+	w, err := fs.OpenFile(name, os.O_WRONLY, 0)
+	util.Ok(t, err)
+	defer w.Close()
+	mountConf.SealWait.Timeout = 1
+	_, err = fs.OpenFile(name, os.O_RDONLY, 0)
+	e, ok := err.(*os.PathError)
+	util.Assert(t, ok && e.Err == ErrTimeout, "open should time out on an unsealed file")
+}
+
+func TestSealWaiter(t *testing.T) {
+	redis, redisConf := util.InitRedisTestServer()
+	defer redis.Stop()
+
+	mountConf := util.GetMountPathConf()
+	mountConf.SealWait.Patterns = []string{"*.out"}
+	mountConf.SealWait.Timeout = 5
+	fs := NewRedisFS(redisConf, mountConf)
+	defer fs.Finalize()
+
+	// callers serializing the calls to the RedisFS (as pdwfs does) release their lock while waiting,
+	// so that a writer of the same process can seal the file
+	var lock sync.Mutex
+	name := filepath.Join(mountConf.Path, "result.out")
+	lock.Lock()
+	wait, err := fs.SealWaiter(name, os.O_RDONLY)
+	lock.Unlock()
+	util.Ok(t, err)
+	go func() {
+		lock.Lock()
+		defer lock.Unlock()
+		if f, err := fs.OpenFile(name, os.O_CREATE|os.O_WRONLY, 0600); err == nil {
+			f.Close()
+		}
+	}()
+	util.Ok(t, wait())
+	lock.Lock()
+	defer lock.Unlock()
+	f, err := fs.OpenFileNoWait(name, os.O_RDONLY, 0)
+	util.Ok(t, err)
+	f.Close()
+
+	// files not matching the patterns and writers do not wait
+	wait, err = fs.SealWaiter(filepath.Join(mountConf.Path, "missing"), os.O_RDONLY)
+	util.Ok(t, err)
+	util.Ok(t, wait())
+	wait, err = fs.SealWaiter(filepath.Join(mountConf.Path, "missing.out"), os.O_WRONLY)
+	util.Ok(t, err)
+	util.Ok(t, wait())
+}
+
+func TestSealDeadWriter(t *testing.T) {
+	redis, redisConf := util.InitRedisTestServer()
+	defer redis.Stop()
+
+	defer func(lease time.Duration) { writerLease = lease }(writerLease)
+	writerLease = time.Second
+
+	mountConf := util.GetMountPathConf()
+	mountConf.SealWait.Patterns = []string{"*.out"}
+	mountConf.SealWait.Timeout = 0
+	fs := NewRedisFS(redisConf, mountConf)
+	defer fs.Finalize()
+
+	name := filepath.Join(mountConf.Path, "result.out")
+	f, err := fs.OpenFile(name, os.O_CREATE|os.O_WRONLY, 0600)
+	util.Ok(t, err)
+	// the writer dies: its lease is no longer refreshed and the file is never closed
+	w := f.(*sealOnCloseFile).writer
+	close(w.stop)
+	<-w.done
+
+	// a reader waiting forever seals the file once the lease of the writer has expired
+	done := make(chan error, 1)
+	go func() {
+		r, err := fs.OpenFile(name, os.O_RDONLY, 0)
+		if err == nil {
+			r.Close()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		util.Ok(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("reader should not wait for a dead writer")
+	}
+}
+
+func TestOpenDir(t *testing.T) {
+	redis, redisConf := util.InitRedisTestServer()
+	defer redis.Stop()
+
+	mountConf := util.GetMountPathConf()
+	fs := NewRedisFS(redisConf, mountConf)
+	defer fs.Finalize()
+
+	dir := filepath.Join(mountConf.Path, "dir")
+	util.Ok(t, fs.Mkdir(dir, 0755))
+	d, err := fs.OpenFile(dir, os.O_RDONLY|syscall.O_DIRECTORY, 0)
+	util.Ok(t, err)
+	util.Assert(t, IsDir(d), "directory handle expected")
+	util.Equals(t, dir, d.Name(), "wrong directory handle name")
+	_, err = d.Read(make([]byte, 1))
+	util.Equals(t, ErrIsDirectory, err, "directory handle cannot be read")
+	util.Ok(t, d.Close())
+
+	_, err = fs.OpenFile(dir, os.O_WRONLY, 0)
+	util.Equals(t, ErrIsDirectory, err.(*os.PathError).Err, "directory cannot be opened for writing")
+
+	f, err := fs.OpenFile(filepath.Join(dir, "file"), os.O_CREATE|os.O_WRONLY, 0600)
+	util.Ok(t, err)
+	util.Assert(t, !IsDir(f), "regular file expected")
+	f.Close()
+	_, err = fs.OpenFile(filepath.Join(dir, "file"), os.O_RDONLY|syscall.O_DIRECTORY, 0)
+	util.Equals(t, ErrNotDirectory, err.(*os.PathError).Err, "regular file is not a directory")
+}
+
+func TestSymlink(t *testing.T) {
+	redis, redisConf := util.InitRedisTestServer()
+	defer redis.Stop()
+
+	mountConf := util.GetMountPathConf()
+	fs := NewRedisFS(redisConf, mountConf)
+	defer fs.Finalize()
+
+	step := filepath.Join(mountConf.Path, "step_0042")
+	util.Ok(t, fs.Mkdir(step, 0755))
+	f, err := fs.OpenFile(filepath.Join(step, "data"), os.O_CREATE|os.O_WRONLY, 0600)
+	util.Ok(t, err)
+	_, err = f.Write([]byte("step 42"))
+	util.Ok(t, err)
+	f.Close()
+
+	latest := filepath.Join(mountConf.Path, "latest")
+	util.Ok(t, fs.Symlink("step_0042", latest))
+	err = fs.Symlink("step_0042", latest)
+	util.Assert(t, os.IsExist(err), "link already exists")
+
+	target, err := fs.Readlink(latest)
+	util.Ok(t, err)
+	util.Equals(t, "step_0042", target, "wrong link target")
+	_, err = fs.Readlink(step)
+	util.Equals(t, ErrNotSymlink, err.(*os.PathError).Err, "directory is not a link")
+
+	// links are followed in the directories of a path and by Stat, not by Lstat
+	f, err = fs.OpenFile(filepath.Join(latest, "data"), os.O_RDONLY, 0)
+	util.Ok(t, err)
+	buf := make([]byte, 7)
+	_, err = f.Read(buf)
+	util.Ok(t, err)
+	util.Equals(t, "step 42", string(buf), "wrong content read through link")
+	f.Close()
+
+	fi, err := fs.Stat(latest)
+	util.Ok(t, err)
+	util.Assert(t, fi.IsDir(), "link to a directory should stat as a directory")
+	fi, err = fs.Lstat(latest)
+	util.Ok(t, err)
+	util.Assert(t, fi.Mode()&os.ModeSymlink != 0, "lstat should describe the link")
+	util.Equals(t, int64(len("step_0042")), fi.Size(), "wrong link size")
+
+	// removing the link leaves its target untouched
+	util.Ok(t, fs.Remove(latest))
+	_, err = fs.Lstat(latest)
+	util.Assert(t, os.IsNotExist(err), "link should be removed")
+	_, err = fs.Stat(filepath.Join(step, "data"))
+	util.Ok(t, err)
+
+	// dangling links and loops
+	dangling := filepath.Join(mountConf.Path, "dangling")
+	util.Ok(t, fs.Symlink("missing", dangling))
+	_, err = fs.Stat(dangling)
+	util.Assert(t, os.IsNotExist(err), "dangling link target should not exist")
+
+	a, b := filepath.Join(mountConf.Path, "a"), filepath.Join(mountConf.Path, "b")
+	util.Ok(t, fs.Symlink(b, a))
+	util.Ok(t, fs.Symlink(a, b))
+	_, err = fs.OpenFile(a, os.O_RDONLY, 0)
+	util.Equals(t, ErrTooManyLinks, err.(*os.PathError).Err, "link loop should be detected")
+
+	_, err = fs.OpenFile(dangling, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	util.Equals(t, ErrTooManyLinks, err.(*os.PathError).Err, "O_NOFOLLOW on a link should fail")
+
+	// links out of the mount point could not be followed
+	outside := filepath.Join(mountConf.Path, "outside")
+	err = fs.Symlink("/etc/passwd", outside)
+	util.Equals(t, ErrLinkOutsideMount, err.(*os.PathError).Err, "absolute target out of the mount point")
+	err = fs.Symlink("../etc/passwd", outside)
+	util.Equals(t, ErrLinkOutsideMount, err.(*os.PathError).Err, "relative target out of the mount point")
+	_, err = fs.Lstat(outside)
+	util.Assert(t, os.IsNotExist(err), "link out of the mount point should not be created")
+}
+
+func TestFileAsDirectory(t *testing.T) {
+	redis, redisConf := util.InitRedisTestServer()
+	defer redis.Stop()
+
+	mountConf := util.GetMountPathConf()
+	fs := NewRedisFS(redisConf, mountConf)
+	defer fs.Finalize()
+
+	file := filepath.Join(mountConf.Path, "file")
+	f, err := fs.OpenFile(file, os.O_CREATE|os.O_WRONLY, 0600)
+	util.Ok(t, err)
+	f.Close()
+
+	_, err = fs.Stat(filepath.Join(file, "x"))
+	util.Equals(t, ErrNotDirectory, err.(*os.PathError).Err, "file used as parent directory")
+	_, err = fs.OpenFile(filepath.Join(file, "x", "y"), os.O_CREATE|os.O_WRONLY, 0600)
+	util.Equals(t, ErrNotDirectory, err.(*os.PathError).Err, "file used as intermediate directory")
+
+	// paths sharing a prefix with the mount path are not managed
+	err = fs.ValidatePath(mountConf.Path + "2/x")
+	util.Equals(t, ErrFileNotManaged, err, "sibling of the mount path should not be managed")
+}
+
+func TestAttrCache(t *testing.T) {
+	redis, redisConf := util.InitRedisTestServer()
+	defer redis.Stop()
+
+	mountConf := util.GetMountPathConf()
+	mountConf.AttrTimeout = 0.1
+	fs := NewRedisFS(redisConf, mountConf)
+	defer fs.Finalize()
+	fs2 := NewRedisFS(redisConf, mountConf) // another process sharing the same Redis instances
+	defer fs2.Finalize()
+
+	path := filepath.Join(mountConf.Path, "file")
+	_, err := writeFile(fs, path, os.O_CREATE|os.O_WRONLY, 0600, []byte(dots))
+	util.Ok(t, err)
+
+	fi, err := fs2.Stat(path)
+	util.Ok(t, err)
+	util.Equals(t, int64(len(dots)), fi.Size(), "wrong size")
+
+	// local writes are seen at once
+	f, err := fs2.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	util.Ok(t, err)
+	_, err = f.Write([]byte(abc))
+	util.Ok(t, err)
+	util.Ok(t, f.Close())
+	fi, err = fs2.Stat(path)
+	util.Ok(t, err)
+	util.Equals(t, int64(len(dots)+len(abc)), fi.Size(), "local write not seen")
+
+	// another process removes the file and creates a directory in its place
+	util.Ok(t, fs.Remove(path))
+	util.Ok(t, fs.Mkdir(path, 0755))
+
+	// opening revalidates the cached inode
+	d, err := fs2.OpenFile(path, os.O_RDONLY, 0)
+	util.Ok(t, err)
+	util.Assert(t, IsDir(d), "recreated directory not seen on open")
+
+	util.Ok(t, fs.RmDir(path))
+	_, err = writeFile(fs, path, os.O_CREATE|os.O_WRONLY, 0600, []byte(abc))
+	util.Ok(t, err)
+
+	// other accesses revalidate once the attributes have timed out
+	time.Sleep(150 * time.Millisecond)
+	fi, err = fs2.Stat(path)
+	util.Ok(t, err)
+	util.Assert(t, !fi.IsDir(), "recreated file not seen after timeout")
+	util.Equals(t, int64(len(abc)), fi.Size(), "wrong size of recreated file")
+}
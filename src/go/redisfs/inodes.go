@@ -18,10 +18,15 @@
 package redisfs
 
 import (
+	"fmt"
+	"log"
+	"math"
 	"os"
 	"strconv"
-	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/cea-hpc/pdwfs/redigo/redis"
 )
 
 //Inode object
@@ -30,9 +35,9 @@ type Inode struct {
 	redisRing *RedisRing
 	path      string
 	keyPrefix string
-	mtx       *sync.RWMutex
-	isDir     *bool
-	mode      *os.FileMode
+	ranges    *RangeMutex // byte-range lock of the open files
+	attrs     *attrCache  // cached attributes, see attrcache.go
+	ttl       int64       // time to live in seconds of the inode metadata and content (0 for no expiry)
 }
 
 //NewInode returns a new Inode object
@@ -41,11 +46,19 @@ func NewInode(dataStore *DataStore, ring *RedisRing, path string) *Inode {
 		dataStore: dataStore,
 		redisRing: ring,
 		path:      path,
-		mtx:       &sync.RWMutex{},
-		keyPrefix: "{" + path + "}", // key prefix is in curly braces to ensure all metadata keys goes on the same instance (see RedisRing)
+		ranges:    NewRangeMutex(),
+		attrs:     newAttrCache(),
+		keyPrefix: metaKeyPrefix(dataStore, path),
 	}
 }
 
+// returns the prefix of the metadata keys of a path,
+// the path is in curly braces to ensure all metadata keys goes on the same instance (see RedisRing),
+// the namespace is kept outside of the braces
+func metaKeyPrefix(dataStore *DataStore, path string) string {
+	return dataStore.namespaced("{" + path + "}")
+}
+
 // check if the inode object already exists in pdwfs (check in Redis)
 func (i *Inode) exists() bool {
 	client := i.redisRing.GetClient(i.keyPrefix)
@@ -54,6 +67,17 @@ func (i *Inode) exists() bool {
 	return ret
 }
 
+// checks the inode against Redis, returns false if it no longer exists (removed or expired),
+// otherwise its cached attributes are dropped as the path may have been removed and created again meanwhile
+func (i *Inode) revalidate() bool {
+	if !i.exists() {
+		return false
+	}
+	i.attrs.invalidate()
+	i.loadPin()
+	return true
+}
+
 // creates the metadata in Redis of a newly created Inode in pdwfs
 func (i *Inode) initMeta(isDir bool, mode os.FileMode) {
 	pipeline := i.redisRing.GetClient(i.keyPrefix).Pipeline()
@@ -61,38 +85,362 @@ func (i *Inode) initMeta(isDir bool, mode os.FileMode) {
 		pipeline.Do("SADD", i.keyPrefix+":children", "")
 	}
 	pipeline.Do("SETNX", i.keyPrefix+":mode", []byte(strconv.FormatInt(int64(mode), 10)))
-	pipeline.Flush()
+	if i.ttl > 0 {
+		for _, k := range i.metaKeys() {
+			pipeline.Do("EXPIRE", k, i.ttl)
+		}
+	}
+	Check(pipeline.Flush())
+}
+
+// returns the keys holding the inode metadata
+func (i *Inode) metaKeys() []string {
+	return []string{i.keyPrefix + ":children", i.keyPrefix + ":mode", i.keyPrefix + ":node", i.keyPrefix + ":" + stagingName, i.keyPrefix + ":" + flushName,
+		i.keyPrefix + ":writers", i.keyPrefix + ":sealed", i.keyPrefix + ":sealtoken", i.keyPrefix + ":reads",
+		locksKey(i.keyPrefix), i.keyPrefix + ":target", i.xattrsKey(), whiteoutsKey(i.dataStore, i.path)}
+}
+
+// sets the time to live of the inode, the content is set to expire at the same time as the metadata
+func (i *Inode) setTTL(ttl int64) {
+	i.ttl = ttl
+	if !i.IsDir() {
+		i.dataStore.SetTTL(i.path, ttl)
+	}
+}
+
+// reads from the metadata whether the inode has been persisted (see persist), in which case it has no time to live
+func (i *Inode) loadTTL(ttl int64) {
+	if ttl > 0 {
+		conn := i.redisRing.GetClient(i.keyPrefix).pool.Get()
+		defer conn.Close()
+		pttl, err := redis.Int64(conn.Do("PTTL", i.keyPrefix+":mode"))
+		Check(err)
+		if pttl == -1 {
+			ttl = 0
+		}
+	}
+	i.setTTL(ttl)
+}
+
+// refreshes the time to live of the metadata only (used for directories)
+func (i *Inode) touchMeta() {
+	if i.ttl <= 0 {
+		return
+	}
+	pipeline := i.redisRing.GetClient(i.keyPrefix).Pipeline()
+	for _, k := range i.metaKeys() {
+		pipeline.Do("EXPIRE", k, i.ttl)
+	}
+	Check(pipeline.Flush())
+	i.dataStore.quota.expire(i.path, i.ttl)
+}
+
+// refreshes the time to live of the metadata and content of the inode on access
+func (i *Inode) touch() {
+	if i.ttl <= 0 {
+		return
+	}
+	i.touchMeta()
+	if !i.IsDir() {
+		Check(i.dataStore.Expire(i.path, i.ttl))
+	}
+}
+
+// removes the expiry of the metadata and content of the inode
+func (i *Inode) persist() {
+	pipeline := i.redisRing.GetClient(i.keyPrefix).Pipeline()
+	for _, k := range i.metaKeys() {
+		pipeline.Do("PERSIST", k)
+	}
+	Check(pipeline.Flush())
+	i.dataStore.quota.expire(i.path, 0)
+	i.setTTL(0)
+	if !i.IsDir() {
+		Check(i.dataStore.Expire(i.path, 0))
+	}
 }
 
 // delete the metadata from Redis
 func (i *Inode) delMeta() {
 	client := i.redisRing.GetClient(i.keyPrefix)
-	Try(client.Unlink(i.keyPrefix+":children", i.keyPrefix+":mode"))
+	Try(client.Unlink(i.metaKeys()...))
+}
+
+// pins the file content on a Redis instance and records it in the metadata,
+// so that readers find the stripes without hashing
+func (i *Inode) pin(node string) error {
+	if err := i.dataStore.Pin(i.path, node); err != nil {
+		return err
+	}
+	client := i.redisRing.GetClient(i.keyPrefix)
+	if err := client.Set(i.keyPrefix+":node", []byte(node)); err != nil {
+		return err
+	}
+	i.touchMeta()
+	return nil
+}
+
+// reads the Redis instance the file content is pinned to (if any) from the metadata,
+// the file falls back to the ring placement if the instance has left the ring
+func (i *Inode) loadPin() {
+	client := i.redisRing.GetClient(i.keyPrefix)
+	node, err := client.Get(i.keyPrefix + ":node")
+	if err == ErrRedisKeyNotFound {
+		node, err = nil, nil
+	}
+	Check(err)
+	if err := i.dataStore.LoadPin(i.path, string(node)); err != nil {
+		log.Printf("WARNING cannot place '%s' on its pinned node, using ring placement: %s", i.path, err)
+	}
+}
+
+// writerLease is the duration after which the registration of a writer not refreshing it expires,
+// a file whose writers all died is then sealed for the readers waiting for it
+var writerLease = 10 * time.Second
+
+// number of writers registered by the process, numbers the writer IDs
+var writerCount int64
+
+// removes the writers of the file whose lease has expired, prefix of the writer scripts ('now' is the time in ms).
+// Keys are the writers sorted set (the lease deadline of each writer), the seal, the seal token list,
+// the mode (for the time to live of the file) and the reads count.
+const expireWritersScript = `
+		redis.replicate_commands()
+		local now = redis.call("TIME")
+		now = now[1] * 1000 + math.floor(now[2] / 1000)
+		local expired = redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now)
+		local function seal()
+			redis.call("DEL", KEYS[1], KEYS[3])
+			redis.call("SET", KEYS[2], 1)
+			redis.call("RPUSH", KEYS[3], 1)
+			local ttl = redis.call("PTTL", KEYS[4])
+			if ttl > 0 then
+				redis.call("PEXPIRE", KEYS[2], ttl)
+				redis.call("PEXPIRE", KEYS[3], ttl)
+			end
+		end
+`
+
+// registers the writer ARGV[1] of the file for ARGV[2] ms, the file is no longer sealed and its reads are counted again
+var openWriterScript = redis.NewScript(5, expireWritersScript+`
+		redis.call("DEL", KEYS[2], KEYS[3], KEYS[5])
+		return redis.call("ZADD", KEYS[1], now + tonumber(ARGV[2]), ARGV[1])
+	`)
+
+// extends the lease of the writer ARGV[1] by ARGV[2] ms
+var refreshWriterScript = redis.NewScript(5, expireWritersScript+`
+		return redis.call("ZADD", KEYS[1], "XX", now + tonumber(ARGV[2]), ARGV[1])
+	`)
+
+// unregisters the writer ARGV[1] of the file, the last writer seals the file and wakes up the readers waiting for it
+var closeWriterScript = redis.NewScript(5, expireWritersScript+`
+		redis.call("ZREM", KEYS[1], ARGV[1])
+		local n = redis.call("ZCARD", KEYS[1])
+		if n == 0 then
+			seal()
+		end
+		return n
+	`)
+
+// seals the file if all its writers died, returns 1 if sealed
+var sealAbandonedScript = redis.NewScript(5, expireWritersScript+`
+		if expired == 0 or redis.call("ZCARD", KEYS[1]) > 0 then
+			return 0
+		end
+		seal()
+		return 1
+	`)
+
+// gives back the token popped by a reader waiting for the file to be sealed, unless a writer reopened the file
+var returnSealTokenScript = redis.NewScript(2, `
+		if redis.call("EXISTS", KEYS[1]) == 1 then
+			redis.call("RPUSH", KEYS[2], 1)
+		end
+		return 1
+	`)
+
+// returns the keys of the writer scripts
+func (i *Inode) writerKeys() []interface{} {
+	return []interface{}{i.keyPrefix + ":writers", i.keyPrefix + ":sealed", i.keyPrefix + ":sealtoken", i.keyPrefix + ":mode", i.keyPrefix + ":reads"}
+}
+
+// runs a writer script with the arguments 'args'
+func (i *Inode) doWriter(script *redis.Script, args ...interface{}) (interface{}, error) {
+	conn := i.redisRing.GetClient(i.keyPrefix).pool.Get()
+	defer conn.Close()
+	return script.Do(conn, append(i.writerKeys(), args...)...)
+}
+
+// writer is the registration of an open file description writing to the file,
+// its lease is refreshed in the background until it is closed
+type writer struct {
+	inode *Inode
+	id    string
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// registers a new writer of the file
+func (i *Inode) openWriter() *writer {
+	host, _ := os.Hostname()
+	w := &writer{
+		inode: i,
+		id:    fmt.Sprintf("%s:%d:%d", host, os.Getpid(), atomic.AddInt64(&writerCount, 1)),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	Try(err(i.doWriter(openWriterScript, w.id, int64(writerLease/time.Millisecond))))
+	go w.refresher()
+	return w
+}
+
+func (w *writer) refresher() {
+	defer close(w.done)
+	ticker := time.NewTicker(writerLease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := w.inode.doWriter(refreshWriterScript, w.id, int64(writerLease/time.Millisecond)); err != nil {
+				log.Printf("WARNING cannot refresh the writer lease of '%s': %s", w.inode.path, err)
+			}
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// unregisters the writer, the file is sealed if it was the last one
+func (w *writer) close() {
+	close(w.stop)
+	<-w.done
+	Try(err(w.inode.doWriter(closeWriterScript, w.id)))
+}
+
+// counts a read of the file, returns 0 if the file is still opened for writing (by a writer alive)
+var addReadScript = redis.NewScript(3, `
+		redis.replicate_commands()
+		local now = redis.call("TIME")
+		redis.call("ZREMRANGEBYSCORE", KEYS[2], "-inf", now[1] * 1000 + math.floor(now[2] / 1000))
+		if redis.call("EXISTS", KEYS[2]) == 1 then
+			return 0
+		end
+		local n = redis.call("INCR", KEYS[1])
+		local ttl = redis.call("PTTL", KEYS[3])
+		if ttl > 0 then
+			redis.call("PEXPIRE", KEYS[1], ttl)
+		end
+		return n
+	`)
+
+// counts a reader closing the file, returns the number of reads since the file was last written
+// or 0 if the file is still opened for writing
+func (i *Inode) addRead() int64 {
+	conn := i.redisRing.GetClient(i.keyPrefix).pool.Get()
+	defer conn.Close()
+	n, err := redis.Int64(addReadScript.Do(conn, i.keyPrefix+":reads", i.keyPrefix+":writers", i.keyPrefix+":mode"))
+	Check(err)
+	return n
+}
+
+//Sealed returns true if the file has been closed by its last writer
+func (i *Inode) Sealed() bool {
+	client := i.redisRing.GetClient(i.keyPrefix)
+	res, err := client.Exists(i.keyPrefix + ":sealed")
+	Check(err)
+	return res
+}
+
+// blocks until the file is sealed by its last writer, the file may not exist yet (a timeout of 0 waits forever).
+// The waiter wakes up at every writer lease to seal the file itself if its writers died.
+func (i *Inode) waitSealed(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	conn := i.redisRing.GetClient(i.keyPrefix).pool.Get()
+	defer conn.Close()
+	for !i.Sealed() {
+		wait := writerLease
+		if timeout > 0 {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				return ErrTimeout
+			}
+			if remaining < wait {
+				wait = remaining
+			}
+		}
+		reply, failure := conn.Do("BLPOP", i.keyPrefix+":sealtoken", int64(math.Ceil(wait.Seconds())))
+		if failure != nil {
+			return failure
+		}
+		if reply != nil {
+			// each seal pushes a single token, give it back for the other readers
+			return err(returnSealTokenScript.Do(conn, i.keyPrefix+":sealed", i.keyPrefix+":sealtoken"))
+		}
+		if _, failure := i.doWriter(sealAbandonedScript); failure != nil {
+			return failure
+		}
+	}
+	return nil
 }
 
 //IsDir returns true if inode is a directory
 func (i *Inode) IsDir() bool {
-	if i.isDir == nil {
+	i.attrs.mtx.Lock()
+	defer i.attrs.mtx.Unlock()
+	if i.attrs.isDir == nil {
 		client := i.redisRing.GetClient(i.keyPrefix)
 		res, err := client.Exists(i.keyPrefix + ":children")
 		Check(err)
-		i.isDir = &res
+		i.attrs.isDir = &res
 	}
-	return *i.isDir
+	return *i.attrs.isDir
 }
 
 //Mode returns the inode access mode
 func (i *Inode) Mode() os.FileMode {
-	if i.mode == nil {
+	i.attrs.mtx.Lock()
+	defer i.attrs.mtx.Unlock()
+	if i.attrs.mode == nil {
 		client := i.redisRing.GetClient(i.keyPrefix)
 		val, err := client.Get(i.keyPrefix + ":mode")
 		Check(err)
 		res, err := strconv.ParseInt(string(val), 10, 64)
 		Check(err)
 		m := os.FileMode(res)
-		i.mode = &m
+		i.attrs.mode = &m
 	}
-	return *i.mode
+	return *i.attrs.mode
+}
+
+//IsSymlink returns true if inode is a symbolic link
+func (i *Inode) IsSymlink() bool {
+	return i.Mode()&os.ModeSymlink != 0
+}
+
+// records the target of a symbolic link, before its metadata is created (see initMeta)
+func (i *Inode) setTarget(target string) error {
+	client := i.redisRing.GetClient(i.keyPrefix)
+	if err := client.Set(i.keyPrefix+":target", []byte(target)); err != nil {
+		return err
+	}
+	i.attrs.mtx.Lock()
+	defer i.attrs.mtx.Unlock()
+	i.attrs.target = &target
+	return nil
+}
+
+//Target returns the path a symbolic link points to
+func (i *Inode) Target() string {
+	i.attrs.mtx.Lock()
+	defer i.attrs.mtx.Unlock()
+	if i.attrs.target == nil {
+		client := i.redisRing.GetClient(i.keyPrefix)
+		val, err := client.Get(i.keyPrefix + ":target")
+		Check(err)
+		target := string(val)
+		i.attrs.target = &target
+	}
+	return *i.attrs.target
 }
 
 //Path returns the Path of the file
@@ -115,18 +463,22 @@ func (i *Inode) ModTime() time.Time {
 	return time.Now()
 }
 
-//Size returns the size of the file
+//Size returns the size of the file (the length of the target for a symbolic link)
 func (i *Inode) Size() int64 {
 	if i.IsDir() {
 		return 0
 	}
-	return i.dataStore.GetSize(i.path)
+	if i.IsSymlink() {
+		return int64(len(i.Target()))
+	}
+	return i.attrs.getSize(func() int64 { return i.dataStore.GetSize(i.path) })
 }
 
 // records a child inode to the current inode
 func (i *Inode) setChild(child *Inode) {
 	client := i.redisRing.GetClient(i.keyPrefix)
 	Try(client.SAdd(i.keyPrefix+":children", child.Path()))
+	i.touchMeta()
 }
 
 // removes a child inode from the current inode children list
@@ -145,9 +497,16 @@ func (i *Inode) getChildren() ([]*Inode, error) {
 	Check(err)
 	children := make([]*Inode, 0, len(paths)-1)
 	for _, path := range paths {
-		if path != "" {
-			children = append(children, NewInode(i.dataStore, i.redisRing, path))
+		if path == "" {
+			continue
+		}
+		child := NewInode(i.dataStore, i.redisRing, path)
+		if !child.exists() {
+			// the child metadata has expired, prune the directory entry
+			Try(client.SRem(i.keyPrefix+":children", path))
+			continue
 		}
+		children = append(children, child)
 	}
 	return children, nil
 }
@@ -160,9 +519,12 @@ func (i *Inode) getFile(flag int) (File, error) {
 
 	if hasFlag(os.O_TRUNC, flag) {
 		i.dataStore.Remove(i.path)
+		i.attrs.invalidateSize()
 	}
 
-	var f File = NewMemFile(i.dataStore, i.path, i.mtx)
+	m := NewMemFile(i.dataStore, i.path, i.ranges)
+	m.attrs = i.attrs
+	var f File = m
 
 	if hasFlag(os.O_APPEND, flag) {
 		f.Seek(0, os.SEEK_END)
@@ -180,16 +542,21 @@ func (i *Inode) getFile(flag int) (File, error) {
 	return f, nil
 }
 
-// removes the current inode (file content, children, metadata)
-func (i *Inode) remove() {
+// removes the current inode (file content, children, metadata), returns the paths of the inodes removed
+func (i *Inode) remove() []string {
+	removed := []string{i.path}
 	if !i.IsDir() {
+		i.loadPin()
 		i.dataStore.Remove(i.path)
+		i.dataStore.Unpin(i.path)
+		i.dataStore.SetTTL(i.path, 0)
 	} else {
 		if children, _ := i.getChildren(); children != nil {
 			for _, child := range children {
-				child.remove()
+				removed = append(removed, child.remove()...)
 			}
 		}
 	}
 	i.delMeta()
+	return removed
 }
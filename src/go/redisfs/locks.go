@@ -0,0 +1,380 @@
+// Copyright 2019 CEA
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Distributed advisory locks (flock, fcntl and lockf) on byte ranges of files.
+// The locks of a file are stored in a Redis hash (one field per locked range) so that
+// they are seen by all the processes of all the hosts using the mount point.
+// Each lock has a lease refreshed in the background by the owning process,
+// so that the locks of a dead process expire instead of being held forever.
+
+package redisfs
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cea-hpc/pdwfs/redigo/redis"
+)
+
+var (
+	// ErrLocked is returned if a lock conflicts with a lock held by another owner
+	ErrLocked = errors.New("Resource locked by another owner")
+)
+
+// lock types
+const (
+	LockShared    = "r" // read lock, compatible with other read locks
+	LockExclusive = "w" // write lock
+	LockNone      = "u" // unlock
+)
+
+// DefaultLockLease is the default duration after which the locks of a process not refreshing them expire
+const DefaultLockLease = 30 * time.Second
+
+// maximum delay between two attempts to take a lock held by another owner
+const maxLockRetryDelay = time.Second
+
+// LockOwner identifies the holder of a lock: the file descriptor of a process on a host
+type LockOwner struct {
+	Host string
+	Pid  int
+	Fd   int
+}
+
+var (
+	hostname     string
+	hostnameOnce sync.Once
+)
+
+// NewLockOwner returns the owner of the locks taken by the current process through fd
+func NewLockOwner(fd int) LockOwner {
+	hostnameOnce.Do(func() {
+		host, err := os.Hostname()
+		Check(err)
+		hostname = host
+	})
+	return LockOwner{Host: hostname, Pid: os.Getpid(), Fd: fd}
+}
+
+// ProcessLockFd is the file descriptor of the owner of the locks held by a whole process (see NewProcessLockOwner)
+const ProcessLockFd = -1
+
+// NewProcessLockOwner returns the owner of the locks taken by the current process whatever the file descriptor
+// (POSIX record locks of fcntl and lockf), as opposed to flock locks owned by an open file description
+func NewProcessLockOwner() LockOwner {
+	return NewLockOwner(ProcessLockFd)
+}
+
+// String returns the owner as "host:pid:fd"
+func (o LockOwner) String() string {
+	return fmt.Sprintf("%s:%d:%d", o.Host, o.Pid, o.Fd)
+}
+
+// returns the prefix of the owners of all the file descriptors of the process
+func (o LockOwner) process() string {
+	return fmt.Sprintf("%s:%d:", o.Host, o.Pid)
+}
+
+func parseLockOwner(s string) LockOwner {
+	parts := strings.Split(s, ":")
+	if len(parts) < 3 {
+		return LockOwner{Host: s}
+	}
+	n := len(parts)
+	pid, _ := strconv.Atoi(parts[n-2])
+	fd, _ := strconv.Atoi(parts[n-1])
+	return LockOwner{Host: strings.Join(parts[:n-2], ":"), Pid: pid, Fd: fd}
+}
+
+// FileLock is an advisory lock on a byte range of a file
+type FileLock struct {
+	Type  string // LockShared, LockExclusive or LockNone
+	Start int64
+	Len   int64 // 0 locks up to the end of the file, wherever it is
+	Owner LockOwner
+}
+
+// returns the end of the range (exclusive), -1 if the range has no end
+func (l FileLock) end() int64 {
+	if l.Len == 0 {
+		return -1
+	}
+	return l.Start + l.Len
+}
+
+// Lua helpers shared by the lock scripts: fields are "owner|start|end" (end -1 for no end)
+// and values "type|expiry in ms"
+const lockScriptHelpers = `
+		local function stop(e)
+			e = tonumber(e)
+			if e < 0 then
+				return math.huge
+			end
+			return e
+		end
+		local function parse(field, value)
+			local o, s, e = string.match(field, "^(.*)|(%-?%d+)|(%-?%d+)$")
+			local t, exp = string.match(value, "^(%a)|(%d+)$")
+			return o, s, e, t, tonumber(exp)
+		end
+`
+
+// sets, tests or removes a lock, returns the first conflicting lock of another owner if any
+var setLockScript = redis.NewScript(1, lockScriptHelpers+`
+		local owner, typ, start, finish = ARGV[1], ARGV[2], ARGV[3], ARGV[4]
+		local s, e = tonumber(start), stop(finish)
+		local now, expiry = tonumber(ARGV[5]), ARGV[6]
+		local locks = redis.call("HGETALL", KEYS[1])
+		local mine = {}
+		for i = 1, #locks, 2 do
+			local o, ls, le, lt, exp = parse(locks[i], locks[i+1])
+			if exp < now then
+				redis.call("HDEL", KEYS[1], locks[i])
+			elseif tonumber(ls) < e and s < stop(le) then
+				if o ~= owner then
+					if typ ~= "u" and (typ == "w" or lt == "w") then
+						return {o, lt, ls, le}
+					end
+				else
+					table.insert(mine, {locks[i], lt, ls, le})
+				end
+			end
+		end
+		if ARGV[7] == "test" then
+			return {}
+		end
+		-- the new lock replaces the overlapped parts of the locks of the same owner
+		for _, l in ipairs(mine) do
+			redis.call("HDEL", KEYS[1], l[1])
+			if tonumber(l[3]) < s then
+				redis.call("HSET", KEYS[1], owner .. "|" .. l[3] .. "|" .. start, l[2] .. "|" .. expiry)
+			end
+			if e < stop(l[4]) then
+				redis.call("HSET", KEYS[1], owner .. "|" .. finish .. "|" .. l[4], l[2] .. "|" .. expiry)
+			end
+		end
+		if typ ~= "u" then
+			redis.call("HSET", KEYS[1], owner .. "|" .. start .. "|" .. finish, typ .. "|" .. expiry)
+		end
+		return {}
+	`)
+
+// removes all the locks whose owner starts with ARGV[1]
+var releaseLocksScript = redis.NewScript(1, `
+		local locks = redis.call("HKEYS", KEYS[1])
+		for _, f in ipairs(locks) do
+			if string.sub(f, 1, #ARGV[1]) == ARGV[1] then
+				redis.call("HDEL", KEYS[1], f)
+			end
+		end
+		return 1
+	`)
+
+// extends the lease of the locks whose owner starts with ARGV[1], returns the number of locks refreshed
+var refreshLocksScript = redis.NewScript(1, `
+		local locks = redis.call("HGETALL", KEYS[1])
+		local n = 0
+		for i = 1, #locks, 2 do
+			if string.sub(locks[i], 1, #ARGV[1]) == ARGV[1] then
+				local t = string.match(locks[i+1], "^(%a)|")
+				redis.call("HSET", KEYS[1], locks[i], t .. "|" .. ARGV[2])
+				n = n + 1
+			end
+		end
+		return n
+	`)
+
+// Locker manages the advisory locks of a mount point and refreshes the leases of the locks held by the process
+type Locker struct {
+	redisRing *RedisRing
+	lease     time.Duration
+	held      map[string]bool // key prefixes of the files the process holds locks on
+	mtx       sync.Mutex
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// NewLocker returns a Locker whose locks expire after 'lease' if not refreshed
+func NewLocker(ring *RedisRing, lease time.Duration) *Locker {
+	if lease <= 0 {
+		lease = DefaultLockLease
+	}
+	l := &Locker{
+		redisRing: ring,
+		lease:     lease,
+		held:      map[string]bool{},
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go l.refresher()
+	return l
+}
+
+// returns the current time and the expiry of a lease taken now, in milliseconds
+func (l *Locker) times() (int64, int64) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	return now, now + int64(l.lease/time.Millisecond)
+}
+
+// locks of a file are stored along its metadata keys, see metaKeyPrefix
+func locksKey(prefix string) string {
+	return prefix + ":locks"
+}
+
+func (l *Locker) do(prefix string, lock FileLock, mode string) (*FileLock, error) {
+	conn := l.redisRing.GetClient(prefix).pool.Get()
+	defer conn.Close()
+	now, expiry := l.times()
+	res, err := redis.Strings(setLockScript.Do(conn, locksKey(prefix), lock.Owner.String(), lock.Type, lock.Start, lock.end(), now, expiry, mode))
+	if err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, nil
+	}
+	start, _ := strconv.ParseInt(res[2], 10, 64)
+	end, _ := strconv.ParseInt(res[3], 10, 64)
+	conflict := &FileLock{Type: res[1], Start: start, Owner: parseLockOwner(res[0])}
+	if end >= 0 {
+		conflict.Len = end - start
+	}
+	return conflict, nil
+}
+
+// Lock sets or removes (LockNone) a lock on the file of metadata key prefix 'prefix', if 'wait' is true
+// it retries until the conflicting locks are released, otherwise it returns ErrLocked
+func (l *Locker) Lock(prefix string, lock FileLock, wait bool) error {
+	delay := 10 * time.Millisecond
+	for {
+		conflict, err := l.do(prefix, lock, "set")
+		if err != nil {
+			return err
+		}
+		if conflict == nil {
+			break
+		}
+		if !wait {
+			return ErrLocked
+		}
+		time.Sleep(delay)
+		if delay *= 2; delay > maxLockRetryDelay {
+			delay = maxLockRetryDelay
+		}
+	}
+	if lock.Type != LockNone {
+		l.mtx.Lock()
+		l.held[prefix] = true
+		l.mtx.Unlock()
+	}
+	return nil
+}
+
+// Test returns the first lock conflicting with 'lock', nil if the lock could be set
+func (l *Locker) Test(prefix string, lock FileLock) (*FileLock, error) {
+	return l.do(prefix, lock, "test")
+}
+
+// Release removes all the locks of the owner
+func (l *Locker) Release(prefix string, owner LockOwner) error {
+	return l.release(prefix, owner.String()+"|")
+}
+
+// removes the locks whose owner starts with 'owner'
+func (l *Locker) release(prefix, owner string) error {
+	conn := l.redisRing.GetClient(prefix).pool.Get()
+	defer conn.Close()
+	return err(releaseLocksScript.Do(conn, locksKey(prefix), owner))
+}
+
+// extends the leases of the locks held by the process
+func (l *Locker) refresh() {
+	l.mtx.Lock()
+	prefixes := make([]string, 0, len(l.held))
+	for prefix := range l.held {
+		prefixes = append(prefixes, prefix)
+	}
+	l.mtx.Unlock()
+	process := NewLockOwner(0).process()
+	for _, prefix := range prefixes {
+		conn := l.redisRing.GetClient(prefix).pool.Get()
+		_, expiry := l.times()
+		n, err := redis.Int(refreshLocksScript.Do(conn, locksKey(prefix), process, expiry))
+		conn.Close()
+		if err != nil {
+			log.Printf("WARNING cannot refresh locks of '%s': %s", prefix, err)
+			continue
+		}
+		if n == 0 {
+			l.mtx.Lock()
+			delete(l.held, prefix)
+			l.mtx.Unlock()
+		}
+	}
+}
+
+func (l *Locker) refresher() {
+	defer close(l.done)
+	ticker := time.NewTicker(l.lease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.refresh()
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// Close stops refreshing the leases and releases all the locks held by the process
+func (l *Locker) Close() {
+	close(l.stop)
+	<-l.done
+	process := NewLockOwner(0).process()
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	for prefix := range l.held {
+		if e := l.release(prefix, process); e != nil {
+			log.Printf("WARNING cannot release locks of '%s': %s", prefix, e)
+		}
+	}
+}
+
+// Lock sets or removes (LockNone) an advisory lock on the named file, if 'wait' is true
+// it blocks until the conflicting locks are released, otherwise it returns ErrLocked
+func (fs *RedisFS) Lock(name string, lock FileLock, wait bool) error {
+	path, err := AbsPath(name)
+	Check(err)
+	return fs.locker.Lock(metaKeyPrefix(fs.dataStore, path), lock, wait)
+}
+
+// TestLock returns the first lock on the named file conflicting with 'lock', nil if the lock could be set
+func (fs *RedisFS) TestLock(name string, lock FileLock) (*FileLock, error) {
+	path, err := AbsPath(name)
+	Check(err)
+	return fs.locker.Test(metaKeyPrefix(fs.dataStore, path), lock)
+}
+
+// Unlock removes all the locks of the owner on the named file
+func (fs *RedisFS) Unlock(name string, owner LockOwner) error {
+	path, err := AbsPath(name)
+	Check(err)
+	return fs.locker.Release(metaKeyPrefix(fs.dataStore, path), owner)
+}
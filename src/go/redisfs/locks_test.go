@@ -0,0 +1,91 @@
+// Copyright 2019 CEA
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redisfs
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cea-hpc/pdwfs/util"
+)
+
+func TestParseLockOwner(t *testing.T) {
+	owner := LockOwner{Host: "node[1]:ib", Pid: 1234, Fd: 5}
+	util.Equals(t, owner, parseLockOwner(owner.String()), "owner should survive a round trip")
+}
+
+func TestLocks(t *testing.T) {
+	redis, redisConf := util.InitRedisTestServer()
+	defer redis.Stop()
+
+	mountConf := util.GetMountPathConf()
+	fs := NewRedisFS(redisConf, mountConf)
+	defer fs.Finalize()
+
+	name := filepath.Join(mountConf.Path, "file")
+	a, b := NewLockOwner(3), NewLockOwner(4)
+
+	// shared locks are compatible
+	util.Ok(t, fs.Lock(name, FileLock{Type: LockShared, Start: 0, Len: 100, Owner: a}, false))
+	util.Ok(t, fs.Lock(name, FileLock{Type: LockShared, Start: 50, Len: 100, Owner: b}, false))
+	util.Equals(t, ErrLocked, fs.Lock(name, FileLock{Type: LockExclusive, Start: 90, Len: 1, Owner: a}, false), "overlapping exclusive lock should conflict")
+
+	// a lock of the same owner replaces the overlapped part of its previous locks
+	util.Ok(t, fs.Lock(name, FileLock{Type: LockExclusive, Start: 0, Len: 10, Owner: a}, false))
+	conflict, err := fs.TestLock(name, FileLock{Type: LockShared, Start: 5, Len: 1, Owner: b})
+	util.Ok(t, err)
+	util.Assert(t, conflict != nil, "exclusive lock should be reported")
+	util.Equals(t, FileLock{Type: LockExclusive, Start: 0, Len: 10, Owner: a}, *conflict, "wrong conflicting lock")
+
+	// unlocking a sub-range keeps the rest of the lock
+	util.Ok(t, fs.Lock(name, FileLock{Type: LockNone, Start: 0, Len: 5, Owner: a}, false))
+	conflict, err = fs.TestLock(name, FileLock{Type: LockExclusive, Start: 0, Len: 5, Owner: b})
+	util.Ok(t, err)
+	util.Assert(t, conflict == nil, "unlocked range should be free")
+	util.Equals(t, ErrLocked, fs.Lock(name, FileLock{Type: LockShared, Start: 5, Len: 5, Owner: b}, false), "remaining range should be locked")
+
+	// a blocking lock waits for the conflicting locks to be released
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		fs.Unlock(name, b)
+	}()
+	util.Ok(t, fs.Lock(name, FileLock{Type: LockExclusive, Start: 0, Len: 0, Owner: a}, true))
+}
+
+func TestLockLease(t *testing.T) {
+	redis, redisConf := util.InitRedisTestServer()
+	defer redis.Stop()
+
+	mountConf := util.GetMountPathConf()
+	mountConf.LockLease = 0.5
+	fs := NewRedisFS(redisConf, mountConf)
+	defer fs.Finalize()
+
+	name := filepath.Join(mountConf.Path, "file")
+	dead := LockOwner{Host: "elsewhere", Pid: 1, Fd: 3}
+	alive := NewLockOwner(3)
+	util.Ok(t, fs.Lock(name, FileLock{Type: LockExclusive, Owner: dead}, false))
+	util.Ok(t, fs.Lock(name, FileLock{Type: LockExclusive, Start: 1000, Len: 1, Owner: alive}, false))
+
+	time.Sleep(time.Second)
+
+	// the locks of the process are refreshed, the locks of the dead process expired
+	other := LockOwner{Host: "elsewhere", Pid: 2, Fd: 3}
+	conflict, err := fs.TestLock(name, FileLock{Type: LockExclusive, Owner: other})
+	util.Ok(t, err)
+	util.Assert(t, conflict != nil, "lock of the process should still be held")
+	util.Equals(t, alive, conflict.Owner, "lock of the dead process should have expired")
+}
@@ -0,0 +1,143 @@
+// Copyright 2019 CEA
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Emulation of memory mapped files. The C layer maps anonymous memory in place of a managed file,
+// the content of the file is loaded into it and, for shared mappings, the modified pages are written
+// back to the store on msync and munmap. Modified pages are detected by comparing the hash of each page
+// with its hash when last loaded or written back.
+
+package redisfs
+
+import (
+	"hash/fnv"
+	"os"
+)
+
+// Mapping is a memory mapping of a page aligned byte range of a File
+type Mapping struct {
+	fs       *RedisFS
+	file     File
+	off      int64
+	data     []byte   // memory of the mapping, allocated out of Go by the C layer
+	pageSize int      // size of the pages, the length of data is a multiple of it
+	hashes   []uint64 // hash of each page when last synchronized with the file
+}
+
+func hashPage(page []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(page)
+	return h.Sum64()
+}
+
+// Map loads into data the content of the file f starting at offset off, data beyond the end of the file is zeroed.
+// Offset and length of data must be multiples of pageSize.
+func (fs *RedisFS) Map(f File, data []byte, off int64, pageSize int) (*Mapping, error) {
+	if IsDir(f) {
+		return nil, &os.PathError{Op: "mmap", Path: f.Name(), Err: ErrIsDirectory}
+	}
+	if off < 0 || off%int64(pageSize) != 0 || len(data) == 0 || len(data)%pageSize != 0 {
+		return nil, &os.PathError{Op: "mmap", Path: f.Name(), Err: ErrInvalidRange}
+	}
+	n, _ := f.ReadAt(data, off) // io.EOF if the mapping goes beyond the end of the file
+	for i := n; i < len(data); i++ {
+		data[i] = 0
+	}
+	m := &Mapping{
+		fs:       fs,
+		file:     f,
+		off:      off,
+		data:     data,
+		pageSize: pageSize,
+		hashes:   make([]uint64, len(data)/pageSize),
+	}
+	for p := range m.hashes {
+		m.hashes[p] = hashPage(m.page(p))
+	}
+	return m, nil
+}
+
+func (m *Mapping) page(p int) []byte {
+	return m.data[p*m.pageSize : (p+1)*m.pageSize]
+}
+
+// Len returns the length of the mapping
+func (m *Mapping) Len() int {
+	return len(m.data)
+}
+
+// Sync writes back to the file the modified pages overlapping the byte range [start, start+length[ of the mapping.
+// As for a real mapping, the modified bytes beyond the end of the file are not written back.
+func (m *Mapping) Sync(start, length int) error {
+	if start < 0 || length < 0 {
+		return &os.PathError{Op: "msync", Path: m.file.Name(), Err: ErrInvalidRange}
+	}
+	first, last := start/m.pageSize, (start+length+m.pageSize-1)/m.pageSize
+	if last > len(m.hashes) {
+		last = len(m.hashes)
+	}
+	if first > last {
+		first = last
+	}
+	fi, err := m.fs.Stat(m.file.Name())
+	if os.IsNotExist(err) {
+		return nil // the file has been removed, the mapping is private from now on
+	}
+	if err != nil {
+		return err
+	}
+	size := fi.Size() - m.off
+
+	// contiguous modified pages are written back at once, their new hashes are kept
+	// once written so that pages failing to be written back are still seen as modified
+	hashes := make([]uint64, last-first)
+	from := -1
+	for p := first; p <= last; p++ {
+		dirty := false
+		if p < last {
+			hashes[p-first] = hashPage(m.page(p))
+			dirty = hashes[p-first] != m.hashes[p]
+		}
+		if dirty && from < 0 {
+			from = p
+		}
+		if dirty || from < 0 {
+			continue
+		}
+		begin, end := int64(from*m.pageSize), int64(p*m.pageSize)
+		if end > size {
+			end = size
+		}
+		if begin < end {
+			if _, err := m.file.WriteAt(m.data[begin:end], m.off+begin); err != nil {
+				return err
+			}
+		}
+		copy(m.hashes[from:p], hashes[from-first:p-first])
+		from = -1
+	}
+	return nil
+}
+
+// Sub returns the mapping of the pages of m in the byte range [start, end[, used when m is partially unmapped
+func (m *Mapping) Sub(start, end int) *Mapping {
+	first, last := start/m.pageSize, (end+m.pageSize-1)/m.pageSize
+	return &Mapping{
+		fs:       m.fs,
+		file:     m.file,
+		off:      m.off + int64(first*m.pageSize),
+		data:     m.data[first*m.pageSize : last*m.pageSize],
+		pageSize: m.pageSize,
+		hashes:   m.hashes[first:last],
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2019 CEA
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redisfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cea-hpc/pdwfs/util"
+)
+
+// failingFile is a File whose writes fail
+type failingFile struct {
+	File
+}
+
+func (f failingFile) WriteAt(data []byte, off int64) (int, error) {
+	return 0, errors.New("write failure")
+}
+
+func TestMapping(t *testing.T) {
+	server, redisConf := util.InitRedisTestServer()
+	defer server.Stop()
+
+	mountConf := util.GetMountPathConf()
+	fs := NewRedisFS(redisConf, mountConf)
+	defer fs.Finalize()
+
+	name := filepath.Join(mountConf.Path, "mapped")
+	_, err := writeFile(fs, name, os.O_CREATE|os.O_WRONLY, 0600, []byte(strings.Repeat("a", 10)))
+	util.Ok(t, err)
+
+	f, err := fs.OpenFile(name, os.O_RDWR, 0)
+	util.Ok(t, err)
+	defer f.Close()
+
+	_, err = fs.Map(f, make([]byte, 8), 3, 8)
+	util.Equals(t, ErrInvalidRange, err.(*os.PathError).Err, "offset must be page aligned")
+
+	data := make([]byte, 16)
+	m, err := fs.Map(f, data, 0, 8)
+	util.Ok(t, err)
+	util.Equals(t, strings.Repeat("a", 10)+strings.Repeat("\000", 6), string(data), "wrong mapped content")
+
+	// modified bytes beyond the end of the file are not written back
+	copy(data[4:], "bbbbbbbb")
+	util.Ok(t, m.Sync(0, 8))
+	content, err := readFile(fs, name)
+	util.Ok(t, err)
+	util.Equals(t, "aaaabbbbaa", string(content), "only the first page should be written back")
+	util.Ok(t, m.Sync(0, m.Len()))
+	content, err = readFile(fs, name)
+	util.Ok(t, err)
+	util.Equals(t, "aaaabbbbbb", string(content), "wrong written back content")
+
+	// unmodified pages are not written back over the file
+	_, err = writeFile(fs, name, os.O_WRONLY, 0600, []byte("cc"))
+	util.Ok(t, err)
+	copy(data[8:], "dd")
+	util.Ok(t, m.Sync(0, m.Len()))
+	content, err = readFile(fs, name)
+	util.Ok(t, err)
+	util.Equals(t, "ccaabbbbdd", string(content), "first page should not be written back")
+
+	sub := m.Sub(8, 16)
+	util.Equals(t, 8, sub.Len(), "wrong length of the sub mapping")
+	copy(data[9:], "e")
+	util.Ok(t, sub.Sync(0, sub.Len()))
+	content, err = readFile(fs, name)
+	util.Ok(t, err)
+	util.Equals(t, "ccaabbbbde", string(content), "wrong written back content of the sub mapping")
+
+	// pages failing to be written back are written back by the next synchronization
+	copy(data, "ff")
+	m.file = failingFile{f}
+	util.Assert(t, m.Sync(0, m.Len()) != nil, "write back should fail")
+	m.file = f
+	util.Ok(t, m.Sync(0, m.Len()))
+	content, err = readFile(fs, name)
+	util.Ok(t, err)
+	util.Equals(t, "ffaabbbbde", string(content), "failed page should be written back")
+}
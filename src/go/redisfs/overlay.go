@@ -0,0 +1,261 @@
+// Copyright 2019 CEA
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Overlay mode: lookups that miss in Redis fall back to the real directory the mount point is placed on,
+// so that pdwfs can be mounted on a directory already holding input files.
+// Files of the real directory (lower layer) are read from disk, and either cannot be modified (read-only overlay)
+// or are copied into Redis when opened for writing (copy-up overlay).
+// Removing a copied-up file records a whiteout in the metadata of its parent directory,
+// which hides the file of the real directory until a file of the same name is created again.
+
+package redisfs
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/cea-hpc/pdwfs/config"
+	"github.com/cea-hpc/pdwfs/redigo/redis"
+)
+
+var (
+	// ErrReadOnlyFS is returned when modifying a file of the real directory under a read-only overlay
+	ErrReadOnlyFS = errors.New("Read-only file system")
+)
+
+// lowerInfo describes a file of the real directory, named by its full path like Inode
+type lowerInfo struct {
+	os.FileInfo
+	path string
+}
+
+// Name returns the full path of the file
+func (fi lowerInfo) Name() string {
+	return fi.path
+}
+
+// returns the description of a file of the real directory if the overlay mode is enabled
+func (fs *RedisFS) lowerStat(path string) (os.FileInfo, bool) {
+	if fs.mountConf.Overlay == "" {
+		return nil, false
+	}
+	fi, err := os.Stat(path)
+	if err != nil || fs.whitedOut(path) {
+		return nil, false
+	}
+	return lowerInfo{fi, path}, true
+}
+
+// returns the key of the names of the files of the real directory hidden in the directory 'dir'
+func whiteoutsKey(dataStore *DataStore, dir string) string {
+	return metaKeyPrefix(dataStore, dir) + ":whiteouts"
+}
+
+// returns true if the file of the real directory has been removed from the mount point
+func (fs *RedisFS) whitedOut(path string) bool {
+	key := whiteoutsKey(fs.dataStore, filepath.Dir(path))
+	conn := fs.redisRing.GetClient(key).pool.Get()
+	defer conn.Close()
+	hidden, err := redis.Bool(conn.Do("SISMEMBER", key, filepath.Base(path)))
+	Check(err)
+	return hidden
+}
+
+// hides the file of the real directory at 'path' of the directory 'parent'
+func (fs *RedisFS) addWhiteout(parent *Inode, path string) {
+	client := fs.redisRing.GetClient(parent.keyPrefix)
+	Try(client.SAdd(whiteoutsKey(fs.dataStore, parent.Path()), filepath.Base(path)))
+	parent.touchMeta()
+}
+
+// shows again the file of the real directory at 'path' of the directory 'parent', replaced by a new file
+func (fs *RedisFS) removeWhiteout(parent *Inode, path string) {
+	if fs.mountConf.Overlay == "" {
+		return
+	}
+	client := fs.redisRing.GetClient(parent.keyPrefix)
+	Try(client.SRem(whiteoutsKey(fs.dataStore, parent.Path()), filepath.Base(path)))
+}
+
+// returns the directory inode for path, creating it in Redis if the directory only exists in the real directory
+func (fs *RedisFS) lowerDir(path string) *Inode {
+	if i, ok := fs.getInode(path); ok {
+		return i
+	}
+	fi, ok := fs.lowerStat(path)
+	if !ok || !fi.IsDir() || path == fs.root.Path() {
+		return nil
+	}
+	parent := fs.lowerDir(filepath.Dir(path))
+	if parent == nil {
+		return nil
+	}
+	i, err := fs.createInode(path, true, fi.Mode().Perm(), parent)
+	if err != nil {
+		return nil
+	}
+	return i
+}
+
+// merges the listing of the real directory with the entries found in Redis, Redis entries take precedence
+func (fs *RedisFS) mergeLower(path string, entries []os.FileInfo) []os.FileInfo {
+	if fs.mountConf.Overlay == "" {
+		return entries
+	}
+	lower, err := ioutil.ReadDir(path)
+	if err != nil {
+		return entries
+	}
+	found := make(map[string]bool, len(entries))
+	for _, fi := range entries {
+		found[fi.Name()] = true
+	}
+	key := whiteoutsKey(fs.dataStore, path)
+	hidden, err := fs.redisRing.GetClient(key).SMembers(key)
+	Check(err)
+	for _, name := range hidden {
+		found[filepath.Join(path, name)] = true
+	}
+	for _, fi := range lower {
+		p := filepath.Join(path, fi.Name())
+		if !found[p] {
+			entries = append(entries, lowerInfo{fi, p})
+		}
+	}
+	return entries
+}
+
+// opens a file of the real directory, either read-only or by copying it up into Redis
+func (fs *RedisFS) openLower(path string, fi os.FileInfo, flag int, parent *Inode) (File, *Inode, error) {
+	if fi.IsDir() {
+		if isWriteFlag(flag) {
+			return nil, nil, ErrIsDirectory
+		}
+		return &dirFile{path}, nil, nil
+	}
+	if hasFlag(os.O_CREATE|os.O_EXCL, flag) {
+		return nil, nil, os.ErrExist
+	}
+	if !isWriteFlag(flag) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &lowerFile{f}, nil, nil
+	}
+	if fs.mountConf.Overlay != config.OverlayCopyUp {
+		return nil, nil, ErrReadOnlyFS
+	}
+	i, err := fs.copyUp(path, fi, !hasFlag(os.O_TRUNC, flag), parent)
+	return nil, i, err
+}
+
+// copies a file of the real directory into Redis (content is copied only if 'content' is true)
+func (fs *RedisFS) copyUp(path string, fi os.FileInfo, content bool, parent *Inode) (*Inode, error) {
+	var src *os.File
+	if content {
+		var err error
+		if src, err = os.Open(path); err != nil {
+			return nil, err
+		}
+		defer src.Close()
+	}
+	i, err := fs.createInode(path, false, fi.Mode().Perm(), parent)
+	if err != nil || !content {
+		return i, err
+	}
+	buf := make([]byte, fs.dataStore.stripeSize)
+	for off := int64(0); ; {
+		n, err := src.ReadAt(buf, off)
+		if n > 0 {
+			if err := fs.dataStore.WriteAt(path, off, buf[:n]); err != nil {
+				return i, err
+			}
+			off += int64(n)
+		}
+		if err == io.EOF {
+			return i, nil
+		}
+		if err != nil {
+			return i, err
+		}
+	}
+}
+
+// lowerFile is a read-only file of the real directory
+type lowerFile struct {
+	*os.File
+}
+
+// Write is disabled and returns ErrReadOnly
+func (f *lowerFile) Write(p []byte) (int, error) {
+	return 0, ErrReadOnly
+}
+
+// WriteAt is disabled and returns ErrReadOnly
+func (f *lowerFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, ErrReadOnly
+}
+
+// Truncate is disabled and returns ErrReadOnly
+func (f *lowerFile) Truncate(size int64) error {
+	return ErrReadOnly
+}
+
+// Fallocate is disabled and returns ErrReadOnly
+func (f *lowerFile) Fallocate(mode int, off, length int64) error {
+	return ErrReadOnly
+}
+
+// WriteVec is disabled and returns ErrReadOnly
+func (f *lowerFile) WriteVec(datav [][]byte) (int, error) {
+	return 0, ErrReadOnly
+}
+
+// WriteVecAt is disabled and returns ErrReadOnly
+func (f *lowerFile) WriteVecAt(datav [][]byte, off int64) (int, error) {
+	return 0, ErrReadOnly
+}
+
+// ReadVec reads into a vector of buffers from the current offset
+func (f *lowerFile) ReadVec(datav [][]byte) (int, error) {
+	read := 0
+	for _, data := range datav {
+		n, err := io.ReadFull(f.File, data)
+		read += n
+		if err == io.ErrUnexpectedEOF {
+			return read, io.EOF
+		}
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+// ReadVecAt reads into a vector of buffers from offset off
+func (f *lowerFile) ReadVecAt(datav [][]byte, off int64) (int, error) {
+	read := 0
+	for _, data := range datav {
+		n, err := f.ReadAt(data, off+int64(read))
+		read += n
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
@@ -0,0 +1,144 @@
+// Copyright 2019 CEA
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redisfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cea-hpc/pdwfs/config"
+	"github.com/cea-hpc/pdwfs/util"
+)
+
+// returns a mount configuration on a temporary directory holding an input file
+func overlayMountConf(t *testing.T, mode string) *config.Mount {
+	dir, err := ioutil.TempDir("", "pdwfs-overlay")
+	util.Ok(t, err)
+	util.Ok(t, os.Mkdir(filepath.Join(dir, "inputs"), 0755))
+	util.Ok(t, ioutil.WriteFile(filepath.Join(dir, "inputs", "mesh"), []byte("mesh data"), 0644))
+	mountConf := util.GetMountPathConf()
+	mountConf.Path = dir
+	mountConf.Overlay = mode
+	return mountConf
+}
+
+func TestOverlayReadOnly(t *testing.T) {
+	redis, redisConf := util.InitRedisTestServer()
+	defer redis.Stop()
+
+	mountConf := overlayMountConf(t, config.OverlayReadOnly)
+	defer os.RemoveAll(mountConf.Path)
+	fs := NewRedisFS(redisConf, mountConf)
+	defer fs.Finalize()
+
+	mesh := filepath.Join(mountConf.Path, "inputs", "mesh")
+	fi, err := fs.Stat(mesh)
+	util.Ok(t, err)
+	util.Equals(t, int64(9), fi.Size(), "wrong size of file on disk")
+
+	f, err := fs.OpenFile(mesh, os.O_RDONLY, 0)
+	util.Ok(t, err)
+	data := make([]byte, 9)
+	_, err = f.Read(data)
+	util.Ok(t, err)
+	util.Equals(t, []byte("mesh data"), data, "wrong content of file on disk")
+	util.Ok(t, f.Close())
+
+	_, err = fs.OpenFile(mesh, os.O_WRONLY, 0)
+	e, ok := err.(*os.PathError)
+	util.Assert(t, ok && e.Err == ErrReadOnlyFS, "file on disk should be read-only")
+
+	// new files go to Redis, listings are merged
+	output := filepath.Join(mountConf.Path, "inputs", "output")
+	f, err = fs.OpenFile(output, os.O_CREATE|os.O_WRONLY, 0600)
+	util.Ok(t, err)
+	util.Ok(t, f.Close())
+	_, err = os.Stat(output)
+	util.Assert(t, os.IsNotExist(err), "new file should not be written on disk")
+
+	entries, err := fs.ReadDir(filepath.Join(mountConf.Path, "inputs"))
+	util.Ok(t, err)
+	util.Equals(t, 2, len(entries), "listings should be merged")
+	util.Equals(t, mesh, entries[0].Name(), "wrong entry")
+	util.Equals(t, output, entries[1].Name(), "wrong entry")
+}
+
+func TestOverlayCopyUp(t *testing.T) {
+	redis, redisConf := util.InitRedisTestServer()
+	defer redis.Stop()
+
+	mountConf := overlayMountConf(t, config.OverlayCopyUp)
+	defer os.RemoveAll(mountConf.Path)
+	fs := NewRedisFS(redisConf, mountConf)
+	defer fs.Finalize()
+
+	mesh := filepath.Join(mountConf.Path, "inputs", "mesh")
+	f, err := fs.OpenFile(mesh, os.O_WRONLY|os.O_APPEND, 0)
+	util.Ok(t, err)
+	_, err = f.Write([]byte(" updated"))
+	util.Ok(t, err)
+	util.Ok(t, f.Close())
+
+	fi, err := fs.Stat(mesh)
+	util.Ok(t, err)
+	util.Equals(t, int64(17), fi.Size(), "copied up file should be updated")
+
+	data, err := ioutil.ReadFile(mesh)
+	util.Ok(t, err)
+	util.Equals(t, []byte("mesh data"), data, "file on disk should be left unchanged")
+}
+
+func TestOverlayRemoveCopiedUp(t *testing.T) {
+	redis, redisConf := util.InitRedisTestServer()
+	defer redis.Stop()
+
+	mountConf := overlayMountConf(t, config.OverlayCopyUp)
+	defer os.RemoveAll(mountConf.Path)
+	fs := NewRedisFS(redisConf, mountConf)
+	defer fs.Finalize()
+
+	inputs := filepath.Join(mountConf.Path, "inputs")
+	mesh := filepath.Join(inputs, "mesh")
+	f, err := fs.OpenFile(mesh, os.O_WRONLY|os.O_APPEND, 0)
+	util.Ok(t, err)
+	util.Ok(t, f.Close())
+
+	// the file of the real directory is hidden once the copied-up file is removed
+	util.Ok(t, fs.Remove(mesh))
+	_, err = fs.Stat(mesh)
+	util.Assert(t, os.IsNotExist(err), "removed file should not be visible")
+	entries, err := fs.ReadDir(inputs)
+	util.Ok(t, err)
+	for _, fi := range entries {
+		util.Assert(t, fi.Name() != mesh, "removed file should not be listed")
+	}
+	_, err = fs.OpenFile(mesh, os.O_RDONLY, 0)
+	util.Assert(t, os.IsNotExist(err), "removed file should not be opened")
+	_, err = os.Stat(mesh)
+	util.Ok(t, err)
+
+	// a new file of the same name replaces it
+	f, err = fs.OpenFile(mesh, os.O_CREATE|os.O_WRONLY, 0600)
+	util.Ok(t, err)
+	util.Ok(t, f.Close())
+	fi, err := fs.Stat(mesh)
+	util.Ok(t, err)
+	util.Equals(t, int64(0), fi.Size(), "new file should not show the removed content")
+	util.Ok(t, fs.Remove(mesh))
+	_, err = fs.Stat(mesh)
+	util.Assert(t, os.IsNotExist(err), "removed file should not be visible")
+}
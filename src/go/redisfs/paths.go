@@ -0,0 +1,88 @@
+// Copyright 2019 CEA
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Canonical form of the paths handled by pdwfs, shared by the mount points and the interception layer.
+// Directories created in a mount point only exist in Redis, the process cannot enter them with the
+// chdir system call, so the current directory is tracked here while it is inside a mount point.
+
+package redisfs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// current directory of the process when inside a mount point, empty otherwise
+var workDir struct {
+	sync.RWMutex
+	path string
+}
+
+// SetWorkDir records 'dir', an absolute directory of a mount point, as the current directory,
+// an empty 'dir' restores the current directory of the process
+func SetWorkDir(dir string) {
+	workDir.Lock()
+	defer workDir.Unlock()
+	workDir.path = dir
+}
+
+// WorkDir returns the current directory if inside a mount point, an empty string otherwise
+func WorkDir() string {
+	workDir.RLock()
+	defer workDir.RUnlock()
+	return workDir.path
+}
+
+// Getwd returns the current directory, inside a mount point after SetWorkDir
+func Getwd() (string, error) {
+	if dir := WorkDir(); dir != "" {
+		return dir, nil
+	}
+	return os.Getwd()
+}
+
+// AbsPath returns the canonical absolute form of a path: relative paths are resolved from the current
+// directory (see Getwd), "." and ".." elements, repeated and trailing slashes are removed
+func AbsPath(name string) (string, error) {
+	if filepath.IsAbs(name) {
+		return filepath.Clean(name), nil
+	}
+	wd, err := Getwd()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(wd, name), nil
+}
+
+// InMount returns true if path is the mount path or one of its descendants,
+// paths are compared element-wise so that /scratch/out2 is not in /scratch/out
+func InMount(path, mount string) bool {
+	if path == mount || mount == "/" {
+		return true
+	}
+	return strings.HasPrefix(path, mount+"/")
+}
+
+// LongestMount returns the mount path containing path, the deepest one if mount points are nested
+func LongestMount(path string, mounts []string) (string, bool) {
+	found := ""
+	for _, mount := range mounts {
+		if InMount(path, mount) && len(mount) > len(found) {
+			found = mount
+		}
+	}
+	return found, found != ""
+}
@@ -0,0 +1,63 @@
+// Copyright 2019 CEA
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redisfs
+
+import (
+	"os"
+	"testing"
+
+	"github.com/cea-hpc/pdwfs/util"
+)
+
+func TestInMount(t *testing.T) {
+	util.Assert(t, InMount("/scratch/out", "/scratch/out"), "mount path is in the mount")
+	util.Assert(t, InMount("/scratch/out/x", "/scratch/out"), "child is in the mount")
+	util.Assert(t, !InMount("/scratch/out2/x", "/scratch/out"), "sibling with common prefix is not in the mount")
+	util.Assert(t, !InMount("/scratch", "/scratch/out"), "parent is not in the mount")
+	util.Assert(t, InMount("/any", "/"), "everything is in the root mount")
+}
+
+func TestLongestMount(t *testing.T) {
+	mounts := []string{"/scratch", "/scratch/out", "/data"}
+	mount, ok := LongestMount("/scratch/out/run/x", mounts)
+	util.Assert(t, ok, "mount expected")
+	util.Equals(t, "/scratch/out", mount, "nested mount should win")
+	mount, ok = LongestMount("/scratch/out2/x", mounts)
+	util.Assert(t, ok, "mount expected")
+	util.Equals(t, "/scratch", mount, "wrong mount")
+	_, ok = LongestMount("/home/x", mounts)
+	util.Assert(t, !ok, "path is not managed")
+}
+
+func TestAbsPath(t *testing.T) {
+	path, err := AbsPath("/scratch/out/../out//run/")
+	util.Ok(t, err)
+	util.Equals(t, "/scratch/out/run", path, "path should be cleaned")
+
+	cwd, err := os.Getwd()
+	util.Ok(t, err)
+	path, err = AbsPath("x")
+	util.Ok(t, err)
+	util.Equals(t, cwd+"/x", path, "relative path from the process directory")
+
+	SetWorkDir("/scratch/out/run")
+	defer SetWorkDir("")
+	path, err = AbsPath("../x")
+	util.Ok(t, err)
+	util.Equals(t, "/scratch/out/x", path, "relative path from the directory in the mount")
+	wd, err := Getwd()
+	util.Ok(t, err)
+	util.Equals(t, "/scratch/out/run", wd, "wrong current directory")
+}
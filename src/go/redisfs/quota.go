@@ -0,0 +1,217 @@
+// Copyright 2019 CEA
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Quota accounting of the bytes and inodes used in a mount point.
+// Usage counters are stored in a Redis hash so that all the processes writing
+// in the same mount point (or job) are accounted together.
+// The usage of the files with a time to live is also recorded per file with their expiry time,
+// it is released once they expire, before any other change of the counters.
+
+package redisfs
+
+import (
+	"errors"
+
+	"github.com/cea-hpc/pdwfs/redigo/redis"
+)
+
+var (
+	// ErrQuotaExceeded is returned if a write or a file creation would exceed the mount point quota
+	ErrQuotaExceeded = errors.New("Quota exceeded")
+)
+
+// fields of the quota hash in Redis
+const (
+	quotaBytes  = "bytes"
+	quotaInodes = "inodes"
+)
+
+// Quota enforces limits on the bytes and inodes used in a mount point.
+// A nil *Quota is valid and does not account anything.
+type Quota struct {
+	redisRing *RedisRing
+	scope     string
+	key       string // hash of the usage counters
+	maxBytes  int64
+	maxInodes int64
+}
+
+// NewQuota returns a Quota accounting usage for 'scope' (mount point path, optionally suffixed by a job ID),
+// a limit of 0 means no limit
+func NewQuota(ring *RedisRing, scope string, maxBytes, maxInodes int64) *Quota {
+	return &Quota{
+		redisRing: ring,
+		scope:     scope,
+		key:       "pdwfs:quota:{" + scope + "}",
+		maxBytes:  maxBytes,
+		maxInodes: maxInodes,
+	}
+}
+
+// SetNamespace sets the namespace of the usage counters, dropped with the other keys of the namespace
+func (q *Quota) SetNamespace(namespace string) {
+	q.key = "pdwfs:quota:{" + q.scope + "}"
+	if namespace != "" {
+		q.key = namespace + namespaceSeparator + q.key
+	}
+}
+
+// keys of the quota scripts: the usage counters, the sorted set of the expiry time (ms) of the files
+// with a time to live and the hash of their usage (fields "bytes:<path>" and "inodes:<path>")
+func (q *Quota) keys() []interface{} {
+	return []interface{}{q.key, q.key + ":expiry", q.key + ":charges"}
+}
+
+// releases the usage of the expired files, prefix of all the quota scripts ('now' is the time in ms)
+const reclaimExpiredScript = `
+		redis.replicate_commands()
+		local now = redis.call("TIME")
+		now = now[1] * 1000 + math.floor(now[2] / 1000)
+		for _, name in ipairs(redis.call("ZRANGEBYSCORE", KEYS[2], "-inf", now)) do
+			for _, field in ipairs({"bytes", "inodes"}) do
+				local charged = redis.call("HGET", KEYS[3], field .. ":" .. name)
+				if charged then
+					redis.call("HINCRBY", KEYS[1], field, -tonumber(charged))
+					redis.call("HDEL", KEYS[3], field .. ":" .. name)
+				end
+			end
+			redis.call("ZREM", KEYS[2], name)
+		end
+`
+
+// adds ARGV[2] to the counter ARGV[1] unless above the limit ARGV[3], the usage of the file ARGV[4]
+// is recorded if it expires in ARGV[5] seconds
+var reserveScript = redis.NewScript(3, reclaimExpiredScript+`
+		local used = tonumber(redis.call("HGET", KEYS[1], ARGV[1]) or "0")
+		local n = tonumber(ARGV[2])
+		local limit = tonumber(ARGV[3])
+		local ttl = tonumber(ARGV[5])
+		if limit > 0 and n > 0 and used + n > limit then
+			return -1
+		end
+		if ttl > 0 then
+			redis.call("HINCRBY", KEYS[3], ARGV[1] .. ":" .. ARGV[4], n)
+			redis.call("ZADD", KEYS[2], now + ttl * 1000, ARGV[4])
+		end
+		return redis.call("HINCRBY", KEYS[1], ARGV[1], n)
+	`)
+
+// subtracts ARGV[2] from the counter ARGV[1] and from the usage recorded for the file ARGV[3], if any
+var releaseScript = redis.NewScript(3, reclaimExpiredScript+`
+		local n = tonumber(ARGV[2])
+		redis.call("HINCRBY", KEYS[1], ARGV[1], -n)
+		local field = ARGV[1] .. ":" .. ARGV[3]
+		if redis.call("HEXISTS", KEYS[3], field) == 1 and redis.call("HINCRBY", KEYS[3], field, -n) <= 0 then
+			redis.call("HDEL", KEYS[3], field)
+		end
+		return 0
+	`)
+
+// sets the usage of the file ARGV[1] to expire in ARGV[2] seconds, or never for 0
+var expireScript = redis.NewScript(3, reclaimExpiredScript+`
+		local ttl = tonumber(ARGV[2])
+		if ttl > 0 then
+			redis.call("ZADD", KEYS[2], "XX", now + ttl * 1000, ARGV[1])
+		else
+			redis.call("ZREM", KEYS[2], ARGV[1])
+			redis.call("HDEL", KEYS[3], "bytes:" .. ARGV[1], "inodes:" .. ARGV[1])
+		end
+		return 0
+	`)
+
+var usageScript = redis.NewScript(3, reclaimExpiredScript+`
+		return redis.call("HMGET", KEYS[1], "bytes", "inodes")
+	`)
+
+// runs a quota script with the arguments 'args'
+func (q *Quota) do(script *redis.Script, args ...interface{}) (interface{}, error) {
+	conn := q.redisRing.GetClient(q.key).pool.Get()
+	defer conn.Close()
+	return script.Do(conn, append(q.keys(), args...)...)
+}
+
+// atomically adds n to the usage counter 'field' for the file 'name' expiring in 'ttl' seconds (0 for never),
+// returns ErrQuotaExceeded if it would go above limit
+func (q *Quota) reserve(field, name string, n, limit, ttl int64) error {
+	if q == nil || n == 0 {
+		return nil
+	}
+	ret, err := redis.Int64(q.do(reserveScript, field, n, limit, name, ttl))
+	if err != nil {
+		return err
+	}
+	if ret < 0 {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// releases n units of the usage counter 'field' used by the file 'name' (n may be negative to add units
+// beyond the limit)
+func (q *Quota) release(field, name string, n int64) {
+	if q == nil || n == 0 {
+		return
+	}
+	Check(err(q.do(releaseScript, field, n, name)))
+}
+
+// sets the usage of the file 'name' to be released in 'ttl' seconds, when the file expires (0 for never)
+func (q *Quota) expire(name string, ttl int64) {
+	if q == nil {
+		return
+	}
+	Check(err(q.do(expireScript, name, ttl)))
+}
+
+func (q *Quota) reserveBytes(name string, n, ttl int64) error {
+	if q == nil {
+		return nil
+	}
+	return q.reserve(quotaBytes, name, n, q.maxBytes, ttl)
+}
+
+func (q *Quota) releaseBytes(name string, n int64) {
+	q.release(quotaBytes, name, n)
+}
+
+func (q *Quota) reserveInodes(name string, n, ttl int64) error {
+	if q == nil {
+		return nil
+	}
+	return q.reserve(quotaInodes, name, n, q.maxInodes, ttl)
+}
+
+func (q *Quota) releaseInodes(name string, n int64) {
+	q.release(quotaInodes, name, n)
+}
+
+// Limits returns the maximum number of bytes and inodes (0 for no limit)
+func (q *Quota) Limits() (bytes, inodes int64) {
+	if q == nil {
+		return 0, 0
+	}
+	return q.maxBytes, q.maxInodes
+}
+
+// Usage returns the number of bytes and inodes currently accounted
+func (q *Quota) Usage() (bytes, inodes int64, err error) {
+	if q == nil {
+		return 0, 0, nil
+	}
+	values, err := redis.Int64s(q.do(usageScript))
+	if err != nil {
+		return 0, 0, err
+	}
+	return values[0], values[1], nil
+}
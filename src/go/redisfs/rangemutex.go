@@ -0,0 +1,108 @@
+// Copyright 2019 CEA
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Byte-range mutual exclusion of the I/Os of the open files of an inode (in-process only,
+// see locks.go for the advisory locks shared by all the clients of a file).
+
+package redisfs
+
+import (
+	"math"
+	"sync"
+)
+
+// ToEOF is the end of the ranges extending to the end of the file, whatever its size
+const ToEOF = math.MaxInt64
+
+// Range is a byte range [Start, End[ of a file locked in a RangeMutex
+type Range struct {
+	Start, End int64
+	write      bool
+	granted    bool
+}
+
+func (r *Range) conflicts(o *Range) bool {
+	return (r.write || o.write) && r.Start < o.End && o.Start < r.End
+}
+
+// RangeMutex is a reader/writer mutual exclusion lock on the byte ranges of a file.
+// Ranges locked for reading may overlap, a range locked for writing excludes any overlapping range
+// so that I/Os to disjoint regions of a file proceed concurrently while overlapping ones are atomic.
+// Ranges are granted in the order of the requests overlapping them, a writer is not starved by readers.
+type RangeMutex struct {
+	mtx     sync.Mutex
+	cond    *sync.Cond
+	pending []*Range // granted ranges and waiting requests, in order of request
+}
+
+// NewRangeMutex returns an unlocked RangeMutex
+func NewRangeMutex() *RangeMutex {
+	m := &RangeMutex{}
+	m.cond = sync.NewCond(&m.mtx)
+	return m
+}
+
+// returns true if no range granted or requested before r conflicts with r
+func (m *RangeMutex) grantable(r *Range) bool {
+	for _, p := range m.pending {
+		if p == r {
+			return true
+		}
+		if p.conflicts(r) {
+			return false
+		}
+	}
+	panic("range is not pending")
+}
+
+func (m *RangeMutex) lock(r *Range) *Range {
+	if r.End <= r.Start {
+		r.End = r.Start + 1 // empty I/Os are still ordered with the I/Os at their offset
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.pending = append(m.pending, r)
+	for !m.grantable(r) {
+		m.cond.Wait()
+	}
+	r.granted = true
+	return r
+}
+
+// Lock locks the byte range [start, end[ for writing, it blocks until no overlapping range is locked
+func (m *RangeMutex) Lock(start, end int64) *Range {
+	return m.lock(&Range{Start: start, End: end, write: true})
+}
+
+// RLock locks the byte range [start, end[ for reading, it blocks until no overlapping range is locked for writing
+func (m *RangeMutex) RLock(start, end int64) *Range {
+	return m.lock(&Range{Start: start, End: end})
+}
+
+// Unlock releases a range returned by Lock or RLock
+func (m *RangeMutex) Unlock(r *Range) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if !r.granted {
+		panic("unlock of unlocked range")
+	}
+	r.granted = false
+	for i, p := range m.pending {
+		if p == r {
+			m.pending = append(m.pending[:i], m.pending[i+1:]...)
+			break
+		}
+	}
+	m.cond.Broadcast()
+}
@@ -0,0 +1,80 @@
+// Copyright 2019 CEA
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redisfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cea-hpc/pdwfs/util"
+)
+
+// locks a range in a goroutine, the returned channel receives the range once granted
+func lockAsync(lock func(start, end int64) *Range, start, end int64) chan *Range {
+	c := make(chan *Range, 1)
+	go func() {
+		c <- lock(start, end)
+	}()
+	return c
+}
+
+func granted(c chan *Range) (*Range, bool) {
+	select {
+	case r := <-c:
+		return r, true
+	case <-time.After(50 * time.Millisecond):
+		return nil, false
+	}
+}
+
+func TestRangeMutex(t *testing.T) {
+	m := NewRangeMutex()
+
+	// disjoint writes and overlapping reads proceed concurrently
+	w1 := m.Lock(0, 100)
+	w2 := m.Lock(100, 200)
+	r1 := m.RLock(200, 300)
+	r2 := m.RLock(250, ToEOF)
+
+	// an overlapping write waits
+	c := lockAsync(m.Lock, 50, 150)
+	_, ok := granted(c)
+	util.Assert(t, !ok, "overlapping write should wait")
+	m.Unlock(w1)
+	_, ok = granted(c)
+	util.Assert(t, !ok, "write should wait for all overlapping ranges")
+	m.Unlock(w2)
+	w3, ok := granted(c)
+	util.Assert(t, ok, "write should be granted once overlapping ranges are unlocked")
+
+	// a write waiting for readers is not starved by later readers
+	c = lockAsync(m.Lock, 280, 290)
+	_, ok = granted(c)
+	util.Assert(t, !ok, "write should wait for readers")
+	cr := lockAsync(m.RLock, 280, 285)
+	_, ok = granted(cr)
+	util.Assert(t, !ok, "read should wait for the write requested before")
+	m.Unlock(r1)
+	m.Unlock(r2)
+	w4, ok := granted(c)
+	util.Assert(t, ok, "write should be granted")
+	m.Unlock(w4)
+	r3, ok := granted(cr)
+	util.Assert(t, ok, "read should be granted")
+
+	m.Unlock(w3)
+	m.Unlock(r3)
+	util.Equals(t, 0, len(m.pending), "all ranges should be unlocked")
+}
@@ -19,8 +19,16 @@ package redisfs
 import (
 	"errors"
 	"fmt"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
-	
+	"sync"
+	"time"
+
 	"github.com/cea-hpc/pdwfs/config"
 	"github.com/cea-hpc/pdwfs/redigo/redis"
 	"github.com/cea-hpc/pdwfs/util"
@@ -29,6 +37,12 @@ import (
 var (
 	// ErrRedisKeyNotFound is returned if a queried key in Redis is not found
 	ErrRedisKeyNotFound = errors.New("Redis key not found")
+	// ErrNoSpace is returned if Redis instances are out of memory or above the configured high watermark
+	ErrNoSpace = errors.New("No space left on Redis instances")
+	// ErrRingEmpty is returned if a change of membership would leave the ring without any node
+	ErrRingEmpty = errors.New("Redis ring has no node left")
+	// ErrInvalidNamespace is returned if a namespace contains characters not allowed in namespaces
+	ErrInvalidNamespace = errors.New("Invalid namespace")
 )
 
 // Try ...
@@ -45,6 +59,14 @@ func err(a interface{}, err error) error {
 	return err
 }
 
+// converts Redis out of memory error replies (maxmemory reached) to ErrNoSpace
+func oomToNoSpace(err error) error {
+	if e, ok := err.(redis.Error); ok && strings.HasPrefix(string(e), "OOM ") {
+		return ErrNoSpace
+	}
+	return err
+}
+
 // RedisClient is a client to a single Redis instance, safe to use by multiple goroutines
 type RedisClient struct {
 	pool *redis.Pool
@@ -76,7 +98,7 @@ func (c *RedisClient) Close() error {
 func (c *RedisClient) SetRange(key string, offset int64, data []byte) error {
 	conn := c.pool.Get()
 	defer conn.Close()
-	return err(conn.Do("SETRANGE", key, offset, data))
+	return oomToNoSpace(err(conn.Do("SETRANGE", key, offset, data)))
 }
 
 // GetRange command
@@ -116,7 +138,7 @@ func (c *RedisClient) Exists(key string) (bool, error) {
 func (c *RedisClient) Set(key string, data []byte) error {
 	conn := c.pool.Get()
 	defer conn.Close()
-	return err(conn.Do("SET", key, data))
+	return oomToNoSpace(err(conn.Do("SET", key, data)))
 }
 
 // SetNX command
@@ -196,6 +218,50 @@ func (c *RedisClient) SMembers(key string) ([]string, error) {
 	return redis.Strings(conn.Do("SMEMBERS", key))
 }
 
+// Scan iterates over the keys matching 'pattern' with the SCAN command and returns them
+func (c *RedisClient) Scan(pattern string) ([]string, error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+	var keys []string
+	cursor := "0"
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return nil, err
+		}
+		cursor, _ = redis.String(values[0], nil)
+		batch, _ := redis.Strings(values[1], nil)
+		keys = append(keys, batch...)
+		if cursor == "0" {
+			return keys, nil
+		}
+	}
+}
+
+// MemoryInfo returns the memory used by the Redis instance and the maximum memory it can use
+// (maxmemory setting if set, total memory of the host otherwise) in bytes
+func (c *RedisClient) MemoryInfo() (used, max int64, err error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+	info, err := redis.String(conn.Do("INFO", "memory"))
+	if err != nil {
+		return 0, 0, err
+	}
+	fields := map[string]int64{}
+	for _, line := range strings.Split(info, "\r\n") {
+		if kv := strings.SplitN(line, ":", 2); len(kv) == 2 {
+			if v, err := strconv.ParseInt(kv[1], 10, 64); err == nil {
+				fields[kv[0]] = v
+			}
+		}
+	}
+	max = fields["maxmemory"]
+	if max == 0 {
+		max = fields["total_system_memory"]
+	}
+	return fields["used_memory"], max, nil
+}
+
 // Pipe wraps the Redis pipeline feature of redigo
 type Pipe struct {
 	conn redis.Conn
@@ -207,10 +273,16 @@ func (p Pipe) Do(cmd string, args ...interface{}) {
 }
 
 // Flush flushes all pipeline commands to Redis
-func (p Pipe) Flush() {
+func (p Pipe) Flush() error {
+	_, err := p.Exec()
+	return err
+}
+
+// Exec flushes all pipeline commands to Redis and returns their replies
+func (p Pipe) Exec() ([]interface{}, error) {
 	defer p.conn.Close()
-	_, err := p.conn.Do("EXEC")
-	Check(err)
+	replies, err := redis.Values(p.conn.Do("EXEC"))
+	return replies, oomToNoSpace(err)
 }
 
 // Pipeline returns a Pipe instance
@@ -220,45 +292,740 @@ func (c *RedisClient) Pipeline() *Pipe {
 	return &Pipe{conn}
 }
 
-// RedisRing manages multiple Redis instances and use consistent hashing to distribute the load
+// ringKey is the well-known key holding the ring membership (the set of node addresses).
+// It is replicated on every node of the ring so that any of them can tell the current membership.
+const ringKey = "pdwfs:ring"
+
+// ringPlacementKey is the hash holding the placement strategy (field "strategy"), the order in which the nodes
+// joined the ring (field "order", comma-separated addresses) and the weight of each node (a field per node address),
+// replicated next to the ring membership so that all processes place keys alike
+const ringPlacementKey = "pdwfs:ring:placement"
+
+// ringLockKey is the key used as a mutex between processes changing the ring membership,
+// it is held by the first node of the persisted membership
+const ringLockKey = "pdwfs:ring:lock"
+
+// pinnedKey is the node-local set of files whose stripes are pinned on that node
+const pinnedKey = "pdwfs:pinned"
+
+// maximum duration a process can hold the ring lock (ms), rebalancing large data sets may take a while
+const ringLockTimeout = 10 * 60 * 1000
+
+// RedisRing manages multiple Redis instances and use consistent hashing to distribute the load.
+// Nodes are identified by their address so that the placement of keys only depends on the ring membership,
+// the membership and the placement (strategy and node weights) are persisted in Redis and are authoritative
+// over the configured addresses, strategy and weights. The membership is read once when the ring is created:
+// processes running while the membership changes keep placing keys on the former nodes.
 type RedisRing struct {
 	clients map[string]*RedisClient
-	hash    *util.ConsistentHash
+	hash    util.Placement
+	conf    *config.Redis
+	nodes   []string // sorted addresses of the ring members
+	seed    string   // address of the node holding the ring lock before the membership is persisted
+	addrs   []string // configured addresses
+	mtx     sync.RWMutex
+	mem     memoryUsage
+}
+
+// memory usage of the ring, cached to avoid querying all instances on each write
+type memoryUsage struct {
+	used, max int64
+	updated   time.Time
+	mtx       sync.Mutex
+}
+
+// validity of the cached memory usage
+const memoryUsageTTL = time.Second
+
+// ringPlacement is the strategy and the node weights used to place keys on the ring
+type ringPlacement struct {
+	strategy string
+	weights  map[string]int // weight by node address
+}
+
+// returns the placement of the nodes following the configured strategy and weights (default 1)
+func (r *RedisRing) configuredPlacement(nodes []string) ringPlacement {
+	p := ringPlacement{strategy: r.conf.Placement, weights: map[string]int{}}
+	if p.strategy == "" {
+		p.strategy = util.ConsistentPlacement
+	}
+	return p.withNodes(nodes, r.conf.Weights)
+}
+
+// returns the placement restricted to 'nodes', nodes without a weight get their configured weight (default 1)
+func (p ringPlacement) withNodes(nodes []string, configured map[string]int) ringPlacement {
+	res := ringPlacement{strategy: p.strategy, weights: map[string]int{}}
+	for _, addr := range nodes {
+		weight, ok := p.weights[addr]
+		if !ok {
+			if weight, ok = configured[addr]; !ok {
+				weight = 1
+			}
+		}
+		res.weights[addr] = weight
+	}
+	return res
+}
+
+// warns about the configured strategy and weights overridden by the persisted placement
+func (r *RedisRing) checkPlacement(p ringPlacement) {
+	if r.conf.Placement != "" && r.conf.Placement != p.strategy {
+		log.Printf("WARNING placement strategy '%s' of the Redis ring overrides the configured '%s'", p.strategy, r.conf.Placement)
+	}
+	for addr, weight := range r.conf.Weights {
+		if w, ok := p.weights[addr]; ok && w != weight {
+			log.Printf("WARNING weight %d of node %s in the Redis ring overrides the configured %d", w, addr, weight)
+		}
+	}
+}
+
+// returns a new placement of the nodes
+func newHash(nodes []string, p ringPlacement) util.Placement {
+	hash, err := util.NewPlacement(p.strategy, 100)
+	Check(err)
+	for _, addr := range nodes {
+		hash.AddWeighted(addr, p.weights[addr])
+	}
+	return hash
 }
 
-// NewRedisRing returns a new RedisRing instance
+// NewRedisRing returns a new RedisRing instance.
+// Configured addresses which are not yet part of the persisted ring membership are added to the ring,
+// data whose owner has changed is migrated to its new node (see AddNode).
 func NewRedisRing(conf *config.Redis) *RedisRing {
+	r := &RedisRing{
+		clients: map[string]*RedisClient{},
+		conf:    conf,
+		seed:    conf.Addrs[0],
+		addrs:   conf.Addrs,
+	}
+	nodes, placement, err := r.loadMembership()
+	Check(err)
+	if len(nodes) == 0 {
+		// fresh set of Redis instances, the configuration defines the ring
+		nodes = conf.Addrs
+		placement = r.configuredPlacement(nodes)
+		Check(r.saveMembership(nodes, placement, nil))
+	}
+	r.checkPlacement(placement)
+	r.setNodes(nodes, placement)
 
-	ids := make([]string, len(conf.Addrs))
-	clients := make(map[string]*RedisClient)
-	for i, addr := range conf.Addrs {
-		ids[i] = fmt.Sprintf("%d", i)
-		clients[ids[i]] = NewRedisClient(addr)
+	for _, addr := range conf.Addrs {
+		if !r.isMember(addr) {
+			Check(r.AddNode(addr))
+		}
 	}
-	hash := util.NewConsistentHash(100, nil)
-	hash.Add(ids...)
+	return r
+}
 
-	return &RedisRing{
-		clients: clients,
-		hash:    hash,
+// returns the client to a node, creates it if needed (ring must be locked)
+func (r *RedisRing) client(addr string) *RedisClient {
+	if c, ok := r.clients[addr]; ok {
+		return c
 	}
+	c := NewRedisClient(addr)
+	r.clients[addr] = c
+	return c
+}
+
+// replaces the ring nodes and hash (ring must be locked)
+func (r *RedisRing) setNodes(nodes []string, placement ringPlacement) {
+	for _, addr := range nodes {
+		r.client(addr)
+	}
+	r.nodes = nodes
+	r.hash = newHash(nodes, placement)
+}
+
+// reads the persisted ring membership and placement from the first configured node knowing them,
+// a ring persisted without placement follows the configuration
+func (r *RedisRing) loadMembership() ([]string, ringPlacement, error) {
+	for _, addr := range r.addrs {
+		client := r.client(addr)
+		nodes, err := client.SMembers(ringKey)
+		if err != nil {
+			return nil, ringPlacement{}, err
+		}
+		if len(nodes) == 0 {
+			continue
+		}
+		conn := client.pool.Get()
+		fields, err := redis.StringMap(conn.Do("HGETALL", ringPlacementKey))
+		conn.Close()
+		if err != nil {
+			return nil, ringPlacement{}, err
+		}
+		nodes = joinOrder(nodes, fields["order"])
+		placement := r.configuredPlacement(nil)
+		if strategy, ok := fields["strategy"]; ok {
+			placement.strategy = strategy
+			for addr, value := range fields {
+				if addr == "strategy" || addr == "order" {
+					continue
+				}
+				if placement.weights[addr], err = strconv.Atoi(value); err != nil {
+					return nil, ringPlacement{}, err
+				}
+			}
+		}
+		return nodes, placement.withNodes(nodes, r.conf.Weights), nil
+	}
+	return nil, ringPlacement{}, nil
+}
+
+// returns the members of the ring in the order they joined it, sorted if the order was not persisted
+func joinOrder(members []string, order string) []string {
+	sort.Strings(members)
+	if order == "" {
+		return members
+	}
+	ordered := strings.Split(order, ",")
+	sorted := append([]string{}, ordered...)
+	sort.Strings(sorted)
+	if !reflect.DeepEqual(sorted, members) {
+		return members
+	}
+	return ordered
+}
+
+// persists the ring membership and placement on every node of the ring, drained nodes forget them
+func (r *RedisRing) saveMembership(nodes []string, placement ringPlacement, drained []string) error {
+	members := make([]interface{}, 0, len(nodes)+1)
+	members = append(members, ringKey)
+	fields := []interface{}{ringPlacementKey, "strategy", placement.strategy, "order", strings.Join(nodes, ",")}
+	for _, addr := range nodes {
+		members = append(members, addr)
+		fields = append(fields, addr, placement.weights[addr])
+	}
+	for _, addr := range nodes {
+		conn := r.client(addr).pool.Get()
+		conn.Send("MULTI")
+		conn.Send("DEL", ringKey, ringPlacementKey)
+		conn.Send("SADD", members...)
+		conn.Send("HMSET", fields...)
+		_, err := conn.Do("EXEC")
+		conn.Close()
+		if err != nil {
+			return err
+		}
+	}
+	for _, addr := range drained {
+		if err := r.client(addr).Unlink(ringKey, ringPlacementKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var unlockScript = redis.NewScript(1, `
+		if redis.call("GET", KEYS[1]) == ARGV[1] then
+			return redis.call("DEL", KEYS[1])
+		end
+		return 0
+	`)
+
+// acquires the ring lock shared by all processes using the ring, waits until it is available (ring must be locked).
+// The lock is held by the first node of the persisted membership so that processes configured with different
+// addresses exclude each other, the membership read once the lock is acquired is returned.
+func (r *RedisRing) lock() (unlock func(), nodes []string, placement ringPlacement, err error) {
+	host, _ := os.Hostname()
+	token := fmt.Sprintf("%s:%d:%d", host, os.Getpid(), time.Now().UnixNano())
+	for {
+		if nodes, _, err = r.loadMembership(); err != nil {
+			return nil, nil, ringPlacement{}, err
+		}
+		holder := r.seed
+		if len(nodes) > 0 {
+			holder = nodes[0]
+		}
+		if unlock, err = lockNode(r.client(holder), token); err != nil {
+			return nil, nil, ringPlacement{}, err
+		}
+		if nodes, placement, err = r.loadMembership(); err != nil {
+			unlock()
+			return nil, nil, ringPlacement{}, err
+		}
+		if (len(nodes) == 0 && holder == r.seed) || (len(nodes) > 0 && nodes[0] == holder) {
+			return unlock, nodes, placement, nil
+		}
+		// the membership changed while waiting, the lock is now held by another node
+		unlock()
+	}
+}
+
+// takes the ring lock on a node, waits until it is available
+func lockNode(client *RedisClient, token string) (unlock func(), err error) {
+	conn := client.pool.Get()
+	defer conn.Close()
+	for {
+		_, err := redis.String(conn.Do("SET", ringLockKey, token, "NX", "PX", ringLockTimeout))
+		if err == nil {
+			break
+		}
+		if err != redis.ErrNil {
+			return nil, err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return func() {
+		conn := client.pool.Get()
+		defer conn.Close()
+		unlockScript.Do(conn, ringLockKey, token)
+	}, nil
+}
+
+func (r *RedisRing) isMember(addr string) bool {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	for _, n := range r.nodes {
+		if n == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// Nodes returns the addresses of the nodes in the ring
+func (r *RedisRing) Nodes() []string {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return append([]string{}, r.nodes...)
+}
+
+// Clients returns the clients to all nodes in the ring
+func (r *RedisRing) Clients() []*RedisClient {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	clients := make([]*RedisClient, len(r.nodes))
+	for i, addr := range r.nodes {
+		clients[i] = r.clients[addr]
+	}
+	return clients
+}
+
+// AddNode adds the Redis instance at 'addr' to the ring and migrates the stripes and metadata
+// now owned by the new node. Processes sharing the ring are serialized by a lock stored in Redis,
+// only the first one does the migration, the others pick up the new membership.
+// The ring must be idle: no other process should be using it while the ring is rebalanced, as processes
+// already running do not reload the membership and would keep looking for keys on their former nodes.
+func (r *RedisRing) AddNode(addr string) error {
+	return r.changeMembership(func(nodes []string) ([]string, []string) {
+		for _, n := range nodes {
+			if n == addr {
+				return nodes, nil
+			}
+		}
+		return append(nodes, addr), nil
+	})
+}
+
+// DrainNode removes the Redis instance at 'addr' from the ring after having migrated
+// all its keys to the remaining nodes (see AddNode).
+func (r *RedisRing) DrainNode(addr string) error {
+	return r.changeMembership(func(nodes []string) ([]string, []string) {
+		newNodes := make([]string, 0, len(nodes))
+		for _, n := range nodes {
+			if n != addr {
+				newNodes = append(newNodes, n)
+			}
+		}
+		if len(newNodes) == len(nodes) {
+			return nodes, nil
+		}
+		return newNodes, []string{addr}
+	})
+}
+
+// applies a change of membership: computes new nodes, rebalances the data and persists the membership.
+// The process only switches to the new membership once it is persisted, a failed change is rolled back.
+func (r *RedisRing) changeMembership(change func(nodes []string) (newNodes, drained []string)) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	// another process may have changed the membership in the meantime
+	unlock, nodes, placement, err := r.lock()
+	if err != nil {
+		return err
+	}
+	var closing []string // clients to the drained nodes, closed once the lock is released
+	defer func() {
+		for _, addr := range closing {
+			r.clients[addr].Close()
+			delete(r.clients, addr)
+		}
+	}()
+	defer unlock()
+
+	if len(nodes) == 0 {
+		nodes = r.addrs
+		placement = r.configuredPlacement(nodes)
+	}
+	newNodes, drained := change(append([]string{}, nodes...))
+	if len(newNodes) == 0 {
+		return ErrRingEmpty
+	}
+	if reflect.DeepEqual(nodes, newNodes) {
+		r.setNodes(nodes, placement)
+		return nil
+	}
+
+	newPlacement := placement.withNodes(newNodes, r.conf.Weights)
+	for _, addr := range newNodes {
+		r.client(addr)
+	}
+	if err := r.rebalance(nodes, drained, newHash(newNodes, newPlacement)); err != nil {
+		r.rollback(nodes, newNodes, placement)
+		return err
+	}
+	if err := r.saveMembership(newNodes, newPlacement, drained); err != nil {
+		r.rollback(nodes, newNodes, placement)
+		return err
+	}
+	r.setNodes(newNodes, newPlacement)
+	closing = drained
+	return nil
+}
+
+// restores the membership and placement of 'nodes' after a failed change to 'newNodes' (ring must be locked):
+// the data already migrated is moved back and the former membership is persisted again.
+// Errors are only logged, the error of the change is the one reported.
+func (r *RedisRing) rollback(nodes, newNodes []string, placement ringPlacement) {
+	all := append([]string{}, nodes...)
+	var added []string
+	for _, addr := range newNodes {
+		if !contains(nodes, addr) {
+			all = append(all, addr)
+			added = append(added, addr)
+		}
+	}
+	if err := r.rebalance(all, nil, newHash(nodes, placement)); err != nil {
+		log.Printf("WARNING cannot move back the data migrated by the failed change of the Redis ring: %s", err)
+	}
+	if err := r.saveMembership(nodes, placement, added); err != nil {
+		log.Printf("WARNING cannot restore the membership of the Redis ring: %s", err)
+	}
+	r.setNodes(nodes, placement)
+	for _, addr := range added {
+		r.clients[addr].Close()
+		delete(r.clients, addr)
+	}
+}
+
+// returns the hashing key of a Redis key,
+// if the key has curly braces in it (e.g "{mydirectory}/file"), only the string within the braces is used
+func hashKey(key string) string {
+	if s := strings.IndexByte(key, '{'); s > -1 {
+		if e := strings.IndexByte(key[s+1:], '}'); e > 0 {
+			return key[s+1 : s+e+1]
+		}
+	}
+	return key
+}
+
+// returns true if the key is attached to a specific node and must not be migrated on its own
+func isNodeLocalKey(key string) bool {
+	return key == ringKey || key == ringPlacementKey || key == ringLockKey || key == pinnedKey || strings.HasSuffix(key, ":stripes")
+}
+
+// migrates the keys of the given nodes whose owner has changed with the placement 'hash' (ring must be locked).
+// Stripes of pinned files stay on their node unless the node is drained, in which case the files are unpinned.
+func (r *RedisRing) rebalance(nodes []string, drained []string, hash util.Placement) error {
+	errs := make(chan error, len(nodes))
+	unpinned := make(chan []string, len(nodes))
+	wg := sync.WaitGroup{}
+	for _, addr := range nodes {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			names, err := r.rebalanceNode(addr, contains(drained, addr), hash)
+			errs <- err
+			unpinned <- names
+		}(addr)
+	}
+	wg.Wait()
+	close(errs)
+	close(unpinned)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	// metadata has been migrated, the placement of the files can now be reset
+	for names := range unpinned {
+		for _, name := range names {
+			if err := r.clients[ownerIn(hash, pinKey(name))].Unlink(pinKey(name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the metadata key recording the node a file is pinned to
+func pinKey(name string) string {
+	return "{" + name + "}:node"
+}
+
+// migrates the keys of a node, returns the files which were pinned to it if it is drained
+func (r *RedisRing) rebalanceNode(addr string, drained bool, hash util.Placement) ([]string, error) {
+	src := r.clients[addr]
+	pinned, err := src.SMembers(pinnedKey)
+	if err != nil {
+		return nil, err
+	}
+	isPinned := map[string]bool{}
+	for _, name := range pinned {
+		isPinned[name] = true
+	}
+	keys, err := src.Scan("*")
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if isNodeLocalKey(key) {
+			continue
+		}
+		name, _, isStripe := parseStripeKey(key)
+		if isStripe && isPinned[name] && !drained {
+			continue
+		}
+		owner := ownerIn(hash, key)
+		if owner == addr {
+			continue
+		}
+		if err := migrateKey(src, r.clients[owner], key); err != nil {
+			return nil, err
+		}
+	}
+	if drained {
+		return pinned, src.Unlink(pinnedKey)
+	}
+	return nil, nil
+}
+
+// moves a key from one node to another, stripes are also moved from one stripes index to the other
+func migrateKey(src, dst *RedisClient, key string) error {
+	srcConn := src.pool.Get()
+	defer srcConn.Close()
+	dstConn := dst.pool.Get()
+	defer dstConn.Close()
+
+	srcConn.Send("MULTI")
+	srcConn.Send("DUMP", key)
+	srcConn.Send("PTTL", key)
+	values, err := redis.Values(srcConn.Do("EXEC"))
+	if err != nil {
+		return err
+	}
+	if values[0] == nil {
+		return nil // key vanished (expired or removed) in the meantime
+	}
+	dump, _ := redis.Bytes(values[0], nil)
+	ttl, _ := redis.Int64(values[1], nil)
+	if ttl < 0 {
+		ttl = 0
+	}
+
+	name, id, isStripe := parseStripeKey(key)
+	dstConn.Send("MULTI")
+	dstConn.Send("RESTORE", key, ttl, dump, "REPLACE")
+	if isStripe {
+		dstConn.Send("SADD", name+":stripes", id)
+	}
+	if _, err := dstConn.Do("EXEC"); err != nil {
+		return err
+	}
+	srcConn.Send("MULTI")
+	if isStripe {
+		srcConn.Send("SREM", name+":stripes", id)
+	}
+	srcConn.Send("UNLINK", key)
+	_, err = srcConn.Do("EXEC")
+	return err
 }
 
 // GetClient returns a client from the ring based on a key
 // if the key has curly braces in it (e.g "{mydirectory}/file"), only the string within the braces is used
 // in the hasing process to get a client
 func (r *RedisRing) GetClient(key string) *RedisClient {
-	k := key
-	if s := strings.IndexByte(key, '{'); s > -1 {
-		if e := strings.IndexByte(key[s+1:], '}'); e > 0 {
-			k = key[s+1 : s+e+1]
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.clients[r.owner(key)]
+}
+
+// MemoryUsage returns the memory used and the maximum memory of all the ring nodes in bytes
+// Values are cached for a short amount of time.
+func (r *RedisRing) MemoryUsage() (used, max int64, err error) {
+	r.mem.mtx.Lock()
+	defer r.mem.mtx.Unlock()
+	if time.Since(r.mem.updated) < memoryUsageTTL {
+		return r.mem.used, r.mem.max, nil
+	}
+	used, max = 0, 0
+	for _, client := range r.Clients() {
+		u, m, err := client.MemoryInfo()
+		if err != nil {
+			return 0, 0, err
+		}
+		used += u
+		max += m
+	}
+	r.mem.used, r.mem.max, r.mem.updated = used, max, time.Now()
+	return used, max, nil
+}
+
+// GetNodeClient returns the client to the ring node at address 'addr', nil if it is not part of the ring
+func (r *RedisRing) GetNodeClient(addr string) *RedisClient {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	if !contains(r.nodes, addr) {
+		return nil
+	}
+	return r.clients[addr]
+}
+
+// LocalNodes returns the addresses of the ring nodes running on the current host
+func (r *RedisRing) LocalNodes() []string {
+	var local []string
+	for _, addr := range r.Nodes() {
+		if isLocalAddr(addr) {
+			local = append(local, addr)
+		}
+	}
+	return local
+}
+
+// returns true if the host part of the address designates the current host
+func isLocalAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "" || host == "localhost" {
+		return true
+	}
+	if hostname, err := os.Hostname(); err == nil && (host == hostname || strings.HasPrefix(hostname, host+".")) {
+		return true
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return false
+	}
+	ifAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, ip := range ips {
+		if ip.IsLoopback() {
+			return true
+		}
+		for _, ifAddr := range ifAddrs {
+			if ipNet, ok := ifAddr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// namespaceSeparator separates the namespace from the rest of a key: <namespace>@{/path}:mode, <namespace>@/path:3
+const namespaceSeparator = "@"
+
+// returns the namespace of a key, or an empty string if the key is not namespaced
+func keyNamespace(key string) string {
+	i := strings.Index(key, namespaceSeparator)
+	if i < 1 || !config.ValidNamespace(key[:i]) {
+		return ""
+	}
+	return key[:i]
+}
+
+// Namespaces returns the sorted list of the namespaces having keys in the ring
+func (r *RedisRing) Namespaces() ([]string, error) {
+	found := map[string]bool{}
+	for _, client := range r.Clients() {
+		keys, err := client.Scan("*" + namespaceSeparator + "*")
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if ns := keyNamespace(key); ns != "" {
+				found[ns] = true
+			}
+		}
+	}
+	namespaces := make([]string, 0, len(found))
+	for ns := range found {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	return namespaces, nil
+}
+
+// DropNamespace removes all the keys (files data and metadata) of a namespace from the ring
+func (r *RedisRing) DropNamespace(namespace string) error {
+	if !config.ValidNamespace(namespace) {
+		return ErrInvalidNamespace
+	}
+	prefix := namespace + namespaceSeparator
+	for _, client := range r.Clients() {
+		keys, err := client.Scan(prefix + "*")
+		if err != nil {
+			return err
+		}
+		for len(keys) > 0 {
+			n := len(keys)
+			if n > 1000 {
+				n = 1000
+			}
+			if err := client.Unlink(keys[:n]...); err != nil {
+				return err
+			}
+			keys = keys[n:]
+		}
+		pinned, err := client.SMembers(pinnedKey)
+		if err != nil {
+			return err
+		}
+		for _, name := range pinned {
+			if strings.HasPrefix(name, prefix) {
+				if err := client.SRem(pinnedKey, name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// returns the address of the node owning the key (ring must be locked)
+func (r *RedisRing) owner(key string) string {
+	return ownerIn(r.hash, key)
+}
+
+// returns the address of the node owning the key with the placement 'hash'
+func ownerIn(hash util.Placement, key string) string {
+	if stripes, ok := hash.(util.StripePlacement); ok {
+		if name, id, ok := parseStripeKey(key); ok {
+			return stripes.GetStripe(name, id)
 		}
 	}
-	return r.clients[r.hash.Get(k)]
+	return hash.Get(hashKey(key))
 }
 
 // Close all clients in the ring
 func (r *RedisRing) Close() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
 	var err error
 	for _, client := range r.clients {
 		err = client.Close()
@@ -15,9 +15,13 @@
 package redisfs
 
 import (
+	"bytes"
+	"fmt"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/cea-hpc/pdwfs/redigo/redis"
 	"github.com/cea-hpc/pdwfs/util"
 )
 
@@ -105,3 +109,168 @@ func TestGetRangeInto(t *testing.T) {
 	util.Equals(t, len(b), read, "wrong number of bytes read")
 	util.Equals(t, data[4:9], b, "read data does not match written data")
 }
+
+func TestRingMembership(t *testing.T) {
+	server1, conf := util.InitRedisTestServer()
+	defer server1.Stop()
+	server2, conf2 := util.InitRedisTestServer()
+	defer server2.Stop()
+
+	ring := NewRedisRing(conf)
+	defer ring.Close()
+	util.Equals(t, conf.Addrs, ring.Nodes(), "ring should be made of the configured node")
+
+	store := NewDataStore(ring, 10)
+	data := bytes.Repeat([]byte("0123456789"), 100) // 100 stripes
+	store.WriteAt("myfile", 0, data)
+
+	// the new node gets its share of stripes, data is still fully readable
+	util.Ok(t, ring.AddNode(conf2.Addrs[0]))
+	util.Equals(t, 2, len(ring.Nodes()), "ring should have two nodes")
+	stripes, err := NewRedisClient(conf2.Addrs[0]).SMembers("myfile:stripes")
+	util.Ok(t, err)
+	util.Assert(t, len(stripes) > 0, "stripes should have been migrated to the new node")
+	readData := make([]byte, len(data))
+	util.Equals(t, int64(len(data)), store.ReadAt("myfile", 0, readData), "wrong number of bytes read")
+	util.Equals(t, data, readData, "read data does not match written data")
+
+	// membership is persisted, a new ring configured with the first node only sees both nodes
+	ring2 := NewRedisRing(conf)
+	defer ring2.Close()
+	util.Equals(t, ring.Nodes(), ring2.Nodes(), "ring membership should be persisted")
+
+	// draining the first node moves all its data to the second one
+	util.Ok(t, ring.DrainNode(conf.Addrs[0]))
+	util.Equals(t, conf2.Addrs, ring.Nodes(), "ring should only have the second node")
+	keys, err := NewRedisClient(conf.Addrs[0]).Scan("myfile*")
+	util.Ok(t, err)
+	util.Equals(t, 0, len(keys), "drained node should not hold any data")
+	readData = make([]byte, len(data))
+	util.Equals(t, int64(len(data)), store.ReadAt("myfile", 0, readData), "wrong number of bytes read")
+	util.Equals(t, data, readData, "read data does not match written data")
+}
+
+func TestRingPlacementPersisted(t *testing.T) {
+	server1, conf := util.InitRedisTestServer()
+	defer server1.Stop()
+	server2, conf2 := util.InitRedisTestServer()
+	defer server2.Stop()
+	conf.Addrs = append(conf.Addrs, conf2.Addrs...)
+	conf.Placement = util.JumpPlacement
+	conf.Weights = map[string]int{conf2.Addrs[0]: 3}
+
+	ring := NewRedisRing(conf)
+	defer ring.Close()
+
+	// a process configured differently places keys as the ring was created
+	other := *conf
+	other.Placement = util.RendezvousPlacement
+	other.Weights = nil
+	ring2 := NewRedisRing(&other)
+	defer ring2.Close()
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("file:%d", i)
+		util.Equals(t, ring.owner(key), ring2.owner(key), "processes should place keys alike")
+	}
+
+	_, placement, err := ring2.loadMembership()
+	util.Ok(t, err)
+	util.Equals(t, util.JumpPlacement, placement.strategy, "strategy should be persisted")
+	util.Equals(t, map[string]int{conf.Addrs[0]: 1, conf2.Addrs[0]: 3}, placement.weights, "weights should be persisted")
+}
+
+func TestRingFailedChange(t *testing.T) {
+	server, conf := util.InitRedisTestServer()
+	defer server.Stop()
+
+	ring := NewRedisRing(conf)
+	defer ring.Close()
+	store := NewDataStore(ring, 10)
+	data := bytes.Repeat([]byte("0123456789"), 100) // 100 stripes
+	util.Ok(t, store.WriteAt("myfile", 0, data))
+
+	// stripes cannot be migrated to an unreachable node, the ring keeps its membership and data
+	util.Assert(t, ring.AddNode("127.0.0.1:1") != nil, "adding an unreachable node should fail")
+	util.Equals(t, conf.Addrs, ring.Nodes(), "membership should be unchanged")
+	ring2 := NewRedisRing(conf)
+	defer ring2.Close()
+	util.Equals(t, conf.Addrs, ring2.Nodes(), "persisted membership should be unchanged")
+	readData := make([]byte, len(data))
+	util.Equals(t, int64(len(data)), store.ReadAt("myfile", 0, readData), "wrong number of bytes read")
+	util.Equals(t, data, readData, "read data does not match written data")
+}
+
+func TestRingLockSharedByMembers(t *testing.T) {
+	server1, conf := util.InitRedisTestServer()
+	defer server1.Stop()
+	server2, conf2 := util.InitRedisTestServer()
+	defer server2.Stop()
+	conf.Addrs = append(conf.Addrs, conf2.Addrs...)
+
+	ring := NewRedisRing(conf)
+	defer ring.Close()
+	// configured with the second node only, the process finds the ring membership from it
+	ring2 := NewRedisRing(conf2)
+	defer ring2.Close()
+
+	ring.mtx.Lock()
+	unlock, _, _, err := ring.lock()
+	ring.mtx.Unlock()
+	util.Ok(t, err)
+	done := make(chan error)
+	go func() {
+		done <- ring2.DrainNode(conf.Addrs[0])
+	}()
+	select {
+	case <-done:
+		t.Fatal("change of membership should wait for the ring lock")
+	case <-time.After(300 * time.Millisecond):
+	}
+	unlock()
+	util.Ok(t, <-done)
+	util.Equals(t, conf2.Addrs, ring2.Nodes(), "node should have been drained")
+}
+
+func TestOOMToNoSpace(t *testing.T) {
+	err := oomToNoSpace(redis.Error("OOM command not allowed when used memory > 'maxmemory'."))
+	util.Equals(t, ErrNoSpace, err, "OOM error should be converted")
+
+	err = oomToNoSpace(redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value"))
+	util.Assert(t, err != ErrNoSpace, "other errors should not be converted")
+}
+
+func TestKeyNamespace(t *testing.T) {
+	util.Equals(t, "job1", keyNamespace("job1@{/path/to/file}:mode"), "wrong namespace")
+	util.Equals(t, "job1", keyNamespace("job1@/path/to/file:3"), "wrong namespace")
+	util.Equals(t, "", keyNamespace("/path/to/a@b:3"), "key is not namespaced")
+	util.Equals(t, "", keyNamespace("{/path/to/a@b}:mode"), "key is not namespaced")
+	util.Equals(t, "", keyNamespace("pdwfs:quota:{/path@job1}"), "key is not namespaced")
+}
+
+func TestNamespaces(t *testing.T) {
+	server, conf := util.InitRedisTestServer()
+	defer server.Stop()
+
+	ring := NewRedisRing(conf)
+	defer ring.Close()
+
+	store1 := NewDataStore(ring, 10)
+	store1.SetNamespace("job1")
+	store2 := NewDataStore(ring, 10)
+	store2.SetNamespace("job2")
+
+	util.Ok(t, store1.WriteAt("/path/to/file", 0, []byte("job1 content")))
+	util.Ok(t, store2.WriteAt("/path/to/file", 0, []byte("job2 data")))
+	util.Equals(t, int64(12), store1.GetSize("/path/to/file"), "namespaces should not collide")
+	util.Equals(t, int64(9), store2.GetSize("/path/to/file"), "namespaces should not collide")
+
+	namespaces, err := ring.Namespaces()
+	util.Ok(t, err)
+	util.Equals(t, []string{"job1", "job2"}, namespaces, "wrong namespaces")
+
+	util.Ok(t, ring.DropNamespace("job1"))
+	util.Equals(t, int64(0), store1.GetSize("/path/to/file"), "namespace should be dropped")
+	util.Equals(t, int64(9), store2.GetSize("/path/to/file"), "other namespaces should be kept")
+
+	util.Equals(t, ErrInvalidNamespace, ring.DropNamespace("job*"), "glob patterns are not valid namespaces")
+}
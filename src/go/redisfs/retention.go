@@ -0,0 +1,108 @@
+// Copyright 2019 CEA
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Retention policies keep the memory used by long simulations bounded:
+// files can be removed once read a given number of times (consume-once time steps),
+// and only the last files of a series are kept, the files of a series being ordered by creation time
+// in a Redis sorted set shared by all the processes writing in the mount point.
+
+package redisfs
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/cea-hpc/pdwfs/config"
+	"github.com/cea-hpc/pdwfs/redigo/redis"
+)
+
+// returns the retention rule applying to path, nil if none
+func (fs *RedisFS) retention(path string) *config.RetentionRule {
+	for i, rule := range fs.mountConf.Retention {
+		if matchPathOrParent(rule.Pattern, path, fs.mountConf.Path) {
+			return &fs.mountConf.Retention[i]
+		}
+	}
+	return nil
+}
+
+// returns the key of the sorted set holding the series of files of a retention rule
+func (fs *RedisFS) seriesKey(rule *config.RetentionRule) string {
+	return fs.dataStore.namespaced("pdwfs:series:{" + fs.mountConf.Path + "}:" + rule.Pattern)
+}
+
+// adds a file to a series and returns the oldest files above the number of files to keep
+var keepLastScript = redis.NewScript(1, `
+		redis.call("ZADD", KEYS[1], ARGV[1], ARGV[2])
+		local excess = redis.call("ZCARD", KEYS[1]) - tonumber(ARGV[3])
+		if excess <= 0 then
+			return {}
+		end
+		local evicted = redis.call("ZRANGE", KEYS[1], 0, excess - 1)
+		redis.call("ZREMRANGEBYRANK", KEYS[1], 0, excess - 1)
+		return evicted
+	`)
+
+// registers a created file in its series and removes the files falling out of the series
+func (fs *RedisFS) addToSeries(path string) {
+	rule := fs.retention(path)
+	if rule == nil || rule.KeepLast <= 0 {
+		return
+	}
+	key := fs.seriesKey(rule)
+	conn := fs.redisRing.GetClient(key).pool.Get()
+	defer conn.Close()
+	now := time.Now().UnixNano() / int64(time.Microsecond)
+	evicted, err := redis.Strings(keepLastScript.Do(conn, key, now, path, rule.KeepLast))
+	Check(err)
+	for _, name := range evicted {
+		fs.evict(name, "out of its series")
+	}
+}
+
+// counts a reader closing the file and removes the file once read enough
+func (fs *RedisFS) consume(i *Inode) {
+	rule := fs.retention(i.Path())
+	if rule == nil || rule.MaxReads <= 0 {
+		return
+	}
+	if i.addRead() >= rule.MaxReads {
+		fs.evict(i.Path(), "read enough")
+	}
+}
+
+// removes a file by retention policy, the file may have been removed already
+func (fs *RedisFS) evict(path, reason string) {
+	err := fs.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("WARNING cannot remove '%s' %s: %s", path, reason, err)
+	}
+}
+
+// consumeOnCloseFile wraps a file opened for reading so that its reads are counted once closed
+type consumeOnCloseFile struct {
+	File
+	fs    *RedisFS
+	inode *Inode
+}
+
+// Close closes the file and counts the read
+func (f *consumeOnCloseFile) Close() error {
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+	f.fs.consume(f.inode)
+	return nil
+}
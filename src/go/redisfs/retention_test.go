@@ -0,0 +1,74 @@
+// Copyright 2019 CEA
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redisfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cea-hpc/pdwfs/config"
+	"github.com/cea-hpc/pdwfs/util"
+)
+
+func TestConsumeOnce(t *testing.T) {
+	redis, redisConf := util.InitRedisTestServer()
+	defer redis.Stop()
+
+	mountConf := util.GetMountPathConf()
+	mountConf.Retention = []config.RetentionRule{{Pattern: "*.step", MaxReads: 2}}
+	fs := NewRedisFS(redisConf, mountConf)
+	defer fs.Finalize()
+
+	name := filepath.Join(mountConf.Path, "1.step")
+	f, err := fs.OpenFile(name, os.O_CREATE|os.O_WRONLY, 0600)
+	util.Ok(t, err)
+	// readers closing while the file is written are not counted
+	r, err := fs.OpenFile(name, os.O_RDONLY, 0)
+	util.Ok(t, err)
+	r.Close()
+	f.Close()
+
+	for n := 1; n <= 2; n++ {
+		_, err := fs.Stat(name)
+		util.Ok(t, err)
+		r, err := fs.OpenFile(name, os.O_RDONLY, 0)
+		util.Ok(t, err)
+		r.Close()
+	}
+	_, err = fs.Stat(name)
+	util.Assert(t, os.IsNotExist(err), "file should be removed after 2 reads")
+}
+
+func TestKeepLast(t *testing.T) {
+	redis, redisConf := util.InitRedisTestServer()
+	defer redis.Stop()
+
+	mountConf := util.GetMountPathConf()
+	mountConf.Retention = []config.RetentionRule{{Pattern: "*.step", KeepLast: 2}}
+	fs := NewRedisFS(redisConf, mountConf)
+	defer fs.Finalize()
+
+	for n := 1; n <= 4; n++ {
+		f, err := fs.OpenFile(filepath.Join(mountConf.Path, fmt.Sprintf("%d.step", n)), os.O_CREATE|os.O_WRONLY, 0600)
+		util.Ok(t, err)
+		f.Close()
+	}
+	for n := 1; n <= 4; n++ {
+		_, err := fs.Stat(filepath.Join(mountConf.Path, fmt.Sprintf("%d.step", n)))
+		util.Equals(t, n <= 2, os.IsNotExist(err), fmt.Sprintf("only the last 2 files should be kept (file %d)", n))
+	}
+}
@@ -0,0 +1,567 @@
+// Copyright 2019 CEA
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Staging copies files between a RedisFS mount point and persistent directories:
+// a directory tree can be imported at initialization (stage-in) and files are drained
+// to a persistent directory (stage-out) asynchronously, on close or at finalization.
+// Copies are done stripe by stripe in parallel and a status record is kept in Redis for each file.
+
+package redisfs
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cea-hpc/pdwfs/redigo/redis"
+)
+
+// states of the staging status record of a file
+const (
+	StageImported = "imported" // copied from the stage-in directory and not modified since
+	StagePending  = "pending"  // queued for stage-out
+	StageRunning  = "running"  // being drained to the stage-out directory
+	StageDone     = "done"     // drained and not modified since
+	StageFailed   = "failed"   // stage-out failed (see StageStatus.Error)
+)
+
+// StageStatus is the staging status record of a file
+type StageStatus struct {
+	State string
+	Size  int64     // number of bytes copied
+	Error string    // error message of a failed stage-out
+	Time  time.Time // time of the last state change
+}
+
+// names of the stagers, see NewStager
+const (
+	stagingName = "staging" // stage-out to a persistent directory
+	flushName   = "flush"   // write-through to the real directory of the mount point
+)
+
+// DefaultStageWorkers is the default number of concurrent stripe copies
+const DefaultStageWorkers = 4
+
+// DefaultStageQueueSize is the default size of the queue of files waiting to be drained,
+// closing a file blocks when the queue is full
+const DefaultStageQueueSize = 1024
+
+// delay before the first retry of a failed copy, doubled at each retry
+const stageRetryDelay = 100 * time.Millisecond
+
+// StagerOptions tunes a Stager
+type StagerOptions struct {
+	Workers   int // number of concurrent stripe copies (default DefaultStageWorkers)
+	QueueSize int // number of files waiting to be drained (default DefaultStageQueueSize)
+	Retries   int // number of retries of a failed copy
+}
+
+// Stager drains the files of a mount point to a persistent directory with a pool of workers
+type Stager struct {
+	name      string // name of the stager, used as suffix of the status record keys
+	mountPath string
+	dir       string // stage-out directory
+	dataStore *DataStore
+	redisRing *RedisRing
+	retries   int
+	queue     chan stageJob
+	sem       chan struct{}  // bounds the number of concurrent stripe copies
+	pending   sync.WaitGroup // files queued or being drained
+	queued    int64          // number of files queued or being drained
+	workers   sync.WaitGroup
+}
+
+// stageJob is a file queued for stage-out, with the generation of its status record when it was claimed
+type stageJob struct {
+	path string
+	gen  int64
+}
+
+// NewStager returns a Stager draining files of the mount point to 'dir',
+// 'name' distinguishes the status records of stagers draining the same files
+func NewStager(name string, dataStore *DataStore, ring *RedisRing, mountPath, dir string, opts StagerOptions) *Stager {
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultStageWorkers
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultStageQueueSize
+	}
+	s := &Stager{
+		name:      name,
+		mountPath: mountPath,
+		dir:       dir,
+		dataStore: dataStore,
+		redisRing: ring,
+		retries:   opts.Retries,
+		queue:     make(chan stageJob, opts.QueueSize),
+		sem:       make(chan struct{}, opts.Workers),
+	}
+	for i := 0; i < opts.Workers; i++ {
+		s.workers.Add(1)
+		go s.worker()
+	}
+	return s
+}
+
+// returns the key of the staging status record of a file
+func (s *Stager) statusKey(path string) string {
+	return metaKeyPrefix(s.dataStore, path) + ":" + s.name
+}
+
+// sets the staging state of a file, the record expires with the file metadata.
+// The state is not changed if the record has been reset since the generation ARGV[5] was claimed (if any).
+var setStageStatusScript = redis.NewScript(2, `
+		if ARGV[5] ~= "" and (redis.call("HGET", KEYS[1], "gen") or "0") ~= ARGV[5] then
+			return 0
+		end
+		redis.call("HSET", KEYS[1], "state", ARGV[1], "size", ARGV[2], "error", ARGV[3], "time", ARGV[4])
+		local ttl = redis.call("PTTL", KEYS[2])
+		if ttl > 0 then
+			redis.call("PEXPIRE", KEYS[1], ttl)
+		end
+		return 1
+	`)
+
+// sets the staging state of a file claimed with generation 'gen', whatever its generation if 'gen' is negative
+func (s *Stager) setStatus(path string, gen int64, state string, size int64, failure error) {
+	msg := ""
+	if failure != nil {
+		msg = failure.Error()
+	}
+	claimed := ""
+	if gen >= 0 {
+		claimed = strconv.FormatInt(gen, 10)
+	}
+	key := s.statusKey(path)
+	conn := s.redisRing.GetClient(key).pool.Get()
+	defer conn.Close()
+	Try(err(setStageStatusScript.Do(conn, key, metaKeyPrefix(s.dataStore, path)+":mode", state, size, msg, time.Now().Unix(), claimed)))
+}
+
+// marks a file as pending if it is not already queued, being drained or unmodified since its last copy,
+// returns the generation of the status record, -1 if the file should not be drained
+var claimStageScript = redis.NewScript(2, `
+		local state = redis.call("HGET", KEYS[1], "state")
+		if state == "pending" or state == "running" or state == "done" or state == "imported" then
+			return -1
+		end
+		redis.call("HSET", KEYS[1], "state", "pending", "size", 0, "error", "", "time", ARGV[1])
+		local ttl = redis.call("PTTL", KEYS[2])
+		if ttl > 0 then
+			redis.call("PEXPIRE", KEYS[1], ttl)
+		end
+		return tonumber(redis.call("HGET", KEYS[1], "gen") or "0")
+	`)
+
+func (s *Stager) claim(path string) int64 {
+	key := s.statusKey(path)
+	conn := s.redisRing.GetClient(key).pool.Get()
+	defer conn.Close()
+	gen, err := redis.Int64(claimStageScript.Do(conn, key, metaKeyPrefix(s.dataStore, path)+":mode", time.Now().Unix()))
+	Check(err)
+	return gen
+}
+
+// discards the staging state of a file and starts a new generation of its status record,
+// the state set by a worker still draining a previous generation is then ignored
+var resetStageScript = redis.NewScript(2, `
+		redis.call("HDEL", KEYS[1], "state", "size", "error", "time")
+		redis.call("HINCRBY", KEYS[1], "gen", 1)
+		local ttl = redis.call("PTTL", KEYS[2])
+		if ttl > 0 then
+			redis.call("PEXPIRE", KEYS[1], ttl)
+		end
+		return 1
+	`)
+
+// Reset discards the staging status of a modified file so that it is drained again
+func (s *Stager) Reset(path string) {
+	key := s.statusKey(path)
+	conn := s.redisRing.GetClient(key).pool.Get()
+	defer conn.Close()
+	Try(err(resetStageScript.Do(conn, key, metaKeyPrefix(s.dataStore, path)+":mode")))
+}
+
+// Status returns the staging status record of a file, with an empty state if the file has never been staged
+func (s *Stager) Status(path string) (StageStatus, error) {
+	key := s.statusKey(path)
+	conn := s.redisRing.GetClient(key).pool.Get()
+	defer conn.Close()
+	fields, err := redis.StringMap(conn.Do("HGETALL", key))
+	if err != nil {
+		return StageStatus{}, err
+	}
+	size, _ := strconv.ParseInt(fields["size"], 10, 64)
+	t, _ := strconv.ParseInt(fields["time"], 10, 64)
+	return StageStatus{
+		State: fields["state"],
+		Size:  size,
+		Error: fields["error"],
+		Time:  time.Unix(t, 0),
+	}, nil
+}
+
+// Enqueue schedules the asynchronous stage-out of a file, unless it is already drained or queued
+func (s *Stager) Enqueue(path string) {
+	gen := s.claim(path)
+	if gen < 0 {
+		return
+	}
+	s.pending.Add(1)
+	atomic.AddInt64(&s.queued, 1)
+	s.queue <- stageJob{path, gen}
+}
+
+// Wait blocks until all queued files are drained
+func (s *Stager) Wait() {
+	s.pending.Wait()
+}
+
+// Pending returns the number of files queued or being drained
+func (s *Stager) Pending() int {
+	return int(atomic.LoadInt64(&s.queued))
+}
+
+// Close waits for the queued files to be drained and stops the workers
+func (s *Stager) Close() {
+	s.Wait()
+	close(s.queue)
+	s.workers.Wait()
+}
+
+func (s *Stager) worker() {
+	defer s.workers.Done()
+	for job := range s.queue {
+		path := job.path
+		s.setStatus(path, job.gen, StageRunning, 0, nil)
+		size, err := s.drain(path)
+		for retry, delay := 0, stageRetryDelay; err != nil && retry < s.retries; retry, delay = retry+1, 2*delay {
+			log.Printf("WARNING %s of '%s' failed, retrying in %s: %s", s.name, path, delay, err)
+			time.Sleep(delay)
+			size, err = s.drain(path)
+		}
+		if err != nil {
+			log.Printf("WARNING %s of '%s' failed: %s", s.name, path, err)
+			s.setStatus(path, job.gen, StageFailed, size, err)
+		} else {
+			s.setStatus(path, job.gen, StageDone, size, nil)
+		}
+		atomic.AddInt64(&s.queued, -1)
+		s.pending.Done()
+	}
+}
+
+// returns the path in the stage-out directory of a file of the mount point
+func (s *Stager) destination(path string) string {
+	return filepath.Join(s.dir, strings.TrimPrefix(path, s.mountPath))
+}
+
+// copies a file to the stage-out directory, the copy is written aside and renamed once complete
+func (s *Stager) drain(path string) (int64, error) {
+	dst := s.destination(path)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return 0, err
+	}
+	mode := NewInode(s.dataStore, s.redisRing, path).Mode()
+	tmp := dst + ".pdwfs-staging"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm()|0200)
+	if err != nil {
+		return 0, err
+	}
+	size := s.dataStore.GetSize(path)
+	if err = f.Truncate(size); err == nil {
+		err = s.copyStripes(size, func(off int64, buf []byte) error {
+			n := s.dataStore.ReadAt(path, off, buf)
+			_, err := f.WriteAt(buf[:n], off)
+			return err
+		})
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	return size, nil
+}
+
+// runs the copy function on each stripe-sized chunk of a content of 'size' bytes in parallel,
+// the number of concurrent copies is bounded by the number of workers
+func (s *Stager) copyStripes(size int64, copy func(off int64, buf []byte) error) error {
+	stripeSize := s.dataStore.stripeSize
+	wg := sync.WaitGroup{}
+	errs := errorOnce{}
+	for off := int64(0); off < size; off += stripeSize {
+		n := stripeSize
+		if size-off < n {
+			n = size - off
+		}
+		s.sem <- struct{}{}
+		wg.Add(1)
+		go func(off, n int64) {
+			defer func() {
+				<-s.sem
+				wg.Done()
+			}()
+			errs.set(copy(off, make([]byte, n)))
+		}(off, n)
+	}
+	wg.Wait()
+	return errs.err
+}
+
+// copies a file from disk into the store under 'path'
+func (s *Stager) importFile(src string, path string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	err = s.copyStripes(info.Size(), func(off int64, buf []byte) error {
+		if _, err := f.ReadAt(buf, off); err != nil && err != io.EOF {
+			return err
+		}
+		return s.dataStore.WriteAt(path, off, buf)
+	})
+	if err != nil {
+		return err
+	}
+	s.setStatus(path, -1, StageImported, info.Size(), nil)
+	return nil
+}
+
+// how long processes wait between checks of the stage-in completion by another process
+const stageInPollInterval = 100 * time.Millisecond
+
+// stageInLease is the duration after which the stage-in claimed by a process not refreshing it expires,
+// another process then imports the tree again. A failed stage-in is reported for the same duration.
+var stageInLease = 30 * time.Second
+
+// extends the stage-in claim ARGV[1] by ARGV[2] ms, returns 0 if the claim was lost
+var refreshStageInScript = redis.NewScript(1, `
+		if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+			return 0
+		end
+		return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	`)
+
+// sets the final state ARGV[2] of the stage-in claimed by ARGV[1], expiring after ARGV[3] ms if positive,
+// returns 0 if the claim was lost
+var finishStageInScript = redis.NewScript(1, `
+		if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+			return 0
+		end
+		if tonumber(ARGV[3]) > 0 then
+			redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+		else
+			redis.call("SET", KEYS[1], ARGV[2])
+		end
+		return 1
+	`)
+
+// StageIn imports the directory tree 'dir' into the mount point.
+// Only the first process sharing the mount point (and namespace) imports the tree, the others wait for its completion
+// (up to the configured timeout) and take the import over if the importing process dies.
+func (fs *RedisFS) StageIn(dir string) error {
+	if fs.stager == nil {
+		return fmt.Errorf("staging is not configured on mount point %s", fs.mountConf.Path)
+	}
+	dir = filepath.Clean(dir)
+	key := fs.dataStore.namespaced("pdwfs:stagein:{" + fs.mountConf.Path + "}")
+	client := fs.redisRing.GetClient(key)
+	conn := client.pool.Get()
+	defer conn.Close()
+	host, _ := os.Hostname()
+	token := fmt.Sprintf("%s:%d:%d", host, os.Getpid(), time.Now().UnixNano())
+	lease := int64(stageInLease / time.Millisecond)
+	timeout := time.Duration(fs.mountConf.Staging.InTimeout * float64(time.Second))
+	deadline := time.Now().Add(timeout)
+	for {
+		_, err := redis.String(conn.Do("SET", key, token, "NX", "PX", lease))
+		if err == nil {
+			break
+		}
+		if err != redis.ErrNil {
+			return err
+		}
+		// another process imports the tree
+		state, err := redis.String(conn.Do("GET", key))
+		if err == redis.ErrNil {
+			continue // its claim has expired, take the import over
+		}
+		if err != nil {
+			return err
+		}
+		switch state {
+		case StageDone:
+			return nil
+		case StageFailed:
+			return fmt.Errorf("stage-in of %s failed", dir)
+		}
+		if timeout > 0 && time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for the stage-in of %s", dir)
+		}
+		time.Sleep(stageInPollInterval)
+	}
+
+	// refresh the claim while importing
+	stop := make(chan struct{})
+	refreshed := make(chan struct{})
+	go func() {
+		defer close(refreshed)
+		conn := client.pool.Get()
+		defer conn.Close()
+		ticker := time.NewTicker(stageInLease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := refreshStageInScript.Do(conn, key, token, lease); err != nil {
+					log.Printf("WARNING cannot refresh the stage-in claim of %s: %s", dir, err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	err := filepath.Walk(dir, func(src string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(fs.mountConf.Path, strings.TrimPrefix(src, dir))
+		if info.IsDir() {
+			if err := fs.Mkdir(path, info.Mode().Perm()); err != nil && !os.IsExist(err) {
+				return err
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := fs.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return fs.stager.importFile(src, path)
+	})
+	close(stop)
+	<-refreshed
+	state, expiry := StageDone, int64(0)
+	if err != nil {
+		// later runs import the tree again once the failure expires
+		state, expiry = StageFailed, lease
+	}
+	ok, e := redis.Bool(finishStageInScript.Do(conn, key, token, state, expiry))
+	Check(e)
+	if !ok {
+		log.Printf("WARNING stage-in claim of %s expired before its completion", dir)
+	}
+	return err
+}
+
+// StageOut drains all the files of the mount point matching the stage-out patterns
+// (all files if none is configured) which have not been drained yet, and waits for completion
+func (fs *RedisFS) StageOut() {
+	if fs.stager == nil {
+		return
+	}
+	fs.walkFiles(fs.root, func(i *Inode) {
+		if len(fs.mountConf.Staging.Patterns) == 0 || fs.matchAny(fs.mountConf.Staging.Patterns, i.Path()) {
+			fs.stager.Enqueue(i.Path())
+		}
+	})
+	fs.stager.Wait()
+}
+
+// StageStatus returns the staging status record of the named file
+func (fs *RedisFS) StageStatus(name string) (StageStatus, error) {
+	if fs.stager == nil {
+		return StageStatus{}, fmt.Errorf("staging is not configured on mount point %s", fs.mountConf.Path)
+	}
+	path, err := AbsPath(name)
+	if err != nil {
+		return StageStatus{}, err
+	}
+	return fs.stager.Status(path)
+}
+
+// FlushStatus returns the write-through status record of the named file, the file has landed
+// in the real directory once the state is StageDone
+func (fs *RedisFS) FlushStatus(name string) (StageStatus, error) {
+	if fs.flusher == nil {
+		return StageStatus{}, fmt.Errorf("write-through is not enabled on mount point %s", fs.mountConf.Path)
+	}
+	path, err := AbsPath(name)
+	if err != nil {
+		return StageStatus{}, err
+	}
+	return fs.flusher.Status(path)
+}
+
+// returns true if the path (or one of its parent directories) matches one of the patterns
+func (fs *RedisFS) matchAny(patterns []string, path string) bool {
+	for _, pattern := range patterns {
+		if matchPathOrParent(pattern, path, fs.mountConf.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// calls fn on all the regular files of the tree rooted at inode i
+func (fs *RedisFS) walkFiles(i *Inode, fn func(*Inode)) {
+	children, err := i.getChildren()
+	Check(err)
+	for _, child := range children {
+		if c, ok := fs.getInode(child.Path()); ok {
+			if c.IsDir() {
+				fs.walkFiles(c, fn)
+			} else {
+				fn(c)
+			}
+		}
+	}
+}
+
+// stageOnCloseFile wraps a file opened for writing so that it is drained once closed
+type stageOnCloseFile struct {
+	File
+	stager *Stager
+}
+
+// Close closes the file and schedules its stage-out
+func (f *stageOnCloseFile) Close() error {
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+	f.stager.Enqueue(f.Name())
+	return nil
+}
@@ -0,0 +1,193 @@
+// Copyright 2019 CEA
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redisfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cea-hpc/pdwfs/config"
+	"github.com/cea-hpc/pdwfs/util"
+)
+
+func writeStagedFile(t *testing.T, fs *RedisFS, path string, data []byte) {
+	f, err := fs.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	util.Ok(t, err)
+	_, err = f.Write(data)
+	util.Ok(t, err)
+	util.Ok(t, f.Close())
+}
+
+func TestStaging(t *testing.T) {
+	redis, redisConf := util.InitRedisTestServer()
+	defer redis.Stop()
+
+	inDir, err := ioutil.TempDir("", "pdwfs-stagein")
+	util.Ok(t, err)
+	defer os.RemoveAll(inDir)
+	outDir, err := ioutil.TempDir("", "pdwfs-stageout")
+	util.Ok(t, err)
+	defer os.RemoveAll(outDir)
+
+	util.Ok(t, os.Mkdir(filepath.Join(inDir, "sub"), 0755))
+	util.Ok(t, ioutil.WriteFile(filepath.Join(inDir, "sub", "input"), []byte("input data"), 0644))
+
+	mountConf := util.GetMountPathConf()
+	mountConf.StripeSize = 4 // several stripes per file
+	mountConf.Staging = config.Staging{In: inDir, Out: outDir, OnClose: []string{"*.out"}}
+	fs := NewRedisFS(redisConf, mountConf)
+
+	// stage-in
+	input := filepath.Join(mountConf.Path, "sub", "input")
+	fi, err := fs.Stat(input)
+	util.Ok(t, err)
+	util.Equals(t, int64(10), fi.Size(), "imported file size error")
+	status, err := fs.StageStatus(input)
+	util.Ok(t, err)
+	util.Equals(t, StageImported, status.State, "wrong staging state")
+
+	// stage-out on close
+	result := filepath.Join(mountConf.Path, "result.out")
+	writeStagedFile(t, fs, result, []byte("result data"))
+	fs.stager.Wait()
+	data, err := ioutil.ReadFile(filepath.Join(outDir, "result.out"))
+	util.Ok(t, err)
+	util.Equals(t, []byte("result data"), data, "drained file content error")
+	status, err = fs.StageStatus(result)
+	util.Ok(t, err)
+	util.Equals(t, StageDone, status.State, "wrong staging state")
+	util.Equals(t, int64(11), status.Size, "wrong staged size")
+
+	// stage-out at finalization
+	writeStagedFile(t, fs, filepath.Join(mountConf.Path, "other"), []byte("other data"))
+	_, err = os.Stat(filepath.Join(outDir, "other"))
+	util.Assert(t, os.IsNotExist(err), "file should not be drained before finalization")
+
+	fs.Finalize()
+	data, err = ioutil.ReadFile(filepath.Join(outDir, "other"))
+	util.Ok(t, err)
+	util.Equals(t, []byte("other data"), data, "drained file content error")
+	_, err = os.Stat(filepath.Join(outDir, "sub", "input"))
+	util.Assert(t, os.IsNotExist(err), "unmodified imported files should not be drained")
+}
+
+func TestWriteThrough(t *testing.T) {
+	redis, redisConf := util.InitRedisTestServer()
+	defer redis.Stop()
+
+	dir, err := ioutil.TempDir("", "pdwfs-writethrough")
+	util.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	mountConf := util.GetMountPathConf()
+	mountConf.Path = dir
+	mountConf.StripeSize = 4
+	mountConf.WriteThrough = config.WriteThrough{Enabled: true, Workers: 2, QueueSize: 1, Retries: 1}
+	fs := NewRedisFS(redisConf, mountConf)
+
+	util.Ok(t, fs.Mkdir(filepath.Join(dir, "sub"), 0755))
+	for _, name := range []string{"a", "b", "c"} {
+		writeStagedFile(t, fs, filepath.Join(dir, "sub", name), []byte("content of "+name))
+	}
+	fs.flusher.Wait()
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "sub", "b"))
+	util.Ok(t, err)
+	util.Equals(t, []byte("content of b"), data, "flushed file content error")
+	status, err := fs.FlushStatus(filepath.Join(dir, "sub", "b"))
+	util.Ok(t, err)
+	util.Equals(t, StageDone, status.State, "flushed file should be marked as done")
+
+	// a modified file is flushed again
+	writeStagedFile(t, fs, filepath.Join(dir, "sub", "a"), []byte("new content"))
+	fs.Finalize()
+	data, err = ioutil.ReadFile(filepath.Join(dir, "sub", "a"))
+	util.Ok(t, err)
+	util.Equals(t, []byte("new content"), data, "finalize should wait for the flush")
+}
+
+func TestStagingResetWhileDraining(t *testing.T) {
+	redis, redisConf := util.InitRedisTestServer()
+	defer redis.Stop()
+
+	outDir, err := ioutil.TempDir("", "pdwfs-stageout")
+	util.Ok(t, err)
+	defer os.RemoveAll(outDir)
+
+	mountConf := util.GetMountPathConf()
+	mountConf.Staging = config.Staging{Out: outDir}
+	fs := NewRedisFS(redisConf, mountConf)
+	defer fs.Finalize()
+
+	path := filepath.Join(mountConf.Path, "result")
+	writeStagedFile(t, fs, path, []byte("old data"))
+	gen := fs.stager.claim(path)
+	util.Assert(t, gen >= 0, "closed file should be claimed")
+
+	// the file is reopened for writing while a worker drains the old version
+	f, err := fs.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	util.Ok(t, err)
+	fs.stager.setStatus(path, gen, StageDone, 8, nil)
+	status, err := fs.StageStatus(path)
+	util.Ok(t, err)
+	util.Equals(t, "", status.State, "the old version should not mark the new one as drained")
+	_, err = f.Write([]byte("new data"))
+	util.Ok(t, err)
+	util.Ok(t, f.Close())
+
+	fs.StageOut()
+	data, err := ioutil.ReadFile(filepath.Join(outDir, "result"))
+	util.Ok(t, err)
+	util.Equals(t, []byte("new data"), data, "new version should be drained")
+}
+
+func TestStageInDeadImporter(t *testing.T) {
+	redis, redisConf := util.InitRedisTestServer()
+	defer redis.Stop()
+
+	defer func(lease time.Duration) { stageInLease = lease }(stageInLease)
+	stageInLease = 500 * time.Millisecond
+
+	inDir, err := ioutil.TempDir("", "pdwfs-stagein")
+	util.Ok(t, err)
+	defer os.RemoveAll(inDir)
+	util.Ok(t, ioutil.WriteFile(filepath.Join(inDir, "input"), []byte("input data"), 0644))
+	outDir, err := ioutil.TempDir("", "pdwfs-stageout")
+	util.Ok(t, err)
+	defer os.RemoveAll(outDir)
+
+	mountConf := util.GetMountPathConf()
+	mountConf.Staging = config.Staging{Out: outDir, InTimeout: 0.2}
+	fs := NewRedisFS(redisConf, mountConf)
+	defer fs.Finalize()
+
+	// a process claimed the stage-in and died
+	key := fs.dataStore.namespaced("pdwfs:stagein:{" + mountConf.Path + "}")
+	conn := fs.redisRing.GetClient(key).pool.Get()
+	defer conn.Close()
+	_, err = conn.Do("SET", key, "dead", "PX", 300)
+	util.Ok(t, err)
+	util.Assert(t, fs.StageIn(inDir) != nil, "stage-in should time out while the claim is alive")
+
+	// the claim expires and the import is taken over
+	time.Sleep(300 * time.Millisecond)
+	util.Ok(t, fs.StageIn(inDir))
+	fi, err := fs.Stat(filepath.Join(mountConf.Path, "input"))
+	util.Ok(t, err)
+	util.Equals(t, int64(10), fi.Size(), "imported file size error")
+}
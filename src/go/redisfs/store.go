@@ -19,6 +19,8 @@ package redisfs
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 
@@ -32,6 +34,22 @@ func key(name string, id int64) string {
 	return fmt.Sprintf("%s:%d", name, id)
 }
 
+// parses a stripe key built with key(), returns false if the key does not address a stripe
+func parseStripeKey(k string) (name string, id int64, ok bool) {
+	if strings.HasPrefix(k, "{") {
+		return "", 0, false // metadata key
+	}
+	i := strings.LastIndexByte(k, ':')
+	if i < 1 {
+		return "", 0, false
+	}
+	id, err := strconv.ParseInt(k[i+1:], 10, 64)
+	if err != nil || id < 0 {
+		return "", 0, false
+	}
+	return k[:i], id, true
+}
+
 func divmod(n, d int64) (q, r int64) {
 	q = n / d
 	r = n % d
@@ -42,6 +60,16 @@ func divmod(n, d int64) (q, r int64) {
 type DataStore struct {
 	redisRing  *RedisRing
 	stripeSize int64
+	pins       map[string]*RedisClient // instances on which all stripes of some contents are placed
+	pinsMtx    *sync.RWMutex
+	ttls       map[string]int64 // time to live in seconds of the stripes of some contents
+	ttlsMtx    *sync.RWMutex
+	// percentage of the ring memory above which writes are refused
+	highWatermark float64
+	quota         *Quota // bytes accounting, nil if no quota applies
+	namespace     string // prefix of all the keys of the store, empty for none
+	// size up to which writes spanning several stripes are seen whole or not at all by readers (see atomic.go)
+	atomicWriteSize int64
 }
 
 // NewDataStore returns a DataStore struct instance
@@ -49,7 +77,134 @@ func NewDataStore(ring *RedisRing, stripeSize int64) *DataStore {
 	return &DataStore{
 		redisRing:  ring,
 		stripeSize: stripeSize,
+		pins:       map[string]*RedisClient{},
+		pinsMtx:    &sync.RWMutex{},
+		ttls:       map[string]int64{},
+		ttlsMtx:    &sync.RWMutex{},
+	}
+}
+
+// SetNamespace sets the namespace prepended to all the keys of the store
+func (s *DataStore) SetNamespace(namespace string) {
+	s.namespace = namespace
+}
+
+// returns the key or content name prefixed by the namespace of the store, if any
+func (s DataStore) namespaced(name string) string {
+	if s.namespace == "" {
+		return name
+	}
+	return s.namespace + namespaceSeparator + name
+}
+
+// Pin places all stripes of the content keyed by 'name' on the ring node at address 'addr'.
+// The pin is recorded on the node itself so that rebalancing the ring does not move the stripes.
+func (s DataStore) Pin(name string, addr string) error {
+	name = s.namespaced(name)
+	client := s.redisRing.GetNodeClient(addr)
+	if client == nil {
+		return fmt.Errorf("node %s is not part of the Redis ring", addr)
+	}
+	if err := client.SAdd(pinnedKey, name); err != nil {
+		return err
 	}
+	s.pinsMtx.Lock()
+	defer s.pinsMtx.Unlock()
+	s.pins[name] = client
+	return nil
+}
+
+// LoadPin places the stripes of the content keyed by 'name' on the node at address 'addr' it was pinned to
+// with Pin, possibly by another process, without recording the pin again. An empty address or a node
+// which is no longer part of the ring (an error is returned) resets the content to the ring placement.
+func (s DataStore) LoadPin(name string, addr string) error {
+	name = s.namespaced(name)
+	s.pinsMtx.Lock()
+	defer s.pinsMtx.Unlock()
+	delete(s.pins, name)
+	if addr == "" {
+		return nil
+	}
+	client := s.redisRing.GetNodeClient(addr)
+	if client == nil {
+		return fmt.Errorf("node %s is not part of the Redis ring", addr)
+	}
+	s.pins[name] = client
+	return nil
+}
+
+// Unpin removes the placement of the content keyed by 'name', stripes are placed by hashing again
+func (s DataStore) Unpin(name string) {
+	name = s.namespaced(name)
+	s.pinsMtx.Lock()
+	client, ok := s.pins[name]
+	delete(s.pins, name)
+	s.pinsMtx.Unlock()
+	if ok {
+		Try(client.SRem(pinnedKey, name))
+	}
+}
+
+// SetTTL sets the time to live in seconds applied to the stripes of the content keyed by 'name'
+// each time they are written (0 for no expiry)
+func (s DataStore) SetTTL(name string, ttl int64) {
+	name = s.namespaced(name)
+	s.ttlsMtx.Lock()
+	defer s.ttlsMtx.Unlock()
+	if ttl > 0 {
+		s.ttls[name] = ttl
+	} else {
+		delete(s.ttls, name)
+	}
+}
+
+// returns the time to live of the stripes of a content (0 for no expiry)
+func (s DataStore) ttl(name string) int64 {
+	s.ttlsMtx.RLock()
+	defer s.ttlsMtx.RUnlock()
+	return s.ttls[name]
+}
+
+// Expire sets the time to live in seconds of all the stored stripes of the content keyed by 'name',
+// a ttl of 0 removes the expiry
+func (s DataStore) Expire(name string, ttl int64) error {
+	name = s.namespaced(name)
+	for _, client := range s.redisRing.Clients() {
+		ids, err := client.SMembers(name + ":stripes")
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		pipeline := client.Pipeline()
+		keys := []string{name + ":stripes"}
+		for _, id := range ids {
+			keys = append(keys, name+":"+id)
+		}
+		for _, k := range keys {
+			if ttl > 0 {
+				pipeline.Do("EXPIRE", k, ttl)
+			} else {
+				pipeline.Do("PERSIST", k)
+			}
+		}
+		if err := pipeline.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// returns the client of the Redis instance storing a stripe
+func (s DataStore) stripeClient(name string, id int64) *RedisClient {
+	s.pinsMtx.RLock()
+	client, ok := s.pins[name]
+	s.pinsMtx.RUnlock()
+	if ok {
+		return client
+	}
+	return s.redisRing.GetClient(key(name, id))
 }
 
 // Close the Redis clients in the ring
@@ -89,31 +244,54 @@ loop:
 	return stripes
 }
 
-// writes a single stripe in the store
+// writes a single stripe in the store and atomically adds to 'grown' the number of bytes the stripe has grown by
 // Note: each Redis instance in the store contains a set of all the stripes stored by that instance for a specific file
 // this is used when searching the last stripe of a file to compute its size, see next methods
-func (s DataStore) writeStripe(name string, stripe stripeInfo, wg *sync.WaitGroup) {
+func (s DataStore) writeStripe(name string, stripe stripeInfo, wg *sync.WaitGroup, errs *errorOnce, grown *int64) {
 	defer wg.Done()
 	stripeKey := key(name, stripe.id)
-	pipeline := s.redisRing.GetClient(stripeKey).Pipeline()
+	pipeline := s.stripeClient(name, stripe.id).Pipeline()
 	pipeline.Do("SADD", name+":stripes", stripe.id)
-	if stripe.off == 0 && int64(len(stripe.data)) == s.stripeSize {
+	pipeline.Do("STRLEN", stripeKey)
+	full := stripe.off == 0 && int64(len(stripe.data)) == s.stripeSize
+	if full {
 		// SET is faster than SETRANGE
 		pipeline.Do("SET", stripeKey, stripe.data)
 	} else {
 		pipeline.Do("SETRANGE", stripeKey, stripe.off, stripe.data)
 	}
-	pipeline.Flush()
+	if ttl := s.ttl(name); ttl > 0 {
+		pipeline.Do("EXPIRE", stripeKey, ttl)
+		pipeline.Do("EXPIRE", name+":stripes", ttl)
+	}
+	replies, err := pipeline.Exec()
+	if err != nil {
+		errs.set(err)
+		return
+	}
+	oldLen, err := redis.Int64(replies[1], nil)
+	Check(err)
+	newLen := s.stripeSize
+	if !full {
+		newLen, err = redis.Int64(replies[2], nil)
+		Check(err)
+	}
+	atomic.AddInt64(grown, newLen-oldLen)
 }
 
-// erases the stripe from its instance
-func (s DataStore) removeStripe(name string, id int64, wg *sync.WaitGroup) {
+// erases the stripe from its instance and atomically adds to 'freed' the number of bytes released
+func (s DataStore) removeStripe(name string, id int64, wg *sync.WaitGroup, freed *int64) {
 	defer wg.Done()
 	stripeKey := key(name, id)
-	pipeline := s.redisRing.GetClient(stripeKey).Pipeline()
+	pipeline := s.stripeClient(name, id).Pipeline()
 	pipeline.Do("SREM", name+":stripes", id)
+	pipeline.Do("STRLEN", stripeKey)
 	pipeline.Do("UNLINK", stripeKey)
-	pipeline.Flush()
+	replies, err := pipeline.Exec()
+	Check(err)
+	n, err := redis.Int64(replies[1], nil)
+	Check(err)
+	atomic.AddInt64(freed, n)
 }
 
 // reads stripe data from its Redis instance, copy the data into the destination buffer
@@ -121,7 +299,7 @@ func (s DataStore) removeStripe(name string, id int64, wg *sync.WaitGroup) {
 func (s DataStore) readStripe(name string, stripe stripeInfo, wg *sync.WaitGroup, read *int64) {
 	defer wg.Done()
 	stripeKey := key(name, stripe.id)
-	client := s.redisRing.GetClient(stripeKey)
+	client := s.stripeClient(name, stripe.id)
 
 	var n int
 	var err error
@@ -134,72 +312,186 @@ func (s DataStore) readStripe(name string, stripe stripeInfo, wg *sync.WaitGroup
 	if err != nil && err != ErrRedisKeyNotFound {
 		panic(err)
 	}
+	// a missing or short stripe may be a hole, which reads as null bytes (see ReadAt)
+	for i := n; i < len(stripe.data); i++ {
+		stripe.data[i] = 0
+	}
 	// copy res into destination data buffer and atomically increment the number of bytes read
 	atomic.AddInt64(read, int64(n))
 }
 
-var trimStripeScript = redis.NewScript(1, `
-		local str = redis.call("GETRANGE", KEYS[1], 0, ARGV[1])
-		return redis.call("SET", KEYS[1], str)
+// trims the stripe to ARGV[1] bytes (ARGV[1] > 0), returns the number of bytes released,
+// a stripe shorter than ARGV[1] bytes is a hole (see Deallocate) and is padded with null bytes
+var trimStripeScript = redis.NewScript(2, `
+		local old = redis.call("STRLEN", KEYS[1])
+		local str = redis.call("GETRANGE", KEYS[1], 0, ARGV[1] - 1)
+		local size = tonumber(ARGV[1])
+		if string.len(str) < size then
+			str = str .. string.rep("\0", size - string.len(str))
+			redis.call("SADD", KEYS[2], ARGV[2])
+		end
+		redis.call("SET", KEYS[1], str)
+		return old - string.len(str)
 	`)
 
-func (s DataStore) trimStripe(name string, id int64, size int64, wg *sync.WaitGroup) {
+func (s DataStore) trimStripe(name string, id int64, size int64, wg *sync.WaitGroup, freed *int64) {
 	defer wg.Done()
 	stripeKey := key(name, id)
-	client := s.redisRing.GetClient(stripeKey)
+	client := s.stripeClient(name, id)
 	conn := client.pool.Get()
 	defer conn.Close()
 
+	var n int64
+	var err error
 	if size == 0 {
-		_, err := conn.Do("SET", stripeKey, []byte(""))
+		n, err = redis.Int64(conn.Do("STRLEN", stripeKey))
 		Check(err)
+		_, err = conn.Do("SET", stripeKey, []byte(""))
 	} else {
-		Try(err(trimStripeScript.Do(conn, stripeKey, size-1)))
+		n, err = redis.Int64(trimStripeScript.Do(conn, stripeKey, name+":stripes", size, id))
+	}
+	Check(err)
+	if ttl := s.ttl(name); ttl > 0 {
+		// SET discards the time to live of the stripe
+		_, err = conn.Do("EXPIRE", stripeKey, ttl)
+		Check(err)
+	}
+	atomic.AddInt64(freed, n)
+}
+
+// errorOnce records the first error returned by a group of goroutines
+type errorOnce struct {
+	err  error
+	once sync.Once
+}
+
+func (e *errorOnce) set(err error) {
+	if err != nil {
+		e.once.Do(func() { e.err = err })
+	}
+}
+
+// returns ErrNoSpace if the memory used in the ring is above the high watermark
+func (s DataStore) checkSpace() error {
+	if s.highWatermark <= 0 {
+		return nil
 	}
+	used, max, err := s.redisRing.MemoryUsage()
+	if err != nil {
+		return err
+	}
+	if max > 0 && float64(used) >= s.highWatermark*float64(max)/100 {
+		return ErrNoSpace
+	}
+	return nil
 }
 
 // main DataStore public API
 
+// SetHighWatermark sets the percentage of the ring memory above which writes are refused with ErrNoSpace
+// (0 disables the check)
+func (s *DataStore) SetHighWatermark(percent float64) {
+	s.highWatermark = percent
+}
+
+// SetQuota sets the quota accounting the bytes stored (nil to disable accounting)
+func (s *DataStore) SetQuota(quota *Quota) {
+	s.quota = quota
+}
+
 // WriteAt writes the content of 'data' keyed by 'name' at offset 'off' into the DataStore
 // the content is stripped and each stripe is written concurrently in its own goroutine
 // Note: goroutines are throttled by the limited connection pools of each Redis instance
-func (s DataStore) WriteAt(name string, off int64, data []byte) {
+func (s DataStore) WriteAt(name string, off int64, data []byte) error {
+	path := name
+	name = s.namespaced(name)
+	if err := s.checkSpace(); err != nil {
+		return err
+	}
+	if len(data) <= int(s.atomicWriteSize) && s.spansStripes(off, len(data)) {
+		gen, err := s.beginWrite(name, off, off+int64(len(data)))
+		if err != nil {
+			return err
+		}
+		defer s.endWrite(name, gen)
+	}
+	// the stored size can grow at most by the data length plus the null bytes padding the first stripe,
+	// reserve this upper bound and give back the difference once the actual growth is known
+	ttl := s.ttl(name)
+	reserved := int64(len(data)) + off%s.stripeSize
+	err := s.quota.reserveBytes(path, reserved, ttl)
+	if err == ErrQuotaExceeded {
+		// close to the limit, only the bytes past the end of the content are reserved: an overwrite does not
+		// grow it (refilling holes may grow it still, the growth is then accounted above the limit)
+		if reserved = off + int64(len(data)) - s.size(name); reserved < 0 {
+			reserved = 0
+		}
+		err = s.quota.reserveBytes(path, reserved, ttl)
+	}
+	if err != nil {
+		return err
+	}
+	var grown int64
 	wg := sync.WaitGroup{}
+	errs := errorOnce{}
 	for _, stripe := range stripeLayout(s.stripeSize, off, data) {
 		wg.Add(1)
-		go s.writeStripe(name, stripe, &wg)
+		go s.writeStripe(name, stripe, &wg, &errs, &grown)
 	}
 	wg.Wait()
+	s.quota.releaseBytes(path, reserved-grown)
+	return errs.err
 }
 
 // ReadAt reads data into 'dst' byte slice and returns the number of read bytes
 func (s DataStore) ReadAt(name string, off int64, dst []byte) int64 {
+	name = s.namespaced(name)
 	var read int64
-	wg := sync.WaitGroup{}
-	for _, stripe := range stripeLayout(s.stripeSize, off, dst) {
-		wg.Add(1)
-		go s.readStripe(name, stripe, &wg, &read)
+	s.consistentRead(name, off, len(dst), func() {
+		read = 0
+		wg := sync.WaitGroup{}
+		for _, stripe := range stripeLayout(s.stripeSize, off, dst) {
+			wg.Add(1)
+			go s.readStripe(name, stripe, &wg, &read)
+		}
+		wg.Wait()
+	})
+	if read < int64(len(dst)) {
+		// the stripes missing or short before the end of the content are holes (see Deallocate)
+		if avail := s.size(name) - off; avail > read {
+			read = avail
+			if read > int64(len(dst)) {
+				read = int64(len(dst))
+			}
+		}
 	}
-	wg.Wait()
 	return read
 }
 
 // Remove all stripes keyed by 'name'
 func (s DataStore) Remove(name string) {
+	path := name
+	name = s.namespaced(name)
+	var freed int64
 	wg := sync.WaitGroup{}
 	lastStripe := s.searchLastStripe(name)
 	for i := int64(0); i <= lastStripe; i++ {
 		wg.Add(1)
-		go s.removeStripe(name, i, &wg)
+		go s.removeStripe(name, i, &wg, &freed)
 	}
 	wg.Wait()
+	s.quota.releaseBytes(path, freed)
+	if s.atomicWriteSize > 0 {
+		Try(s.redisRing.GetClient(writesKey(name)).Unlink(writesKey(name)))
+	}
 }
 
 // gather from all Redis instances the list of stripes keyed by 'name' and returns the highest stripe ID
 func (s DataStore) searchLastStripe(name string) int64 {
-	retChan := make(chan int64, len(s.redisRing.clients))
+	clients := s.redisRing.Clients()
+	retChan := make(chan int64, len(clients))
 	wg := sync.WaitGroup{}
-	for _, client := range s.redisRing.clients {
+	for _, client := range clients {
 		wg.Add(1)
 		go func(c *RedisClient, wg *sync.WaitGroup, ch chan int64) {
 			defer wg.Done()
@@ -219,7 +511,7 @@ func (s DataStore) searchLastStripe(name string) int64 {
 	wg.Wait()
 	var n int64
 	max := int64(-1)
-	for i := 0; i < len(s.redisRing.clients); i++ {
+	for i := 0; i < len(clients); i++ {
 		n = <-retChan
 		if n > max {
 			max = n
@@ -230,12 +522,16 @@ func (s DataStore) searchLastStripe(name string) int64 {
 
 // GetSize returns the total size in bytes of data stored keyed by 'name' (all stripes).
 func (s DataStore) GetSize(name string) int64 {
+	return s.size(s.namespaced(name))
+}
+
+func (s DataStore) size(name string) int64 {
 	ilast := s.searchLastStripe(name)
 	if ilast < 0 {
 		return 0
 	}
 	key := key(name, ilast)
-	l, err := s.redisRing.GetClient(key).Strlen(key)
+	l, err := s.stripeClient(name, ilast).Strlen(key)
 	Check(err)
 	return ilast*s.stripeSize + int64(l)
 }
@@ -251,41 +547,120 @@ func lastStripeInfo(size, stripeSize int64) (stripeID, stripeLen int64) {
 }
 
 // Resize (grow or shrink) the data content keyed by 'name'
-func (s DataStore) Resize(name string, newSize int64) {
+func (s DataStore) Resize(name string, newSize int64) error {
 	if newSize < 0 {
 		panic(fmt.Errorf("size must be non-negative"))
 	}
-	curSize := s.GetSize(name)
+	path := name
+	name = s.namespaced(name)
+	curSize := s.size(name)
 	curLastStripeID, curLastStripeLen := lastStripeInfo(curSize, s.stripeSize)
 	newLastStripeID, newLastStripeLen := lastStripeInfo(newSize, s.stripeSize)
 	switch {
 	case newSize < curSize: // shrink
 		// remove all existing stripes after this new last stripe
+		var freed int64
 		wg := sync.WaitGroup{}
 		for id := newLastStripeID + 1; id <= curLastStripeID; id++ {
 			wg.Add(1)
-			go s.removeStripe(name, id, &wg)
+			go s.removeStripe(name, id, &wg, &freed)
 		}
 		// resize the last stripe
-		wg.Add(1)
-		go s.trimStripe(name, newLastStripeID, newLastStripeLen, &wg)
+		if newLastStripeID >= 0 {
+			wg.Add(1)
+			go s.trimStripe(name, newLastStripeID, newLastStripeLen, &wg, &freed)
+		}
 		wg.Wait()
+		s.quota.releaseBytes(path, freed)
 
 	case newSize > curSize: // grow
+		if err := s.checkSpace(); err != nil {
+			return err
+		}
+		reserved := newSize - curSize
+		if err := s.quota.reserveBytes(path, reserved, s.ttl(name)); err != nil {
+			return err
+		}
 		// write new stripes but the last
+		var grown int64
 		wg := sync.WaitGroup{}
+		errs := errorOnce{}
 		for id := curLastStripeID + 1; id < newLastStripeID; id++ {
 			wg.Add(1)
-			go s.writeStripe(name, stripeInfo{id, s.stripeSize - 1, []byte("\x00")}, &wg)
+			go s.writeStripe(name, stripeInfo{id, s.stripeSize - 1, []byte("\x00")}, &wg, &errs, &grown)
 		}
 		// write last stripe
 		wg.Add(1)
-		go s.writeStripe(name, stripeInfo{newLastStripeID, newLastStripeLen - 1, []byte("\x00")}, &wg)
-		// fill current last stripe with null bytes if needed
-		if curLastStripeLen < s.stripeSize {
+		go s.writeStripe(name, stripeInfo{newLastStripeID, newLastStripeLen - 1, []byte("\x00")}, &wg, &errs, &grown)
+		// fill current last stripe with null bytes if the content grows beyond it
+		if newLastStripeID > curLastStripeID && curLastStripeLen < s.stripeSize {
 			wg.Add(1)
-			go s.writeStripe(name, stripeInfo{curLastStripeID, s.stripeSize - curLastStripeLen - 1, []byte("\x00")}, &wg)
+			go s.writeStripe(name, stripeInfo{curLastStripeID, s.stripeSize - 1, []byte("\x00")}, &wg, &errs, &grown)
 		}
 		wg.Wait()
+		s.quota.releaseBytes(path, reserved-grown)
+		return errs.err
+	}
+	return nil
+}
+
+// zeroes ARGV[2] bytes of the stripe from offset ARGV[1], without extending it, returns the number of bytes zeroed
+var zeroStripeScript = redis.NewScript(1, `
+		local len = redis.call("STRLEN", KEYS[1])
+		local off, n = tonumber(ARGV[1]), tonumber(ARGV[2])
+		if off + n > len then
+			n = len - off
+		end
+		if n <= 0 then
+			return 0
+		end
+		redis.call("SETRANGE", KEYS[1], off, string.rep("\0", n))
+		return n
+	`)
+
+func (s DataStore) zeroStripe(name string, id, off, n int64, wg *sync.WaitGroup, errs *errorOnce) {
+	defer wg.Done()
+	conn := s.stripeClient(name, id).pool.Get()
+	defer conn.Close()
+	errs.set(err(zeroStripeScript.Do(conn, key(name, id), off, n)))
+}
+
+// Deallocate releases the byte range [off, off+length[ of the content keyed by 'name', the range then reads as
+// null bytes: the stripes inside the range are removed and the stripes partially in the range are zeroed.
+// The size of the content is unchanged.
+func (s DataStore) Deallocate(name string, off, length int64) error {
+	if off < 0 || length < 0 {
+		panic(fmt.Errorf("offset and length must be non-negative"))
+	}
+	path := name
+	name = s.namespaced(name)
+	size := s.size(name)
+	if off+length > size {
+		length = size - off
+	}
+	if length <= 0 {
+		return nil
 	}
+	// the last stripe gives the size of the content, it is zeroed but never removed
+	lastStripeID, _ := lastStripeInfo(size, s.stripeSize)
+	var freed int64
+	wg := sync.WaitGroup{}
+	errs := errorOnce{}
+	for pos, end := off, off+length; pos < end; {
+		id, stripeOff := divmod(pos, s.stripeSize)
+		n := s.stripeSize - stripeOff
+		if n > end-pos {
+			n = end - pos
+		}
+		wg.Add(1)
+		if n == s.stripeSize && id != lastStripeID {
+			go s.removeStripe(name, id, &wg, &freed)
+		} else {
+			go s.zeroStripe(name, id, stripeOff, n, &wg, &errs)
+		}
+		pos += n
+	}
+	wg.Wait()
+	s.quota.releaseBytes(path, freed)
+	return errs.err
 }
@@ -17,6 +17,7 @@ package redisfs
 import (
 	"bytes"
 	"testing"
+	"time"
 
 	"github.com/cea-hpc/pdwfs/util"
 )
@@ -212,6 +213,35 @@ func TestResize(t *testing.T) {
 	util.Equals(t, int64(0), store.GetSize("myfile"), "resize error")
 }
 
+func TestResizeWithinStripe(t *testing.T) {
+	redis, conf := util.InitRedisTestServer()
+	defer redis.Stop()
+
+	ring := NewRedisRing(conf)
+	store := NewDataStore(ring, 100)
+	defer store.Close()
+	quota := NewQuota(ring, "/quota", 1000, 0)
+	store.SetQuota(quota)
+
+	util.Ok(t, store.WriteAt("myfile", 0, []byte("0123456789")))
+	util.Ok(t, store.Resize("myfile", 30))
+	util.Equals(t, int64(30), store.GetSize("myfile"), "resize within the last stripe error")
+	used, _, err := quota.Usage()
+	util.Ok(t, err)
+	util.Equals(t, int64(30), used, "wrong bytes accounted")
+
+	readData := make([]byte, 100)
+	n := store.ReadAt("myfile", 0, readData)
+	util.Equals(t, append([]byte("0123456789"), make([]byte, 20)...), readData[:n], "wrong data after growing")
+
+	// growing to the next stripes fills the current last stripe
+	util.Ok(t, store.Resize("myfile", 150))
+	util.Equals(t, int64(150), store.GetSize("myfile"), "resize error")
+	used, _, err = quota.Usage()
+	util.Ok(t, err)
+	util.Equals(t, int64(150), used, "wrong bytes accounted")
+}
+
 func TestTruncate(t *testing.T) {
 	redis, conf := util.InitRedisTestServer()
 	defer redis.Stop()
@@ -230,3 +260,183 @@ func TestTruncate(t *testing.T) {
 	util.Equals(t, int64(15), n, "read error")
 	util.Equals(t, data[:15], readData[:n], "data read does not match data written")
 }
+
+func TestDeallocate(t *testing.T) {
+	redis, conf := util.InitRedisTestServer()
+	defer redis.Stop()
+
+	store := NewDataStore(NewRedisRing(conf), 10) // 10 bytes stripes
+	defer store.Close()
+
+	data := bytes.Repeat([]byte("0123456789"), 5) // 50 bytes to write
+	store.WriteAt("myfile", 0, data)
+
+	// stripes 1 and 2 are removed, stripe 0 and 3 are partially zeroed
+	util.Ok(t, store.Deallocate("myfile", 5, 30))
+	util.Equals(t, int64(50), store.GetSize("myfile"), "deallocation should not change the size")
+
+	expected := append([]byte{}, data...)
+	copy(expected[5:35], make([]byte, 30))
+	readData := make([]byte, 60)
+	for i := range readData {
+		readData[i] = 'x'
+	}
+	n := store.ReadAt("myfile", 0, readData)
+	util.Equals(t, int64(50), n, "holes should be read")
+	util.Equals(t, expected, readData[:n], "holes should read as null bytes")
+
+	// writing in a hole and shrinking the content to a hole
+	store.WriteAt("myfile", 22, []byte("ab"))
+	copy(expected[22:], "ab")
+	store.Resize("myfile", 15)
+	util.Equals(t, int64(15), store.GetSize("myfile"), "resize error")
+	n = store.ReadAt("myfile", 0, readData)
+	util.Equals(t, expected[:15], readData[:n], "wrong data after shrinking to a hole")
+	store.Resize("myfile", 30)
+	n = store.ReadAt("myfile", 0, readData)
+	util.Equals(t, append(expected[:15], make([]byte, 15)...), readData[:n], "wrong data after growing")
+}
+
+func TestParseStripeKey(t *testing.T) {
+	name, id, ok := parseStripeKey(key("/path/to/file", 42))
+	util.Assert(t, ok, "stripe key expected")
+	util.Equals(t, "/path/to/file", name, "wrong file name")
+	util.Equals(t, int64(42), id, "wrong stripe id")
+
+	name, id, ok = parseStripeKey(key("/path/with:colon", 3))
+	util.Assert(t, ok, "stripe key expected")
+	util.Equals(t, "/path/with:colon", name, "wrong file name")
+	util.Equals(t, int64(3), id, "wrong stripe id")
+
+	_, _, ok = parseStripeKey("{/path/to/dir}:children")
+	util.Assert(t, !ok, "metadata key is not a stripe key")
+
+	_, _, ok = parseStripeKey("/path/to/file:stripes")
+	util.Assert(t, !ok, "stripes index is not a stripe key")
+}
+
+func TestWriteNoSpace(t *testing.T) {
+	redis, conf := util.InitRedisTestServer()
+	defer redis.Stop()
+
+	client := NewRedisClient(conf.Addrs[0])
+	defer client.Close()
+	conn := client.pool.Get()
+	_, err := conn.Do("CONFIG", "SET", "maxmemory", 2*1024*1024)
+	util.Ok(t, err)
+	conn.Close()
+
+	store := NewDataStore(NewRedisRing(conf), 1024*1024)
+	defer store.Close()
+
+	data := make([]byte, 4*1024*1024)
+	err = store.WriteAt("myfile", 0, data)
+	util.Equals(t, ErrNoSpace, err, "out of memory should be reported as ErrNoSpace")
+
+	err = store.Resize("otherfile", 4*1024*1024)
+	util.Equals(t, ErrNoSpace, err, "out of memory should be reported as ErrNoSpace")
+}
+
+func TestHighWatermark(t *testing.T) {
+	redis, conf := util.InitRedisTestServer()
+	defer redis.Stop()
+
+	client := NewRedisClient(conf.Addrs[0])
+	defer client.Close()
+	conn := client.pool.Get()
+	_, err := conn.Do("CONFIG", "SET", "maxmemory", 100*1024*1024)
+	util.Ok(t, err)
+	conn.Close()
+
+	used, max, err := client.MemoryInfo()
+	util.Ok(t, err)
+	util.Equals(t, int64(100*1024*1024), max, "maxmemory should be reported")
+
+	store := NewDataStore(NewRedisRing(conf), 1024)
+	defer store.Close()
+
+	// watermark below the memory currently used
+	store.SetHighWatermark(100 * float64(used) / float64(max) / 2)
+	err = store.WriteAt("myfile", 0, []byte("0123456789"))
+	util.Equals(t, ErrNoSpace, err, "write above high watermark should be refused")
+
+	store.SetHighWatermark(90)
+	err = store.WriteAt("myfile", 0, []byte("0123456789"))
+	util.Ok(t, err)
+}
+
+func TestQuotaBytes(t *testing.T) {
+	redis, conf := util.InitRedisTestServer()
+	defer redis.Stop()
+
+	ring := NewRedisRing(conf)
+	store := NewDataStore(ring, 100)
+	defer store.Close()
+	quota := NewQuota(ring, "/quota", 1000, 0)
+	store.SetQuota(quota)
+
+	data := bytes.Repeat([]byte("0123456789"), 50) // 500 bytes
+	util.Ok(t, store.WriteAt("file1", 0, data))
+	used, _, err := quota.Usage()
+	util.Ok(t, err)
+	util.Equals(t, int64(500), used, "wrong bytes accounted")
+
+	// overwriting does not consume quota
+	util.Ok(t, store.WriteAt("file1", 0, data))
+	used, _, err = quota.Usage()
+	util.Ok(t, err)
+	util.Equals(t, int64(500), used, "overwrite should not be accounted")
+
+	util.Ok(t, store.WriteAt("file2", 0, data))
+	err = store.WriteAt("file3", 0, []byte("0"))
+	util.Equals(t, ErrQuotaExceeded, err, "write above quota should fail")
+
+	// at the limit, overwriting only reserves the bytes past the end of the file
+	util.Ok(t, store.WriteAt("file2", 100, data[:400]))
+	err = store.WriteAt("file2", 400, data[:200])
+	util.Equals(t, ErrQuotaExceeded, err, "write growing the file above quota should fail")
+
+	util.Ok(t, store.Resize("file2", 200))
+	used, _, err = quota.Usage()
+	util.Ok(t, err)
+	util.Equals(t, int64(700), used, "shrink should release bytes")
+
+	err = store.Resize("file2", 600)
+	util.Equals(t, ErrQuotaExceeded, err, "grow above quota should fail")
+
+	store.Remove("file1")
+	used, _, err = quota.Usage()
+	util.Ok(t, err)
+	util.Equals(t, int64(200), used, "remove should release bytes")
+}
+
+func TestQuotaExpiry(t *testing.T) {
+	redis, conf := util.InitRedisTestServer()
+	defer redis.Stop()
+
+	ring := NewRedisRing(conf)
+	store := NewDataStore(ring, 100)
+	defer store.Close()
+	store.SetNamespace("job1")
+	quota := NewQuota(ring, "/quota", 1000, 0)
+	quota.SetNamespace("job1")
+	store.SetQuota(quota)
+
+	// the bytes of an expired file are released
+	store.SetTTL("file1", 1)
+	util.Ok(t, store.WriteAt("file1", 0, bytes.Repeat([]byte("0123456789"), 50)))
+	util.Ok(t, store.WriteAt("file2", 0, []byte("0123456789")))
+	used, _, err := quota.Usage()
+	util.Ok(t, err)
+	util.Equals(t, int64(510), used, "wrong bytes accounted")
+	time.Sleep(1100 * time.Millisecond)
+	used, _, err = quota.Usage()
+	util.Ok(t, err)
+	util.Equals(t, int64(10), used, "bytes of the expired file should be released")
+
+	// the usage is dropped with the namespace
+	util.Ok(t, ring.DropNamespace("job1"))
+	used, _, err = quota.Usage()
+	util.Ok(t, err)
+	util.Equals(t, int64(0), used, "usage should be dropped with the namespace")
+}
@@ -0,0 +1,234 @@
+// Copyright 2019 CEA
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Extended attributes of files and directories, stored in a Redis hash along the inode metadata.
+// Only the user, trusted and security namespaces are supported, with the size limits of Linux.
+
+package redisfs
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/cea-hpc/pdwfs/redigo/redis"
+)
+
+var (
+	// ErrNoAttr is returned if an extended attribute does not exist
+	ErrNoAttr = errors.New("No such attribute")
+	// ErrAttrExists is returned if an extended attribute to create already exists
+	ErrAttrExists = errors.New("Attribute exists")
+	// ErrAttrNotSupported is returned if the namespace of an extended attribute is not supported
+	ErrAttrNotSupported = errors.New("Attribute namespace not supported")
+	// ErrAttrNameTooLong is returned if the name of an extended attribute is above XattrNameMax
+	ErrAttrNameTooLong = errors.New("Attribute name too long")
+	// ErrAttrTooBig is returned if the value of an extended attribute is above XattrSizeMax
+	ErrAttrTooBig = errors.New("Attribute value too big")
+)
+
+// extended attributes flags and limits, same values as Linux
+const (
+	XattrCreate  = 0x1   // fails if the attribute exists
+	XattrReplace = 0x2   // fails if the attribute does not exist
+	XattrNameMax = 255   // maximum length of a name
+	XattrSizeMax = 65536 // maximum size of a value
+)
+
+var xattrNamespaces = []string{"user.", "trusted.", "security."}
+
+func validateXattrName(attr string) error {
+	if len(attr) > XattrNameMax {
+		return ErrAttrNameTooLong
+	}
+	for _, ns := range xattrNamespaces {
+		if strings.HasPrefix(attr, ns) && len(attr) > len(ns) {
+			return nil
+		}
+	}
+	return ErrAttrNotSupported
+}
+
+func (i *Inode) xattrsKey() string {
+	return i.keyPrefix + ":xattrs"
+}
+
+// sets an attribute, returns 0 if the attribute exists and ARGV[3] is "create",
+// -1 if it does not exist and ARGV[3] is "replace"
+var setXattrScript = redis.NewScript(2, `
+		local exists = redis.call("HEXISTS", KEYS[1], ARGV[1]) == 1
+		if ARGV[3] == "create" and exists then
+			return 0
+		end
+		if ARGV[3] == "replace" and not exists then
+			return -1
+		end
+		redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+		local ttl = redis.call("PTTL", KEYS[2])
+		if ttl > 0 then
+			redis.call("PEXPIRE", KEYS[1], ttl)
+		end
+		return 1
+	`)
+
+func (i *Inode) setXattr(attr string, value []byte, flags int) error {
+	mode := ""
+	if flags&XattrCreate != 0 {
+		mode = "create"
+	} else if flags&XattrReplace != 0 {
+		mode = "replace"
+	}
+	conn := i.redisRing.GetClient(i.keyPrefix).pool.Get()
+	defer conn.Close()
+	res, err := redis.Int(setXattrScript.Do(conn, i.xattrsKey(), i.keyPrefix+":mode", attr, value, mode))
+	if err != nil {
+		return oomToNoSpace(err)
+	}
+	switch res {
+	case 0:
+		return ErrAttrExists
+	case -1:
+		return ErrNoAttr
+	}
+	return nil
+}
+
+func (i *Inode) getXattr(attr string) ([]byte, error) {
+	conn := i.redisRing.GetClient(i.keyPrefix).pool.Get()
+	defer conn.Close()
+	value, err := redis.Bytes(conn.Do("HGET", i.xattrsKey(), attr))
+	if err == redis.ErrNil {
+		return nil, ErrNoAttr
+	}
+	return value, err
+}
+
+func (i *Inode) listXattrs() ([]string, error) {
+	conn := i.redisRing.GetClient(i.keyPrefix).pool.Get()
+	defer conn.Close()
+	attrs, err := redis.Strings(conn.Do("HKEYS", i.xattrsKey()))
+	sort.Strings(attrs)
+	return attrs, err
+}
+
+func (i *Inode) removeXattr(attr string) error {
+	conn := i.redisRing.GetClient(i.keyPrefix).pool.Get()
+	defer conn.Close()
+	n, err := redis.Int(conn.Do("HDEL", i.xattrsKey(), attr))
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoAttr
+	}
+	return nil
+}
+
+// returns the inode of the named file for an extended attribute operation, nil for a file of the real directory
+func (fs *RedisFS) xattrInode(op, name string) (*Inode, error) {
+	if err := fs.ValidatePath(name); err != nil {
+		return nil, &os.PathError{Op: op, Path: name, Err: err}
+	}
+	path, err := AbsPath(name)
+	Check(err)
+	if path, err = fs.resolve(path, true); err != nil {
+		return nil, &os.PathError{Op: op, Path: name, Err: err}
+	}
+	_, fiNode, err := fs.fileInfo(path)
+	if err != nil {
+		return nil, &os.PathError{Op: op, Path: name, Err: err}
+	}
+	if fiNode == nil {
+		if _, ok := fs.lowerStat(path); ok {
+			return nil, nil
+		}
+		return nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	return fiNode, nil
+}
+
+// Getxattr returns the value of the extended attribute 'attr' of the named file
+func (fs *RedisFS) Getxattr(name, attr string) ([]byte, error) {
+	if err := validateXattrName(attr); err != nil {
+		return nil, &os.PathError{Op: "getxattr", Path: name, Err: err}
+	}
+	i, err := fs.xattrInode("getxattr", name)
+	if err != nil {
+		return nil, err
+	}
+	if i == nil {
+		return nil, &os.PathError{Op: "getxattr", Path: name, Err: ErrNoAttr}
+	}
+	value, err := i.getXattr(attr)
+	if err != nil {
+		return nil, &os.PathError{Op: "getxattr", Path: name, Err: err}
+	}
+	return value, nil
+}
+
+// Setxattr sets the extended attribute 'attr' of the named file, flags is 0 or one of XattrCreate and XattrReplace
+func (fs *RedisFS) Setxattr(name, attr string, value []byte, flags int) error {
+	if err := validateXattrName(attr); err != nil {
+		return &os.PathError{Op: "setxattr", Path: name, Err: err}
+	}
+	if len(value) > XattrSizeMax {
+		return &os.PathError{Op: "setxattr", Path: name, Err: ErrAttrTooBig}
+	}
+	i, err := fs.xattrInode("setxattr", name)
+	if err != nil {
+		return err
+	}
+	if i == nil {
+		return &os.PathError{Op: "setxattr", Path: name, Err: ErrReadOnlyFS}
+	}
+	if err := i.setXattr(attr, value, flags); err != nil {
+		return &os.PathError{Op: "setxattr", Path: name, Err: err}
+	}
+	return nil
+}
+
+// Listxattr returns the sorted names of the extended attributes of the named file
+func (fs *RedisFS) Listxattr(name string) ([]string, error) {
+	i, err := fs.xattrInode("listxattr", name)
+	if err != nil {
+		return nil, err
+	}
+	if i == nil {
+		return []string{}, nil
+	}
+	attrs, err := i.listXattrs()
+	if err != nil {
+		return nil, &os.PathError{Op: "listxattr", Path: name, Err: err}
+	}
+	return attrs, nil
+}
+
+// Removexattr removes the extended attribute 'attr' of the named file
+func (fs *RedisFS) Removexattr(name, attr string) error {
+	if err := validateXattrName(attr); err != nil {
+		return &os.PathError{Op: "removexattr", Path: name, Err: err}
+	}
+	i, err := fs.xattrInode("removexattr", name)
+	if err != nil {
+		return err
+	}
+	if i == nil {
+		return &os.PathError{Op: "removexattr", Path: name, Err: ErrReadOnlyFS}
+	}
+	if err := i.removeXattr(attr); err != nil {
+		return &os.PathError{Op: "removexattr", Path: name, Err: err}
+	}
+	return nil
+}
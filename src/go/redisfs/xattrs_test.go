@@ -0,0 +1,80 @@
+// Copyright 2019 CEA
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redisfs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cea-hpc/pdwfs/util"
+)
+
+func TestValidateXattrName(t *testing.T) {
+	util.Ok(t, validateXattrName("user.checksum"))
+	util.Ok(t, validateXattrName("trusted.lov"))
+	util.Equals(t, ErrAttrNotSupported, validateXattrName("user."), "empty name")
+	util.Equals(t, ErrAttrNotSupported, validateXattrName("system.posix_acl_access"), "unsupported namespace")
+	util.Equals(t, ErrAttrNameTooLong, validateXattrName("user."+strings.Repeat("x", XattrNameMax)), "name too long")
+}
+
+func TestXattrs(t *testing.T) {
+	server, redisConf := util.InitRedisTestServer()
+	defer server.Stop()
+
+	mountConf := util.GetMountPathConf()
+	fs := NewRedisFS(redisConf, mountConf)
+	defer fs.Finalize()
+
+	name := filepath.Join(mountConf.Path, "file")
+	f, err := fs.OpenFile(name, os.O_CREATE|os.O_WRONLY, 0600)
+	util.Ok(t, err)
+	f.Close()
+
+	_, err = fs.Getxattr(name, "user.checksum")
+	util.Equals(t, ErrNoAttr, err.(*os.PathError).Err, "attribute should not exist")
+	err = fs.Setxattr(name, "user.checksum", []byte("abcd"), XattrReplace)
+	util.Equals(t, ErrNoAttr, err.(*os.PathError).Err, "replace needs an existing attribute")
+
+	util.Ok(t, fs.Setxattr(name, "user.checksum", []byte("abcd"), XattrCreate))
+	err = fs.Setxattr(name, "user.checksum", []byte("efgh"), XattrCreate)
+	util.Equals(t, ErrAttrExists, err.(*os.PathError).Err, "create needs a new attribute")
+	util.Ok(t, fs.Setxattr(name, "user.checksum", []byte("efgh"), XattrReplace))
+	util.Ok(t, fs.Setxattr(name, "user.author", []byte{}, 0))
+
+	value, err := fs.Getxattr(name, "user.checksum")
+	util.Ok(t, err)
+	util.Equals(t, "efgh", string(value), "wrong attribute value")
+	attrs, err := fs.Listxattr(name)
+	util.Ok(t, err)
+	util.Equals(t, []string{"user.author", "user.checksum"}, attrs, "wrong attribute list")
+
+	err = fs.Setxattr(name, "user.big", make([]byte, XattrSizeMax+1), 0)
+	util.Equals(t, ErrAttrTooBig, err.(*os.PathError).Err, "value above the size limit")
+
+	util.Ok(t, fs.Removexattr(name, "user.checksum"))
+	err = fs.Removexattr(name, "user.checksum")
+	util.Equals(t, ErrNoAttr, err.(*os.PathError).Err, "attribute already removed")
+
+	// attributes are removed along the file
+	util.Ok(t, fs.Remove(name))
+	f, err = fs.OpenFile(name, os.O_CREATE|os.O_WRONLY, 0600)
+	util.Ok(t, err)
+	f.Close()
+	attrs, err = fs.Listxattr(name)
+	util.Ok(t, err)
+	util.Equals(t, 0, len(attrs), "new file should have no attributes")
+}
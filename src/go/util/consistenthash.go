@@ -33,6 +33,7 @@ type ConsistentHash struct {
 	replicas int
 	keys     []int // Sorted
 	hashMap  map[int]string
+	weights  map[string]int
 }
 
 // NewConsistentHash ...
@@ -41,6 +42,7 @@ func NewConsistentHash(replicas int, fn Hash) *ConsistentHash {
 		replicas: replicas,
 		hash:     fn,
 		hashMap:  make(map[int]string),
+		weights:  make(map[string]int),
 	}
 	if m.hash == nil {
 		m.hash = crc32.ChecksumIEEE
@@ -56,15 +58,44 @@ func (m *ConsistentHash) IsEmpty() bool {
 // Add some keys to the hash.
 func (m *ConsistentHash) Add(keys ...string) {
 	for _, key := range keys {
-		for i := 0; i < m.replicas; i++ {
-			hash := int(m.hash([]byte(strconv.Itoa(i) + key)))
-			m.keys = append(m.keys, hash)
-			m.hashMap[hash] = key
-		}
+		m.AddWeighted(key, 1)
+	}
+}
+
+// AddWeighted adds a key to the hash with a number of replicas proportional to its weight.
+func (m *ConsistentHash) AddWeighted(key string, weight int) {
+	if weight < 1 {
+		weight = 1
+	}
+	if _, ok := m.weights[key]; ok {
+		m.Remove(key)
+	}
+	m.weights[key] = weight
+	for i := 0; i < m.replicas*weight; i++ {
+		hash := int(m.hash([]byte(strconv.Itoa(i) + key)))
+		m.keys = append(m.keys, hash)
+		m.hashMap[hash] = key
 	}
 	sort.Ints(m.keys)
 }
 
+// Remove a key and its replicas from the hash.
+func (m *ConsistentHash) Remove(key string) {
+	if _, ok := m.weights[key]; !ok {
+		return
+	}
+	delete(m.weights, key)
+	keys := m.keys[:0]
+	for _, hash := range m.keys {
+		if m.hashMap[hash] == key {
+			delete(m.hashMap, hash)
+		} else {
+			keys = append(keys, hash)
+		}
+	}
+	m.keys = keys
+}
+
 // Get the closest item in the hash to the provided key.
 func (m *ConsistentHash) Get(key string) string {
 	if m.IsEmpty() {
@@ -108,3 +108,26 @@ func benchmarkGet(b *testing.B, shards int) {
 		hash.Get(buckets[i&(shards-1)])
 	}
 }
+
+func TestRemove(t *testing.T) {
+	hash := NewConsistentHash(50, nil)
+	hash.Add("Bill", "Bob", "Bonny")
+
+	owners := map[string]string{}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		owners[key] = hash.Get(key)
+	}
+
+	hash.Remove("Bob")
+
+	for key, owner := range owners {
+		newOwner := hash.Get(key)
+		if newOwner == "Bob" {
+			t.Fatalf("%s still mapped to removed key", key)
+		}
+		if owner != "Bob" && newOwner != owner {
+			t.Errorf("%s should not have moved from %s to %s", key, owner, newOwner)
+		}
+	}
+}
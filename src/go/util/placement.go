@@ -0,0 +1,293 @@
+// Copyright 2019 CEA
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Placement strategies mapping keys (and file stripes) to nodes
+
+package util
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
+)
+
+// Placement strategies names (see NewPlacement)
+const (
+	ConsistentPlacement = "consistent"
+	JumpPlacement       = "jump"
+	RendezvousPlacement = "rendezvous"
+	RAID0Placement      = "raid0"
+)
+
+// Placement maps keys to a set of weighted nodes
+type Placement interface {
+	// Add nodes with a weight of 1
+	Add(nodes ...string)
+	// AddWeighted adds a node receiving a share of keys proportional to its weight
+	AddWeighted(node string, weight int)
+	// Remove a node
+	Remove(node string)
+	// Get returns the node owning the key
+	Get(key string) string
+	// IsEmpty returns true if there are no nodes
+	IsEmpty() bool
+}
+
+// StripePlacement is implemented by placements having a specific layout for the stripes of a file
+type StripePlacement interface {
+	// GetStripe returns the node owning the stripe 'id' of the file 'name'
+	GetStripe(name string, id int64) string
+}
+
+// NewPlacement returns a placement implementing the given strategy,
+// replicas is the number of points per unit of weight on the consistent hash ring
+func NewPlacement(strategy string, replicas int) (Placement, error) {
+	switch strategy {
+	case "", ConsistentPlacement:
+		return NewConsistentHash(replicas, nil), nil
+	case JumpPlacement:
+		return NewJumpHash(), nil
+	case RendezvousPlacement:
+		return NewRendezvousHash(), nil
+	case RAID0Placement:
+		return NewRAID0(), nil
+	}
+	return nil, fmt.Errorf("unknown placement strategy '%s'", strategy)
+}
+
+func hash64(data ...string) uint64 {
+	h := fnv.New64a()
+	for _, d := range data {
+		h.Write([]byte(d))
+	}
+	// fnv has a poor avalanche on short inputs, finalize with the splitmix64 mixer
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// weighted set of nodes kept sorted so that placement does not depend on insertion order
+type nodeSet struct {
+	nodes   []string
+	weights map[string]int
+}
+
+func newNodeSet() nodeSet {
+	return nodeSet{weights: map[string]int{}}
+}
+
+func (s *nodeSet) add(node string, weight int) {
+	if weight < 1 {
+		weight = 1
+	}
+	if _, ok := s.weights[node]; !ok {
+		s.nodes = append(s.nodes, node)
+		sort.Strings(s.nodes)
+	}
+	s.weights[node] = weight
+}
+
+func (s *nodeSet) remove(node string) {
+	if _, ok := s.weights[node]; !ok {
+		return
+	}
+	delete(s.weights, node)
+	i := sort.SearchStrings(s.nodes, node)
+	s.nodes = append(s.nodes[:i], s.nodes[i+1:]...)
+}
+
+// JumpHash implements Lamping and Veach "jump consistent hash".
+// Nodes are mapped to buckets in insertion order (as many buckets as its weight for a node), so that
+// all processes must add the nodes in the same order (the persisted ring membership order).
+// Adding a node appends its buckets and moves to it a share of the keys of every other node,
+// as buckets are numbered removing a node other than the last one remaps more keys than a consistent hash ring would.
+type JumpHash struct {
+	nodeSet
+	order   []string // nodes in insertion order
+	buckets []string
+}
+
+// NewJumpHash returns an empty JumpHash
+func NewJumpHash() *JumpHash {
+	return &JumpHash{nodeSet: newNodeSet()}
+}
+
+// adds a node after the nodes already added
+func (m *JumpHash) addNode(node string, weight int) {
+	if _, ok := m.weights[node]; !ok {
+		m.order = append(m.order, node)
+	}
+	m.add(node, weight)
+}
+
+func (m *JumpHash) update() {
+	m.buckets = m.buckets[:0]
+	for _, node := range m.order {
+		for i := 0; i < m.weights[node]; i++ {
+			m.buckets = append(m.buckets, node)
+		}
+	}
+}
+
+// Add nodes with a weight of 1
+func (m *JumpHash) Add(nodes ...string) {
+	for _, node := range nodes {
+		m.addNode(node, 1)
+	}
+	m.update()
+}
+
+// AddWeighted adds a node with 'weight' buckets
+func (m *JumpHash) AddWeighted(node string, weight int) {
+	m.addNode(node, weight)
+	m.update()
+}
+
+// Remove a node
+func (m *JumpHash) Remove(node string) {
+	m.remove(node)
+	for i, n := range m.order {
+		if n == node {
+			m.order = append(m.order[:i], m.order[i+1:]...)
+			break
+		}
+	}
+	m.update()
+}
+
+// IsEmpty returns true if there are no nodes
+func (m *JumpHash) IsEmpty() bool {
+	return len(m.buckets) == 0
+}
+
+// Get returns the node owning the key
+func (m *JumpHash) Get(key string) string {
+	if m.IsEmpty() {
+		return ""
+	}
+	k := hash64(key)
+	var b, j int64 = -1, 0
+	for j < int64(len(m.buckets)) {
+		b = j
+		k = k*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((k>>33)+1)))
+	}
+	return m.buckets[b]
+}
+
+// RendezvousHash implements weighted highest random weight (HRW) hashing:
+// the owner of a key is the node with the highest score for this key,
+// adding or removing a node only remaps the keys it owns (or will own).
+type RendezvousHash struct {
+	nodeSet
+}
+
+// NewRendezvousHash returns an empty RendezvousHash
+func NewRendezvousHash() *RendezvousHash {
+	return &RendezvousHash{newNodeSet()}
+}
+
+// Add nodes with a weight of 1
+func (m *RendezvousHash) Add(nodes ...string) {
+	for _, node := range nodes {
+		m.add(node, 1)
+	}
+}
+
+// AddWeighted adds a node with a weight
+func (m *RendezvousHash) AddWeighted(node string, weight int) {
+	m.add(node, weight)
+}
+
+// Remove a node
+func (m *RendezvousHash) Remove(node string) {
+	m.remove(node)
+}
+
+// IsEmpty returns true if there are no nodes
+func (m *RendezvousHash) IsEmpty() bool {
+	return len(m.nodes) == 0
+}
+
+// Get returns the node owning the key
+func (m *RendezvousHash) Get(key string) string {
+	var owner string
+	max := math.Inf(-1)
+	for _, node := range m.nodes {
+		// uniform value in ]0, 1[, score is -w/ln(u) (see "Weighted distributed hash tables", Schindelhauer and Schomaker)
+		u := (float64(hash64(node, key)>>11) + 0.5) / (1 << 53)
+		score := -float64(m.weights[node]) / math.Log(u)
+		if score > max {
+			max = score
+			owner = node
+		}
+	}
+	return owner
+}
+
+// RAID0 places the stripes of a file in a round-robin fashion on the nodes, starting from a node chosen
+// by hashing the file name, so that consecutive stripes of a file always land on distinct nodes
+// (if there is more than one node). Weights are ignored. Other keys are placed by hashing.
+type RAID0 struct {
+	nodeSet
+}
+
+// NewRAID0 returns an empty RAID0 placement
+func NewRAID0() *RAID0 {
+	return &RAID0{newNodeSet()}
+}
+
+// Add nodes
+func (m *RAID0) Add(nodes ...string) {
+	for _, node := range nodes {
+		m.add(node, 1)
+	}
+}
+
+// AddWeighted adds a node, the weight is ignored
+func (m *RAID0) AddWeighted(node string, weight int) {
+	m.add(node, 1)
+}
+
+// Remove a node
+func (m *RAID0) Remove(node string) {
+	m.remove(node)
+}
+
+// IsEmpty returns true if there are no nodes
+func (m *RAID0) IsEmpty() bool {
+	return len(m.nodes) == 0
+}
+
+// Get returns the node owning the key
+func (m *RAID0) Get(key string) string {
+	if m.IsEmpty() {
+		return ""
+	}
+	return m.nodes[hash64(key)%uint64(len(m.nodes))]
+}
+
+// GetStripe returns the node owning the stripe 'id' of the file 'name'
+func (m *RAID0) GetStripe(name string, id int64) string {
+	if m.IsEmpty() {
+		return ""
+	}
+	n := uint64(len(m.nodes))
+	return m.nodes[(hash64(name)%n+uint64(id)%n)%n]
+}
@@ -0,0 +1,125 @@
+// Copyright 2019 CEA
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"fmt"
+	"testing"
+)
+
+// returns the number of keys owned by each node
+func distribution(p Placement, nkeys int) map[string]int {
+	count := map[string]int{}
+	for i := 0; i < nkeys; i++ {
+		count[p.Get(fmt.Sprintf("/path/to/file:%d", i))]++
+	}
+	return count
+}
+
+func TestPlacementWeights(t *testing.T) {
+	for _, strategy := range []string{ConsistentPlacement, JumpPlacement, RendezvousPlacement} {
+		p, err := NewPlacement(strategy, 100)
+		Ok(t, err)
+		p.AddWeighted(":6379", 1)
+		p.AddWeighted(":6380", 1)
+		p.AddWeighted(":6381", 2)
+
+		count := distribution(p, 40000)
+		Equals(t, 3, len(count), strategy+": all nodes should own keys")
+		// ':6381' should own about half of the keys
+		ratio := float64(count[":6381"]) / 40000
+		Assert(t, ratio > 0.4 && ratio < 0.6, "%s: unbalanced placement for weighted node: %f", strategy, ratio)
+		ratio = float64(count[":6379"]) / 40000
+		Assert(t, ratio > 0.18 && ratio < 0.32, "%s: unbalanced placement: %f", strategy, ratio)
+	}
+}
+
+func TestPlacementRemove(t *testing.T) {
+	for _, strategy := range []string{ConsistentPlacement, JumpPlacement, RendezvousPlacement, RAID0Placement} {
+		p, err := NewPlacement(strategy, 100)
+		Ok(t, err)
+		p.Add(":6379", ":6380", ":6381")
+		p.Remove(":6380")
+		count := distribution(p, 1000)
+		Equals(t, 0, count[":6380"], strategy+": removed node should not own keys")
+		Equals(t, 2, len(count), strategy+": remaining nodes should own keys")
+
+		p.Remove(":6379")
+		p.Remove(":6381")
+		Assert(t, p.IsEmpty(), "%s: placement should be empty", strategy)
+		Equals(t, "", p.Get("key"), strategy+": empty placement should not return a node")
+	}
+}
+
+func TestRendezvousMinimalDisruption(t *testing.T) {
+	p := NewRendezvousHash()
+	p.Add(":6379", ":6380", ":6381")
+	owners := map[string]string{}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		owners[key] = p.Get(key)
+	}
+	p.Add(":6382")
+	for key, owner := range owners {
+		if newOwner := p.Get(key); newOwner != owner && newOwner != ":6382" {
+			t.Errorf("%s should not have moved from %s to %s", key, owner, newOwner)
+		}
+	}
+}
+
+func TestJumpHashAppend(t *testing.T) {
+	p := NewJumpHash()
+	p.Add(":6381", ":6379", ":6380")
+	owners := map[string]string{}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		owners[key] = p.Get(key)
+	}
+	// a node sorting before the others is appended after them, keys only move to it
+	p.Add(":6378")
+	moved := 0
+	for key, owner := range owners {
+		if newOwner := p.Get(key); newOwner != owner {
+			Equals(t, ":6378", newOwner, key+" should only move to the new node")
+			moved++
+		}
+	}
+	Assert(t, moved > 150 && moved < 350, "about a quarter of the keys should move: %d", moved)
+}
+
+func TestRAID0Stripes(t *testing.T) {
+	p, err := NewPlacement(RAID0Placement, 0)
+	Ok(t, err)
+	p.Add(":6379", ":6380", ":6381")
+	sp, ok := p.(StripePlacement)
+	Assert(t, ok, "RAID0 should implement StripePlacement")
+
+	for _, name := range []string{"/a", "/b", "/path/to/file"} {
+		count := map[string]int{}
+		prev := ""
+		for id := int64(0); id < 30; id++ {
+			node := sp.GetStripe(name, id)
+			Assert(t, node != prev, "consecutive stripes %d and %d of %s on the same node", id-1, id, name)
+			prev = node
+			count[node]++
+		}
+		Equals(t, map[string]int{":6379": 10, ":6380": 10, ":6381": 10}, count, "stripes should be evenly spread")
+	}
+}
+
+func TestUnknownPlacement(t *testing.T) {
+	_, err := NewPlacement("random", 100)
+	Assert(t, err != nil, "unknown strategy should return an error")
+}